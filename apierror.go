@@ -0,0 +1,110 @@
+package main
+
+import (
+	"errors"
+	"log/slog"
+	"net/http"
+	"strings"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// Error codes sent in the "code" field of an error response. Clients should
+// branch on these; the messages are for people and may change.
+const (
+	errCodeInvalidRequest       = "INVALID_REQUEST"
+	errCodeInvalidFilename      = "INVALID_FILENAME"
+	errCodeInvalidFolder        = "INVALID_FOLDER"
+	errCodeInvalidConfig        = "INVALID_CONFIG"
+	errCodeURLNotAllowed        = "URL_NOT_ALLOWED"
+	errCodeInvalidCredentials   = "INVALID_CREDENTIALS"
+	errCodeConfirmationRequired = "CONFIRMATION_REQUIRED"
+	errCodeCSRFTokenInvalid     = "CSRF_TOKEN_INVALID"
+	errCodeForbidden            = "FORBIDDEN"
+	errCodeNotFound             = "NOT_FOUND"
+	errCodeFileNotFound         = "FILE_NOT_FOUND"
+	errCodeThumbnailNotFound    = "THUMBNAIL_NOT_FOUND"
+	errCodeUploadNotFound       = "UPLOAD_NOT_FOUND"
+	errCodeBackupNotFound       = "BACKUP_NOT_FOUND"
+	errCodeFileExists           = "FILE_EXISTS"
+	errCodeDuplicateContent     = "DUPLICATE_CONTENT"
+	errCodeEmptyFile            = "EMPTY_FILE"
+	errCodeFileTooLarge         = "FILE_TOO_LARGE"
+	errCodeQuotaExceeded        = "QUOTA_EXCEEDED"
+	errCodeExtensionNotAllowed  = "EXTENSION_NOT_ALLOWED"
+	errCodeContentTypeMismatch  = "CONTENT_TYPE_MISMATCH"
+	errCodeUploadIncomplete     = "UPLOAD_INCOMPLETE"
+	errCodeMalwareDetected      = "MALWARE_DETECTED"
+	errCodeScanFailed           = "SCAN_FAILED"
+	errCodeOffsetMismatch       = "OFFSET_MISMATCH"
+	errCodePreconditionFailed   = "PRECONDITION_FAILED"
+	errCodeRangeNotSatisfiable  = "RANGE_NOT_SATISFIABLE"
+	errCodeShareExpired         = "SHARE_EXPIRED"
+	errCodeShareInvalid         = "SHARE_INVALID"
+	errCodeUploadTokenInvalid   = "UPLOAD_TOKEN_INVALID"
+	errCodeUploadTokenUsed      = "UPLOAD_TOKEN_USED"
+	errCodeBodyTooLarge         = "BODY_TOO_LARGE"
+	errCodeLengthRequired       = "LENGTH_REQUIRED"
+	errCodeMethodNotAllowed     = "METHOD_NOT_ALLOWED"
+	errCodeRateLimited          = "RATE_LIMITED"
+	errCodeLoginLocked          = "LOGIN_LOCKED"
+	errCodeTooManyUploads       = "TOO_MANY_UPLOADS"
+	errCodeServiceUnavailable   = "SERVICE_UNAVAILABLE"
+	errCodeFetchFailed          = "FETCH_FAILED"
+	errCodeInternal             = "INTERNAL_ERROR"
+)
+
+// apiError is the body of every error response, under "error".
+type apiError struct {
+	Code      string `json:"code"`
+	Message   string `json:"message"`
+	RequestID string `json:"requestId,omitempty"`
+}
+
+// newAPIError builds the error object for the request c, tagged with its ID.
+func newAPIError(c *fiber.Ctx, code, msg string) apiError {
+	return apiError{Code: code, Message: msg, RequestID: requestID(c)}
+}
+
+// jsonError answers with status and
+// {"error": {"code": code, "message": msg, "requestId": ...}}.
+func jsonError(c *fiber.Ctx, status int, code, msg string) error {
+	return c.Status(status).JSON(fiber.Map{"error": newAPIError(c, code, msg)})
+}
+
+// errorHandler turns errors returned by handlers and Fiber itself, such as an
+// unknown route, into the same JSON shape.
+func errorHandler(c *fiber.Ctx, err error) error {
+	status := fiber.StatusInternalServerError
+	msg := "Internal server error"
+	var fiberErr *fiber.Error
+	if errors.As(err, &fiberErr) {
+		status = fiberErr.Code
+		msg = fiberErr.Message
+	} else {
+		slog.ErrorContext(c.UserContext(), "Unhandled error", "method", c.Method(), "path", c.Path(), "error", err)
+	}
+
+	code := errCodeInternal
+	switch status {
+	case fiber.StatusBadRequest:
+		code = errCodeInvalidRequest
+	case fiber.StatusForbidden:
+		code = errCodeForbidden
+	case fiber.StatusNotFound:
+		code = errCodeNotFound
+	case fiber.StatusMethodNotAllowed:
+		code = errCodeMethodNotAllowed
+	case fiber.StatusRequestEntityTooLarge:
+		code = errCodeBodyTooLarge
+	case fiber.StatusTooManyRequests:
+		code = errCodeRateLimited
+	case fiber.StatusServiceUnavailable:
+		code = errCodeServiceUnavailable
+	default:
+		if status < fiber.StatusInternalServerError {
+			code = strings.ToUpper(strings.ReplaceAll(http.StatusText(status), " ", "_"))
+		}
+	}
+	return jsonError(c, status, code, msg)
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"log/slog"
+	"os"
+	"strings"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// minAPIKeyLength keeps API_KEY out of reach of guessing: unlike the login
+// form, requests carrying it aren't rate limited as logins.
+const minAPIKeyLength = 16
+
+// apiKey, from API_KEY, lets scripts authenticate with HTTP Basic auth or a
+// bearer token instead of the login form. Empty, the default, turns it off.
+// In multi-user mode the key acts as apiKeyUser, from API_KEY_USER.
+var (
+	apiKey     string
+	apiKeyUser string
+)
+
+// loadAPIKey reads API_KEY and API_KEY_USER. It must run after the users
+// file has been loaded.
+func loadAPIKey() {
+	apiKey = os.Getenv("API_KEY")
+	apiKeyUser = os.Getenv("API_KEY_USER")
+	if apiKey == "" {
+		return
+	}
+	if len(apiKey) < minAPIKeyLength {
+		fatal("API_KEY must be at least 16 characters; generate one with e.g. openssl rand -hex 32")
+	}
+	if multiUser() {
+		if _, ok := users[apiKeyUser]; !ok {
+			fatal("API_KEY_USER must name a user in USERS_FILE when API_KEY is set", "user", apiKeyUser)
+		}
+	}
+	slog.Info("API key authentication enabled", "component", "auth", "user", apiKeyUser)
+}
+
+// requestAPIKey returns the credential in the Authorization header: the
+// password of Basic auth, whatever the username, or a Bearer token. ok is
+// false when the header holds neither.
+func requestAPIKey(c *fiber.Ctx) (key string, ok bool) {
+	scheme, value, _ := strings.Cut(strings.TrimSpace(c.Get(fiber.HeaderAuthorization)), " ")
+	value = strings.TrimSpace(value)
+	switch {
+	case strings.EqualFold(scheme, "Bearer"):
+		return value, true
+	case strings.EqualFold(scheme, "Basic"):
+		decoded, err := base64.StdEncoding.DecodeString(value)
+		if err != nil {
+			return "", true
+		}
+		_, password, _ := strings.Cut(string(decoded), ":")
+		return password, true
+	}
+	return "", false
+}
+
+// validAPIKey compares key with apiKey in constant time. Both are hashed
+// first so the comparison doesn't reveal the key's length either.
+func validAPIKey(key string) bool {
+	got, want := sha256.Sum256([]byte(key)), sha256.Sum256([]byte(apiKey))
+	return subtle.ConstantTimeCompare(got[:], want[:]) == 1
+}
+
+// apiKeyRequest reports whether the request was authenticated with the API
+// key rather than a session cookie.
+func apiKeyRequest(c *fiber.Ctx) bool {
+	ok, _ := c.Locals("apiKey").(bool)
+	return ok
+}
+
+// authenticateAPIKey handles a request carrying Basic or Bearer
+// credentials. handled is false when API keys are off or the request has
+// none, and the session cookie decides instead. A wrong key gets 401 rather
+// than the login redirect, which a script couldn't follow anyway. No cookie
+// is set either way: the key is sent with every request.
+func authenticateAPIKey(c *fiber.Ctx) (handled bool, err error) {
+	if apiKey == "" {
+		return false, nil
+	}
+	key, ok := requestAPIKey(c)
+	if !ok {
+		return false, nil
+	}
+	if !validAPIKey(key) {
+		loginFailuresTotal.Inc()
+		slog.WarnContext(c.UserContext(), "Rejected request with an invalid API key", "component", "auth", "ip", c.IP(), "path", c.Path())
+		// Not a Basic challenge: that would make a browser prompt for the
+		// key and then send it on its own, cross-site requests included.
+		c.Set(fiber.HeaderWWWAuthenticate, `Bearer realm="WebFiles"`)
+		return true, jsonError(c, fiber.StatusUnauthorized, errCodeInvalidCredentials, "Invalid API key")
+	}
+	if multiUser() {
+		if _, ok := users[apiKeyUser]; !ok {
+			return true, jsonError(c, fiber.StatusUnauthorized, errCodeInvalidCredentials, "Invalid API key")
+		}
+		c.Locals("username", apiKeyUser)
+	}
+	c.Locals("apiKey", true)
+	return true, c.Next()
+}
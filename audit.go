@@ -0,0 +1,233 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log/slog"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+const (
+	defaultAuditLogFile = "./audit.jsonl"
+
+	// auditQueueSize is how many records may wait to be written before
+	// recording one blocks the request making it.
+	auditQueueSize = 1024
+)
+
+// Audited actions.
+const (
+	auditUpload      = "upload"
+	auditDelete      = "delete"
+	auditDeleteAll   = "delete_all"
+	auditRename      = "rename"
+	auditMove        = "move"
+	auditCopy        = "copy"
+	auditRestore     = "restore"
+	auditLogin       = "login"
+	auditLoginFailed = "login_failed"
+	auditLogoutAll   = "logout_all"
+	auditPINChanged  = "pin_changed"
+)
+
+// AuditRecord is one line of the audit log. Detail carries what the action
+// needs beyond a file: the new name of a rename, the destination of a move
+// or copy, the backup a restore came from.
+type AuditRecord struct {
+	Time      time.Time `json:"time"`
+	Action    string    `json:"action"`
+	Filename  string    `json:"filename,omitempty"`
+	Folder    string    `json:"folder,omitempty"`
+	Size      int64     `json:"size,omitempty"`
+	Detail    string    `json:"detail,omitempty"`
+	User      string    `json:"user,omitempty"`
+	IP        string    `json:"ip"`
+	RequestID string    `json:"requestId,omitempty"`
+}
+
+// auditLog appends AuditRecords to auditLogFile as JSON Lines. Records are
+// queued and written by a single goroutine, so a request only waits for the
+// disk when the queue is full.
+type auditLog struct {
+	mu     sync.Mutex
+	queue  chan AuditRecord
+	closed bool
+	done   chan struct{}
+}
+
+// auditLogFile is the audit log path from AUDIT_LOG_FILE. audit is nil when
+// AUDIT_LOG is false.
+var (
+	auditLogFile = defaultAuditLogFile
+	audit        *auditLog
+)
+
+// openAuditLog opens auditLogFile for appending and starts its writer.
+func openAuditLog() {
+	f, err := os.OpenFile(auditLogFile, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		fatal("Could not open audit log", "path", auditLogFile, "error", err)
+	}
+	audit = &auditLog{queue: make(chan AuditRecord, auditQueueSize), done: make(chan struct{})}
+	go audit.write(f)
+	slog.Info("Audit log enabled", "path", auditLogFile)
+}
+
+func (a *auditLog) write(f *os.File) {
+	defer close(a.done)
+	defer f.Close()
+	for rec := range a.queue {
+		line, err := json.Marshal(rec)
+		if err == nil {
+			_, err = f.Write(append(line, '\n'))
+		}
+		if err != nil {
+			slog.Error("Could not write audit record", "path", auditLogFile, "action", rec.Action, "filename", rec.Filename, "error", err)
+		}
+	}
+}
+
+// close writes out the queued records. Records made afterwards are dropped.
+func (a *auditLog) close() {
+	a.mu.Lock()
+	if !a.closed {
+		a.closed = true
+		close(a.queue)
+	}
+	a.mu.Unlock()
+	<-a.done
+}
+
+// recordAudit queues rec, filling in the time, the client and the user of
+// the request. rec.User is kept when set, for failed logins.
+func recordAudit(c *fiber.Ctx, rec AuditRecord) {
+	if audit == nil {
+		return
+	}
+	rec.Time = time.Now().UTC()
+	rec.IP = c.IP()
+	rec.RequestID = requestID(c)
+	if rec.User == "" {
+		rec.User = currentUser(c)
+	}
+	audit.mu.Lock()
+	defer audit.mu.Unlock()
+	if audit.closed {
+		return
+	}
+	audit.queue <- rec
+}
+
+// parseAuditTime reads the since and until filters: an RFC 3339 time or a
+// date, which stands for its start (UTC) or, as an upper bound, its end.
+func parseAuditTime(raw string, end bool) (time.Time, error) {
+	if t, err := time.Parse(time.RFC3339, raw); err == nil {
+		return t, nil
+	}
+	t, err := time.Parse(time.DateOnly, raw)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("%q is not a date (2006-01-02) or an RFC 3339 time", raw)
+	}
+	if end {
+		t = t.AddDate(0, 0, 1)
+	}
+	return t, nil
+}
+
+// auditHandler lists audit records, newest first, filtered by ?action=
+// (comma-separated), ?user=, ?since= and ?until=, and paginated with
+// ?limit= and ?offset= as in /files.
+func auditHandler(c *fiber.Ctx) error {
+	if !isAdmin(c) {
+		return jsonError(c, fiber.StatusForbidden, errCodeForbidden, "Only admins can read the audit log")
+	}
+	if audit == nil {
+		return jsonError(c, fiber.StatusNotFound, errCodeNotFound, "The audit log is disabled")
+	}
+
+	limit, offset := defaultPageLimit, 0
+	if raw := c.Query("limit"); raw != "" {
+		n, err := strconv.Atoi(raw)
+		if err != nil || n < 1 || n > maxPageLimit {
+			return jsonError(c, fiber.StatusBadRequest, errCodeInvalidRequest, fmt.Sprintf("limit must be between 1 and %d", maxPageLimit))
+		}
+		limit = n
+	}
+	if raw := c.Query("offset"); raw != "" {
+		n, err := strconv.Atoi(raw)
+		if err != nil || n < 0 {
+			return jsonError(c, fiber.StatusBadRequest, errCodeInvalidRequest, "offset must be a non-negative integer")
+		}
+		offset = n
+	}
+	actions := map[string]bool{}
+	for _, action := range strings.Split(c.Query("action"), ",") {
+		if action = strings.TrimSpace(action); action != "" {
+			actions[action] = true
+		}
+	}
+	user := c.Query("user")
+	var since, until time.Time
+	var err error
+	if raw := c.Query("since"); raw != "" {
+		if since, err = parseAuditTime(raw, false); err != nil {
+			return jsonError(c, fiber.StatusBadRequest, errCodeInvalidRequest, "since: "+err.Error())
+		}
+	}
+	if raw := c.Query("until"); raw != "" {
+		if until, err = parseAuditTime(raw, true); err != nil {
+			return jsonError(c, fiber.StatusBadRequest, errCodeInvalidRequest, "until: "+err.Error())
+		}
+	}
+
+	f, err := os.Open(auditLogFile)
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		slog.ErrorContext(c.UserContext(), "Could not open audit log", "path", auditLogFile, "error", err)
+		return jsonError(c, fiber.StatusInternalServerError, errCodeInternal, "Could not read the audit log")
+	}
+	records := []AuditRecord{}
+	if f != nil {
+		defer f.Close()
+		scanner := bufio.NewScanner(f)
+		scanner.Buffer(make([]byte, 64<<10), 1<<20)
+		for scanner.Scan() {
+			var rec AuditRecord
+			// A line being appended right now may be incomplete.
+			if json.Unmarshal(scanner.Bytes(), &rec) != nil {
+				continue
+			}
+			if (len(actions) > 0 && !actions[rec.Action]) || (user != "" && rec.User != user) ||
+				(!since.IsZero() && rec.Time.Before(since)) || (!until.IsZero() && !rec.Time.Before(until)) {
+				continue
+			}
+			records = append(records, rec)
+		}
+		if err := scanner.Err(); err != nil {
+			slog.ErrorContext(c.UserContext(), "Could not read audit log", "path", auditLogFile, "error", err)
+			return jsonError(c, fiber.StatusInternalServerError, errCodeInternal, "Could not read the audit log")
+		}
+	}
+
+	total := len(records)
+	start := min(offset, total)
+	end := min(start+limit, total)
+	page := make([]AuditRecord, 0, end-start)
+	for i := start; i < end; i++ {
+		page = append(page, records[total-1-i])
+	}
+	return c.JSON(fiber.Map{
+		"entries": page,
+		"total":   total,
+		"limit":   limit,
+		"offset":  offset,
+	})
+}
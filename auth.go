@@ -0,0 +1,166 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/golang-jwt/jwt/v5"
+)
+
+const (
+	defaultSessionTTL           = 24 * time.Hour
+	defaultSessionRefreshWindow = time.Hour
+)
+
+// COOKIE_SECURE values.
+const (
+	cookieSecureAlways = "true"
+	cookieSecureNever  = "false"
+	cookieSecureAuto   = "auto"
+)
+
+// secureCookies reports whether cookies set by this request get the Secure
+// flag. In auto mode that follows the scheme of the request, taken from
+// X-Forwarded-Proto behind a proxy, so login works over http://localhost.
+func secureCookies(c *fiber.Ctx) bool {
+	switch settings().cookieSecure {
+	case cookieSecureNever:
+		return false
+	case cookieSecureAuto:
+		return c.Protocol() == "https"
+	}
+	return true
+}
+
+// jwtPreviousSecrets holds secrets from before a rotation. Tokens signed with
+// them are still accepted until they expire; new tokens always use jwtSecret.
+var jwtPreviousSecrets [][]byte
+
+// parseSessionToken validates a session token against the current secret and
+// then each previous one, returning the first token that verifies. Tokens
+// carrying an audience were issued for something else (share links) and are
+// not sessions.
+func parseSessionToken(tokenString string) (*jwt.Token, error) {
+	token, err := parseSignedToken(tokenString)
+	if err != nil {
+		return nil, err
+	}
+	if aud, _ := token.Claims.GetAudience(); len(aud) > 0 {
+		return nil, fmt.Errorf("token is not a session token")
+	}
+	return token, nil
+}
+
+// parseSignedToken verifies an HMAC-signed JWT with the current secret and
+// then each previous one, applying opts to every attempt.
+func parseSignedToken(tokenString string, opts ...jwt.ParserOption) (*jwt.Token, error) {
+	secrets := append([][]byte{jwtSecret}, jwtPreviousSecrets...)
+
+	var lastErr error
+	for i, secret := range secrets {
+		token, err := jwt.Parse(tokenString, func(token *jwt.Token) (interface{}, error) {
+			if _, ok := token.Method.(*jwt.SigningMethodHMAC); !ok {
+				return nil, fmt.Errorf("unexpected signing method: %v", token.Header["alg"])
+			}
+			return secret, nil
+		}, opts...)
+		if err == nil && token.Valid {
+			if i > 0 {
+				slog.Debug("Token validated with a previous secret", "component", "auth", "secret", i)
+			}
+			return token, nil
+		}
+		lastErr = err
+		// Only a bad signature is worth retrying with another key; an
+		// expired or malformed token fails the same way for every secret.
+		if err != nil && !errors.Is(err, jwt.ErrTokenSignatureInvalid) {
+			break
+		}
+	}
+	if lastErr == nil {
+		lastErr = fmt.Errorf("invalid token")
+	}
+	return nil, lastErr
+}
+
+// issueSession signs a new session token for username ("" in single-user
+// mode), valid for SESSION_TTL, and sets it as the session cookie. It returns
+// the expiry.
+func issueSession(c *fiber.Ctx, username string) (time.Time, error) {
+	issuedAt := time.Now()
+	expiresAt := issuedAt.Add(settings().sessionTTL)
+	claims := jwt.MapClaims{
+		"iat": issuedAt.Unix(),
+		"exp": expiresAt.Unix(),
+	}
+	if username != "" {
+		claims["sub"] = username
+	}
+	ver, err := sessionVersion(username)
+	if err != nil && !revocationRedisFailOpen {
+		return time.Time{}, err
+	}
+	if ver > 0 {
+		claims["ver"] = ver
+	}
+	tokenString, err := jwt.NewWithClaims(jwt.SigningMethodHS256, claims).SignedString(jwtSecret)
+	if err != nil {
+		return time.Time{}, err
+	}
+
+	c.Cookie(&fiber.Cookie{
+		Name:     "session",
+		Value:    tokenString,
+		Expires:  expiresAt,
+		HTTPOnly: true,
+		Secure:   secureCookies(c),
+		SameSite: fiber.CookieSameSiteStrictMode,
+	})
+	setSessionTimes(c, issuedAt, expiresAt)
+	return expiresAt, nil
+}
+
+// setSessionTimes records when the session of the request was issued and
+// expires, for /whoami. They follow a renewal made earlier in the request.
+func setSessionTimes(c *fiber.Ctx, issuedAt, expiresAt time.Time) {
+	c.Locals("sessionIssuedAt", issuedAt)
+	c.Locals("sessionExpiresAt", expiresAt)
+}
+
+// refreshHandler reissues the session with a fresh expiry. The auth
+// middleware has already checked the current cookie is valid.
+func refreshHandler(c *fiber.Ctx) error {
+	if apiKeyRequest(c) {
+		return jsonError(c, fiber.StatusBadRequest, errCodeInvalidRequest, "Requests made with the API key have no session to refresh")
+	}
+	expiresAt, err := issueSession(c, currentUser(c))
+	if err != nil {
+		return jsonError(c, fiber.StatusInternalServerError, errCodeInternal, "Failed to generate token")
+	}
+	slog.DebugContext(c.UserContext(), "Session refreshed", "component", "auth", "user", currentUser(c))
+	return c.JSON(fiber.Map{"status": "ok", "expiresAt": expiresAt.UTC()})
+}
+
+// whoamiHandler describes the current session so the page can show who is
+// signed in and prompt for a new login before the session runs out. Tokens
+// issued before the iat claim was added have no issuedAt.
+func whoamiHandler(c *fiber.Ctx) error {
+	issuedAt, _ := c.Locals("sessionIssuedAt").(time.Time)
+	expiresAt, _ := c.Locals("sessionExpiresAt").(time.Time)
+	resp := fiber.Map{
+		"admin":            isAdmin(c),
+		"expiresAt":        expiresAt.UTC(),
+		"remainingSeconds": max(int64(time.Until(expiresAt).Seconds()), 0),
+	}
+	if username := currentUser(c); username != "" {
+		resp["username"] = username
+	}
+	if !issuedAt.IsZero() {
+		resp["issuedAt"] = issuedAt.UTC()
+	}
+	c.Set(fiber.HeaderCacheControl, "no-store")
+	return c.JSON(resp)
+}
@@ -0,0 +1,211 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"io/fs"
+	"log/slog"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/golang-jwt/jwt/v5"
+	"golang.org/x/crypto/bcrypt"
+)
+
+const defaultAuthStateFile = "./authstate.json"
+
+// authStateFile, from AUTH_STATE_FILE, keeps the login settings changed at
+// runtime, which can't be written back to the environment.
+var authStateFile = defaultAuthStateFile
+
+// authState is the content of authStateFile. PINHash replaces
+// LOGIN_PIN/LOGIN_PIN_HASH once the PIN has been changed through
+// POST /admin/change-pin. SessionVersions holds the session version of each
+// user ("" in single-user mode): sessions carry the version they were
+// issued under, and bumping it ends all of them. UsedUploadTokens maps the
+// ID of each spent upload token to its expiry, after which it is dropped.
+type authState struct {
+	PINHash          string               `json:"pinHash,omitempty"`
+	SessionVersions  map[string]int       `json:"sessionVersions,omitempty"`
+	UsedUploadTokens map[string]time.Time `json:"usedUploadTokens,omitempty"`
+}
+
+var auth = struct {
+	mu    sync.Mutex
+	state authState
+}{}
+
+// loadAuthState reads authStateFile at startup. A missing file means
+// nothing was changed at runtime yet.
+func loadAuthState() {
+	data, err := os.ReadFile(authStateFile)
+	if errors.Is(err, fs.ErrNotExist) {
+		return
+	}
+	if err != nil {
+		fatal("Could not read auth state file", "path", authStateFile, "error", err)
+	}
+	var state authState
+	if err := json.Unmarshal(data, &state); err != nil {
+		fatal("Auth state file is not valid JSON", "path", authStateFile, "error", err)
+	}
+	if state.PINHash != "" {
+		if _, err := bcrypt.Cost([]byte(state.PINHash)); err != nil {
+			fatal("Auth state file has an invalid PIN hash", "path", authStateFile, "error", err)
+		}
+		if !multiUser() {
+			setLoginPINHash([]byte(state.PINHash))
+			slog.Info("Using the PIN set through /admin/change-pin instead of LOGIN_PIN or LOGIN_PIN_HASH", "path", authStateFile)
+		}
+	}
+	auth.mu.Lock()
+	auth.state = state
+	auth.mu.Unlock()
+}
+
+// saveAuthStateLocked writes state to authStateFile. The write is atomic,
+// since a torn one would lock everyone out. The caller must hold auth.mu.
+func saveAuthStateLocked(state authState) error {
+	data, err := json.MarshalIndent(state, "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(authStateFile, data, 0600)
+}
+
+// sessionVersion returns the version new sessions of username are issued
+// under and old ones must carry to stay valid. With REVOCATION_STORE=redis
+// it comes from Redis, and err is set when Redis can't be reached.
+func sessionVersion(username string) (int, error) {
+	if revocationUseRedis {
+		return redisSessionVersion(username)
+	}
+	auth.mu.Lock()
+	defer auth.mu.Unlock()
+	return auth.state.SessionVersions[username], nil
+}
+
+// tokenSessionVersion reads the version a session token was issued under.
+// Tokens from before versions existed have none, which counts as 0.
+func tokenSessionVersion(token *jwt.Token) int {
+	claims, ok := token.Claims.(jwt.MapClaims)
+	if !ok {
+		return 0
+	}
+	ver, _ := claims["ver"].(float64)
+	return int(ver)
+}
+
+// withBumpedSessionVersion returns a copy of state in which every session of
+// username is revoked.
+func withBumpedSessionVersion(state authState, username string) authState {
+	versions := make(map[string]int, len(state.SessionVersions)+1)
+	for user, ver := range state.SessionVersions {
+		versions[user] = ver
+	}
+	versions[username]++
+	state.SessionVersions = versions
+	return state
+}
+
+type ChangePINRequest struct {
+	OldPIN         string `json:"oldPin"`
+	NewPIN         string `json:"newPin"`
+	LogoutSessions bool   `json:"logoutSessions"`
+}
+
+// changePINHandler replaces the shared login PIN. The new PIN is stored as
+// a bcrypt hash in authStateFile, so it survives a restart and takes
+// precedence over the environment. With logoutSessions every other session
+// ends; the one making the change is reissued so it stays logged in.
+func changePINHandler(c *fiber.Ctx) error {
+	if !isAdmin(c) {
+		return jsonError(c, fiber.StatusForbidden, errCodeForbidden, "Only admins can change the PIN")
+	}
+	if multiUser() {
+		return jsonError(c, fiber.StatusBadRequest, errCodeInvalidRequest, "Each user has their own PIN in USERS_FILE; there is no shared PIN to change")
+	}
+	var req ChangePINRequest
+	if err := c.BodyParser(&req); err != nil {
+		return jsonError(c, fiber.StatusBadRequest, errCodeInvalidRequest, "Invalid request body")
+	}
+	if req.NewPIN == "" {
+		return jsonError(c, fiber.StatusBadRequest, errCodeInvalidRequest, "newPin must not be empty")
+	}
+	// bcrypt only looks at the first 72 bytes.
+	if len(req.NewPIN) > 72 {
+		return jsonError(c, fiber.StatusBadRequest, errCodeInvalidRequest, "newPin must be at most 72 bytes")
+	}
+	if !verifyPIN(req.OldPIN) {
+		loginFailuresTotal.Inc()
+		lockout.recordFailure()
+		slog.WarnContext(c.UserContext(), "PIN change with an incorrect PIN", "component", "auth", "ip", c.IP())
+		return jsonError(c, fiber.StatusForbidden, errCodeInvalidCredentials, "Incorrect PIN")
+	}
+	hash, err := bcrypt.GenerateFromPassword([]byte(req.NewPIN), bcrypt.DefaultCost)
+	if err != nil {
+		slog.ErrorContext(c.UserContext(), "Could not hash PIN", "component", "auth", "error", err)
+		return jsonError(c, fiber.StatusInternalServerError, errCodeInternal, "Could not change the PIN")
+	}
+
+	if req.LogoutSessions && revocationUseRedis {
+		if err := bumpRedisSessionVersion(currentUser(c)); err != nil {
+			slog.ErrorContext(c.UserContext(), "Could not revoke sessions in Redis", "component", "redis", "error", err)
+			return jsonError(c, fiber.StatusServiceUnavailable, errCodeServiceUnavailable, "Could not end sessions, try again later")
+		}
+	}
+
+	auth.mu.Lock()
+	state := auth.state
+	state.PINHash = string(hash)
+	if req.LogoutSessions && !revocationUseRedis {
+		state = withBumpedSessionVersion(state, currentUser(c))
+	}
+	if err := saveAuthStateLocked(state); err != nil {
+		auth.mu.Unlock()
+		slog.ErrorContext(c.UserContext(), "Could not save auth state", "component", "auth", "path", authStateFile, "error", err)
+		return jsonError(c, fiber.StatusInternalServerError, errCodeInternal, "Could not change the PIN")
+	}
+	auth.state = state
+	setLoginPINHash(hash)
+	auth.mu.Unlock()
+
+	slog.WarnContext(c.UserContext(), "Login PIN changed", "component", "auth", "ip", c.IP(), "sessionsRevoked", req.LogoutSessions)
+	recordAudit(c, AuditRecord{Action: auditPINChanged})
+	if req.LogoutSessions {
+		if _, err := issueSession(c, currentUser(c)); err != nil {
+			return jsonError(c, fiber.StatusInternalServerError, errCodeInternal, "Failed to generate token")
+		}
+	}
+	return c.JSON(fiber.Map{"status": "ok", "sessionsRevoked": req.LogoutSessions})
+}
+
+// logoutAllHandler ends every session of the current user, on every device,
+// including the one making the request. A stolen session cookie stops
+// working at once instead of when it expires.
+func logoutAllHandler(c *fiber.Ctx) error {
+	username := currentUser(c)
+	if revocationUseRedis {
+		if err := bumpRedisSessionVersion(username); err != nil {
+			slog.ErrorContext(c.UserContext(), "Could not revoke sessions in Redis", "component", "redis", "error", err)
+			return jsonError(c, fiber.StatusServiceUnavailable, errCodeServiceUnavailable, "Could not end sessions, try again later")
+		}
+	} else {
+		auth.mu.Lock()
+		state := withBumpedSessionVersion(auth.state, username)
+		if err := saveAuthStateLocked(state); err != nil {
+			auth.mu.Unlock()
+			slog.ErrorContext(c.UserContext(), "Could not save auth state", "component", "auth", "path", authStateFile, "error", err)
+			return jsonError(c, fiber.StatusInternalServerError, errCodeInternal, "Could not end sessions")
+		}
+		auth.state = state
+		auth.mu.Unlock()
+	}
+
+	slog.WarnContext(c.UserContext(), "All sessions ended", "component", "auth", "user", username, "ip", c.IP())
+	recordAudit(c, AuditRecord{Action: auditLogoutAll})
+	c.ClearCookie("session", csrfCookieName)
+	return c.JSON(fiber.Map{"status": "ok"})
+}
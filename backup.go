@@ -0,0 +1,201 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"io/fs"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+const (
+	defaultMetadataBackupDir      = "./backups"
+	defaultMetadataBackups        = 10
+	defaultMetadataBackupInterval = time.Hour
+
+	// backupTimeFormat sorts in time order as a string and keeps
+	// milliseconds so saves in quick succession get distinct names.
+	backupTimeFormat = "20060102T150405.000Z"
+)
+
+// metadataBackupDir, from METADATA_BACKUP_DIR, is where metadata backups
+// are kept.
+var metadataBackupDir = defaultMetadataBackupDir
+
+type BackupInfo struct {
+	Name      string    `json:"name"`
+	Size      int64     `json:"size"`
+	CreatedAt time.Time `json:"createdAt"`
+}
+
+// backupNameParts splits the metadata file name around the timestamp a
+// backup of it carries: filedata.json is backed up as
+// filedata-20240131T120000.000Z.json.
+func backupNameParts() (prefix, ext string) {
+	base := filepath.Base(metadataFile)
+	ext = filepath.Ext(base)
+	return strings.TrimSuffix(base, ext) + "-", ext
+}
+
+// listBackups returns the metadata backups, newest first. A missing backup
+// directory means there are none yet.
+func listBackups() ([]BackupInfo, error) {
+	entries, err := os.ReadDir(metadataBackupDir)
+	if errors.Is(err, fs.ErrNotExist) {
+		return []BackupInfo{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	prefix, ext := backupNameParts()
+	backups := []BackupInfo{}
+	for _, entry := range entries {
+		name := entry.Name()
+		if !entry.Type().IsRegular() || !strings.HasPrefix(name, prefix) || !strings.HasSuffix(name, ext) {
+			continue
+		}
+		createdAt, err := time.Parse(backupTimeFormat, strings.TrimSuffix(strings.TrimPrefix(name, prefix), ext))
+		if err != nil {
+			continue
+		}
+		info, err := entry.Info()
+		if err != nil {
+			continue
+		}
+		backups = append(backups, BackupInfo{Name: name, Size: info.Size(), CreatedAt: createdAt})
+	}
+	sort.Slice(backups, func(i, j int) bool { return backups[i].Name > backups[j].Name })
+	return backups, nil
+}
+
+// backupMetadataFile copies filedata.json into the backup directory before
+// it is overwritten, then deletes all but the newest METADATA_BACKUPS
+// copies. Nothing is copied when the newest backup already holds the
+// current file, or, unless force is set, when it is younger than
+// METADATA_BACKUP_INTERVAL. A failed backup is logged but doesn't stop the
+// save.
+func backupMetadataFile(force bool) {
+	cfg := settings()
+	if cfg.metadataBackups <= 0 {
+		return
+	}
+	data, err := os.ReadFile(metadataFile)
+	if errors.Is(err, fs.ErrNotExist) {
+		return
+	}
+	if err != nil {
+		slog.Warn("Could not read metadata for backup", "path", metadataFile, "error", err)
+		return
+	}
+	backups, err := listBackups()
+	if err != nil {
+		slog.Warn("Could not list metadata backups", "dir", metadataBackupDir, "error", err)
+		return
+	}
+	now := time.Now().UTC()
+	if len(backups) > 0 {
+		if !force && now.Sub(backups[0].CreatedAt) < cfg.metadataBackupInterval {
+			return
+		}
+		if backups[0].Size == int64(len(data)) {
+			if newest, err := os.ReadFile(filepath.Join(metadataBackupDir, backups[0].Name)); err == nil && bytes.Equal(newest, data) {
+				return
+			}
+		}
+	}
+
+	if err := os.MkdirAll(metadataBackupDir, 0755); err != nil {
+		slog.Warn("Could not create metadata backup directory", "dir", metadataBackupDir, "error", err)
+		return
+	}
+	prefix, ext := backupNameParts()
+	name := prefix + now.Format(backupTimeFormat) + ext
+	if err := os.WriteFile(filepath.Join(metadataBackupDir, name), data, 0644); err != nil {
+		slog.Warn("Could not write metadata backup", "dir", metadataBackupDir, "name", name, "error", err)
+		return
+	}
+	slog.Debug("Backed up metadata", "name", name)
+
+	backups = append([]BackupInfo{{Name: name}}, backups...)
+	for _, old := range backups[min(len(backups), cfg.metadataBackups):] {
+		if err := os.Remove(filepath.Join(metadataBackupDir, old.Name)); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			slog.Warn("Could not remove old metadata backup", "name", old.Name, "error", err)
+		}
+	}
+}
+
+// backupsHandler lists the metadata backups, newest first.
+func backupsHandler(c *fiber.Ctx) error {
+	if !isAdmin(c) {
+		return jsonError(c, fiber.StatusForbidden, errCodeForbidden, "Only admins can list backups")
+	}
+	backups, err := listBackups()
+	if err != nil {
+		slog.ErrorContext(c.UserContext(), "Could not list metadata backups", "dir", metadataBackupDir, "error", err)
+		return jsonError(c, fiber.StatusInternalServerError, errCodeInternal, "Could not list backups")
+	}
+	return c.JSON(backups)
+}
+
+// restoreHandler replaces the metadata with a backup. Only names that
+// listBackups returns are accepted, so the parameter can't reach outside the
+// backup directory. The metadata being replaced is backed up first, so a
+// restore can be undone. Files uploaded since the backup are left in storage
+// untracked; POST /admin/reconcile lists them again.
+func restoreHandler(c *fiber.Ctx) error {
+	if !isAdmin(c) {
+		return jsonError(c, fiber.StatusForbidden, errCodeForbidden, "Only admins can restore backups")
+	}
+	name := c.Params("name")
+	backups, err := listBackups()
+	if err != nil {
+		slog.ErrorContext(c.UserContext(), "Could not list metadata backups", "dir", metadataBackupDir, "error", err)
+		return jsonError(c, fiber.StatusInternalServerError, errCodeInternal, "Could not list backups")
+	}
+	found := false
+	for _, b := range backups {
+		if b.Name == name {
+			found = true
+			break
+		}
+	}
+	if !found {
+		return jsonError(c, fiber.StatusNotFound, errCodeBackupNotFound, "Backup not found")
+	}
+
+	data, err := os.ReadFile(filepath.Join(metadataBackupDir, name))
+	if err != nil {
+		slog.ErrorContext(c.UserContext(), "Could not read metadata backup", "name", name, "error", err)
+		return jsonError(c, fiber.StatusInternalServerError, errCodeInternal, "Could not read backup")
+	}
+	files, err := decodeMetadataJSON(data)
+	if err != nil {
+		slog.WarnContext(c.UserContext(), "Could not parse metadata backup", "name", name, "error", err)
+		return jsonError(c, fiber.StatusUnprocessableEntity, errCodeInvalidRequest, "Backup is not valid metadata: "+err.Error())
+	}
+
+	webfiles.mu.Lock()
+	defer webfiles.mu.Unlock()
+	if metadataDB == nil {
+		if err := flushMetadataUnlocked(); err != nil {
+			return jsonError(c, fiber.StatusInternalServerError, errCodeInternal, "Failed to update metadata")
+		}
+		backupMetadataFile(true)
+	}
+	webfiles.Files = files
+	fillOriginalNamesUnlocked()
+	if err := saveMetadataUnlocked(); err != nil {
+		return jsonError(c, fiber.StatusInternalServerError, errCodeInternal, "Failed to update metadata")
+	}
+
+	slog.WarnContext(c.UserContext(), "Restored metadata from backup", "name", name, "files", len(files), "user", currentUser(c), "ip", c.IP())
+	recordAudit(c, AuditRecord{Action: auditRestore, Detail: name})
+	events.broadcastAll(FileEvent{Type: eventRestored})
+	return c.JSON(fiber.Map{"restored": name, "files": len(files)})
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"fmt"
+	"html/template"
+	"strings"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// browseEnabled serves the server-rendered /browse page. API-only
+// deployments can turn it off.
+var browseEnabled = true
+
+var browseTemplate = template.Must(template.New("browse").Funcs(template.FuncMap{
+	"size": formatSize,
+	"date": func(t time.Time) string {
+		if t.IsZero() {
+			return "-"
+		}
+		return t.Format("2006-01-02 15:04")
+	},
+	"download": func(f FileMeta) string { return fileLocation(f.Folder, f.Filename) },
+	"sortLink": func(current, order, key string) string {
+		next := "asc"
+		if current == key && order == "asc" {
+			next = "desc"
+		}
+		return "?sort=" + key + "&order=" + next
+	},
+}).Parse(`<!DOCTYPE html>
+<html lang="th">
+<head>
+<meta charset="UTF-8">
+<title>Files</title>
+<style>
+  body { font-family: "Segoe UI", Tahoma, Geneva, Verdana, sans-serif; margin: 2rem; }
+  table { border-collapse: collapse; width: 100%; }
+  th, td { text-align: left; padding: 0.4rem 0.8rem; border-bottom: 1px solid #ddd; }
+  th a { color: inherit; }
+  td.size { text-align: right; white-space: nowrap; }
+</style>
+</head>
+<body>
+<h1>Files ({{len .Files}})</h1>
+<table>
+  <thead>
+    <tr>
+      <th><a href="{{sortLink .Sort .Order "name"}}">Name</a></th>
+      <th><a href="{{sortLink .Sort .Order "size"}}">Size</a></th>
+      <th><a href="{{sortLink .Sort .Order "date"}}">Uploaded</a></th>
+    </tr>
+  </thead>
+  <tbody>
+  {{range .Files}}
+    <tr>
+      <td><a href="{{download .}}">{{if .Folder}}{{.Folder}}/{{end}}{{.Filename}}</a></td>
+      <td class="size">{{size .Size}}</td>
+      <td>{{date .UploadedAt}}</td>
+    </tr>
+  {{else}}
+    <tr><td colspan="3">No files yet.</td></tr>
+  {{end}}
+  </tbody>
+</table>
+<p><a href="/">Back</a> · <a href="/logout">Log out</a></p>
+</body>
+</html>
+`))
+
+// formatSize renders a byte count the same way the frontend does.
+func formatSize(bytes int64) string {
+	if bytes < 1024 {
+		return fmt.Sprintf("%d B", bytes)
+	}
+	size := float64(bytes) / 1024
+	for _, unit := range []string{"KB", "MB"} {
+		if size < 1024 {
+			return fmt.Sprintf("%.2f %s", size, unit)
+		}
+		size /= 1024
+	}
+	return fmt.Sprintf("%.2f GB", size)
+}
+
+// browseHandler renders the file list as plain HTML for clients without
+// JavaScript. It shows the same data as /files.
+func browseHandler(c *fiber.Ctx) error {
+	sortKey := c.Query("sort", "name")
+	if !isValidSortKey(sortKey) {
+		sortKey = "name"
+	}
+	order := c.Query("order", "asc")
+	if order != "asc" && order != "desc" {
+		order = "asc"
+	}
+
+	webfiles.mu.Lock()
+	files := make([]FileMeta, 0, len(webfiles.Files))
+	for _, f := range webfiles.Files {
+		if canAccess(c, f) {
+			files = append(files, f)
+		}
+	}
+	webfiles.mu.Unlock()
+
+	sortFiles(files, sortKey, order)
+
+	var b strings.Builder
+	if err := browseTemplate.Execute(&b, fiber.Map{"Files": files, "Sort": sortKey, "Order": order}); err != nil {
+		return c.Status(fiber.StatusInternalServerError).SendString("Failed to render page")
+	}
+	c.Type("html", "utf-8")
+	return c.SendString(b.String())
+}
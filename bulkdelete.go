@@ -0,0 +1,157 @@
+package main
+
+import (
+	"log/slog"
+	"path/filepath"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+type BulkDeleteRequest struct {
+	Filenames []string `json:"filenames"`
+	Glob      string   `json:"glob"`
+	Folder    string   `json:"folder"`
+	DryRun    bool     `json:"dryRun"`
+}
+
+type BulkDeleteEntry struct {
+	Filename      string `json:"filename"`
+	Folder        string `json:"folder,omitempty"`
+	Key           string `json:"key,omitempty"`
+	Size          int64  `json:"size,omitempty"`
+	ContentShared bool   `json:"contentShared,omitempty"`
+	Error         string `json:"error,omitempty"`
+}
+
+type BulkDeleteResult struct {
+	DryRun  bool              `json:"dryRun"`
+	Deleted []BulkDeleteEntry `json:"deleted"`
+	Failed  []BulkDeleteEntry `json:"failed"`
+	Bytes   int64             `json:"bytes"`
+}
+
+// bulkDeleteHandler deletes the files named in the body, or every file in
+// the folder whose name matches a glob. With dryRun (in the body or as
+// ?dryRun=true) it only reports what would go. As in deleteHandler the
+// entries are removed first and their content deleted after the lock is
+// released; content that entries outside the batch still link to is kept.
+// Content that can't be deleted is reported as failed and left behind as
+// an untracked file, which POST /admin/reconcile can list again.
+func bulkDeleteHandler(c *fiber.Ctx) error {
+	var req BulkDeleteRequest
+	if err := c.BodyParser(&req); err != nil {
+		return jsonError(c, fiber.StatusBadRequest, errCodeInvalidRequest, "Invalid request body")
+	}
+	if (len(req.Filenames) == 0) == (req.Glob == "") {
+		return jsonError(c, fiber.StatusBadRequest, errCodeInvalidRequest, "Provide either filenames or glob")
+	}
+	if _, err := filepath.Match(req.Glob, ""); err != nil {
+		return jsonError(c, fiber.StatusBadRequest, errCodeInvalidRequest, "Invalid glob pattern")
+	}
+	folder, err := sanitizeFolder(req.Folder)
+	if err != nil {
+		return jsonError(c, fiber.StatusBadRequest, errCodeInvalidFolder, err.Error())
+	}
+	dryRun := req.DryRun || c.QueryBool("dryRun")
+
+	webfiles.mu.Lock()
+	result := BulkDeleteResult{DryRun: dryRun, Deleted: []BulkDeleteEntry{}, Failed: []BulkDeleteEntry{}}
+	selected := make(map[int]bool)
+	if req.Glob != "" {
+		for i, f := range webfiles.Files {
+			if f.Folder != folder || !canAccess(c, f) {
+				continue
+			}
+			if ok, _ := filepath.Match(req.Glob, f.Filename); ok {
+				selected[i] = true
+			}
+		}
+	} else {
+		for _, name := range req.Filenames {
+			index := findAccessibleFileUnlocked(c, folder, name)
+			if index == -1 {
+				result.Failed = append(result.Failed, BulkDeleteEntry{Filename: name, Folder: folder, Error: "File not found in metadata"})
+				continue
+			}
+			selected[index] = true
+		}
+	}
+
+	// Content is only deleted when no entry left behind links to it.
+	keptKeys := make(map[string]bool)
+	for i, f := range webfiles.Files {
+		if !selected[i] {
+			keptKeys[f.Key] = true
+		}
+	}
+
+	// An entry whose key points outside the storage root stays listed.
+	var removed []FileMeta
+	kept := make([]FileMeta, 0, len(webfiles.Files)-len(selected))
+	for i, f := range webfiles.Files {
+		if !selected[i] {
+			kept = append(kept, f)
+			continue
+		}
+		if !keptKeys[f.Key] && !validKey(f.Key) {
+			slog.WarnContext(c.UserContext(), "Refusing to delete key outside the storage root", "component", "security", "filename", f.Filename, "key", f.Key)
+			result.Failed = append(result.Failed, BulkDeleteEntry{Filename: f.Filename, Folder: f.Folder, Key: f.Key, Size: f.Size, Error: "File path is outside the upload directory"})
+			kept = append(kept, f)
+			continue
+		}
+		removed = append(removed, f)
+	}
+	if dryRun || len(removed) == 0 {
+		webfiles.mu.Unlock()
+		for _, f := range removed {
+			result.Deleted = append(result.Deleted, BulkDeleteEntry{Filename: f.Filename, Folder: f.Folder, Key: f.Key, Size: f.Size, ContentShared: keptKeys[f.Key]})
+			result.Bytes += f.Size
+		}
+		return c.JSON(result)
+	}
+
+	webfiles.Files = kept
+	orphaned := make(map[string]FileMeta)
+	for _, f := range removed {
+		if thumbnail := orphanedThumbnailUnlocked(f); thumbnail != "" {
+			orphaned[thumbnail] = f
+		}
+	}
+	err = saveMetadataUnlocked()
+	webfiles.mu.Unlock()
+	if err != nil {
+		return jsonError(c, fiber.StatusInternalServerError, errCodeInternal, "Failed to update metadata")
+	}
+
+	keyErrs := make(map[string]error)
+	for _, f := range removed {
+		entry := BulkDeleteEntry{Filename: f.Filename, Folder: f.Folder, Key: f.Key, Size: f.Size, ContentShared: keptKeys[f.Key]}
+		if !entry.ContentShared {
+			keyErr, done := keyErrs[f.Key]
+			if !done {
+				if keyErr = fileStorage.Delete(f.Key); keyErr != nil {
+					slog.WarnContext(c.UserContext(), "Could not delete file from storage", "filename", f.Filename, "key", f.Key, "error", keyErr)
+				}
+				keyErrs[f.Key] = keyErr
+			}
+			if keyErr != nil {
+				entry.Error = "Could not delete file from storage"
+				result.Failed = append(result.Failed, entry)
+				continue
+			}
+		}
+		result.Deleted = append(result.Deleted, entry)
+		result.Bytes += f.Size
+	}
+	for key, f := range orphaned {
+		removeThumbnail(f, key)
+	}
+
+	deletesTotal.Add(float64(len(removed)))
+	slog.InfoContext(c.UserContext(), "Bulk delete", "deleted", len(result.Deleted), "failed", len(result.Failed), "bytes", result.Bytes, "folder", folder, "glob", req.Glob, "user", currentUser(c))
+	for _, f := range removed {
+		events.broadcast(FileEvent{Type: eventDeleted, Filename: f.Filename, Folder: f.Folder}, f)
+		recordAudit(c, AuditRecord{Action: auditDelete, Filename: f.Filename, Folder: f.Folder, Size: f.Size})
+	}
+	return c.JSON(result)
+}
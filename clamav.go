@@ -0,0 +1,153 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"path"
+	"strings"
+	"time"
+)
+
+const (
+	defaultClamAVTimeout = time.Minute
+
+	// clamavChunkSize is how much is sent to clamd in each INSTREAM chunk.
+	clamavChunkSize = 64 << 10
+
+	// quarantineDir holds uploads while they are scanned. Like the other
+	// dot-directories it is never listed or reconciled.
+	quarantineDir = ".quarantine"
+)
+
+// clamavAddr is the clamd socket from CLAMAV_ADDR: host:port for TCP, or a
+// path (optionally prefixed with unix:) for a Unix socket. Empty turns
+// scanning off. clamavTimeout, from CLAMAV_TIMEOUT, bounds one scan.
+var (
+	clamavAddr    string
+	clamavTimeout = defaultClamAVTimeout
+)
+
+// infectedError reports an upload that clamd found malware in.
+type infectedError struct {
+	signature string
+}
+
+func (e *infectedError) Error() string {
+	return "infected with " + e.signature
+}
+
+// errScanFailed wraps everything that kept a file from being scanned:
+// clamd unreachable, timing out, or answering with an error, or the upload
+// failing to read back.
+var errScanFailed = errors.New("virus scan failed")
+
+// dialClamAV connects to clamd at clamavAddr.
+func dialClamAV() (net.Conn, error) {
+	if socket, ok := strings.CutPrefix(clamavAddr, "unix:"); ok {
+		return net.DialTimeout("unix", socket, clamavTimeout)
+	}
+	if strings.HasPrefix(clamavAddr, "/") {
+		return net.DialTimeout("unix", clamavAddr, clamavTimeout)
+	}
+	return net.DialTimeout("tcp", clamavAddr, clamavTimeout)
+}
+
+// scanWithClamAV streams r to clamd with the INSTREAM command. It returns
+// the signature name when malware is found and "" when the content is
+// clean.
+func scanWithClamAV(r io.Reader) (string, error) {
+	conn, err := dialClamAV()
+	if err != nil {
+		return "", fmt.Errorf("%w: %v", errScanFailed, err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(clamavTimeout))
+
+	if _, err := conn.Write([]byte("zINSTREAM\x00")); err != nil {
+		return "", fmt.Errorf("%w: %v", errScanFailed, err)
+	}
+	buf := make([]byte, 4+clamavChunkSize)
+	for {
+		n, readErr := io.ReadFull(r, buf[4:])
+		if n > 0 {
+			binary.BigEndian.PutUint32(buf[:4], uint32(n))
+			if _, err := conn.Write(buf[:4+n]); err != nil {
+				// clamd closes the connection when the stream exceeds its
+				// StreamMaxLength; its reply says so.
+				break
+			}
+		}
+		if errors.Is(readErr, io.EOF) || errors.Is(readErr, io.ErrUnexpectedEOF) {
+			conn.Write([]byte{0, 0, 0, 0})
+			break
+		}
+		if readErr != nil {
+			return "", fmt.Errorf("%w: reading upload: %v", errScanFailed, readErr)
+		}
+	}
+
+	reply, err := bufio.NewReader(conn).ReadBytes(0)
+	if err != nil && len(reply) == 0 {
+		return "", fmt.Errorf("%w: %v", errScanFailed, err)
+	}
+	// Replies look like "stream: OK", "stream: Eicar-Signature FOUND" or
+	// "INSTREAM size limit exceeded. ERROR".
+	result := string(bytes.TrimRight(reply, "\x00\n"))
+	result = strings.TrimSpace(strings.TrimPrefix(result, "stream:"))
+	switch {
+	case result == "OK":
+		return "", nil
+	case strings.HasSuffix(result, " FOUND"):
+		return strings.TrimSuffix(result, " FOUND"), nil
+	default:
+		return "", fmt.Errorf("%w: clamd answered %q", errScanFailed, result)
+	}
+}
+
+// saveScanned is saveAndHash for when CLAMAV_ADDR is set. The upload is
+// saved in quarantine, scanned as stored and only then moved to key, so
+// nothing unscanned is ever served. Infected content is deleted and
+// reported as an *infectedError; if the scan can't be done the upload is
+// refused with errScanFailed rather than accepted unscanned.
+func saveScanned(file incomingFile, key string) (string, error) {
+	quarantineKey := path.Join(quarantineDir, newUUID()+path.Ext(key))
+	checksum, err := saveAndHash(file, quarantineKey)
+	if err != nil {
+		return "", err
+	}
+	discard := func() {
+		if err := fileStorage.Delete(quarantineKey); err != nil {
+			slog.Warn("Could not remove quarantined upload", "key", quarantineKey, "error", err)
+		}
+	}
+
+	f, err := fileStorage.Open(quarantineKey)
+	if err != nil {
+		discard()
+		return "", err
+	}
+	start := time.Now()
+	signature, err := scanWithClamAV(f)
+	f.Close()
+	if err != nil {
+		discard()
+		return "", err
+	}
+	if signature != "" {
+		discard()
+		return "", &infectedError{signature: signature}
+	}
+	slog.Debug("Virus scan clean", "filename", file.Filename, "sha256", checksum, "durationMs", time.Since(start).Milliseconds())
+
+	if err := fileStorage.Rename(quarantineKey, key); err != nil {
+		discard()
+		return "", err
+	}
+	return checksum, nil
+}
@@ -0,0 +1,35 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"net"
+	"testing"
+)
+
+type failingReader struct{}
+
+func (failingReader) Read([]byte) (int, error) { return 0, errors.New("disk gone") }
+
+func TestScanReadErrorIsScanFailure(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		io.Copy(io.Discard, conn)
+	}()
+	saved := clamavAddr
+	clamavAddr = ln.Addr().String()
+	defer func() { clamavAddr = saved }()
+
+	if _, err := scanWithClamAV(failingReader{}); !errors.Is(err, errScanFailed) {
+		t.Errorf("scanWithClamAV with an unreadable upload: %v, want errScanFailed", err)
+	}
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"mime"
+	"strings"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/valyala/fasthttp"
+)
+
+const (
+	compressionLevelOff     = "off"
+	compressionLevelSpeed   = "speed"
+	compressionLevelDefault = "default"
+	compressionLevelBest    = "best"
+)
+
+// compressors are the brotli/gzip/deflate handlers Fiber's compress
+// middleware uses for each level. They pick the encoding from the request's
+// Accept-Encoding and leave a response that already has a Content-Encoding
+// alone.
+var compressors = map[string]fasthttp.RequestHandler{
+	compressionLevelSpeed:   fasthttp.CompressHandlerBrotliLevel(func(*fasthttp.RequestCtx) {}, fasthttp.CompressBrotliBestSpeed, fasthttp.CompressBestSpeed),
+	compressionLevelDefault: fasthttp.CompressHandlerBrotliLevel(func(*fasthttp.RequestCtx) {}, fasthttp.CompressBrotliDefaultCompression, fasthttp.CompressDefaultCompression),
+	compressionLevelBest:    fasthttp.CompressHandlerBrotliLevel(func(*fasthttp.RequestCtx) {}, fasthttp.CompressBrotliBestCompression, fasthttp.CompressBestCompression),
+}
+
+// compressibleType reports whether content of this type shrinks when
+// compressed. Archives, images, audio, video and PDFs are already
+// compressed, so only text-like types are listed.
+func compressibleType(contentType string) bool {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return false
+	}
+	switch mediaType {
+	case "application/json", "application/javascript", "application/xml", "application/x-ndjson",
+		"application/yaml", "application/x-yaml", "application/toml", "application/sql",
+		"image/svg+xml":
+		return true
+	}
+	return strings.HasPrefix(mediaType, "text/") || strings.HasSuffix(mediaType, "+json") || strings.HasSuffix(mediaType, "+xml")
+}
+
+// compressResponses compresses JSON API responses and downloads of text-like
+// files for clients that accept it. Unlike Fiber's compress middleware, which
+// decides before the handler runs, it looks at the finished response, so the
+// stored content type of a download decides. Partial content is sent as is:
+// a byte range refers to the file, not to its compressed form.
+func compressResponses(c *fiber.Ctx) error {
+	if err := c.Next(); err != nil {
+		return err
+	}
+	compressor, ok := compressors[settings().compressionLevel]
+	if !ok || c.Method() == fiber.MethodHead || c.Response().StatusCode() == fiber.StatusPartialContent {
+		return nil
+	}
+	if len(c.Response().Header.ContentEncoding()) > 0 || !compressibleType(string(c.Response().Header.ContentType())) {
+		return nil
+	}
+	compressor(c.Context())
+	// The compressed body isn't byte-for-byte the file, so a strong ETag no
+	// longer holds.
+	if len(c.Response().Header.ContentEncoding()) > 0 {
+		if etag := c.GetRespHeader(fiber.HeaderETag); etag != "" && !strings.HasPrefix(etag, "W/") {
+			c.Set(fiber.HeaderETag, "W/"+etag)
+		}
+	}
+	return nil
+}
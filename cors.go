@@ -0,0 +1,63 @@
+package main
+
+import (
+	"fmt"
+	"net/url"
+	"strings"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/gofiber/fiber/v2/middleware/cors"
+)
+
+// allowedOrigins are the browser origins, from ALLOWED_ORIGINS, that may call
+// the API with the session cookie. Empty means same-origin only: no CORS
+// headers are sent at all.
+var allowedOrigins []string
+
+// parseOrigins reads a comma-separated list such as
+// "https://app.example.com,http://localhost:5173". Each entry must be a bare
+// scheme://host[:port]; "*" is refused because credentials are allowed.
+func parseOrigins(raw string) ([]string, error) {
+	var origins []string
+	for _, origin := range strings.Split(raw, ",") {
+		origin = strings.TrimSpace(origin)
+		if origin == "" {
+			continue
+		}
+		if origin == "*" {
+			return nil, fmt.Errorf("\"*\" is not allowed since the session cookie is sent cross-origin; list each origin")
+		}
+		u, err := url.Parse(origin)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" || strings.Contains(u.Host, "*") ||
+			(u.Path != "" && u.Path != "/") || u.RawQuery != "" || u.Fragment != "" {
+			return nil, fmt.Errorf("%q is not an origin like https://example.com", origin)
+		}
+		origins = append(origins, strings.ToLower(u.Scheme+"://"+u.Host))
+	}
+	return origins, nil
+}
+
+// corsMiddleware answers preflight requests and adds CORS headers for the
+// allowed origins. Other origins never have their Origin echoed back, and
+// their preflights are refused with 403 so the failure is explicit.
+func corsMiddleware() fiber.Handler {
+	allowed := make(map[string]bool, len(allowedOrigins))
+	for _, origin := range allowedOrigins {
+		allowed[origin] = true
+	}
+	handler := cors.New(cors.Config{
+		AllowOrigins:     strings.Join(allowedOrigins, ","),
+		AllowCredentials: true,
+		AllowMethods:     "GET,HEAD,POST,PUT,PATCH,DELETE",
+		AllowHeaders:     "Content-Type,Range,If-Unmodified-Since,If-Match,Upload-Offset,X-Request-ID," + csrfHeaderName,
+		ExposeHeaders:    "Location,X-Request-ID,Content-Disposition,Content-Range,X-Checksum-SHA256,X-Existing-Filename,X-Extension-Mismatch,X-Missing-Files,Upload-Offset,Upload-Length",
+		MaxAge:           600,
+	})
+	return func(c *fiber.Ctx) error {
+		origin := strings.ToLower(c.Get(fiber.HeaderOrigin))
+		if c.Method() == fiber.MethodOptions && origin != "" && c.Get(fiber.HeaderAccessControlRequestMethod) != "" && !allowed[origin] {
+			return c.SendStatus(fiber.StatusForbidden)
+		}
+		return handler(c)
+	}
+}
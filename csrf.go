@@ -0,0 +1,68 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"log/slog"
+	"strings"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+const (
+	csrfCookieName = "csrf_token"
+	csrfHeaderName = "X-CSRF-Token"
+)
+
+// issueCSRFToken sets a fresh random CSRF token. Unlike the session cookie it
+// is readable from JavaScript, so the page can copy it into the
+// X-CSRF-Token header; another site can't read it and so can't forge the
+// header (double-submit cookie). The token is also returned for clients that
+// can't read the cookie.
+func issueCSRFToken(c *fiber.Ctx) (string, error) {
+	buf := make([]byte, 32)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+	token := hex.EncodeToString(buf)
+	c.Cookie(&fiber.Cookie{
+		Name:     csrfCookieName,
+		Value:    token,
+		Secure:   secureCookies(c),
+		SameSite: fiber.CookieSameSiteStrictMode,
+	})
+	return token, nil
+}
+
+// csrfMiddleware requires state-changing requests to repeat the CSRF cookie
+// in the X-CSRF-Token header, answering 403 otherwise. Safe methods pass and
+// pick up a token if the session predates one. It runs after the session
+// check, so /login and /public are skipped the same way.
+func csrfMiddleware(c *fiber.Ctx) error {
+	// The API key is sent explicitly by a script, not attached by the
+	// browser like a cookie, so it can't be forged cross-site.
+	if apiKeyRequest(c) {
+		return c.Next()
+	}
+	switch c.Method() {
+	case fiber.MethodGet, fiber.MethodHead, fiber.MethodOptions:
+		if c.Cookies(csrfCookieName) == "" {
+			if _, err := issueCSRFToken(c); err != nil {
+				slog.ErrorContext(c.UserContext(), "Could not issue CSRF token", "error", err)
+			}
+		}
+		return c.Next()
+	}
+	if c.Path() == "/login" || strings.HasPrefix(c.Path(), "/public") {
+		return c.Next()
+	}
+
+	cookie := c.Cookies(csrfCookieName)
+	header := c.Get(csrfHeaderName)
+	if cookie == "" || subtle.ConstantTimeCompare([]byte(cookie), []byte(header)) != 1 {
+		slog.WarnContext(c.UserContext(), "Rejected request with missing or mismatched CSRF token", "component", "security", "method", c.Method(), "path", c.Path(), "ip", c.IP())
+		return jsonError(c, fiber.StatusForbidden, errCodeCSRFTokenInvalid, "Missing or invalid CSRF token")
+	}
+	return c.Next()
+}
@@ -0,0 +1,262 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+var errRangeNotSatisfiable = errors.New("range not satisfiable")
+
+// parseRange parses a single-range Range header ("bytes=0-99", "bytes=100-",
+// "bytes=-500") against a file of the given size. ok is false when the header
+// should be ignored and the whole file served, which includes multi-range
+// requests we don't support.
+func parseRange(header string, size int64) (start, end int64, ok bool, err error) {
+	spec, found := strings.CutPrefix(strings.TrimSpace(header), "bytes=")
+	if !found || strings.Contains(spec, ",") {
+		return 0, 0, false, nil
+	}
+	first, last, found := strings.Cut(strings.TrimSpace(spec), "-")
+	if !found {
+		return 0, 0, false, nil
+	}
+
+	if first == "" {
+		// Suffix range: the last N bytes.
+		n, err := strconv.ParseInt(last, 10, 64)
+		if err != nil || n < 0 {
+			return 0, 0, false, nil
+		}
+		if n == 0 || size == 0 {
+			return 0, 0, false, errRangeNotSatisfiable
+		}
+		if n > size {
+			n = size
+		}
+		return size - n, size - 1, true, nil
+	}
+
+	start, err = strconv.ParseInt(first, 10, 64)
+	if err != nil || start < 0 {
+		return 0, 0, false, nil
+	}
+	if start >= size {
+		return 0, 0, false, errRangeNotSatisfiable
+	}
+	end = size - 1
+	if last != "" {
+		end, err = strconv.ParseInt(last, 10, 64)
+		if err != nil || end < start {
+			return 0, 0, false, nil
+		}
+		if end >= size {
+			end = size - 1
+		}
+	}
+	return start, end, true, nil
+}
+
+// serveFile streams a stored file as an attachment under its filename. The
+// stored content type is sent when known; older entries without one get a
+// type guessed from the extension. It honours single byte-range requests
+// with 206 Partial Content so interrupted downloads can resume; requests
+// without a Range header get the whole file. Conditional requests for an
+// unchanged file get 304 Not Modified.
+func serveFile(c *fiber.Ctx, meta FileMeta) error {
+	return sendFile(c, meta, meta.ContentType, false)
+}
+
+// serveFileInline is serveFile with an inline Content-Disposition and the
+// given content type, so the browser displays the file instead of saving
+// it. Callers must make sure the content type is safe to render (see
+// isPreviewable).
+func serveFileInline(c *fiber.Ctx, meta FileMeta, contentType string) error {
+	return sendFile(c, meta, contentType, true)
+}
+
+// fileETag identifies the current content of a file: the stored SHA-256 when
+// known, otherwise a weak tag built from size and modification time.
+func fileETag(meta FileMeta, info fs.FileInfo) string {
+	if meta.Checksum != "" {
+		return `"` + meta.Checksum + `"`
+	}
+	return fmt.Sprintf(`W/"%x-%x"`, info.Size(), info.ModTime().UnixNano())
+}
+
+// notModified reports whether the request's validators show the client
+// already has this version. If-None-Match takes precedence over
+// If-Modified-Since, as in RFC 9110.
+func notModified(c *fiber.Ctx, etag string, modified time.Time) bool {
+	if header := c.Get(fiber.HeaderIfNoneMatch); header != "" {
+		for _, candidate := range strings.Split(header, ",") {
+			candidate = strings.TrimSpace(candidate)
+			if candidate == "*" || strings.TrimPrefix(candidate, "W/") == strings.TrimPrefix(etag, "W/") {
+				return true
+			}
+		}
+		return false
+	}
+	if header := c.Get(fiber.HeaderIfModifiedSince); header != "" {
+		if since, err := http.ParseTime(header); err == nil {
+			return !modified.Truncate(time.Second).After(since)
+		}
+	}
+	return false
+}
+
+// ifMatchFailed reports whether the request has an If-Match header naming
+// none of the current versions of meta, so a change the client hasn't seen
+// isn't silently overwritten. The ETag of a file with a checksum matches in
+// any form: quoted, bare, or weakened by compression, since the checksum
+// pins the exact content. Files without one only have a weak ETag, which
+// If-Match never accepts, so only "*" matches them.
+func ifMatchFailed(c *fiber.Ctx, meta FileMeta) bool {
+	header := c.Get(fiber.HeaderIfMatch)
+	if header == "" {
+		return false
+	}
+	for _, candidate := range strings.Split(header, ",") {
+		candidate = strings.TrimSpace(candidate)
+		if candidate == "*" {
+			return false
+		}
+		if meta.Checksum != "" && strings.Trim(strings.TrimPrefix(candidate, "W/"), `"`) == meta.Checksum {
+			return false
+		}
+	}
+	return true
+}
+
+// downloadHeadHandler answers HEAD /download/:filename with the headers a
+// GET would send, so clients can learn the size and type of a file without
+// downloading it. Nothing is read from the file and no download is counted.
+func downloadHeadHandler(c *fiber.Ctx) error {
+	requestedFilename, err := url.QueryUnescape(c.Params("filename"))
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).Send(nil)
+	}
+	folder, err := folderQuery(c)
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).Send(nil)
+	}
+
+	webfiles.mu.Lock()
+	fileIndex := findAccessibleFileUnlocked(c, folder, requestedFilename)
+	var meta FileMeta
+	if fileIndex != -1 {
+		meta = webfiles.Files[fileIndex]
+	}
+	webfiles.mu.Unlock()
+	if fileIndex == -1 {
+		return c.Status(fiber.StatusNotFound).Send(nil)
+	}
+
+	info, err := fileStorage.Stat(meta.Key)
+	if errors.Is(err, fs.ErrNotExist) {
+		slog.ErrorContext(c.UserContext(), "File in metadata is missing from storage", "filename", requestedFilename, "folder", folder, "key", meta.Key)
+		return c.Status(fiber.StatusNotFound).Send(nil)
+	}
+	if err != nil {
+		slog.ErrorContext(c.UserContext(), "Could not stat file", "key", meta.Key, "error", err)
+		return c.Status(fiber.StatusInternalServerError).Send(nil)
+	}
+
+	etag := fileETag(meta, info)
+	c.Set(fiber.HeaderETag, etag)
+	c.Set(fiber.HeaderLastModified, info.ModTime().UTC().Format(http.TimeFormat))
+	c.Set(fiber.HeaderCacheControl, "private, no-cache")
+	if notModified(c, etag, info.ModTime()) {
+		return c.Status(fiber.StatusNotModified).Send(nil)
+	}
+	filename := downloadName(meta)
+	c.Type(filepath.Ext(filename))
+	if meta.ContentType != "" {
+		c.Set(fiber.HeaderContentType, meta.ContentType)
+	}
+	c.Set(fiber.HeaderContentDisposition, contentDisposition("attachment", filename))
+	c.Set(fiber.HeaderAcceptRanges, "bytes")
+	if meta.Checksum != "" {
+		c.Set("X-Checksum-SHA256", meta.Checksum)
+	}
+	c.Response().Header.SetContentLength(int(info.Size()))
+	return nil
+}
+
+func sendFile(c *fiber.Ctx, meta FileMeta, contentType string, inline bool) error {
+	key, filename := meta.Key, downloadName(meta)
+	begin := time.Now()
+	f, err := fileStorage.Open(key)
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return jsonError(c, fiber.StatusNotFound, errCodeFileNotFound, "File not found on disk")
+		}
+		slog.ErrorContext(c.UserContext(), "Could not open file", "key", key, "error", err)
+		return jsonError(c, fiber.StatusInternalServerError, errCodeInternal, "Could not open file")
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		slog.ErrorContext(c.UserContext(), "Could not stat file", "key", key, "error", err)
+		return jsonError(c, fiber.StatusInternalServerError, errCodeInternal, "Could not open file")
+	}
+	size := info.Size()
+
+	etag := fileETag(meta, info)
+	c.Set(fiber.HeaderETag, etag)
+	c.Set(fiber.HeaderLastModified, info.ModTime().UTC().Format(http.TimeFormat))
+	// Files are behind a login, so only the browser may cache them, and it
+	// must check back each time; unchanged files cost a 304.
+	c.Set(fiber.HeaderCacheControl, "private, no-cache")
+	if notModified(c, etag, info.ModTime()) {
+		f.Close()
+		return c.SendStatus(fiber.StatusNotModified)
+	}
+	if firstFetch(c) {
+		downloadsTotal.Inc()
+	}
+
+	c.Type(filepath.Ext(filename))
+	disposition := "attachment"
+	if inline {
+		disposition = "inline"
+	}
+	c.Set(fiber.HeaderContentDisposition, contentDisposition(disposition, filename))
+	if contentType != "" {
+		c.Set(fiber.HeaderContentType, contentType)
+	}
+	c.Set(fiber.HeaderAcceptRanges, "bytes")
+
+	if header := c.Get(fiber.HeaderRange); header != "" {
+		start, end, ok, err := parseRange(header, size)
+		if err != nil {
+			f.Close()
+			c.Set(fiber.HeaderContentRange, fmt.Sprintf("bytes */%d", size))
+			return jsonError(c, fiber.StatusRequestedRangeNotSatisfiable, errCodeRangeNotSatisfiable, "Requested range not satisfiable")
+		}
+		if ok {
+			length := end - start + 1
+			slog.DebugContext(c.UserContext(), "Serving byte range", "key", key, "start", start, "end", end, "size", size)
+			c.Set(fiber.HeaderContentRange, fmt.Sprintf("bytes %d-%d/%d", start, end, size))
+			if _, err := f.Seek(start, io.SeekStart); err != nil {
+				f.Close()
+				slog.ErrorContext(c.UserContext(), "Could not seek in file", "key", key, "error", err)
+				return jsonError(c, fiber.StatusInternalServerError, errCodeInternal, "Could not open file")
+			}
+			c.Status(fiber.StatusPartialContent)
+			return streamDownload(c, io.LimitReader(f, length), f, length, begin)
+		}
+	}
+
+	return streamDownload(c, f, f, size, begin)
+}
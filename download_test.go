@@ -0,0 +1,63 @@
+package main
+
+import (
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+)
+
+// counterValue reads the current value of a counter.
+func counterValue(t *testing.T, counter prometheus.Counter) float64 {
+	t.Helper()
+	var m dto.Metric
+	if err := counter.Write(&m); err != nil {
+		t.Fatal(err)
+	}
+	return m.GetCounter().GetValue()
+}
+
+func TestDownloadsCountedOnce(t *testing.T) {
+	setupTestStore(t)
+	addTestFile(t, "", "a.txt", "hello world")
+	addTestFile(t, "", "b.txt", "second file")
+	app := fiber.New()
+	app.Get("/download/:filename", downloadHandler)
+	app.Post("/download-zip", downloadZipHandler)
+
+	download := func(rangeHeader string) {
+		req := httptest.NewRequest(fiber.MethodGet, "/download/a.txt", nil)
+		if rangeHeader != "" {
+			req.Header.Set(fiber.HeaderRange, rangeHeader)
+		}
+		if status := doRequest(t, app, req, nil); status != fiber.StatusOK && status != fiber.StatusPartialContent {
+			t.Fatalf("download with Range %q: status %d", rangeHeader, status)
+		}
+	}
+	before := counterValue(t, downloadsTotal)
+
+	// One download fetched in three ranges, then a plain download.
+	download("bytes=0-3")
+	download("bytes=4-7")
+	download("bytes=8-")
+	download("")
+	if got := counterValue(t, downloadsTotal) - before; got != 2 {
+		t.Errorf("downloads counted for two logical downloads: %v", got)
+	}
+	if n := webfiles.Files[findFileUnlocked("", "a.txt")].Downloads; n != 2 {
+		t.Errorf("a.txt download count %d, want 2", n)
+	}
+
+	before = counterValue(t, downloadsTotal)
+	req := httptest.NewRequest(fiber.MethodPost, "/download-zip", strings.NewReader(`["a.txt","b.txt"]`))
+	req.Header.Set(fiber.HeaderContentType, fiber.MIMEApplicationJSON)
+	if status := doRequest(t, app, req, nil); status != fiber.StatusOK {
+		t.Fatalf("zip download: status %d", status)
+	}
+	if got := counterValue(t, downloadsTotal) - before; got != 1 {
+		t.Errorf("downloads counted for one zip archive of two files: %v", got)
+	}
+}
@@ -0,0 +1,45 @@
+package main
+
+import (
+	"log/slog"
+	"strings"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// firstFetch reports whether the request starts a download rather than
+// continuing one. A resumed or segmented download fetches the file with
+// several Range requests; only the one starting at byte 0 (or a request
+// without Range) is first, so each logical download is counted once.
+func firstFetch(c *fiber.Ctx) bool {
+	r := strings.TrimSpace(c.Get(fiber.HeaderRange))
+	return r == "" || strings.HasPrefix(r, "bytes=0-")
+}
+
+// recordDownloadUnlocked counts a served download on f and persists it,
+// once per logical download (see firstFetch). The caller must hold
+// webfiles.mu.
+func recordDownloadUnlocked(c *fiber.Ctx, f *FileMeta) {
+	if status := c.Response().StatusCode(); status != fiber.StatusOK && status != fiber.StatusPartialContent {
+		return
+	}
+	if !firstFetch(c) {
+		return
+	}
+	f.Downloads++
+	f.LastAccessed = time.Now().UTC()
+	if err := saveMetadataUnlocked(); err != nil {
+		slog.WarnContext(c.UserContext(), "Could not save download count", "filename", f.Filename, "folder", f.Folder, "error", err)
+	}
+}
+
+// recordDownload is recordDownloadUnlocked for handlers that have released
+// the lock; the file is looked up again by folder and name.
+func recordDownload(c *fiber.Ctx, folder, filename string) {
+	webfiles.mu.Lock()
+	defer webfiles.mu.Unlock()
+	if index := findFileUnlocked(folder, filename); index != -1 {
+		recordDownloadUnlocked(c, &webfiles.Files[index])
+	}
+}
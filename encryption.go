@@ -0,0 +1,289 @@
+package main
+
+import (
+	"bufio"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+)
+
+// Encrypted files are a header followed by chunks: the magic, then a random
+// nonce prefix, then each encryptionChunkSize bytes of plaintext sealed with
+// AES-256-GCM. A chunk's nonce is the prefix, its index and a flag marking
+// the last chunk, so chunks can't be reordered, dropped or truncated
+// without failing to decrypt, and a range request only decrypts the chunks
+// it covers.
+const (
+	encryptionMagic      = "WFE1"
+	encryptionPrefixSize = 7
+	encryptionHeaderSize = len(encryptionMagic) + encryptionPrefixSize
+	encryptionChunkSize  = 64 * 1024
+	encryptionTagSize    = 16
+)
+
+var errWrongEncryptionKey = errors.New("could not decrypt; the file was encrypted with a different ENCRYPTION_KEY or is damaged")
+
+// parseEncryptionKey decodes ENCRYPTION_KEY, 32 bytes written as hex or
+// base64.
+func parseEncryptionKey(raw string) ([]byte, error) {
+	key, err := hex.DecodeString(raw)
+	if err != nil {
+		key, err = base64.StdEncoding.DecodeString(raw)
+	}
+	if err != nil || len(key) != 32 {
+		return nil, fmt.Errorf("ENCRYPTION_KEY must be 32 bytes written as 64 hex digits or base64, e.g. the output of: openssl rand -hex 32")
+	}
+	return key, nil
+}
+
+// encryptedStorage encrypts everything saved to the wrapped backend and
+// decrypts it when read. Files stored before encryption was turned on have
+// no header and are read as they are.
+type encryptedStorage struct {
+	Storage
+	aead cipher.AEAD
+}
+
+func newEncryptedStorage(inner Storage, key []byte) (encryptedStorage, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return encryptedStorage{}, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return encryptedStorage{}, err
+	}
+	return encryptedStorage{Storage: inner, aead: aead}, nil
+}
+
+// encryptionChunks is the number of chunks size bytes of plaintext take. An
+// empty file still has one, so it can be authenticated.
+func encryptionChunks(size int64) int64 {
+	return max((size+encryptionChunkSize-1)/encryptionChunkSize, 1)
+}
+
+func encryptedSize(size int64) int64 {
+	return int64(encryptionHeaderSize) + size + encryptionChunks(size)*encryptionTagSize
+}
+
+// plaintextSize reverses encryptedSize, reporting false for a length no
+// encrypted file can have.
+func plaintextSize(size int64) (int64, bool) {
+	body := size - int64(encryptionHeaderSize)
+	if body < encryptionTagSize {
+		return 0, false
+	}
+	chunks := (body + encryptionChunkSize + encryptionTagSize - 1) / (encryptionChunkSize + encryptionTagSize)
+	plain := body - chunks*encryptionTagSize
+	return plain, plain >= 0 && encryptionChunks(plain) == chunks
+}
+
+func chunkNonce(prefix []byte, index int64, last bool) []byte {
+	nonce := make([]byte, 12)
+	copy(nonce, prefix)
+	binary.BigEndian.PutUint32(nonce[encryptionPrefixSize:], uint32(index))
+	if last {
+		nonce[11] = 1
+	}
+	return nonce
+}
+
+func (s encryptedStorage) Save(key string, r io.Reader, size int64) error {
+	prefix := make([]byte, encryptionPrefixSize)
+	if _, err := rand.Read(prefix); err != nil {
+		return err
+	}
+	return s.Storage.Save(key, &encryptingReader{
+		aead:   s.aead,
+		src:    bufio.NewReader(r),
+		prefix: prefix,
+		plain:  make([]byte, encryptionChunkSize),
+		out:    append([]byte(encryptionMagic), prefix...),
+	}, encryptedSize(size))
+}
+
+func (s encryptedStorage) Open(key string) (StoredFile, error) {
+	f, err := s.Storage.Open(key)
+	if err != nil {
+		return nil, err
+	}
+	header := make([]byte, encryptionHeaderSize)
+	n, err := io.ReadFull(f, header)
+	if err != nil && !errors.Is(err, io.ErrUnexpectedEOF) && !errors.Is(err, io.EOF) {
+		f.Close()
+		return nil, err
+	}
+	if n < encryptionHeaderSize || string(header[:len(encryptionMagic)]) != encryptionMagic {
+		if _, err := f.Seek(0, io.SeekStart); err != nil {
+			f.Close()
+			return nil, err
+		}
+		return f, nil
+	}
+
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	size, ok := plaintextSize(info.Size())
+	if !ok {
+		f.Close()
+		return nil, fmt.Errorf("%s: %w", key, errWrongEncryptionKey)
+	}
+	d := &decryptingFile{
+		inner:    f,
+		aead:     s.aead,
+		prefix:   header[len(encryptionMagic):],
+		info:     plaintextInfo{info, size},
+		innerPos: int64(encryptionHeaderSize),
+		chunk:    -1,
+	}
+	// Decrypting the first chunk up front turns a wrong key into an error
+	// before any response headers are sent.
+	if err := d.load(0); err != nil {
+		f.Close()
+		return nil, fmt.Errorf("%s: %w", key, err)
+	}
+	return d, nil
+}
+
+func (s encryptedStorage) Stat(key string) (fs.FileInfo, error) {
+	f, err := s.Open(key)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return f.Stat()
+}
+
+// encryptingReader yields the header and then the sealed chunks of src.
+type encryptingReader struct {
+	aead   cipher.AEAD
+	src    *bufio.Reader
+	prefix []byte
+	plain  []byte
+	out    []byte
+	index  int64
+	done   bool
+}
+
+func (e *encryptingReader) Read(p []byte) (int, error) {
+	for len(e.out) == 0 {
+		if e.done {
+			return 0, io.EOF
+		}
+		n, err := io.ReadFull(e.src, e.plain)
+		last := false
+		switch {
+		case errors.Is(err, io.EOF), errors.Is(err, io.ErrUnexpectedEOF):
+			last = true
+		case err != nil:
+			return 0, err
+		default:
+			if _, err := e.src.Peek(1); errors.Is(err, io.EOF) {
+				last = true
+			} else if err != nil {
+				return 0, err
+			}
+		}
+		e.out = e.aead.Seal(e.out[:0], chunkNonce(e.prefix, e.index, last), e.plain[:n], nil)
+		e.index++
+		e.done = last
+	}
+	n := copy(p, e.out)
+	e.out = e.out[n:]
+	return n, nil
+}
+
+// decryptingFile reads an encrypted file as plaintext, decrypting one chunk
+// at a time.
+type decryptingFile struct {
+	inner    StoredFile
+	aead     cipher.AEAD
+	prefix   []byte
+	info     fs.FileInfo
+	offset   int64
+	innerPos int64
+	chunk    int64
+	plain    []byte
+	sealed   []byte
+}
+
+// load decrypts chunk index into d.plain.
+func (d *decryptingFile) load(index int64) error {
+	size := d.info.Size()
+	start := index * encryptionChunkSize
+	length := min(size-start, encryptionChunkSize) + encryptionTagSize
+	pos := int64(encryptionHeaderSize) + index*(encryptionChunkSize+encryptionTagSize)
+	if pos != d.innerPos {
+		if _, err := d.inner.Seek(pos, io.SeekStart); err != nil {
+			return err
+		}
+		d.innerPos = pos
+	}
+	if int64(cap(d.sealed)) < length {
+		d.sealed = make([]byte, encryptionChunkSize+encryptionTagSize)
+	}
+	sealed := d.sealed[:length]
+	n, err := io.ReadFull(d.inner, sealed)
+	d.innerPos += int64(n)
+	if err != nil {
+		return err
+	}
+	last := index == encryptionChunks(size)-1
+	plain, err := d.aead.Open(d.plain[:0], chunkNonce(d.prefix, index, last), sealed, nil)
+	if err != nil {
+		return errWrongEncryptionKey
+	}
+	d.plain = plain
+	d.chunk = index
+	return nil
+}
+
+func (d *decryptingFile) Read(p []byte) (int, error) {
+	if d.offset >= d.info.Size() {
+		return 0, io.EOF
+	}
+	if index := d.offset / encryptionChunkSize; index != d.chunk {
+		if err := d.load(index); err != nil {
+			return 0, err
+		}
+	}
+	n := copy(p, d.plain[d.offset-d.chunk*encryptionChunkSize:])
+	d.offset += int64(n)
+	return n, nil
+}
+
+func (d *decryptingFile) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekCurrent:
+		offset += d.offset
+	case io.SeekEnd:
+		offset += d.info.Size()
+	}
+	if offset < 0 {
+		return 0, errors.New("seek before start of file")
+	}
+	d.offset = offset
+	return offset, nil
+}
+
+func (d *decryptingFile) Stat() (fs.FileInfo, error) { return d.info, nil }
+
+func (d *decryptingFile) Close() error { return d.inner.Close() }
+
+// plaintextInfo reports the decrypted size of an encrypted file.
+type plaintextInfo struct {
+	fs.FileInfo
+	size int64
+}
+
+func (i plaintextInfo) Size() int64 { return i.size }
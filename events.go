@@ -0,0 +1,171 @@
+package main
+
+import (
+	"encoding/json"
+	"log/slog"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gofiber/contrib/websocket"
+	"github.com/gofiber/fiber/v2"
+)
+
+const (
+	eventUploaded = "uploaded"
+	eventDeleted  = "deleted"
+	eventRenamed  = "renamed"
+	eventRestored = "restored"
+
+	// eventBuffer is how many events may queue for a slow client before it
+	// is disconnected rather than holding up everyone else.
+	eventBuffer = 64
+
+	eventPingInterval = 30 * time.Second
+	eventWriteTimeout = 10 * time.Second
+)
+
+// FileEvent is one change to the store as pushed to /ws clients. Uploads
+// and renames carry the file as it now is; renames and deletes also name
+// the file as it was. A restore replaces the whole list and names no file.
+type FileEvent struct {
+	Type     string    `json:"type"`
+	File     *FileMeta `json:"file,omitempty"`
+	Filename string    `json:"filename,omitempty"`
+	Folder   string    `json:"folder,omitempty"`
+}
+
+type eventClient struct {
+	username string
+	send     chan []byte
+}
+
+// eventHub fans store changes out to the connected WebSocket clients. Each
+// client only hears about files its user can access.
+type eventHub struct {
+	mu      sync.Mutex
+	clients map[*eventClient]struct{}
+}
+
+var events = &eventHub{clients: make(map[*eventClient]struct{})}
+
+func (h *eventHub) register(username string) *eventClient {
+	client := &eventClient{username: username, send: make(chan []byte, eventBuffer)}
+	h.mu.Lock()
+	h.clients[client] = struct{}{}
+	h.mu.Unlock()
+	return client
+}
+
+func (h *eventHub) unregister(client *eventClient) {
+	h.mu.Lock()
+	if _, ok := h.clients[client]; ok {
+		delete(h.clients, client)
+		close(client.send)
+	}
+	h.mu.Unlock()
+}
+
+// broadcast queues event for every client allowed to see f. It never
+// blocks, so it is safe to call with webfiles.mu held; a client whose
+// queue is full is dropped and has to reconnect and reload the list.
+func (h *eventHub) broadcast(event FileEvent, f FileMeta) {
+	h.send(event, func(username string) bool { return accessibleBy(username, f) })
+}
+
+// broadcastAll queues event for every client, for changes that aren't
+// about one file.
+func (h *eventHub) broadcastAll(event FileEvent) {
+	h.send(event, func(string) bool { return true })
+}
+
+// send queues event for the clients whose user passes allowed.
+func (h *eventHub) send(event FileEvent, allowed func(username string) bool) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if len(h.clients) == 0 {
+		return
+	}
+	msg, err := json.Marshal(event)
+	if err != nil {
+		slog.Error("Could not encode file event", "type", event.Type, "error", err)
+		return
+	}
+	for client := range h.clients {
+		if !allowed(client.username) {
+			continue
+		}
+		select {
+		case client.send <- msg:
+		default:
+			slog.Warn("Event client too slow, disconnecting", "user", client.username)
+			delete(h.clients, client)
+			close(client.send)
+		}
+	}
+}
+
+// eventsUpgrade lets only WebSocket handshakes through to eventsHandler.
+// The session was already checked by the auth middleware; the Origin check
+// keeps other sites from opening a socket with the user's cookie.
+func eventsUpgrade(c *fiber.Ctx) error {
+	if !websocket.IsWebSocketUpgrade(c) {
+		return jsonError(c, fiber.StatusUpgradeRequired, errCodeInvalidRequest, "This endpoint only accepts WebSocket connections")
+	}
+	if origin := strings.ToLower(c.Get(fiber.HeaderOrigin)); origin != "" && origin != strings.ToLower(c.Protocol()+"://"+c.Hostname()) && !originAllowed(origin) {
+		slog.WarnContext(c.UserContext(), "Refused WebSocket from another origin", "component", "security", "origin", origin, "ip", c.IP())
+		return jsonError(c, fiber.StatusForbidden, errCodeForbidden, "Origin not allowed")
+	}
+	return c.Next()
+}
+
+// originAllowed reports whether origin is one of ALLOWED_ORIGINS.
+func originAllowed(origin string) bool {
+	for _, allowed := range allowedOrigins {
+		if origin == allowed {
+			return true
+		}
+	}
+	return false
+}
+
+// eventsHandler streams FileEvents to one client until it disconnects.
+// Anything the client sends is read and discarded so that close frames and
+// dropped connections are noticed.
+var eventsHandler = websocket.New(func(conn *websocket.Conn) {
+	username, _ := conn.Locals("username").(string)
+	client := events.register(username)
+	slog.Debug("Event client connected", "user", username, "ip", conn.IP())
+
+	go func() {
+		defer events.unregister(client)
+		for {
+			if _, _, err := conn.ReadMessage(); err != nil {
+				return
+			}
+		}
+	}()
+
+	ping := time.NewTicker(eventPingInterval)
+	defer ping.Stop()
+	defer conn.Close()
+	for {
+		select {
+		case msg, ok := <-client.send:
+			if !ok {
+				slog.Debug("Event client disconnected", "user", username)
+				return
+			}
+			conn.SetWriteDeadline(time.Now().Add(eventWriteTimeout))
+			if err := conn.WriteMessage(websocket.TextMessage, msg); err != nil {
+				events.unregister(client)
+				return
+			}
+		case <-ping.C:
+			if err := conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(eventWriteTimeout)); err != nil {
+				events.unregister(client)
+				return
+			}
+		}
+	}
+})
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// listenForEvents registers an event client for the rest of the test.
+func listenForEvents(t *testing.T) *eventClient {
+	t.Helper()
+	client := events.register("")
+	t.Cleanup(func() { events.unregister(client) })
+	return client
+}
+
+// nextEvent returns the event queued for client, failing if there is none.
+func nextEvent(t *testing.T, client *eventClient) FileEvent {
+	t.Helper()
+	select {
+	case msg := <-client.send:
+		var event FileEvent
+		if err := json.Unmarshal(msg, &event); err != nil {
+			t.Fatal(err)
+		}
+		return event
+	default:
+		t.Fatal("no event was broadcast")
+		return FileEvent{}
+	}
+}
+
+func TestMutationsBroadcastEvents(t *testing.T) {
+	moveBody := `{"filename":"a.txt","fromFolder":"","toFolder":"docs"}`
+	tests := []struct {
+		name     string
+		mutate   func(t *testing.T, app *fiber.App)
+		want     string
+		filename string
+		folder   string
+	}{
+		{"move", func(t *testing.T, app *fiber.App) {
+			req := httptest.NewRequest(fiber.MethodPost, "/move", strings.NewReader(moveBody))
+			req.Header.Set(fiber.HeaderContentType, fiber.MIMEApplicationJSON)
+			if status := doRequest(t, app, req, nil); status != fiber.StatusOK {
+				t.Fatalf("move: status %d", status)
+			}
+		}, eventRenamed, "a.txt", ""},
+		{"copy", func(t *testing.T, app *fiber.App) {
+			req := httptest.NewRequest(fiber.MethodPost, "/copy", strings.NewReader(moveBody))
+			req.Header.Set(fiber.HeaderContentType, fiber.MIMEApplicationJSON)
+			if status := doRequest(t, app, req, nil); status != fiber.StatusCreated {
+				t.Fatalf("copy: status %d", status)
+			}
+		}, eventUploaded, "", ""},
+		{"expiry", func(t *testing.T, app *fiber.App) {
+			webfiles.Files[0].ExpiresAt = time.Now().Add(-time.Minute)
+			sweepExpiredFiles()
+		}, eventDeleted, "a.txt", ""},
+		{"delete all", func(t *testing.T, app *fiber.App) {
+			if status := doRequest(t, app, httptest.NewRequest(fiber.MethodDelete, "/admin/files?confirm=true", nil), nil); status != fiber.StatusOK {
+				t.Fatalf("delete all: status %d", status)
+			}
+		}, eventDeleted, "a.txt", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setupTestStore(t)
+			addTestFile(t, "", "a.txt", "hello")
+			app := fiber.New()
+			app.Post("/move", moveHandler)
+			app.Post("/copy", copyHandler)
+			app.Delete("/admin/files", deleteAllHandler)
+			client := listenForEvents(t)
+
+			tt.mutate(t, app)
+			event := nextEvent(t, client)
+			if event.Type != tt.want || event.Filename != tt.filename || event.Folder != tt.folder {
+				t.Errorf("event %+v, want type %q filename %q folder %q", event, tt.want, tt.filename, tt.folder)
+			}
+			if tt.want != eventDeleted && (event.File == nil || event.File.Folder != "docs") {
+				t.Errorf("event file %+v, want the entry in docs", event.File)
+			}
+		})
+	}
+}
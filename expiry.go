@@ -0,0 +1,107 @@
+package main
+
+import (
+	"errors"
+	"log/slog"
+	"time"
+)
+
+const defaultExpirySweepInterval = time.Minute
+
+// expirySweepInterval is how often expired files are deleted, from
+// EXPIRY_SWEEP_INTERVAL.
+var expirySweepInterval = defaultExpirySweepInterval
+
+var errInvalidTTL = errors.New("ttl must be a positive duration such as \"24h\" or \"30m\"")
+
+// parseTTL turns the optional ttl of an upload into an expiry time. An empty
+// ttl means the file never expires.
+func parseTTL(raw string) (time.Time, error) {
+	if raw == "" {
+		return time.Time{}, nil
+	}
+	ttl, err := time.ParseDuration(raw)
+	if err != nil || ttl <= 0 {
+		return time.Time{}, errInvalidTTL
+	}
+	return time.Now().Add(ttl).UTC(), nil
+}
+
+// expired reports whether f has passed its expiry time.
+func expired(f FileMeta) bool {
+	return !f.ExpiresAt.IsZero() && !time.Now().Before(f.ExpiresAt)
+}
+
+// runExpirySweeper deletes expired files every expirySweepInterval. Until a
+// file is swept it is already hidden by canAccess.
+func runExpirySweeper() {
+	ticker := time.NewTicker(expirySweepInterval)
+	defer ticker.Stop()
+	for range ticker.C {
+		sweepExpiredFiles()
+	}
+}
+
+// sweepExpiredFiles removes expired entries and their files on disk. A file
+// that dedup linked to an entry that hasn't expired is kept on disk.
+func sweepExpiredFiles() {
+	webfiles.mu.Lock()
+	var gone []FileMeta
+	kept := webfiles.Files[:0]
+	for _, f := range webfiles.Files {
+		if expired(f) {
+			gone = append(gone, f)
+		} else {
+			kept = append(kept, f)
+		}
+	}
+	if len(gone) == 0 {
+		webfiles.mu.Unlock()
+		return
+	}
+	webfiles.Files = kept
+
+	// Keys and thumbnails are picked under the lock and deleted from
+	// storage after it is released.
+	inUse := make(map[string]bool, len(kept))
+	for _, f := range kept {
+		inUse[f.Key] = true
+	}
+	unused := make(map[string]bool)
+	orphaned := make(map[string]FileMeta)
+	for _, f := range gone {
+		if !inUse[f.Key] {
+			unused[f.Key] = true
+		}
+		if thumbnail := orphanedThumbnailUnlocked(f); thumbnail != "" {
+			orphaned[thumbnail] = f
+		}
+	}
+	if err := saveMetadataUnlocked(); err != nil {
+		slog.Error("Could not save metadata after deleting expired files", "error", err)
+	}
+	webfiles.mu.Unlock()
+
+	for _, f := range gone {
+		switch {
+		case !unused[f.Key]:
+		case !validKey(f.Key):
+			slog.Warn("Refusing to delete key outside the storage root", "component", "security", "filename", f.Filename, "key", f.Key)
+		default:
+			delete(unused, f.Key)
+			if err := fileStorage.Delete(f.Key); err != nil {
+				slog.Warn("Could not delete expired file from storage", "filename", f.Filename, "key", f.Key, "error", err)
+			}
+		}
+		slog.Info("Deleted expired file", "filename", f.Filename, "folder", f.Folder, "expiresAt", f.ExpiresAt)
+	}
+	for key, f := range orphaned {
+		removeThumbnail(f, key)
+	}
+	for _, f := range gone {
+		// accessibleBy hides expired files, so who hears about the delete
+		// is decided as if the file were still there.
+		f.ExpiresAt = time.Time{}
+		events.broadcast(FileEvent{Type: eventDeleted, Filename: f.Filename, Folder: f.Folder}, f)
+	}
+}
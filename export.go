@@ -0,0 +1,118 @@
+package main
+
+import (
+	"bufio"
+	"encoding/csv"
+	"encoding/json"
+	"log/slog"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+const (
+	exportFormatCSV   = "csv"
+	exportFormatJSONL = "jsonl"
+)
+
+var exportCSVHeader = []string{
+	"filename", "folder", "originalName", "owner", "size", "contentType", "checksum",
+	"tags", "uploadedAt", "expiresAt", "lastAccessed", "downloads",
+}
+
+// exportTime formats t for the CSV export, leaving unset times empty.
+func exportTime(t time.Time) string {
+	if t.IsZero() {
+		return ""
+	}
+	return t.UTC().Format(time.RFC3339)
+}
+
+// spreadsheetSafe keeps a cell from being read as a formula when the CSV is
+// opened in a spreadsheet, by prefixing text that starts like one with a
+// quote. Names and tags come from users, so "=HYPERLINK(...)" is possible.
+func spreadsheetSafe(s string) string {
+	if s != "" && strings.ContainsRune("=+-@\t\r", rune(s[0])) {
+		return "'" + s
+	}
+	return s
+}
+
+func exportCSVRow(f FileMeta) []string {
+	return []string{
+		spreadsheetSafe(f.Filename),
+		spreadsheetSafe(f.Folder),
+		spreadsheetSafe(f.OriginalName),
+		spreadsheetSafe(f.Owner),
+		strconv.FormatInt(f.Size, 10),
+		spreadsheetSafe(f.ContentType),
+		f.Checksum,
+		spreadsheetSafe(strings.Join(f.Tags, ",")),
+		exportTime(f.UploadedAt),
+		exportTime(f.ExpiresAt),
+		exportTime(f.LastAccessed),
+		strconv.Itoa(f.Downloads),
+	}
+}
+
+// exportHandler downloads the whole file index as CSV with a header row or
+// as JSON Lines, one entry per line as /files lists it. The entries are
+// copied under the lock, which is cheap, and encoded while the response is
+// streamed, so the encoded export is never held in memory.
+func exportHandler(c *fiber.Ctx) error {
+	if !isAdmin(c) {
+		return jsonError(c, fiber.StatusForbidden, errCodeForbidden, "Only admins can export the file index")
+	}
+	format := strings.ToLower(c.Query("format", exportFormatJSONL))
+	if format != exportFormatCSV && format != exportFormatJSONL {
+		return jsonError(c, fiber.StatusBadRequest, errCodeInvalidRequest, "format must be csv or jsonl")
+	}
+
+	webfiles.mu.Lock()
+	files := make([]FileMeta, len(webfiles.Files))
+	copy(files, webfiles.Files)
+	webfiles.mu.Unlock()
+
+	filename := "webfiles-" + time.Now().Format("20060102-150405") + "." + format
+	c.Set(fiber.HeaderContentDisposition, contentDisposition("attachment", filename))
+	if format == exportFormatCSV {
+		c.Set(fiber.HeaderContentType, "text/csv; charset=utf-8")
+	} else {
+		c.Set(fiber.HeaderContentType, "application/x-ndjson")
+	}
+	slog.InfoContext(c.UserContext(), "Exporting file index", "format", format, "files", len(files), "user", currentUser(c))
+
+	c.Context().SetBodyStreamWriter(func(w *bufio.Writer) {
+		var err error
+		if format == exportFormatCSV {
+			cw := csv.NewWriter(w)
+			err = cw.Write(exportCSVHeader)
+			for _, f := range files {
+				if err != nil {
+					break
+				}
+				err = cw.Write(exportCSVRow(f))
+			}
+			cw.Flush()
+			if err == nil {
+				err = cw.Error()
+			}
+		} else {
+			enc := json.NewEncoder(w)
+			for _, f := range files {
+				if err = enc.Encode(f); err != nil {
+					break
+				}
+			}
+		}
+		if err == nil {
+			err = w.Flush()
+		}
+		if err != nil {
+			slog.Warn("Could not finish export", "format", format, "error", err)
+		}
+	})
+	return nil
+}
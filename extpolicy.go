@@ -0,0 +1,66 @@
+package main
+
+import (
+	"fmt"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// noExtensionToken stands for "no extension at all" in ALLOWED_EXTENSIONS
+// and BLOCKED_EXTENSIONS, so extensionless files are an explicit choice.
+const noExtensionToken = "none"
+
+// parseExtensionList parses a comma-separated list such as ".jpg, PNG, none".
+func parseExtensionList(raw string) map[string]bool {
+	set := make(map[string]bool)
+	for _, ext := range strings.Split(raw, ",") {
+		ext = strings.ToLower(strings.TrimPrefix(strings.TrimSpace(ext), "."))
+		if ext == "" {
+			continue
+		}
+		if ext == noExtensionToken {
+			ext = ""
+		}
+		set[ext] = true
+	}
+	return set
+}
+
+// extensionKey returns the lowercase extension of filename without its dot.
+func extensionKey(filename string) string {
+	return strings.ToLower(strings.TrimPrefix(filepath.Ext(filename), "."))
+}
+
+// checkExtensionPolicy returns an error describing why filename's extension
+// is not accepted, or nil. Files without an extension pass only when the
+// allowlist names "none" (or there is no allowlist) and the denylist doesn't.
+func checkExtensionPolicy(filename string) error {
+	cfg := settings()
+	ext := extensionKey(filename)
+	allowed := !cfg.blockedExtensions[ext] && (len(cfg.allowedExtensions) == 0 || cfg.allowedExtensions[ext])
+	if allowed {
+		return nil
+	}
+	what := "." + ext + " files are"
+	if ext == "" {
+		what = "Files without an extension are"
+	}
+	if !cfg.blockedExtensions[ext] {
+		return fmt.Errorf("%s not allowed; allowed types: %s", what, describeExtensions(cfg.allowedExtensions))
+	}
+	return fmt.Errorf("%s not allowed", what)
+}
+
+func describeExtensions(set map[string]bool) string {
+	list := make([]string, 0, len(set))
+	for ext := range set {
+		if ext == "" {
+			list = append(list, noExtensionToken)
+		} else {
+			list = append(list, "."+ext)
+		}
+	}
+	sort.Strings(list)
+	return strings.Join(list, ", ")
+}
@@ -0,0 +1,245 @@
+package main
+
+import (
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+	"unicode/utf8"
+
+	"golang.org/x/text/unicode/norm"
+)
+
+const (
+	reservedNamePolicyReject = "reject"
+	reservedNamePolicyRename = "rename"
+)
+
+// defaultMaxFilenameLength is the longest name most filesystems accept, in
+// bytes.
+const defaultMaxFilenameLength = 255
+
+const (
+	nameCollisionPolicyTimestamp = "timestamp"
+	nameCollisionPolicyUUID      = "uuid"
+	nameCollisionPolicyCounter   = "counter"
+	nameCollisionPolicyReject    = "reject"
+)
+
+var errNameTaken = errors.New("a file with that name already exists")
+
+// isBidiControl reports whether r is one of the invisible characters that
+// change the direction text is displayed in. In a filename they can make
+// "invoice_cod.exe" with U+202E before "cod" display as "invoice_exe.doc".
+func isBidiControl(r rune) bool {
+	return r == '\u200e' || r == '\u200f' || r == '\u061c' ||
+		('\u202a' <= r && r <= '\u202e') || ('\u2066' <= r && r <= '\u2069')
+}
+
+// normalizeFilename prepares an uploaded or new filename for storing:
+// control characters are dropped, the rest is NFC-normalized so that the
+// same name typed on different systems compares equal, and names with
+// invalid UTF-8 or bidirectional control characters, or longer than
+// MAX_FILENAME_LENGTH, are refused.
+func normalizeFilename(name string) (string, error) {
+	if !utf8.ValidString(name) {
+		return "", errors.New("filename is not valid UTF-8")
+	}
+	if strings.IndexFunc(name, isBidiControl) != -1 {
+		return "", errors.New("filename must not contain text direction control characters")
+	}
+	name = strings.Map(func(r rune) rune {
+		if unicode.IsControl(r) {
+			return -1
+		}
+		return r
+	}, name)
+	name = norm.NFC.String(name)
+	if name == "" {
+		return "", errors.New("filename is empty once control characters are removed")
+	}
+	if limit := settings().maxFilenameLength; limit > 0 && len(name) > limit {
+		return "", fmt.Errorf("filename is %d bytes long; the maximum is %d", len(name), limit)
+	}
+	return name, nil
+}
+
+var windowsReservedNames = map[string]bool{
+	"CON": true, "PRN": true, "AUX": true, "NUL": true,
+	"COM1": true, "COM2": true, "COM3": true, "COM4": true, "COM5": true,
+	"COM6": true, "COM7": true, "COM8": true, "COM9": true,
+	"LPT1": true, "LPT2": true, "LPT3": true, "LPT4": true, "LPT5": true,
+	"LPT6": true, "LPT7": true, "LPT8": true, "LPT9": true,
+}
+
+// isWindowsReservedName reports whether Windows refuses to create a file with
+// this name: a reserved device name (with or without an extension) or a name
+// ending in a dot or space.
+func isWindowsReservedName(name string) bool {
+	if strings.HasSuffix(name, ".") || strings.HasSuffix(name, " ") {
+		return true
+	}
+	stem := name
+	if i := strings.Index(stem, "."); i != -1 {
+		stem = stem[:i]
+	}
+	return windowsReservedNames[strings.ToUpper(strings.TrimRight(stem, " "))]
+}
+
+// makeWindowsSafeName strips trailing dots and spaces and suffixes reserved
+// device names with "_" so "CON.txt" becomes "CON_.txt".
+func makeWindowsSafeName(name string) (string, error) {
+	name = strings.TrimRight(name, ". ")
+	if name == "" {
+		return "", fmt.Errorf("filename is empty once trailing dots and spaces are removed")
+	}
+	stem, rest := name, ""
+	if i := strings.Index(name, "."); i != -1 {
+		stem, rest = name[:i], name[i:]
+	}
+	if windowsReservedNames[strings.ToUpper(strings.TrimRight(stem, " "))] {
+		stem = strings.TrimRight(stem, " ") + "_"
+	}
+	return stem + rest, nil
+}
+
+// checkWindowsName applies RESERVED_NAME_POLICY to name. It returns the name to
+// store under, or an error describing why the name was rejected.
+func checkWindowsName(name string) (string, error) {
+	cfg := settings()
+	if !cfg.windowsSafeNames || !isWindowsReservedName(name) {
+		return name, nil
+	}
+	if cfg.reservedNamePolicy == reservedNamePolicyRename {
+		return makeWindowsSafeName(name)
+	}
+	return "", fmt.Errorf("%q is a reserved name on Windows (CON, PRN, AUX, NUL, COM1-9, LPT1-9) or ends with a dot or space", name)
+}
+
+// uniqueName returns name, or a variant of it under NAME_COLLISION_POLICY, such
+// that taken reports false for it. The suffix goes before the extension, so
+// "report.pdf" becomes "report_2.pdf" with the counter policy. The stem is
+// shortened to make room for the suffix when the name would otherwise
+// exceed MAX_FILENAME_LENGTH.
+func uniqueName(name string, taken func(string) bool) (string, error) {
+	if !taken(name) {
+		return name, nil
+	}
+	ext := filepath.Ext(name)
+	stem := strings.TrimSuffix(name, ext)
+	var suffix func(n int) string
+	switch settings().nameCollisionPolicy {
+	case nameCollisionPolicyReject:
+		return "", errNameTaken
+	case nameCollisionPolicyCounter:
+		suffix = func(n int) string { return "_" + strconv.Itoa(n) }
+	case nameCollisionPolicyUUID:
+		suffix = func(int) string { return "_" + newUUID() }
+	default:
+		suffix = func(int) string { return "_" + strconv.FormatInt(time.Now().UnixNano(), 10) }
+	}
+	limit := settings().maxFilenameLength
+	for n := 1; ; n++ {
+		candidate, err := fitFilename(stem, suffix(n)+ext, limit)
+		if err != nil {
+			return "", err
+		}
+		if !taken(candidate) {
+			return candidate, nil
+		}
+	}
+}
+
+// fitFilename joins stem and tail, dropping characters from the end of stem
+// as needed for the result to be at most limit bytes long; 0 means no
+// limit. It fails when not even one character of stem fits.
+func fitFilename(stem, tail string, limit int) (string, error) {
+	if limit <= 0 || len(stem)+len(tail) <= limit {
+		return stem + tail, nil
+	}
+	for len(stem)+len(tail) > limit && stem != "" {
+		_, size := utf8.DecodeLastRuneInString(stem)
+		stem = stem[:len(stem)-size]
+	}
+	if stem == "" {
+		return "", fmt.Errorf("no room for a unique name within the maximum filename length of %d", limit)
+	}
+	return stem + tail, nil
+}
+
+// newUUID returns a random (version 4) UUID.
+func newUUID() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	b[6] = b[6]&0x0f | 0x40
+	b[8] = b[8]&0x3f | 0x80
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:])
+}
+
+// downloadName is the name a file is saved under by whoever downloads it:
+// the name it was uploaded as, without any collision suffix, but with the
+// extension it is stored under.
+func downloadName(meta FileMeta) string {
+	if meta.OriginalName == "" {
+		return meta.Filename
+	}
+	return strings.TrimSuffix(meta.OriginalName, filepath.Ext(meta.OriginalName)) + filepath.Ext(meta.Filename)
+}
+
+// contentDisposition builds a Content-Disposition header of the given type
+// ("attachment" or "inline") for name. The quoted filename= is an ASCII
+// fallback for old clients: characters outside printable ASCII become "_"
+// and quotes and backslashes are escaped. When that loses anything, the
+// exact name follows as an RFC 5987 filename* parameter, UTF-8 and
+// percent-encoded, which current browsers prefer. Control characters are
+// dropped from both.
+func contentDisposition(kind, name string) string {
+	name = strings.Map(func(r rune) rune {
+		if unicode.IsControl(r) {
+			return -1
+		}
+		return r
+	}, name)
+
+	var fallback strings.Builder
+	exact := true
+	for _, r := range name {
+		switch {
+		case r == '"' || r == '\\':
+			fallback.WriteByte('\\')
+			fallback.WriteRune(r)
+		case r > unicode.MaxASCII:
+			fallback.WriteByte('_')
+			exact = false
+		default:
+			fallback.WriteRune(r)
+		}
+	}
+	header := kind + `; filename="` + fallback.String() + `"`
+	if exact {
+		return header
+	}
+	return header + "; filename*=UTF-8''" + encodeRFC5987(name)
+}
+
+// encodeRFC5987 percent-encodes s as the value of an RFC 5987 extended
+// parameter, leaving only attr-chars unescaped.
+func encodeRFC5987(s string) string {
+	const hex = "0123456789ABCDEF"
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if 'a' <= c && c <= 'z' || 'A' <= c && c <= 'Z' || '0' <= c && c <= '9' || strings.IndexByte("!#$&+-.^_`|~", c) >= 0 {
+			b.WriteByte(c)
+			continue
+		}
+		b.WriteByte('%')
+		b.WriteByte(hex[c>>4])
+		b.WriteByte(hex[c&0x0f])
+	}
+	return b.String()
+}
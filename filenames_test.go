@@ -0,0 +1,203 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"unicode/utf8"
+)
+
+func TestContentDisposition(t *testing.T) {
+	tests := []struct {
+		name, kind, filename, want string
+	}{
+		{"plain ASCII", "attachment", "report.pdf", `attachment; filename="report.pdf"`},
+		{"inline", "inline", "photo.jpg", `inline; filename="photo.jpg"`},
+		{"spaces", "attachment", "annual report 2024.pdf", `attachment; filename="annual report 2024.pdf"`},
+		{"embedded quotes", "attachment", `say "hi".txt`, `attachment; filename="say \"hi\".txt"`},
+		{"backslash", "attachment", `a\b.txt`, `attachment; filename="a\\b.txt"`},
+		{"UTF-8", "attachment", "รายงาน.pdf", `attachment; filename="______.pdf"; filename*=UTF-8''%E0%B8%A3%E0%B8%B2%E0%B8%A2%E0%B8%87%E0%B8%B2%E0%B8%99.pdf`},
+		{"UTF-8 with spaces and quotes", "attachment", `café "menu".pdf`, `attachment; filename="caf_ \"menu\".pdf"; filename*=UTF-8''caf%C3%A9%20%22menu%22.pdf`},
+		{"control characters dropped", "attachment", "a\r\nb\x00.txt", `attachment; filename="ab.txt"`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := contentDisposition(tt.kind, tt.filename); got != tt.want {
+				t.Errorf("contentDisposition(%q, %q) =\n  %s\nwant\n  %s", tt.kind, tt.filename, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestEncodeRFC5987(t *testing.T) {
+	tests := []struct {
+		in, want string
+	}{
+		{"report.pdf", "report.pdf"},
+		{"a b", "a%20b"},
+		{`"quoted"`, "%22quoted%22"},
+		{"50%.txt", "50%25.txt"},
+		{"semi;colon,comma", "semi%3Bcolon%2Ccomma"},
+		{"attr-chars!#$&+-.^_`|~", "attr-chars!#$&+-.^_`|~"},
+		{"é", "%C3%A9"},
+		{"日本", "%E6%97%A5%E6%9C%AC"},
+	}
+	for _, tt := range tests {
+		if got := encodeRFC5987(tt.in); got != tt.want {
+			t.Errorf("encodeRFC5987(%q) = %q, want %q", tt.in, got, tt.want)
+		}
+	}
+}
+
+// withSettings runs the rest of the test with the running configuration
+// changed by edit, and restores it afterwards.
+func withSettings(t *testing.T, edit func(cfg *reloadableConfig)) {
+	t.Helper()
+	saved := settings()
+	cfg := *saved
+	edit(&cfg)
+	runningConfig.Store(&cfg)
+	t.Cleanup(func() { runningConfig.Store(saved) })
+}
+
+func TestNormalizeFilename(t *testing.T) {
+	withSettings(t, func(cfg *reloadableConfig) { cfg.maxFilenameLength = defaultMaxFilenameLength })
+
+	tests := []struct {
+		name, in, want string
+		wantErr        bool
+	}{
+		{"plain", "report.pdf", "report.pdf", false},
+		{"decomposed accent composed", "cafe\u0301.txt", "caf\u00e9.txt", false},
+		{"control characters dropped", "a\tb\x00.txt", "ab.txt", false},
+		{"300 characters", strings.Repeat("a", 296) + ".txt", "", true},
+		{"at the limit", strings.Repeat("a", defaultMaxFilenameLength-4) + ".txt", strings.Repeat("a", defaultMaxFilenameLength-4) + ".txt", false},
+		{"right-to-left override", "invoice_\u202efdp.exe", "", true},
+		{"invalid UTF-8", "bad\xff.txt", "", true},
+		{"only control characters", "\x01\x02", "", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := normalizeFilename(tt.in)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("normalizeFilename(%q) error = %v, wantErr %v", tt.in, err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("normalizeFilename(%q) = %q, want %q", tt.in, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestUniqueNameStaysWithinMaxLength(t *testing.T) {
+	for _, policy := range []string{nameCollisionPolicyTimestamp, nameCollisionPolicyUUID, nameCollisionPolicyCounter} {
+		t.Run(policy, func(t *testing.T) {
+			withSettings(t, func(cfg *reloadableConfig) {
+				cfg.maxFilenameLength = defaultMaxFilenameLength
+				cfg.nameCollisionPolicy = policy
+			})
+			// A multi-byte stem checks the cut doesn't split a character.
+			name := strings.Repeat("\u00e9", (defaultMaxFilenameLength-4)/2) + ".txt"
+			got, err := uniqueName(name, func(n string) bool { return n == name })
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(got) > defaultMaxFilenameLength {
+				t.Errorf("uniqueName returned %d bytes, over the limit of %d", len(got), defaultMaxFilenameLength)
+			}
+			if got == name || !strings.HasSuffix(got, ".txt") || !utf8.ValidString(got) {
+				t.Errorf("uniqueName(%q) = %q", name, got)
+			}
+		})
+	}
+}
+
+func TestUniqueNameNoRoom(t *testing.T) {
+	withSettings(t, func(cfg *reloadableConfig) {
+		cfg.maxFilenameLength = 8
+		cfg.nameCollisionPolicy = nameCollisionPolicyUUID
+	})
+	if got, err := uniqueName("a.txt", func(string) bool { return true }); err == nil {
+		t.Errorf("uniqueName = %q, want an error when the suffix can't fit", got)
+	}
+}
+
+func TestFindFileMatchesNormalizedName(t *testing.T) {
+	saved := webfiles.Files
+	webfiles.Files = []FileMeta{{Filename: "caf\u00e9.txt", Folder: "docs"}, {Filename: "legacy\u0301.txt"}}
+	defer func() { webfiles.Files = saved }()
+
+	tests := []struct {
+		folder, name string
+		want         int
+	}{
+		{"docs", "caf\u00e9.txt", 0},
+		{"docs", "cafe\u0301.txt", 0},
+		{"", "cafe\u0301.txt", -1},
+		// Stored before normalization, decomposed.
+		{"", "legacy\u0301.txt", 1},
+	}
+	for _, tt := range tests {
+		if got := findFileUnlocked(tt.folder, tt.name); got != tt.want {
+			t.Errorf("findFileUnlocked(%q, %q) = %d, want %d", tt.folder, tt.name, got, tt.want)
+		}
+	}
+}
+
+// TestCheckWindowsName runs on every platform: WINDOWS_SAFE_NAMES can be
+// forced on so a store stays portable to Windows.
+func TestCheckWindowsName(t *testing.T) {
+	const rejected = "<rejected>"
+	tests := []struct {
+		name             string
+		reserved, rename string
+	}{
+		{"report.txt", "report.txt", "report.txt"},
+		{"CON", rejected, "CON_"},
+		{"con.txt", rejected, "con_.txt"},
+		{"Aux.tar.gz", rejected, "Aux_.tar.gz"},
+		{"prn", rejected, "prn_"},
+		{"NUL .txt", rejected, "NUL_.txt"},
+		{"COM1", rejected, "COM1_"},
+		{"LPT9.log", rejected, "LPT9_.log"},
+		{"COM10.txt", "COM10.txt", "COM10.txt"},
+		{"CONSOLE.txt", "CONSOLE.txt", "CONSOLE.txt"},
+		{"xcon.txt", "xcon.txt", "xcon.txt"},
+		{"notes.", rejected, "notes"},
+		{"notes ", rejected, "notes"},
+		{"notes. . ", rejected, "notes"},
+		{"CON.", rejected, "CON_"},
+		{"...", rejected, rejected},
+	}
+	for _, policy := range []string{reservedNamePolicyReject, reservedNamePolicyRename} {
+		for _, tt := range tests {
+			t.Run(policy+"/"+tt.name, func(t *testing.T) {
+				withSettings(t, func(cfg *reloadableConfig) {
+					cfg.windowsSafeNames = true
+					cfg.reservedNamePolicy = policy
+				})
+				want := tt.reserved
+				if policy == reservedNamePolicyRename {
+					want = tt.rename
+				}
+				got, err := checkWindowsName(tt.name)
+				if err != nil {
+					got = rejected
+				}
+				if got != want {
+					t.Errorf("checkWindowsName(%q) = %q, want %q (err %v)", tt.name, got, want, err)
+				}
+			})
+		}
+		t.Run("off/"+policy, func(t *testing.T) {
+			withSettings(t, func(cfg *reloadableConfig) {
+				cfg.windowsSafeNames = false
+				cfg.reservedNamePolicy = policy
+			})
+			for _, tt := range tests {
+				if got, err := checkWindowsName(tt.name); err != nil || got != tt.name {
+					t.Errorf("with WINDOWS_SAFE_NAMES off, checkWindowsName(%q) = %q, %v; want it unchanged", tt.name, got, err)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,227 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+const (
+	defaultPageLimit = 100
+	maxPageLimit     = 1000
+)
+
+// listParams holds the pagination and sorting options shared by endpoints
+// that return lists of files.
+type listParams struct {
+	Limit  int
+	Offset int
+	Sort   string
+	Order  string
+}
+
+// listFiles answers with the files the session can access that pass match
+// (all of them when match is nil), optionally limited to ?folder=, ?tag=
+// and ?type=, sorted and paginated per parseListParams.
+func listFiles(c *fiber.Ctx, match func(FileMeta) bool) error {
+	params, err := parseListParams(c)
+	if err != nil {
+		return jsonError(c, fiber.StatusBadRequest, errCodeInvalidRequest, err.Error())
+	}
+	tagged, err := tagQuery(c)
+	if err != nil {
+		return jsonError(c, fiber.StatusBadRequest, errCodeInvalidRequest, err.Error())
+	}
+	typed, err := typeQuery(c)
+	if err != nil {
+		return jsonError(c, fiber.StatusBadRequest, errCodeInvalidRequest, err.Error())
+	}
+
+	var folder string
+	filterFolder := c.Query("folder") != ""
+	if filterFolder {
+		if folder, err = folderQuery(c); err != nil {
+			return jsonError(c, fiber.StatusBadRequest, errCodeInvalidFolder, err.Error())
+		}
+	}
+
+	webfiles.mu.Lock()
+	files := make([]FileMeta, 0, len(webfiles.Files))
+	for _, f := range webfiles.Files {
+		if (!filterFolder || f.Folder == folder) && canAccess(c, f) && (match == nil || match(f)) && (tagged == nil || tagged(f)) && (typed == nil || typed(f)) {
+			files = append(files, f)
+		}
+	}
+	webfiles.mu.Unlock()
+
+	slog.DebugContext(c.UserContext(), "Listing files", "count", len(files))
+	return c.JSON(paginate(files, params))
+}
+
+// fileHandler answers with the metadata of one file, so a client can refresh
+// a single entry or check an upload without listing everything.
+func fileHandler(c *fiber.Ctx) error {
+	requestedFilename, err := url.QueryUnescape(c.Params("filename"))
+	if err != nil {
+		return jsonError(c, fiber.StatusBadRequest, errCodeInvalidFilename, "Invalid filename")
+	}
+	folder, err := folderQuery(c)
+	if err != nil {
+		return jsonError(c, fiber.StatusBadRequest, errCodeInvalidFolder, err.Error())
+	}
+
+	webfiles.mu.Lock()
+	index := findAccessibleFileUnlocked(c, folder, requestedFilename)
+	var meta FileMeta
+	if index != -1 {
+		meta = webfiles.Files[index]
+	}
+	webfiles.mu.Unlock()
+
+	if index == -1 {
+		return jsonError(c, fiber.StatusNotFound, errCodeFileNotFound, "File not found in metadata")
+	}
+	return c.JSON(meta)
+}
+
+// typeUnknown is the ?type= value matching files without a content type.
+const typeUnknown = "unknown"
+
+// typeQuery reads the repeatable ?type= filter, which also takes a
+// comma-separated list. Each value is a full type (application/pdf), a
+// wildcard (image/*) or just the top-level type (image); "unknown" matches
+// files whose content type was never recorded, which no other value does. A
+// file passes when it matches any value. It returns nil when no type is
+// asked for.
+func typeQuery(c *fiber.Ctx) (func(FileMeta) bool, error) {
+	var patterns []string
+	unknown := false
+	for _, v := range c.Context().QueryArgs().PeekMulti("type") {
+		for _, raw := range strings.Split(string(v), ",") {
+			pattern := strings.ToLower(strings.TrimSpace(raw))
+			switch {
+			case pattern == "":
+				continue
+			case pattern == typeUnknown:
+				unknown = true
+				continue
+			case !strings.Contains(pattern, "/"):
+				pattern += "/*"
+			}
+			major, minor, _ := strings.Cut(pattern, "/")
+			if major == "" || minor == "" || strings.Contains(minor, "/") || (major == "*" && minor != "*") {
+				return nil, fmt.Errorf("invalid type %q: use a MIME type such as image/png, image/* or image, or %s", raw, typeUnknown)
+			}
+			patterns = append(patterns, pattern)
+		}
+	}
+	if len(patterns) == 0 && !unknown {
+		return nil, nil
+	}
+	return func(f FileMeta) bool {
+		contentType, _, _ := strings.Cut(f.ContentType, ";")
+		contentType = strings.ToLower(strings.TrimSpace(contentType))
+		if contentType == "" {
+			return unknown
+		}
+		for _, pattern := range patterns {
+			if matchContentType(pattern, contentType) {
+				return true
+			}
+		}
+		return false
+	}, nil
+}
+
+// matchContentType reports whether contentType, without parameters, is
+// pattern or falls under a wildcard pattern (image/*, */*).
+func matchContentType(pattern, contentType string) bool {
+	major, minor, _ := strings.Cut(pattern, "/")
+	if major == "*" {
+		return true
+	}
+	if minor == "*" {
+		return strings.HasPrefix(contentType, major+"/")
+	}
+	return contentType == pattern
+}
+
+// parseListParams reads ?limit=, ?offset=, ?sort= and ?order=. Without them
+// it returns the first page sorted by upload time, newest first.
+func parseListParams(c *fiber.Ctx) (listParams, error) {
+	p := listParams{Limit: defaultPageLimit, Sort: "date", Order: "desc"}
+
+	if raw := c.Query("limit"); raw != "" {
+		limit, err := strconv.Atoi(raw)
+		if err != nil || limit < 1 || limit > maxPageLimit {
+			return p, fmt.Errorf("limit must be between 1 and %d", maxPageLimit)
+		}
+		p.Limit = limit
+	}
+	if raw := c.Query("offset"); raw != "" {
+		offset, err := strconv.Atoi(raw)
+		if err != nil || offset < 0 {
+			return p, fmt.Errorf("offset must be a non-negative integer")
+		}
+		p.Offset = offset
+	}
+	if raw := c.Query("sort"); raw != "" {
+		if !isValidSortKey(raw) {
+			return p, fmt.Errorf("invalid sort key %q: use name, size or date", raw)
+		}
+		p.Sort = raw
+		// Names read naturally A-Z; keep newest/largest first otherwise.
+		if raw == "name" {
+			p.Order = "asc"
+		}
+	}
+	if raw := c.Query("order"); raw != "" {
+		if raw != "asc" && raw != "desc" {
+			return p, fmt.Errorf("order must be asc or desc")
+		}
+		p.Order = raw
+	}
+	return p, nil
+}
+
+func isValidSortKey(key string) bool {
+	return key == "name" || key == "size" || key == "date"
+}
+
+// sortFiles sorts files in place by name, size or upload date.
+func sortFiles(files []FileMeta, key, order string) {
+	sort.SliceStable(files, func(i, j int) bool {
+		if order == "desc" {
+			i, j = j, i
+		}
+		switch key {
+		case "size":
+			return files[i].Size < files[j].Size
+		case "date":
+			return files[i].UploadedAt.Before(files[j].UploadedAt)
+		}
+		return strings.ToLower(files[i].Filename) < strings.ToLower(files[j].Filename)
+	})
+}
+
+// paginate sorts files and returns the requested page in the JSON envelope
+// used by list endpoints. files must be a copy the caller owns.
+func paginate(files []FileMeta, p listParams) fiber.Map {
+	sortFiles(files, p.Sort, p.Order)
+
+	total := len(files)
+	start := min(p.Offset, total)
+	end := min(start+p.Limit, total)
+
+	return fiber.Map{
+		"files":  files[start:end],
+		"total":  total,
+		"limit":  p.Limit,
+		"offset": p.Offset,
+	}
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"errors"
+	"path"
+	"sort"
+	"strings"
+
+	"github.com/gofiber/fiber/v2"
+	"golang.org/x/text/unicode/norm"
+)
+
+var errInvalidFolder = errors.New("Invalid folder")
+
+// sanitizeFolder normalizes a client-supplied folder such as "photos/2024"
+// into a clean, relative, slash-separated path. "" is the root folder.
+// Anything that would escape uploadDir is rejected rather than silently
+// rewritten.
+func sanitizeFolder(raw string) (string, error) {
+	folder := strings.Trim(strings.ReplaceAll(strings.TrimSpace(raw), "\\", "/"), "/")
+	if folder == "" {
+		return "", nil
+	}
+	for _, segment := range strings.Split(folder, "/") {
+		if segment == ".." {
+			return "", errInvalidFolder
+		}
+		if _, err := checkWindowsName(segment); segment != "" && segment != "." && err != nil {
+			return "", err
+		}
+	}
+	folder = path.Clean(folder)
+	if folder == "." {
+		return "", nil
+	}
+	return folder, nil
+}
+
+// folderQuery reads and sanitizes the ?folder= parameter used to address a
+// file alongside its name.
+func folderQuery(c *fiber.Ctx) (string, error) {
+	return sanitizeFolder(c.Query("folder"))
+}
+
+// findFileUnlocked returns the index of the file named name in folder, or -1.
+// name matches NFC-normalized, as names are stored, so a name typed on a
+// system that decomposes accents still finds the file; it also matches as
+// given, for names stored before normalization. The caller must hold
+// webfiles.mu.
+func findFileUnlocked(folder, name string) int {
+	normalized := norm.NFC.String(name)
+	for i, f := range webfiles.Files {
+		if f.Folder == folder && (f.Filename == normalized || f.Filename == name) {
+			return i
+		}
+	}
+	return -1
+}
+
+// nameTakenUnlocked reports whether name in folder belongs to a tracked
+// file or is claimed by an upload, copy, rename or move in progress. The
+// caller must hold webfiles.mu.
+func nameTakenUnlocked(folder, name string) bool {
+	return findFileUnlocked(folder, name) != -1 || webfiles.claimed[path.Join(folder, norm.NFC.String(name))]
+}
+
+// claimNameUnlocked reserves name in folder for a request that writes the
+// content to storage without holding the lock, so no other request takes
+// the name meanwhile. It reports false when the name is taken. The
+// caller must hold webfiles.mu and later call releaseNameUnlocked.
+func claimNameUnlocked(folder, name string) bool {
+	if nameTakenUnlocked(folder, name) {
+		return false
+	}
+	if webfiles.claimed == nil {
+		webfiles.claimed = make(map[string]bool)
+	}
+	webfiles.claimed[path.Join(folder, norm.NFC.String(name))] = true
+	return true
+}
+
+// releaseNameUnlocked ends a claim made with claimNameUnlocked. The caller
+// must hold webfiles.mu.
+func releaseNameUnlocked(folder, name string) {
+	delete(webfiles.claimed, path.Join(folder, norm.NFC.String(name)))
+}
+
+// relinkKeyUnlocked points every entry stored at oldKey to newKey, after
+// the content was renamed in storage without the lock, so entries dedup
+// linked to it meanwhile follow it. The caller must hold webfiles.mu.
+func relinkKeyUnlocked(oldKey, newKey string) {
+	for i := range webfiles.Files {
+		if webfiles.Files[i].Key == oldKey {
+			webfiles.Files[i].Key = newKey
+		}
+	}
+}
+
+type FolderInfo struct {
+	Folder string `json:"folder"`
+	Files  int    `json:"files"`
+}
+
+// foldersHandler lists the distinct folders that contain files, with the
+// number of files directly in each. The root folder is reported as "".
+func foldersHandler(c *fiber.Ctx) error {
+	counts := make(map[string]int)
+	webfiles.mu.Lock()
+	for _, f := range webfiles.Files {
+		if canAccess(c, f) {
+			counts[f.Folder]++
+		}
+	}
+	webfiles.mu.Unlock()
+
+	folders := make([]FolderInfo, 0, len(counts))
+	for folder, n := range counts {
+		folders = append(folders, FolderInfo{Folder: folder, Files: n})
+	}
+	sort.Slice(folders, func(i, j int) bool { return folders[i].Folder < folders[j].Folder })
+	return c.JSON(folders)
+}
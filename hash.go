@@ -0,0 +1,130 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io"
+	"io/fs"
+	"log/slog"
+	"net/url"
+	"os"
+	"strings"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// hashFile returns the hex-encoded SHA-256 of the file at path.
+func hashFile(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// isValidSHA256 reports whether s looks like a hex-encoded SHA-256 digest.
+func isValidSHA256(s string) bool {
+	if len(s) != sha256.Size*2 {
+		return false
+	}
+	_, err := hex.DecodeString(s)
+	return err == nil
+}
+
+// uploadCheckHandler lets a client ask whether content with a given SHA-256 is
+// already stored before uploading it. It answers both GET and HEAD; for HEAD
+// the existing filename is only available in the X-Existing-Filename header.
+func uploadCheckHandler(c *fiber.Ctx) error {
+	hash := strings.ToLower(c.Query("hash"))
+	if !isValidSHA256(hash) {
+		return jsonError(c, fiber.StatusBadRequest, errCodeInvalidRequest, "Invalid or missing hash")
+	}
+
+	webfiles.mu.Lock()
+	defer webfiles.mu.Unlock()
+
+	if f := findAccessibleByChecksumUnlocked(c, hash); f != nil {
+		slog.DebugContext(c.UserContext(), "Upload precheck hit", "sha256", hash, "filename", f.Filename)
+		c.Set("X-Existing-Filename", url.PathEscape(f.Filename))
+		return c.JSON(fiber.Map{"exists": true, "filename": f.Filename, "folder": f.Folder})
+	}
+	return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"exists": false})
+}
+
+// downloadByHashHandler streams the first stored file whose content has the
+// given SHA-256, using that file's name for Content-Disposition.
+func downloadByHashHandler(c *fiber.Ctx) error {
+	hash := strings.ToLower(c.Params("sha256"))
+	if !isValidSHA256(hash) {
+		return jsonError(c, fiber.StatusBadRequest, errCodeInvalidRequest, "Invalid hash")
+	}
+
+	webfiles.mu.Lock()
+	var found *FileMeta
+	if existing := findAccessibleByChecksumUnlocked(c, hash); existing != nil {
+		meta := *existing
+		found = &meta
+	}
+	webfiles.mu.Unlock()
+
+	if found == nil {
+		slog.DebugContext(c.UserContext(), "No file with hash", "sha256", hash)
+		return jsonError(c, fiber.StatusNotFound, errCodeFileNotFound, "File not found in metadata")
+	}
+	if _, err := fileStorage.Stat(found.Key); errors.Is(err, fs.ErrNotExist) {
+		slog.ErrorContext(c.UserContext(), "File in metadata is missing from storage", "filename", found.Filename, "key", found.Key, "sha256", hash)
+		return jsonError(c, fiber.StatusNotFound, errCodeFileNotFound, "File not found on disk")
+	}
+
+	slog.DebugContext(c.UserContext(), "Serving download by hash", "filename", found.Filename, "sha256", hash)
+	c.Set("X-Checksum-SHA256", found.Checksum)
+	if err := serveFile(c, *found); err != nil {
+		return err
+	}
+	recordDownload(c, found.Folder, found.Filename)
+	return nil
+}
+
+// findByChecksumUnlocked returns the first file whose content has the given
+// checksum. The caller must hold webfiles.mu.
+func findByChecksumUnlocked(checksum string) *FileMeta {
+	if checksum == "" {
+		return nil
+	}
+	for i := range webfiles.Files {
+		if webfiles.Files[i].Checksum == checksum {
+			return &webfiles.Files[i]
+		}
+	}
+	return nil
+}
+
+// findAccessibleByChecksumUnlocked is findByChecksumUnlocked limited to
+// files the session can access. The caller must hold webfiles.mu.
+func findAccessibleByChecksumUnlocked(c *fiber.Ctx, checksum string) *FileMeta {
+	for i := range webfiles.Files {
+		if webfiles.Files[i].Checksum == checksum && canAccess(c, webfiles.Files[i]) {
+			return &webfiles.Files[i]
+		}
+	}
+	return nil
+}
+
+// keySharedUnlocked reports whether any entry other than webfiles.Files[skip]
+// points at key, which happens when dedup linked several names to one file.
+// The caller must hold webfiles.mu.
+func keySharedUnlocked(key string, skip int) bool {
+	for i, f := range webfiles.Files {
+		if i != skip && f.Key == key {
+			return true
+		}
+	}
+	return false
+}
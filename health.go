@@ -0,0 +1,67 @@
+package main
+
+import (
+	"errors"
+	"io/fs"
+	"log/slog"
+	"os"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// startTime is when the server started, for the uptime in /healthz.
+var startTime = time.Now()
+
+// checkMetadataReadable reports whether the metadata store can be read. A
+// JSON file that doesn't exist yet is fine: nothing has been uploaded.
+func checkMetadataReadable() error {
+	if metadataDB != nil {
+		return metadataDB.Ping()
+	}
+	f, err := os.Open(metadataFile)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	return f.Close()
+}
+
+// healthHandler answers liveness/readiness probes without authentication.
+// It returns 503 when the upload directory can't be written or the metadata
+// can't be read, so an orchestrator can restart the instance.
+func healthHandler(c *fiber.Ctx) error {
+	webfiles.mu.Lock()
+	fileCount := len(webfiles.Files)
+	webfiles.mu.Unlock()
+
+	status := fiber.StatusOK
+	checks := fiber.Map{}
+	if err := checkUploadDirWritable(uploadDir); err != nil {
+		slog.ErrorContext(c.UserContext(), "Upload directory is not writable", "component", "health", "path", uploadDir, "error", err)
+		checks["uploadDirWritable"] = false
+		status = fiber.StatusServiceUnavailable
+	} else {
+		checks["uploadDirWritable"] = true
+	}
+	if err := checkMetadataReadable(); err != nil {
+		slog.ErrorContext(c.UserContext(), "Metadata is not readable", "component", "health", "error", err)
+		checks["metadataReadable"] = false
+		status = fiber.StatusServiceUnavailable
+	} else {
+		checks["metadataReadable"] = true
+	}
+
+	state := "ok"
+	if status != fiber.StatusOK {
+		state = "unavailable"
+	}
+	return c.Status(status).JSON(fiber.Map{
+		"status":        state,
+		"uptimeSeconds": int64(time.Since(startTime).Seconds()),
+		"files":         fileCount,
+		"checks":        checks,
+	})
+}
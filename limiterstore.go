@@ -0,0 +1,115 @@
+package main
+
+import (
+	"container/list"
+	"sync"
+	"time"
+)
+
+const defaultLimiterMaxKeys = 10000
+
+// lruStorage is a fiber.Storage for the rate limiters that holds at most
+// maxKeys entries. When full, the least recently used key is evicted, so a
+// brute-force spread over many IPs can't grow memory without bound.
+type lruStorage struct {
+	mu      sync.Mutex
+	maxKeys int
+	order   *list.List
+	entries map[string]*list.Element
+}
+
+type lruEntry struct {
+	key     string
+	value   []byte
+	expires time.Time
+}
+
+func newLRUStorage(maxKeys int) *lruStorage {
+	if maxKeys <= 0 {
+		maxKeys = defaultLimiterMaxKeys
+	}
+	return &lruStorage{
+		maxKeys: maxKeys,
+		order:   list.New(),
+		entries: make(map[string]*list.Element),
+	}
+}
+
+func (s *lruStorage) Get(key string) ([]byte, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	elem, ok := s.entries[key]
+	if !ok {
+		return nil, nil
+	}
+	entry := elem.Value.(*lruEntry)
+	if !entry.expires.IsZero() && time.Now().After(entry.expires) {
+		s.removeElement(elem)
+		return nil, nil
+	}
+	s.order.MoveToFront(elem)
+	return entry.value, nil
+}
+
+func (s *lruStorage) Set(key string, val []byte, exp time.Duration) error {
+	if key == "" || len(val) == 0 {
+		return nil
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var expires time.Time
+	if exp > 0 {
+		expires = time.Now().Add(exp)
+	}
+	value := append([]byte(nil), val...)
+
+	if elem, ok := s.entries[key]; ok {
+		entry := elem.Value.(*lruEntry)
+		entry.value = value
+		entry.expires = expires
+		s.order.MoveToFront(elem)
+		return nil
+	}
+
+	s.entries[key] = s.order.PushFront(&lruEntry{key: key, value: value, expires: expires})
+	for s.order.Len() > s.maxKeys {
+		s.removeElement(s.order.Back())
+	}
+	return nil
+}
+
+func (s *lruStorage) Delete(key string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if elem, ok := s.entries[key]; ok {
+		s.removeElement(elem)
+	}
+	return nil
+}
+
+func (s *lruStorage) Reset() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.order.Init()
+	s.entries = make(map[string]*list.Element)
+	return nil
+}
+
+func (s *lruStorage) Close() error {
+	return nil
+}
+
+// Len returns the number of keys currently tracked.
+func (s *lruStorage) Len() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.order.Len()
+}
+
+func (s *lruStorage) removeElement(elem *list.Element) {
+	s.order.Remove(elem)
+	delete(s.entries, elem.Value.(*lruEntry).key)
+}
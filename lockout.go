@@ -0,0 +1,79 @@
+package main
+
+import (
+	"log/slog"
+	"math"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+const (
+	defaultLoginLockoutWindow   = 10 * time.Minute
+	defaultLoginLockoutDuration = 15 * time.Minute
+)
+
+// loginLockout counts failed logins across all clients. The per-IP login
+// limiter slows down one client; this stops a guessing attack spread over
+// many IPs, at the cost of also turning away real users while it lasts.
+type loginLockout struct {
+	mu          sync.Mutex
+	failures    []time.Time
+	lockedUntil time.Time
+}
+
+var lockout = &loginLockout{}
+
+// remaining returns how long the login endpoint stays locked, 0 if it is
+// open.
+func (l *loginLockout) remaining() time.Duration {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return max(time.Until(l.lockedUntil), 0)
+}
+
+// recordFailure counts a failed login and locks the endpoint once the
+// threshold is reached within the window.
+func (l *loginLockout) recordFailure() {
+	cfg := settings()
+	if cfg.loginLockoutThreshold <= 0 {
+		return
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := time.Now()
+	if now.Before(l.lockedUntil) {
+		return
+	}
+	recent := l.failures[:0]
+	for _, t := range l.failures {
+		if now.Sub(t) < cfg.loginLockoutWindow {
+			recent = append(recent, t)
+		}
+	}
+	l.failures = append(recent, now)
+	if len(l.failures) < cfg.loginLockoutThreshold {
+		return
+	}
+
+	l.lockedUntil = now.Add(cfg.loginLockoutDuration)
+	l.failures = nil
+	loginLockoutsTotal.Inc()
+	slog.Warn("Too many failed logins, locking login", "component", "auth", "failures", cfg.loginLockoutThreshold, "window", cfg.loginLockoutWindow.String(), "until", l.lockedUntil.UTC())
+	time.AfterFunc(cfg.loginLockoutDuration, func() {
+		slog.Warn("Login lockout ended", "component", "auth")
+	})
+}
+
+// checkLoginLockout answers 423 with Retry-After while logins are locked.
+func checkLoginLockout(c *fiber.Ctx) error {
+	if wait := lockout.remaining(); wait > 0 {
+		slog.InfoContext(c.UserContext(), "Refused login during lockout", "component", "auth", "ip", c.IP())
+		c.Set(fiber.HeaderRetryAfter, strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+		return jsonError(c, fiber.StatusLocked, errCodeLoginLocked, "Logins are temporarily locked after too many failed attempts, try again later")
+	}
+	return c.Next()
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"errors"
+	"log/slog"
+	"os"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// logLevel is the minimum level written to the log, from LOG_LEVEL. It is a
+// LevelVar so the handler installed before loadEnv picks up the configured
+// level without being replaced.
+var logLevel = new(slog.LevelVar)
+
+// setupLogging makes slog write one JSON object per line to stdout and
+// routes the standard log package through the same handler. Records logged
+// with a request's context carry its requestId.
+func setupLogging() {
+	slog.SetDefault(slog.New(requestIDHandler{slog.NewJSONHandler(os.Stdout, &slog.HandlerOptions{Level: logLevel})}))
+}
+
+// fatal logs msg at error level and exits, for configuration and startup
+// failures the server can't run without.
+func fatal(msg string, args ...any) {
+	slog.Error(msg, args...)
+	os.Exit(1)
+}
+
+// requestLogger writes one record per request once the handler chain has
+// finished. Requests answered with an error are logged at warn level or
+// above so they still show up with LOG_LEVEL=warn.
+func requestLogger(c *fiber.Ctx) error {
+	start := time.Now()
+	err := c.Next()
+
+	status := c.Response().StatusCode()
+	if err != nil {
+		status = fiber.StatusInternalServerError
+		var fe *fiber.Error
+		if errors.As(err, &fe) {
+			status = fe.Code
+		}
+	}
+	level := slog.LevelInfo
+	switch {
+	case status >= fiber.StatusInternalServerError:
+		level = slog.LevelError
+	case status >= fiber.StatusBadRequest:
+		level = slog.LevelWarn
+	}
+
+	attrs := []any{
+		"method", c.Method(),
+		"path", c.Path(),
+		"status", status,
+		"durationMs", time.Since(start).Milliseconds(),
+		"ip", c.IP(),
+	}
+	if filename := c.Params("filename"); filename != "" {
+		attrs = append(attrs, "filename", filename)
+	}
+	if user := currentUser(c); user != "" {
+		attrs = append(attrs, "user", user)
+	}
+	slog.Log(c.UserContext(), level, "request", attrs...)
+	return err
+}
@@ -2,398 +2,968 @@ package main
 
 import (
 	"encoding/json"
+	"errors"
+	"flag"
 	"fmt"
-	"log"
+	"io"
+	"io/fs"
+	"log/slog"
+	"net/http"
 	"net/url"
 	"os"
 	"path/filepath"
+	"strconv"
 	"strings"
 	"sync"
 	"time"
 
 	"github.com/gofiber/fiber/v2"
-	"github.com/gofiber/fiber/v2/middleware/limiter"
-	"github.com/golang-jwt/jwt/v5"
-	"github.com/joho/godotenv"
+	"golang.org/x/crypto/bcrypt"
 )
 
 type FileMeta struct {
-	Filename string `json:"filename"`
-	Size     int64  `json:"size"`
-	Path     string `json:"-"`
+	Filename    string   `json:"filename"`
+	Folder      string   `json:"folder,omitempty"`
+	Owner       string   `json:"owner,omitempty"`
+	Size        int64    `json:"size"`
+	ContentType string   `json:"contentType,omitempty"`
+	Checksum    string   `json:"checksum,omitempty"`
+	PHash       string   `json:"phash,omitempty"`
+	Tags        []string `json:"tags,omitempty"`
+	// OriginalName is the sanitized name the file was uploaded as. Filename
+	// identifies it and can differ, with a corrected extension or a
+	// collision suffix.
+	OriginalName string    `json:"originalName,omitempty"`
+	UploadedAt   time.Time `json:"uploadedAt,omitzero"`
+	Downloads    int       `json:"downloads"`
+	LastAccessed time.Time `json:"lastAccessed,omitzero"`
+	ExpiresAt    time.Time `json:"expiresAt,omitzero"`
+	// ThumbnailPath is the storage key of the generated thumbnail.
+	ThumbnailPath string `json:"thumbnailPath,omitempty"`
+	// Key locates the content in fileStorage. Entries linked by dedup share
+	// one key.
+	Key string `json:"-"`
 }
 
 type FileStore struct {
 	Files []FileMeta `json:"files"`
 	mu    sync.Mutex `json:"-"`
+
+	// dirty is set when Files has changes that haven't been written yet,
+	// and flushPending while a coalesced write is scheduled.
+	dirty        bool
+	flushPending bool
+
+	// claimed holds the folder/name targets of uploads, copies, renames
+	// and moves whose storage step is running without the lock.
+	claimed map[string]bool
 }
 
 type LoginRequest struct {
-	PIN string `json:"pin"`
+	Username string `json:"username"`
+	PIN      string `json:"pin"`
 }
 
 const (
-	uploadDir    = "./uploads"
-	metadataFile = "./filedata.json"
+	defaultUploadDir    = "./uploads"
+	defaultMetadataFile = "./filedata.json"
+	defaultPublicDir    = "./public"
+	defaultPort         = 3002
 )
 
+// listenPort is the TCP port the server binds, from PORT.
+var listenPort = defaultPort
+
+// uploadDir and metadataFile are set from UPLOAD_DIR and METADATA_FILE in
+// loadEnv so storage can live on a mounted volume or be split between
+// instances.
+var uploadDir = defaultUploadDir
+var metadataFile = defaultMetadataFile
+
+// publicDir holds the web frontend served at / and /login, from PUBLIC_DIR.
+var publicDir = defaultPublicDir
+
 var webfiles FileStore
 
 var correctPIN string
 var jwtSecret []byte
 
+// checkUploadDirWritable creates dir if needed and writes and removes a probe
+// file, so a read-only or mistyped mount fails at startup instead of on the
+// first upload.
+func checkUploadDirWritable(dir string) error {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	probe, err := os.CreateTemp(dir, ".write-check-*")
+	if err != nil {
+		return err
+	}
+	name := probe.Name()
+	probe.Close()
+	return os.Remove(name)
+}
+
+// checkPublicDir warns when dir lacks the pages the server links to. The
+// server still starts, since the API works without a frontend.
+func checkPublicDir(dir string) {
+	for _, page := range []string{"index.html", "login.html"} {
+		if _, err := os.Stat(filepath.Join(dir, page)); err != nil {
+			slog.Warn("Frontend page is missing from the public directory", "path", dir, "page", page, "error", err)
+		}
+	}
+}
+
+// envBool reads a boolean environment variable, falling back to def when it is
+// unset or cannot be parsed.
+func envBool(key string, def bool) bool {
+	raw := os.Getenv(key)
+	if raw == "" {
+		return def
+	}
+	v, err := strconv.ParseBool(raw)
+	if err != nil {
+		slog.Warn("Invalid boolean in environment, using default", "key", key, "value", raw, "default", def)
+		return def
+	}
+	return v
+}
+
+// envDuration reads a time.Duration environment variable such as "5s" or
+// "10m", falling back to def when it is unset or cannot be parsed.
+func envDuration(key string, def time.Duration) time.Duration {
+	raw := os.Getenv(key)
+	if raw == "" {
+		return def
+	}
+	v, err := time.ParseDuration(raw)
+	if err != nil {
+		slog.Warn("Invalid duration in environment, using default", "key", key, "value", raw, "default", def.String())
+		return def
+	}
+	return v
+}
+
+// envInt reads an integer environment variable, falling back to def when it is
+// unset or cannot be parsed.
+func envInt(key string, def int) int {
+	raw := os.Getenv(key)
+	if raw == "" {
+		return def
+	}
+	v, err := strconv.Atoi(raw)
+	if err != nil {
+		slog.Warn("Invalid integer in environment, using default", "key", key, "value", raw, "default", def)
+		return def
+	}
+	return v
+}
+
+// envByteSize reads a size such as "500MB" from the environment. Unset means
+// 0 (no limit); an unparsable value is an error rather than a fallback since
+// a typo would otherwise silently disable the limit.
+func envByteSize(key string) (int64, error) {
+	raw := os.Getenv(key)
+	if raw == "" {
+		return 0, nil
+	}
+	v, err := parseByteSize(raw)
+	if err != nil {
+		return 0, fmt.Errorf("%s must be a size such as 500MB or 2GB, got %q", key, raw)
+	}
+	return v, nil
+}
+
 func loadEnv() {
-	err := godotenv.Load()
+	err := loadDotenv()
+	if errors.Is(err, fs.ErrNotExist) {
+		slog.Warn(".env file not found, using default or system environment variables")
+	} else if err != nil {
+		fatal("Could not read .env", "error", err)
+	}
+
+	cfg, err := loadReloadableConfig()
 	if err != nil {
-		log.Println("Warning: .env file not found, using default or system environment variables.")
+		fatal("Invalid configuration", "error", err)
+	}
+	cfg.apply()
+
+	users = nil
+	if usersFile := os.Getenv("USERS_FILE"); usersFile != "" {
+		users, err = loadUsers(usersFile)
+		if err != nil {
+			fatal("Could not load USERS_FILE", "path", usersFile, "error", err)
+		}
+		slog.Info("Multi-user mode enabled", "users", len(users), "path", usersFile)
 	}
 
 	correctPIN = os.Getenv("LOGIN_PIN")
-	if correctPIN == "" {
-		log.Fatal("Error: LOGIN_PIN is not set in the environment.")
+	loginPINHash = nil
+	if hash := os.Getenv("LOGIN_PIN_HASH"); hash != "" {
+		if _, err := bcrypt.Cost([]byte(hash)); err != nil {
+			fatal("LOGIN_PIN_HASH is not a valid bcrypt hash", "error", err)
+		}
+		loginPINHash = []byte(hash)
+		if correctPIN != "" {
+			slog.Warn("Both LOGIN_PIN_HASH and LOGIN_PIN are set; ignoring LOGIN_PIN")
+			correctPIN = ""
+		}
+	} else if correctPIN == "" && !multiUser() {
+		fatal("LOGIN_PIN_HASH or LOGIN_PIN must be set in the environment")
+	}
+	loadAPIKey()
+	authStateFile = os.Getenv("AUTH_STATE_FILE")
+	if authStateFile == "" {
+		authStateFile = defaultAuthStateFile
 	}
+	loadAuthState()
 
 	jwtSecretStr := os.Getenv("JWT_SECRET_KEY")
 	if jwtSecretStr == "" {
-		log.Fatal("Error: JWT_SECRET_KEY is not set in the environment.")
+		fatal("JWT_SECRET_KEY is not set in the environment")
 	}
 	jwtSecret = []byte(jwtSecretStr)
 
-	log.Println("Environment variables loaded successfully.")
+	listenPort = defaultPort
+	if raw := os.Getenv("PORT"); raw != "" {
+		port, err := strconv.Atoi(raw)
+		if err != nil || port < 1 || port > 65535 {
+			fatal("PORT must be a number between 1 and 65535", "value", raw)
+		}
+		listenPort = port
+	}
+
+	uploadDir = os.Getenv("UPLOAD_DIR")
+	if uploadDir == "" {
+		uploadDir = defaultUploadDir
+	}
+	if err := checkUploadDirWritable(uploadDir); err != nil {
+		fatal("Upload directory is not writable", "path", uploadDir, "error", err)
+	}
+	metadataFile = os.Getenv("METADATA_FILE")
+	if metadataFile == "" {
+		metadataFile = defaultMetadataFile
+	}
+	slog.Info("Storage configured", "uploadDir", uploadDir, "metadataFile", metadataFile)
+	publicDir = os.Getenv("PUBLIC_DIR")
+	if publicDir == "" {
+		publicDir = defaultPublicDir
+	}
+	checkPublicDir(publicDir)
+	metadataBackupDir = os.Getenv("METADATA_BACKUP_DIR")
+	if metadataBackupDir == "" {
+		metadataBackupDir = defaultMetadataBackupDir
+	}
+	setupStorage()
+
+	jwtPreviousSecrets = nil
+	for _, old := range strings.Split(os.Getenv("JWT_SECRET_KEY_OLD"), ",") {
+		if old = strings.TrimSpace(old); old != "" {
+			jwtPreviousSecrets = append(jwtPreviousSecrets, []byte(old))
+		}
+	}
+	if len(jwtPreviousSecrets) > 0 {
+		slog.Info("Accepting session tokens signed with previous JWT secrets", "count", len(jwtPreviousSecrets))
+	}
+
+	phashEnabled = envBool("PHASH_ENABLED", false)
+	if redisURL := os.Getenv("REDIS_URL"); redisURL != "" {
+		redisClient = connectRedis(redisURL)
+	}
+	limiterUseRedis = strings.EqualFold(os.Getenv("LIMITER_STORE"), "redis")
+	if limiterUseRedis && redisClient == nil {
+		fatal("LIMITER_STORE=redis requires REDIS_URL to be set")
+	}
+	limiterRedisFailOpen = envBool("LIMITER_REDIS_FAIL_OPEN", true)
+	revocationUseRedis = strings.EqualFold(os.Getenv("REVOCATION_STORE"), "redis")
+	if revocationUseRedis && redisClient == nil {
+		fatal("REVOCATION_STORE=redis requires REDIS_URL to be set")
+	}
+	revocationRedisFailOpen = envBool("REVOCATION_REDIS_FAIL_OPEN", false)
+	idempotencyUseRedis = strings.EqualFold(os.Getenv("IDEMPOTENCY_STORE"), "redis")
+	if idempotencyUseRedis && redisClient == nil {
+		fatal("IDEMPOTENCY_STORE=redis requires REDIS_URL to be set")
+	}
+
+	switch backend := strings.ToLower(os.Getenv("METADATA_BACKEND")); backend {
+	case "", metadataBackendJSON:
+		metadataBackend = metadataBackendJSON
+	case metadataBackendSQLite:
+		metadataBackend = metadataBackendSQLite
+	default:
+		fatal("METADATA_BACKEND must be "+metadataBackendJSON+" or "+metadataBackendSQLite, "value", backend)
+	}
+	if metadataBackend == metadataBackendSQLite && (os.Getenv("METADATA_BACKUPS") != "" || os.Getenv("METADATA_BACKUP_INTERVAL") != "") {
+		slog.Warn("METADATA_BACKUPS and METADATA_BACKUP_INTERVAL only apply to the JSON metadata backend; back up the SQLite database file instead")
+	}
+	auditLogFile = os.Getenv("AUDIT_LOG_FILE")
+	if auditLogFile == "" {
+		auditLogFile = defaultAuditLogFile
+	}
+	if envBool("AUDIT_LOG", true) {
+		openAuditLog()
+	}
+	metadataDBPath = os.Getenv("METADATA_DB")
+	if metadataDBPath == "" {
+		metadataDBPath = defaultMetadataDB
+	}
+
+	clamavAddr = os.Getenv("CLAMAV_ADDR")
+	clamavTimeout = envDuration("CLAMAV_TIMEOUT", defaultClamAVTimeout)
+	if clamavAddr != "" {
+		slog.Info("Scanning uploads for viruses", "clamavAddr", clamavAddr, "timeout", clamavTimeout.String())
+	}
+
+	browseEnabled = envBool("BROWSE_ENABLED", true)
+	allowedOrigins, err = parseOrigins(os.Getenv("ALLOWED_ORIGINS"))
+	if err != nil {
+		fatal("ALLOWED_ORIGINS is invalid", "error", err)
+	}
+	if len(allowedOrigins) > 0 {
+		slog.Info("Allowing cross-origin requests", "origins", allowedOrigins)
+	}
+	trustedProxies, err = parseTrustedProxies(os.Getenv("TRUST_PROXY"))
+	if err != nil {
+		fatal("TRUST_PROXY is invalid", "error", err)
+	}
+	proxyHeader = strings.TrimSpace(os.Getenv("PROXY_HEADER"))
+	switch {
+	case len(trustedProxies) == 0 && proxyHeader != "":
+		fatal("PROXY_HEADER is set but TRUST_PROXY is empty; list the proxies whose header may be trusted")
+	case len(trustedProxies) > 0:
+		if proxyHeader == "" {
+			proxyHeader = fiber.HeaderXForwardedFor
+		}
+		slog.Info("Taking client IPs from trusted proxies", "proxies", trustedProxies, "header", proxyHeader)
+		for _, proxy := range trustedProxies {
+			if proxy.Bits() == 0 {
+				slog.Warn("TRUST_PROXY trusts every address, so any client can choose its own IP", "component", "security", "range", proxy)
+			}
+		}
+	}
+	expirySweepInterval = envDuration("EXPIRY_SWEEP_INTERVAL", defaultExpirySweepInterval)
+	if expirySweepInterval <= 0 {
+		fatal("EXPIRY_SWEEP_INTERVAL must be a positive duration")
+	}
+	tempCleanupAge = envDuration("TEMP_CLEANUP_AGE", defaultTempCleanupAge)
+	tempCleanupInterval = envDuration("TEMP_CLEANUP_INTERVAL", defaultTempCleanupInterval)
+	if tempCleanupAge > 0 && tempCleanupInterval <= 0 {
+		fatal("TEMP_CLEANUP_INTERVAL must be a positive duration")
+	}
+
+	slog.Info("Environment variables loaded", "logLevel", logLevel.Level().String())
 }
 
 func main() {
-	log.Println("Starting File Share Server on :3002 ...")
+	hashPIN := flag.Bool("hash-pin", false, "read a PIN from stdin, print its bcrypt hash for LOGIN_PIN_HASH and exit")
+	flag.Parse()
+	if *hashPIN {
+		runHashPIN()
+		return
+	}
+
+	setupLogging()
+	slog.Info("Starting File Share Server")
 
 	loadEnv()
 
-	app := fiber.New(fiber.Config{
-		BodyLimit: 2 * 1024 * 1024 * 1024,
-	})
+	// Bodies are streamed so an upload is written to disk as it arrives
+	// instead of being buffered whole; see readUploadForm.
+	config := fiber.Config{
+		BodyLimit:                    bodyLimit,
+		StreamRequestBody:            true,
+		DisablePreParseMultipartForm: true,
+		ErrorHandler:                 errorHandler,
+	}
+	applyProxyConfig(&config)
+	app := fiber.New(config)
 
 	loadMetadata()
-
+	clearPartialUploads()
+	go runExpirySweeper()
+	go runTempCleanup()
+	go runResumableUploadSweeper()
+
+	app.Use(resolveProxyHeader)
+	app.Use(assignRequestID)
+	app.Use(requestLogger)
+	if len(allowedOrigins) > 0 {
+		app.Use(corsMiddleware())
+	}
+	app.Use(limitRequestBody)
+	app.Use(compressResponses)
 	app.Use(func(c *fiber.Ctx) error {
-		if c.Path() == "/login" || c.Path() == "/logout" || strings.HasPrefix(c.Path(), "/public") {
+		if c.Path() == "/login" || c.Path() == "/logout" || c.Path() == "/healthz" || c.Path() == "/metrics" || strings.HasPrefix(c.Path(), "/public") {
 			return c.Next()
 		}
 
+		if handled, err := authenticateAPIKey(c); handled {
+			return err
+		}
+
 		tokenString := c.Cookies("session")
 		if tokenString == "" {
-			log.Println("[AUTH] No session cookie found, redirecting to login.")
+			slog.DebugContext(c.UserContext(), "No session cookie, redirecting to login", "component", "auth", "path", c.Path())
 			return c.Redirect("/login")
 		}
 
-		token, err := jwt.Parse(tokenString, func(token *jwt.Token) (interface{}, error) {
-			if _, ok := token.Method.(*jwt.SigningMethodHMAC); !ok {
-				return nil, fmt.Errorf("unexpected signing method: %v", token.Header["alg"])
-			}
-			return jwtSecret, nil
-		})
-
+		token, err := parseSessionToken(tokenString)
 		if err != nil || !token.Valid {
-			log.Println("[AUTH] Invalid or expired token, redirecting to login.")
+			slog.InfoContext(c.UserContext(), "Invalid or expired session, redirecting to login", "component", "auth", "ip", c.IP())
 			c.ClearCookie("session")
 			return c.Redirect("/login")
 		}
 
+		// The user list is consulted on every request so removing an account
+		// ends its sessions immediately.
+		username, _ := token.Claims.GetSubject()
+		if multiUser() {
+			if _, ok := users[username]; !ok {
+				slog.WarnContext(c.UserContext(), "Session for unknown user, redirecting to login", "component", "auth", "user", username)
+				c.ClearCookie("session")
+				return c.Redirect("/login")
+			}
+			c.Locals("username", username)
+		}
+		ver, err := sessionVersion(username)
+		if err != nil {
+			if !revocationRedisFailOpen {
+				slog.ErrorContext(c.UserContext(), "Session store unavailable, refusing request", "component", "redis", "error", err)
+				return jsonError(c, fiber.StatusServiceUnavailable, errCodeServiceUnavailable, "Session store unavailable, try again later")
+			}
+			slog.WarnContext(c.UserContext(), "Session store unavailable, accepting session unchecked", "component", "redis", "user", username, "error", err)
+			ver = tokenSessionVersion(token)
+		}
+		if tokenSessionVersion(token) != ver {
+			slog.InfoContext(c.UserContext(), "Revoked session, redirecting to login", "component", "auth", "user", username, "ip", c.IP())
+			c.ClearCookie("session")
+			return c.Redirect("/login")
+		}
+		var issuedAt, expiresAt time.Time
+		if iat, err := token.Claims.GetIssuedAt(); err == nil && iat != nil {
+			issuedAt = iat.Time
+		}
+		if exp, err := token.Claims.GetExpirationTime(); err == nil && exp != nil {
+			expiresAt = exp.Time
+		}
+		setSessionTimes(c, issuedAt, expiresAt)
+
+		// Sliding expiration: an active session close to expiring is
+		// renewed transparently.
+		if window := settings().sessionRefreshWindow; !expiresAt.IsZero() && window > 0 && time.Until(expiresAt) < window {
+			if _, err := issueSession(c, username); err != nil {
+				slog.ErrorContext(c.UserContext(), "Could not renew session", "component", "auth", "error", err)
+			} else {
+				slog.DebugContext(c.UserContext(), "Session close to expiry renewed", "component", "auth", "user", username)
+			}
+		}
+
 		return c.Next()
 	})
+	app.Use(csrfMiddleware)
 
-	app.Static("/", "./public", fiber.Static{Index: "index.html"})
-	app.Static("/login", "./public", fiber.Static{Index: "login.html"})
+	app.Static("/", publicDir, fiber.Static{Index: "index.html"})
+	app.Static("/login", publicDir, fiber.Static{Index: "login.html"})
 
-	loginLimiter := limiter.New(limiter.Config{
-		Max:        5,
-		Expiration: 1 * time.Minute,
-		KeyGenerator: func(c *fiber.Ctx) string {
-			return c.IP()
-		},
+	limiterMaxKeys := envInt("LIMITER_MAX_KEYS", defaultLimiterMaxKeys)
+	loginLimiterStore = newLRUStorage(limiterMaxKeys)
+	loginLimiter := rateLimiter("LOGIN", defaultLoginRateLimit, loginLimiterStore, func(c *fiber.Ctx) string {
+		return c.IP()
 	})
+	uploadLimiter := rateLimiter("UPLOAD", defaultUploadRateLimit, newLRUStorage(limiterMaxKeys), clientKey)
+	downloadLimiter := rateLimiter("DOWNLOAD", defaultDownloadRateLimit, newLRUStorage(limiterMaxKeys), clientKey)
+	uploadConcurrency := uploadConcurrencyLimiter()
 
-	app.Post("/login", loginLimiter, func(c *fiber.Ctx) error {
+	app.Post("/login", loginLimiter, checkLoginLockout, func(c *fiber.Ctx) error {
 		var req LoginRequest
 		if err := c.BodyParser(&req); err != nil {
-			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "Invalid request"})
+			return jsonError(c, fiber.StatusBadRequest, errCodeInvalidRequest, "Invalid request")
 		}
-		if req.PIN != correctPIN {
-			log.Printf("[AUTH] Failed login attempt with PIN: %s", req.PIN)
-			return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{"error": "Incorrect PIN"})
+		var username string
+		if multiUser() {
+			if !authenticateUser(req.Username, req.PIN) {
+				loginFailuresTotal.Inc()
+				lockout.recordFailure()
+				slog.WarnContext(c.UserContext(), "Failed login attempt", "component", "auth", "user", req.Username, "ip", c.IP())
+				recordAudit(c, AuditRecord{Action: auditLoginFailed, User: req.Username})
+				return jsonError(c, fiber.StatusUnauthorized, errCodeInvalidCredentials, "Incorrect username or PIN")
+			}
+			username = req.Username
+			slog.InfoContext(c.UserContext(), "Login successful", "component", "auth", "user", req.Username, "ip", c.IP())
+		} else {
+			if !verifyPIN(req.PIN) {
+				loginFailuresTotal.Inc()
+				lockout.recordFailure()
+				slog.WarnContext(c.UserContext(), "Failed login attempt", "component", "auth", "ip", c.IP())
+				recordAudit(c, AuditRecord{Action: auditLoginFailed})
+				return jsonError(c, fiber.StatusUnauthorized, errCodeInvalidCredentials, "Incorrect PIN")
+			}
+			slog.InfoContext(c.UserContext(), "Login successful", "component", "auth", "ip", c.IP())
 		}
-
-		log.Println("[AUTH] Login successful.")
-		token := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims{
-			"exp": time.Now().Add(time.Hour * 24).Unix(),
-			"pin": req.PIN,
-		})
-
-		tokenString, err := token.SignedString(jwtSecret)
+		recordAudit(c, AuditRecord{Action: auditLogin, User: username})
+		if _, err := issueSession(c, username); err != nil {
+			return jsonError(c, fiber.StatusInternalServerError, errCodeInternal, "Failed to generate token")
+		}
+		csrfToken, err := issueCSRFToken(c)
 		if err != nil {
-			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Failed to generate token"})
+			return jsonError(c, fiber.StatusInternalServerError, errCodeInternal, "Failed to generate token")
 		}
-
-		c.Cookie(&fiber.Cookie{
-			Name:     "session",
-			Value:    tokenString,
-			Expires:  time.Now().Add(time.Hour * 24),
-			HTTPOnly: true,
-			Secure:   true,
-			SameSite: fiber.CookieSameSiteStrictMode,
-		})
-		return c.JSON(fiber.Map{"status": "ok"})
+		return c.JSON(fiber.Map{"status": "ok", "csrfToken": csrfToken})
 	})
 
+	app.Post("/refresh", refreshHandler)
+	app.Get("/whoami", whoamiHandler)
+
+	app.Post("/logout-all", logoutAllHandler)
 	app.Get("/logout", func(c *fiber.Ctx) error {
-		log.Println("[AUTH] User logged out.")
-		c.ClearCookie("session")
+		slog.InfoContext(c.UserContext(), "User logged out", "component", "auth", "ip", c.IP())
+		c.ClearCookie("session", csrfCookieName)
 		return c.Redirect("/login")
 	})
 
-	app.Post("/upload", uploadHandler)
+	app.Get("/healthz", healthHandler)
+	app.Post("/upload", uploadLimiter, uploadConcurrency, uploadHandler)
+	app.Post("/upload-url", uploadLimiter, uploadConcurrency, uploadURLHandler)
+	app.Get("/upload/check", uploadCheckHandler)
+	app.Post("/upload/init", uploadLimiter, resumableInitHandler)
+	app.Head("/upload/:id", resumableStatusHandler)
+	app.Patch("/upload/:id", uploadConcurrency, resumableChunkHandler)
+	app.Post("/upload/:id/complete", resumableCompleteHandler)
 	app.Get("/files", filesHandler)
-	app.Get("/download/:filename", downloadHandler)
+	app.Get("/files/:filename", fileHandler)
+	app.Get("/folders", foldersHandler)
+	app.Get("/search", searchHandler)
+	app.Get("/download/hash/:sha256", downloadLimiter, downloadByHashHandler)
+	// Registered before the GET route, which would otherwise answer HEAD
+	// requests too, by serving and counting a full download.
+	app.Head("/download/:filename", downloadLimiter, downloadHeadHandler)
+	app.Get("/download/:filename", downloadLimiter, downloadHandler)
+	app.Get("/preview/:filename", downloadLimiter, previewHandler)
+	app.Get("/thumbnail/:filename", thumbnailHandler)
+	app.Post("/download-zip", downloadLimiter, downloadZipHandler)
 	app.Delete("/delete/:filename", deleteHandler)
+	app.Post("/delete-bulk", bulkDeleteHandler)
+	app.Put("/rename/:filename", renameHandler)
+	app.Post("/move", moveHandler)
+	app.Post("/copy", copyHandler)
+	app.Post("/share/:filename", shareHandler)
+	app.Get("/public/share/:token", downloadLimiter, publicShareHandler)
+	app.Post("/public/upload/:token", uploadLimiter, uploadConcurrency, publicUploadHandler)
+	app.Post("/files/tags/bulk", bulkTagHandler)
+	app.Put("/files/:filename/tags", setTagsHandler)
+	app.Get("/tags", tagsHandler)
+	app.Get("/stats", statsHandler)
+	app.Get("/files/:filename/similar", similarHandler)
+	app.Get("/ws", eventsUpgrade, eventsHandler)
+	app.Get("/metrics", metricsHandler)
+	app.Post("/admin/reload", reloadHandler)
+	app.Post("/admin/reconcile", reconcileHandler)
+	app.Post("/admin/verify", verifyAllHandler)
+	app.Post("/admin/verify/:filename", verifyHandler)
+	app.Delete("/admin/files", deleteAllHandler)
+	app.Get("/export", exportHandler)
+	app.Post("/admin/change-pin", checkLoginLockout, changePINHandler)
+	app.Post("/admin/upload-token", uploadTokenHandler)
+	app.Get("/admin/audit", auditHandler)
+	app.Get("/admin/backups", backupsHandler)
+	app.Post("/admin/restore/:name", restoreHandler)
+	if browseEnabled {
+		app.Get("/browse", browseHandler)
+	}
 
-	log.Fatal(app.Listen(":3002"))
+	addr := ":" + strconv.Itoa(listenPort)
+	listenAndServe(app, addr)
 }
 
 // --- Handlers ---
 
 func uploadHandler(c *fiber.Ctx) error {
-	log.Println("\n--- [DEBUG] STARTING UPLOAD HANDLER ---")
-	file, err := c.FormFile("file")
+	form, err := readUploadForm(c)
+	if errors.Is(err, io.ErrUnexpectedEOF) {
+		slog.WarnContext(c.UserContext(), "Upload body ended early", "ip", c.IP(), "error", err)
+		return jsonError(c, fiber.StatusBadRequest, errCodeUploadIncomplete, "Upload was incomplete: the request body ended before the whole file arrived")
+	}
 	if err != nil {
-		log.Printf("[DEBUG] 1. ERROR: Could not get file from form: %v\n", err)
-		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": err.Error()})
+		slog.WarnContext(c.UserContext(), "Could not parse multipart form", "error", err)
+		return jsonError(c, fiber.StatusBadRequest, errCodeInvalidRequest, err.Error())
 	}
-	log.Printf("[DEBUG] 1. Received file from form: '%s' (Size: %d bytes)\n", file.Filename, file.Size)
-
-	if err := os.MkdirAll(uploadDir, 0755); err != nil {
-		log.Printf("[DEBUG] ERROR: Could not create upload directory '%s': %v\n", uploadDir, err)
-		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Could not create upload directory"})
+	defer form.RemoveAll()
+	files := form.File["file"]
+	if len(files) == 0 {
+		return jsonError(c, fiber.StatusBadRequest, errCodeInvalidRequest, "No file uploaded")
 	}
+	slog.DebugContext(c.UserContext(), "Received upload", "files", len(files))
 
-	originalName := file.Filename
-
-	cleanedFilename := filepath.Base(originalName)
-	if cleanedFilename == "." || cleanedFilename == "/" {
-		log.Println("[SECURITY] Invalid filename received:", originalName)
-		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "Invalid filename"})
+	var folder string
+	if values := form.Value["folder"]; len(values) > 0 {
+		if folder, err = sanitizeFolder(values[0]); err != nil {
+			slog.WarnContext(c.UserContext(), "Invalid upload folder", "component", "security", "folder", values[0], "ip", c.IP())
+			return jsonError(c, fiber.StatusBadRequest, errCodeInvalidFolder, err.Error())
+		}
 	}
-
-	finalFilename := cleanedFilename
-	filePath := filepath.Join(uploadDir, finalFilename)
-	log.Printf("[DEBUG] 2. Sanitized file path set to: '%s'\n", filePath)
-
-	if _, err := os.Stat(filePath); err == nil {
-		log.Printf("[DEBUG] 3. File '%s' already exists. Generating a new name.\n", finalFilename)
-		ext := ""
-		name := originalName
-		if dotIndex := strings.LastIndex(originalName, "."); dotIndex != -1 {
-			name = originalName[:dotIndex]
-			ext = originalName[dotIndex:]
+	var expiresAt time.Time
+	if values := form.Value["ttl"]; len(values) > 0 {
+		if expiresAt, err = parseTTL(values[0]); err != nil {
+			return jsonError(c, fiber.StatusBadRequest, errCodeInvalidRequest, err.Error())
 		}
-		finalFilename = fmt.Sprintf("%s_%d%s", name, time.Now().UnixNano(), ext)
-		filePath = fmt.Sprintf("%s/%s", uploadDir, finalFilename)
-		log.Printf("[DEBUG]    - New filename: '%s'\n", finalFilename)
-		log.Printf("[DEBUG]    - New file path: '%s'\n", filePath)
-	} else {
-		log.Println("[DEBUG] 3. File does not exist. Using original name.")
 	}
 
-	if err := c.SaveFile(file, filePath); err != nil {
-		log.Printf("[DEBUG] 4. ERROR: Failed to save file to '%s': %v\n", filePath, err)
-		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": err.Error()})
-	}
-	log.Printf("[DEBUG] 4. File successfully saved to: '%s'\n", filePath)
+	tags := splitTags(form.Value["tags"])
 
-	meta := FileMeta{
-		Filename: finalFilename,
-		Size:     file.Size,
-		Path:     filePath,
+	results := make([]UploadResult, 0, len(files))
+	stored := 0
+	for _, file := range files {
+		result := storeUpload(c, formFile(file), folder, expiresAt, tags)
+		if result.Status == uploadStatusUploaded {
+			stored++
+		}
+		results = append(results, result)
 	}
-	log.Printf("[DEBUG] 5. Created new metadata: {Filename: '%s', Size: %d, Path: '%s'}\n", meta.Filename, meta.Size, meta.Path)
 
-	webfiles.Files = append(webfiles.Files, meta)
-	if err := saveMetadata(); err != nil {
-		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Failed to save metadata"})
+	slog.DebugContext(c.UserContext(), "Upload finished", "stored", stored, "files", len(files))
+	switch {
+	case len(results) == 1 && stored == 1:
+		c.Location(fileLocation(results[0].Folder, results[0].Filename))
+		return c.Status(fiber.StatusCreated).JSON(results)
+	case len(results) == 1:
+		return c.Status(results[0].code).JSON(results)
+	case stored == len(results):
+		return c.Status(fiber.StatusCreated).JSON(results)
+	case stored == 0:
+		return c.Status(fiber.StatusBadRequest).JSON(results)
+	default:
+		return c.Status(fiber.StatusMultiStatus).JSON(results)
 	}
-
-	log.Println("--- [DEBUG] ENDING UPLOAD HANDLER ---")
-	return c.JSON(fiber.Map{"status": "uploaded", "filename": meta.Filename, "size": meta.Size})
 }
 
 func filesHandler(c *fiber.Ctx) error {
-	webfiles.mu.Lock()
-	defer webfiles.mu.Unlock()
-	log.Printf("[API] Listing files. Total count: %d\n", len(webfiles.Files))
-	return c.JSON(webfiles.Files)
+	return listFiles(c, nil)
 }
 
 func downloadHandler(c *fiber.Ctx) error {
-	log.Println("\n--- [DEBUG] STARTING DOWNLOAD HANDLER ---")
-
 	rawFilename := c.Params("filename")
-	log.Printf("[DEBUG] 1. Received raw filename from URL: '%s'\n", rawFilename)
-
 	requestedFilename, err := url.QueryUnescape(rawFilename)
 	if err != nil {
-		log.Println("[DEBUG] ERROR: Failed to decode filename.")
-		return c.Status(fiber.StatusBadRequest).SendString("Invalid filename")
+		slog.DebugContext(c.UserContext(), "Could not decode filename", "filename", rawFilename)
+		return jsonError(c, fiber.StatusBadRequest, errCodeInvalidFilename, "Invalid filename")
+	}
+	folder, err := folderQuery(c)
+	if err != nil {
+		return jsonError(c, fiber.StatusBadRequest, errCodeInvalidFolder, err.Error())
 	}
-	log.Printf("[DEBUG] 2. Decoded filename: '%s'\n", requestedFilename)
 
+	// Storage is read without holding the lock, since with S3 or encryption
+	// a slow download would otherwise stall every other request.
 	webfiles.mu.Lock()
-	defer webfiles.mu.Unlock()
-
-	log.Println("[DEBUG] 3. Starting search in web files...")
-	var foundFile *FileMeta
-	for i := range webfiles.Files {
-		webfilesFilename := webfiles.Files[i].Filename
-		log.Printf("[DEBUG]    - Comparing with web file: '%s'\n", webfilesFilename)
-		if webfilesFilename == requestedFilename {
-			log.Println("[DEBUG]    *** MATCH FOUND! ***")
-			foundFile = &webfiles.Files[i]
-			break
-		}
+	index := findAccessibleFileUnlocked(c, folder, requestedFilename)
+	var meta FileMeta
+	if index != -1 {
+		meta = webfiles.Files[index]
 	}
+	webfiles.mu.Unlock()
 
-	if foundFile == nil {
-		log.Println("[DEBUG] 4. ERROR: No match found in metadata webfiles.")
-		log.Println("--- [DEBUG] ENDING DOWNLOAD HANDLER ---")
-		return c.Status(fiber.StatusNotFound).SendString("File not found in metadata")
+	if index == -1 {
+		slog.DebugContext(c.UserContext(), "Download not found in metadata", "filename", requestedFilename, "folder", folder)
+		return jsonError(c, fiber.StatusNotFound, errCodeFileNotFound, "File not found in metadata")
 	}
 
-	log.Printf("[DEBUG] 4. Match found. File path from metadata is: '%s'\n", foundFile.Path)
-
-	if _, err := os.Stat(foundFile.Path); os.IsNotExist(err) {
-		log.Printf("[DEBUG] 5. ERROR: File path '%s' does NOT exist on disk!\n", foundFile.Path)
-		log.Println("--- [DEBUG] ENDING DOWNLOAD HANDLER ---")
-		return c.Status(fiber.StatusNotFound).SendString("File not found on disk")
+	slog.DebugContext(c.UserContext(), "Serving download", "filename", requestedFilename, "folder", folder, "key", meta.Key)
+	if meta.Checksum != "" {
+		c.Set("X-Checksum-SHA256", meta.Checksum)
 	}
 
-	log.Printf("[DEBUG] 5. File exists on disk. Proceeding to download.\n")
-	log.Println("--- [DEBUG] ENDING DOWNLOAD HANDLER ---")
+	if err := serveFile(c, meta); err != nil {
+		return err
+	}
+	recordDownload(c, meta.Folder, meta.Filename)
+	return nil
+}
 
-	return c.Download(foundFile.Path, foundFile.Filename)
+// DeletePreview is what DELETE /delete/:filename?dryRun=true reports the
+// delete would remove. ContentShared means another entry links to the same
+// content, so only the metadata entry would go.
+type DeletePreview struct {
+	DryRun        bool   `json:"dryRun"`
+	Filename      string `json:"filename"`
+	Folder        string `json:"folder,omitempty"`
+	Key           string `json:"key"`
+	Size          int64  `json:"size"`
+	ContentShared bool   `json:"contentShared"`
 }
 
 func deleteHandler(c *fiber.Ctx) error {
-	log.Println("\n--- [DEBUG] STARTING DELETE HANDLER ---")
-
 	rawFilename := c.Params("filename")
 	requestedFilename, err := url.QueryUnescape(rawFilename)
 	if err != nil {
-		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "Invalid filename"})
+		return jsonError(c, fiber.StatusBadRequest, errCodeInvalidFilename, "Invalid filename")
+	}
+	folder, err := folderQuery(c)
+	if err != nil {
+		return jsonError(c, fiber.StatusBadRequest, errCodeInvalidFolder, err.Error())
 	}
-	log.Printf("[DEBUG] Decoded filename: '%s'\n", requestedFilename)
 
 	webfiles.mu.Lock()
-	defer webfiles.mu.Unlock() // Lock is acquired here
+	fileIndex := findAccessibleFileUnlocked(c, folder, requestedFilename)
+	if fileIndex == -1 {
+		webfiles.mu.Unlock()
+		return jsonError(c, fiber.StatusNotFound, errCodeFileNotFound, "File not found in metadata")
+	}
+	target := webfiles.Files[fileIndex]
+	shared := keySharedUnlocked(target.Key, fileIndex)
+	webfiles.mu.Unlock()
+
+	// Only ever delete the key recorded in metadata, never one built from
+	// the request, and only if it stays inside the storage root.
+	keyToDelete := target.Key
+	if !validKey(keyToDelete) {
+		slog.WarnContext(c.UserContext(), "Refusing to delete key outside the storage root", "component", "security", "filename", requestedFilename, "key", keyToDelete)
+		return jsonError(c, fiber.StatusForbidden, errCodeForbidden, "File path is outside the upload directory")
+	}
 
-	var fileIndex = -1
-	for i, f := range webfiles.Files {
-		if f.Filename == requestedFilename {
-			fileIndex = i
-			break
+	// As in renameHandler, storage is reached without holding the lock.
+	if settings().honorIfUnmodifiedSince {
+		if raw := c.Get(fiber.HeaderIfUnmodifiedSince); raw != "" {
+			since, err := http.ParseTime(raw)
+			if err != nil {
+				slog.DebugContext(c.UserContext(), "Ignoring unparsable If-Unmodified-Since header", "value", raw)
+			} else if info, err := fileStorage.Stat(keyToDelete); err == nil && info.ModTime().Truncate(time.Second).After(since) {
+				slog.DebugContext(c.UserContext(), "File modified after If-Unmodified-Since, refusing delete", "filename", requestedFilename, "modified", info.ModTime().UTC().Format(http.TimeFormat), "ifUnmodifiedSince", raw)
+				return jsonError(c, fiber.StatusPreconditionFailed, errCodePreconditionFailed, "File has been modified since the given time")
+			}
 		}
 	}
+	if ifMatchFailed(c, target) {
+		slog.DebugContext(c.UserContext(), "If-Match does not match the current file, refusing delete", "filename", requestedFilename, "ifMatch", c.Get(fiber.HeaderIfMatch))
+		return jsonError(c, fiber.StatusPreconditionFailed, errCodePreconditionFailed, "File has changed since the given ETag")
+	}
+	if c.QueryBool("dryRun") {
+		slog.DebugContext(c.UserContext(), "Dry-run delete", "filename", requestedFilename, "folder", folder, "key", keyToDelete)
+		return c.JSON(DeletePreview{
+			DryRun:        true,
+			Filename:      target.Filename,
+			Folder:        target.Folder,
+			Key:           keyToDelete,
+			Size:          target.Size,
+			ContentShared: shared,
+		})
+	}
 
-	if fileIndex == -1 {
-		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"error": "File not found in metadata"})
+	// The entry is removed first and the content after, so no upload can
+	// link to the key once it is gone from storage. An entry renamed,
+	// moved or replaced meanwhile is left alone.
+	webfiles.mu.Lock()
+	fileIndex = findFileUnlocked(target.Folder, target.Filename)
+	if fileIndex == -1 || webfiles.Files[fileIndex].Key != keyToDelete {
+		webfiles.mu.Unlock()
+		return jsonError(c, fiber.StatusNotFound, errCodeFileNotFound, "File was removed or replaced during the delete")
+	}
+	deleted := webfiles.Files[fileIndex]
+	shared = keySharedUnlocked(keyToDelete, fileIndex)
+	webfiles.Files = append(webfiles.Files[:fileIndex], webfiles.Files[fileIndex+1:]...)
+	thumbnail := orphanedThumbnailUnlocked(deleted)
+	err = saveMetadataUnlocked()
+	remaining := make([]FileMeta, 0, len(webfiles.Files))
+	for _, f := range webfiles.Files {
+		if canAccess(c, f) {
+			remaining = append(remaining, f)
+		}
+	}
+	webfiles.mu.Unlock()
+	if err != nil {
+		return jsonError(c, fiber.StatusInternalServerError, errCodeInternal, "Failed to update metadata")
 	}
 
-	filePathToDelete := filepath.Join(uploadDir, requestedFilename)
-	if err := os.Remove(filePathToDelete); err != nil && !os.IsNotExist(err) {
-		log.Printf("[DEBUG] WARNING: Could not delete file from disk: %v\n", err)
+	if shared {
+		slog.DebugContext(c.UserContext(), "Key is shared with another entry; keeping it in storage", "filename", requestedFilename, "key", keyToDelete)
+	} else if err := fileStorage.Delete(keyToDelete); err != nil {
+		slog.WarnContext(c.UserContext(), "Could not delete file from storage", "filename", requestedFilename, "key", keyToDelete, "error", err)
 	} else {
-		log.Printf("[DEBUG] Successfully deleted file from disk: '%s'\n", filePathToDelete)
+		slog.DebugContext(c.UserContext(), "Deleted file from storage", "filename", requestedFilename, "key", keyToDelete)
 	}
+	removeThumbnail(deleted, thumbnail)
 
-	webfiles.Files = append(webfiles.Files[:fileIndex], webfiles.Files[fileIndex+1:]...)
-	log.Println("[DEBUG] Removed file metadata from webfiles slice.")
+	deletesTotal.Inc()
+	slog.InfoContext(c.UserContext(), "Deleted file", "filename", requestedFilename, "folder", folder, "user", currentUser(c))
+	recordAudit(c, AuditRecord{Action: auditDelete, Filename: deleted.Filename, Folder: deleted.Folder, Size: deleted.Size})
+	events.broadcast(FileEvent{Type: eventDeleted, Filename: deleted.Filename, Folder: deleted.Folder}, deleted)
+	return c.JSON(remaining)
+}
 
-	// --- [FIX] Call the UNLOCKED version here to avoid deadlock ---
-	if err := saveMetadataUnlocked(); err != nil {
-		log.Println("[DEBUG] ERROR: Failed to save metadata after deletion.")
-		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Failed to update metadata"})
+// fileLocation is the canonical URL of a stored file, used for the Location
+// header of a successful upload.
+func fileLocation(folder, filename string) string {
+	location := "/download/" + url.PathEscape(filename)
+	if folder != "" {
+		location += "?folder=" + url.QueryEscape(folder)
 	}
+	return location
+}
+
+// claimName reserves name in folder for an upload, reporting false when a
+// file with this name is already tracked there or claimed by another
+// upload, copy, rename or move. With date partitioning two uploads can
+// share a name in storage under different keys, so the metadata has to be
+// checked as well. A successful claim must be ended with releaseName.
+func claimName(folder, name string) bool {
+	webfiles.mu.Lock()
+	defer webfiles.mu.Unlock()
+	return claimNameUnlocked(folder, name)
+}
 
-	log.Println("--- [DEBUG] ENDING DELETE HANDLER ---")
-	return c.JSON(webfiles.Files)
+// releaseName ends a claim made with claimName.
+func releaseName(folder, name string) {
+	webfiles.mu.Lock()
+	defer webfiles.mu.Unlock()
+	releaseNameUnlocked(folder, name)
+}
+
+// writeFileAtomic replaces path with data through a temp file in the same
+// directory, so a crash or a full disk mid-write leaves the old content
+// rather than a truncated file.
+func writeFileAtomic(path string, data []byte, perm os.FileMode) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+"-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Chmod(perm); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
 }
 
 // --- Metadata Functions ---
 
+// fillOriginalNamesUnlocked gives entries recorded before OriginalName was
+// kept their current name as the original. The caller must hold webfiles.mu.
+func fillOriginalNamesUnlocked() {
+	for i := range webfiles.Files {
+		if webfiles.Files[i].OriginalName == "" {
+			webfiles.Files[i].OriginalName = webfiles.Files[i].Filename
+		}
+	}
+}
+
+// storedFileMeta is the on-disk form of a FileMeta. Key is kept out of API
+// responses, so it is persisted here instead. Files written before storage
+// backends existed have a path, relative to uploadDir, in the same form.
+type storedFileMeta struct {
+	FileMeta
+	StoredKey  string `json:"key,omitempty"`
+	StoredPath string `json:"path,omitempty"`
+}
+
+func encodeMetadataJSON(files []FileMeta) ([]byte, error) {
+	stored := make([]storedFileMeta, len(files))
+	for i, f := range files {
+		stored[i] = storedFileMeta{FileMeta: f, StoredKey: f.Key}
+	}
+	return json.MarshalIndent(struct {
+		Files []storedFileMeta `json:"files"`
+	}{Files: stored}, "", "  ")
+}
+
+func decodeMetadataJSON(data []byte) ([]FileMeta, error) {
+	var stored struct {
+		Files []storedFileMeta `json:"files"`
+	}
+	if err := json.Unmarshal(data, &stored); err != nil {
+		return nil, err
+	}
+	files := make([]FileMeta, len(stored.Files))
+	for i, f := range stored.Files {
+		files[i] = f.FileMeta
+		files[i].Key = f.StoredKey
+		if files[i].Key == "" {
+			files[i].Key = keyFromStoredPath(f.StoredPath, f.Filename)
+		}
+	}
+	return files, nil
+}
+
 // saveMetadataUnlocked performs the save operation without handling mutex locks.
 // This should be called by functions that have already acquired the lock.
+// With METADATA_FLUSH_INTERVAL set the write is only scheduled; see
+// scheduleMetadataFlushUnlocked.
 func saveMetadataUnlocked() error {
-	log.Println("[DEBUG] Saving metadata to file (unlocked)...")
+	if settings().metadataFlushInterval > 0 {
+		scheduleMetadataFlushUnlocked()
+		return nil
+	}
+	return writeMetadataUnlocked()
+}
 
-	dataToSave := struct {
-		Files []FileMeta `json:"files"`
-	}{
-		Files: webfiles.Files,
+// writeMetadataUnlocked writes webfiles.Files to the metadata backend right
+// away. The caller must hold webfiles.mu.
+func writeMetadataUnlocked() error {
+	webfiles.dirty = false
+	if metadataDB != nil {
+		if err := saveMetadataSQLite(); err != nil {
+			webfiles.dirty = true
+			slog.Error("Failed to write metadata to SQLite", "path", metadataDBPath, "error", err)
+			return err
+		}
+		slog.Debug("Metadata saved", "backend", metadataBackendSQLite, "files", len(webfiles.Files))
+		return nil
 	}
 
-	data, err := json.MarshalIndent(dataToSave, "", "  ")
+	data, err := encodeMetadataJSON(webfiles.Files)
 	if err != nil {
-		log.Printf("[DEBUG] ERROR: Failed to marshal metadata to JSON: %v\n", err)
+		webfiles.dirty = true
+		slog.Error("Failed to marshal metadata to JSON", "error", err)
 		return err
 	}
-	if err := os.WriteFile(metadataFile, data, 0644); err != nil {
-		log.Printf("[DEBUG] ERROR: Failed to write metadata to file '%s': %v\n", metadataFile, err)
+	backupMetadataFile(false)
+	if err := writeFileAtomic(metadataFile, data, 0644); err != nil {
+		webfiles.dirty = true
+		slog.Error("Failed to write metadata file", "path", metadataFile, "error", err)
 		return err
 	}
-	log.Println("[DEBUG] Metadata saved successfully.")
+	slog.Debug("Metadata saved", "backend", metadataBackendJSON, "files", len(webfiles.Files))
 	return nil
 }
 
-// --- Metadata Functions ---
-
-func saveMetadata() error {
-	webfiles.mu.Lock()
-	defer webfiles.mu.Unlock()
-
-	// log.Println("[DEBUG] Saving metadata to file...")
-
-	// dataToSave := struct {
-	// 	Files []FileMeta `json:"files"`
-	// }{
-	// 	Files: webfiles.Files,
-	// }
-
-	// data, err := json.MarshalIndent(dataToSave, "", "  ")
-	// if err != nil {
-	// 	log.Printf("[DEBUG] ERROR: Failed to marshal metadata to JSON: %v\n", err)
-	// 	return err
-	// }
-	// if err := os.WriteFile(metadataFile, data, 0644); err != nil {
-	// 	log.Printf("[DEBUG] ERROR: Failed to write metadata to file '%s': %v\n", metadataFile, err)
-	// 	return err
-	// }
-	// log.Println("[DEBUG] Metadata saved successfully.")
-
-	return saveMetadataUnlocked()
-}
-
 func loadMetadata() {
 	webfiles.mu.Lock()
 	defer webfiles.mu.Unlock()
 
-	log.Println("[DEBUG] Attempting to load metadata from file...")
+	if metadataBackend == metadataBackendSQLite {
+		db, err := openMetadataDB(metadataDBPath)
+		if err != nil {
+			fatal("Could not open metadata database", "path", metadataDBPath, "error", err)
+		}
+		metadataDB = db
+		if err := loadMetadataSQLite(); err != nil {
+			fatal("Could not load metadata", "path", metadataDBPath, "error", err)
+		}
+		fillOriginalNamesUnlocked()
+		slog.Info("Metadata loaded", "backend", metadataBackendSQLite, "path", metadataDBPath, "files", len(webfiles.Files))
+		return
+	}
+
 	if _, err := os.Stat(metadataFile); os.IsNotExist(err) {
-		log.Println("[DEBUG] Metadata file not found, starting fresh.")
+		slog.Info("Metadata file not found, starting fresh", "path", metadataFile)
 		return
 	}
 	data, err := os.ReadFile(metadataFile)
 	if err != nil {
-		log.Printf("[DEBUG] ERROR: Failed to read metadata file '%s': %v\n", metadataFile, err)
+		slog.Error("Failed to read metadata file", "path", metadataFile, "error", err)
 		return
 	}
-	if err := json.Unmarshal(data, &webfiles); err != nil {
-		log.Printf("[DEBUG] ERROR: Failed to unmarshal JSON data from metadata file: %v\n", err)
+	files, err := decodeMetadataJSON(data)
+	if err != nil {
+		slog.Error("Failed to parse metadata file", "path", metadataFile, "error", err)
 		return
 	}
-	log.Printf("[DEBUG] Metadata loaded successfully. Total files: %d\n", len(webfiles.Files))
+	webfiles.Files = files
+	fillOriginalNamesUnlocked()
+	slog.Info("Metadata loaded", "backend", metadataBackendJSON, "path", metadataFile, "files", len(webfiles.Files))
 }
@@ -0,0 +1,180 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// setupTestStore points storage, metadata and backups at a temporary
+// directory and empties the index for the rest of the test. Duplicate
+// upload suppression is turned off so tests can upload the same name twice,
+// and metadata is written right away so no write lands after the test.
+func setupTestStore(t *testing.T) {
+	t.Helper()
+	dir := t.TempDir()
+	savedUploadDir, savedMetadataFile, savedBackupDir := uploadDir, metadataFile, metadataBackupDir
+	savedStorage, savedFiles := fileStorage, webfiles.Files
+	t.Cleanup(func() {
+		uploadDir, metadataFile, metadataBackupDir = savedUploadDir, savedMetadataFile, savedBackupDir
+		fileStorage, webfiles.Files = savedStorage, savedFiles
+	})
+
+	uploadDir = filepath.Join(dir, "uploads")
+	if err := os.MkdirAll(uploadDir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	metadataFile = filepath.Join(dir, "filedata.json")
+	metadataBackupDir = filepath.Join(dir, "backups")
+	fileStorage = localStorage{root: uploadDir}
+	webfiles.Files = []FileMeta{}
+	withSettings(t, func(cfg *reloadableConfig) {
+		cfg.duplicateUploadWindow = 0
+		cfg.metadataFlushInterval = 0
+	})
+}
+
+// uploadRequest builds a POST /upload request carrying one file.
+func uploadRequest(t *testing.T, filename string, content []byte) *http.Request {
+	t.Helper()
+	var body bytes.Buffer
+	w := multipart.NewWriter(&body)
+	part, err := w.CreateFormFile("file", filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	part.Write(content)
+	w.Close()
+	req := httptest.NewRequest(fiber.MethodPost, "/upload", &body)
+	req.Header.Set(fiber.HeaderContentType, w.FormDataContentType())
+	return req
+}
+
+// doRequest sends req to app and returns the status and decoded JSON body.
+func doRequest(t *testing.T, app *fiber.App, req *http.Request, out any) int {
+	t.Helper()
+	resp, err := app.Test(req, -1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if out != nil && len(data) > 0 {
+		if err := json.Unmarshal(data, out); err != nil {
+			t.Fatalf("decoding %s: %v", data, err)
+		}
+	}
+	return resp.StatusCode
+}
+
+// addTestFile stores content under folder/name and records it in the index.
+func addTestFile(t *testing.T, folder, name, content string) FileMeta {
+	t.Helper()
+	key := storageKey(folder, name, time.Now())
+	if err := fileStorage.Save(key, strings.NewReader(content), int64(len(content))); err != nil {
+		t.Fatal(err)
+	}
+	meta := FileMeta{Filename: name, Folder: folder, Size: int64(len(content)), Key: key, UploadedAt: time.Now().UTC()}
+	webfiles.Files = append(webfiles.Files, meta)
+	return meta
+}
+
+func TestDeleteIfUnmodifiedSince(t *testing.T) {
+	modified := time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+	tests := []struct {
+		name   string
+		honor  bool
+		header string
+		want   int
+	}{
+		{"modified since read", true, modified.Add(-time.Hour).Format(http.TimeFormat), fiber.StatusPreconditionFailed},
+		{"unmodified since read", true, modified.Format(http.TimeFormat), fiber.StatusOK},
+		{"read after modification", true, modified.Add(time.Hour).Format(http.TimeFormat), fiber.StatusOK},
+		{"no header", true, "", fiber.StatusOK},
+		{"unparsable header ignored", true, "yesterday", fiber.StatusOK},
+		{"option off", false, modified.Add(-time.Hour).Format(http.TimeFormat), fiber.StatusOK},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setupTestStore(t)
+			withSettings(t, func(cfg *reloadableConfig) { cfg.honorIfUnmodifiedSince = tt.honor })
+			meta := addTestFile(t, "", "report.txt", "v2")
+			if err := os.Chtimes(filepath.Join(uploadDir, meta.Key), modified, modified); err != nil {
+				t.Fatal(err)
+			}
+			app := fiber.New()
+			app.Delete("/delete/:filename", deleteHandler)
+
+			req := httptest.NewRequest(fiber.MethodDelete, "/delete/report.txt", nil)
+			if tt.header != "" {
+				req.Header.Set(fiber.HeaderIfUnmodifiedSince, tt.header)
+			}
+			if status := doRequest(t, app, req, nil); status != tt.want {
+				t.Fatalf("status %d, want %d", status, tt.want)
+			}
+			_, err := os.Stat(filepath.Join(uploadDir, meta.Key))
+			if kept := err == nil; kept != (tt.want == fiber.StatusPreconditionFailed) {
+				t.Errorf("file kept = %v after status %d", kept, tt.want)
+			}
+			if listed := findFileUnlocked("", "report.txt") != -1; listed != (tt.want == fiber.StatusPreconditionFailed) {
+				t.Errorf("file still listed = %v after status %d", listed, tt.want)
+			}
+		})
+	}
+}
+
+func TestDeleteBlocksTraversal(t *testing.T) {
+	tests := []struct {
+		name string
+		// key, when set, is recorded in the metadata for outside.txt as if
+		// the metadata had been tampered with.
+		key  string
+		path string
+		want int
+	}{
+		{"dot-dot in the name", "", "/delete/..%2Foutside.txt", fiber.StatusNotFound},
+		{"dot-dot in the name and folder", "", "/delete/outside.txt?folder=..", fiber.StatusBadRequest},
+		{"absolute name", "", "/delete/%2Ftmp%2Foutside.txt", fiber.StatusNotFound},
+		{"dot-dot key", "../outside.txt", "/delete/outside.txt", fiber.StatusForbidden},
+		{"dot-dot key inside a folder", "docs/../../outside.txt", "/delete/outside.txt", fiber.StatusForbidden},
+		{"absolute key", "<abs>", "/delete/outside.txt", fiber.StatusForbidden},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setupTestStore(t)
+			outside := filepath.Join(filepath.Dir(uploadDir), "outside.txt")
+			if err := os.WriteFile(outside, []byte("keep me"), 0644); err != nil {
+				t.Fatal(err)
+			}
+			if tt.key != "" {
+				key := tt.key
+				if key == "<abs>" {
+					key = outside
+				}
+				webfiles.Files = append(webfiles.Files, FileMeta{Filename: "outside.txt", Size: 7, Key: key})
+			}
+			app := fiber.New()
+			app.Delete("/delete/:filename", deleteHandler)
+
+			if status := doRequest(t, app, httptest.NewRequest(fiber.MethodDelete, tt.path, nil), nil); status != tt.want {
+				t.Errorf("DELETE %s: status %d, want %d", tt.path, status, tt.want)
+			}
+			if _, err := os.Stat(outside); err != nil {
+				t.Fatalf("file outside the upload directory was touched: %v", err)
+			}
+		})
+	}
+}
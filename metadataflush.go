@@ -0,0 +1,42 @@
+package main
+
+import (
+	"log/slog"
+	"time"
+)
+
+// defaultMetadataFlushInterval keeps the window of changes a crash can lose
+// short while still turning a burst of uploads into one write.
+const defaultMetadataFlushInterval = 500 * time.Millisecond
+
+// scheduleMetadataFlushUnlocked marks the metadata dirty and, unless one is
+// already pending, schedules a write in METADATA_FLUSH_INTERVAL. The caller
+// must hold webfiles.mu.
+func scheduleMetadataFlushUnlocked() {
+	webfiles.dirty = true
+	if webfiles.flushPending {
+		return
+	}
+	webfiles.flushPending = true
+	time.AfterFunc(settings().metadataFlushInterval, func() {
+		webfiles.mu.Lock()
+		defer webfiles.mu.Unlock()
+		webfiles.flushPending = false
+		interval := settings().metadataFlushInterval
+		if err := flushMetadataUnlocked(); err != nil && interval > 0 {
+			// Keep the changes and try again later rather than drop them.
+			slog.Warn("Coalesced metadata write failed, retrying", "in", interval.String(), "error", err)
+			scheduleMetadataFlushUnlocked()
+		}
+	})
+}
+
+// flushMetadataUnlocked writes the metadata now if it has unwritten changes,
+// for anything that needs the metadata file to be current, such as a backup
+// taken before a restore. The caller must hold webfiles.mu.
+func flushMetadataUnlocked() error {
+	if !webfiles.dirty {
+		return nil
+	}
+	return writeMetadataUnlocked()
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"github.com/gofiber/fiber/v2/middleware/adaptor"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// loginLimiterStore backs the login rate limiter; it is kept so its size can
+// be reported.
+var loginLimiterStore *lruStorage
+
+// transferBuckets spans small files on a fast disk to large ones on a slow
+// disk or link.
+var transferBuckets = prometheus.ExponentialBuckets(0.005, 4, 10)
+
+var (
+	uploadsTotal = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "webfiles_uploads_total",
+		Help: "Number of files stored by uploads.",
+	})
+	downloadsTotal = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "webfiles_downloads_total",
+		Help: "Number of downloads served, including previews, share links and zip archives. A download fetched in several ranges counts once.",
+	})
+	deletesTotal = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "webfiles_deletes_total",
+		Help: "Number of files deleted.",
+	})
+	loginFailuresTotal = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "webfiles_login_failures_total",
+		Help: "Number of rejected login attempts.",
+	})
+	loginLockoutsTotal = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "webfiles_login_lockouts_total",
+		Help: "Number of times logins were locked after too many failures.",
+	})
+	malwareDetectedTotal = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "webfiles_malware_detected_total",
+		Help: "Number of uploads rejected because the virus scanner found malware.",
+	})
+	uploadDuration = promauto.NewHistogram(prometheus.HistogramOpts{
+		Name:    "webfiles_upload_duration_seconds",
+		Help:    "Time taken to process and store one uploaded file.",
+		Buckets: transferBuckets,
+	})
+	activeUploads = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "webfiles_active_uploads",
+		Help: "Number of upload requests currently receiving a body.",
+	})
+	downloadBytesTotal = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "webfiles_download_bytes_total",
+		Help: "Bytes of file content sent to clients, counted as each chunk is written.",
+	})
+	downloadDuration = promauto.NewHistogram(prometheus.HistogramOpts{
+		Name:    "webfiles_download_duration_seconds",
+		Help:    "Time taken to stream one file to the client.",
+		Buckets: transferBuckets,
+	})
+)
+
+func init() {
+	promauto.NewGaugeFunc(prometheus.GaugeOpts{
+		Name: "webfiles_files",
+		Help: "Number of files tracked in metadata.",
+	}, func() float64 {
+		webfiles.mu.Lock()
+		defer webfiles.mu.Unlock()
+		return float64(len(webfiles.Files))
+	})
+	promauto.NewGaugeFunc(prometheus.GaugeOpts{
+		Name: "webfiles_stored_bytes",
+		Help: "Bytes used on disk by stored files; deduplicated copies count once.",
+	}, func() float64 {
+		webfiles.mu.Lock()
+		defer webfiles.mu.Unlock()
+		return float64(storedBytesUnlocked())
+	})
+	promauto.NewGaugeFunc(prometheus.GaugeOpts{
+		Name: "webfiles_login_limiter_keys",
+		Help: "Number of client keys tracked by the login rate limiter.",
+	}, func() float64 {
+		if loginLimiterStore == nil {
+			return 0
+		}
+		return float64(loginLimiterStore.Len())
+	})
+}
+
+// metricsHandler reports server metrics in the Prometheus text format. It
+// needs no login so a scraper can reach it; it exposes counts, not file
+// names.
+var metricsHandler = adaptor.HTTPHandler(promhttp.Handler())
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"io"
+	"mime"
+	"net/http"
+	"path/filepath"
+	"strings"
+)
+
+const (
+	mimeExtensionPolicyOff    = "off"
+	mimeExtensionPolicyWarn   = "warn"
+	mimeExtensionPolicyFix    = "fix"
+	mimeExtensionPolicyReject = "reject"
+)
+
+// defaultContentType is recorded when neither sniffing nor the client can
+// tell what a file is.
+const defaultContentType = "application/octet-stream"
+
+// canonicalExtensions lists the sniffed types we trust enough to second-guess
+// a client's extension. Container formats are left out on purpose: a .docx or
+// .jar sniffs as application/zip and must not be "corrected" to .zip.
+var canonicalExtensions = map[string]string{
+	"image/png":       ".png",
+	"image/jpeg":      ".jpg",
+	"image/gif":       ".gif",
+	"image/webp":      ".webp",
+	"image/bmp":       ".bmp",
+	"application/pdf": ".pdf",
+}
+
+// sniffContentType returns the content type detected from the first 512
+// bytes of an uploaded file.
+func sniffContentType(file incomingFile) (string, error) {
+	f, err := file.open()
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	buf := make([]byte, 512)
+	n, err := io.ReadFull(f, buf)
+	if err != nil && err != io.ErrUnexpectedEOF && err != io.EOF {
+		return "", err
+	}
+	return http.DetectContentType(buf[:n]), nil
+}
+
+// detectContentType picks the content type to store for an upload. The
+// sniffed type wins since it comes from the bytes themselves; when sniffing
+// only gives the generic fallback, the Content-Type the client declared is
+// used if it is well-formed.
+func detectContentType(file incomingFile, sniffed string) string {
+	if sniffed != "" && sniffed != defaultContentType {
+		return sniffed
+	}
+	if header := file.ContentType; header != "" {
+
+		if mediaType, _, err := mime.ParseMediaType(header); err == nil && mediaType != defaultContentType {
+			return header
+		}
+	}
+	return defaultContentType
+}
+
+// extensionMismatch reports the canonical extension for contentType when it
+// disagrees with the extension of filename. It returns "" when the two agree
+// or the content type is not one we can judge.
+func extensionMismatch(filename, contentType string) string {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return ""
+	}
+	want, ok := canonicalExtensions[mediaType]
+	if !ok {
+		return ""
+	}
+
+	ext := strings.ToLower(filepath.Ext(filename))
+	if ext == want {
+		return ""
+	}
+	if byExt, _, err := mime.ParseMediaType(mime.TypeByExtension(ext)); err == nil && byExt == mediaType {
+		return ""
+	}
+	return want
+}
+
+// claimedTypeMismatch reports the content type the extension of filename
+// claims when the content doesn't back it up, such as an executable named
+// .jpg, which sniffs as application/octet-stream and so slips past
+// extensionMismatch. Only the types in canonicalExtensions are judged,
+// since sniffing recognises those reliably; it returns "" for anything else.
+func claimedTypeMismatch(filename, sniffed string) string {
+	claimed, _, err := mime.ParseMediaType(mime.TypeByExtension(strings.ToLower(filepath.Ext(filename))))
+	if err != nil {
+		return ""
+	}
+	if _, ok := canonicalExtensions[claimed]; !ok {
+		return ""
+	}
+	if mediaType, _, err := mime.ParseMediaType(sniffed); err == nil && mediaType == claimed {
+		return ""
+	}
+	return claimed
+}
+
+// withExtension replaces the extension of filename with ext.
+func withExtension(filename, ext string) string {
+	return strings.TrimSuffix(filename, filepath.Ext(filename)) + ext
+}
@@ -0,0 +1,228 @@
+package main
+
+import (
+	"errors"
+	"log/slog"
+	"path"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+type MoveRequest struct {
+	Filename   string `json:"filename"`
+	FromFolder string `json:"fromFolder"`
+	ToFolder   string `json:"toFolder"`
+}
+
+// parseMoveRequest reads the body of /move and /copy and sanitizes both
+// folders. On failure it returns the error code to answer with.
+func parseMoveRequest(c *fiber.Ctx) (filename, from, to, code string, err error) {
+	var req MoveRequest
+	if err := c.BodyParser(&req); err != nil {
+		return "", "", "", errCodeInvalidRequest, errors.New("Invalid request body")
+	}
+	if req.Filename == "" {
+		return "", "", "", errCodeInvalidFilename, errors.New("filename is required")
+	}
+	if from, err = sanitizeFolder(req.FromFolder); err != nil {
+		return "", "", "", errCodeInvalidFolder, err
+	}
+	if to, err = sanitizeFolder(req.ToFolder); err != nil {
+		return "", "", "", errCodeInvalidFolder, err
+	}
+	return req.Filename, from, to, "", nil
+}
+
+// keyInFolder returns where the content stored at key goes when its file
+// moves from one folder to another. The part of the key below the folder,
+// such as a date partition, is kept.
+func keyInFolder(key, from, to string) string {
+	if from != "" {
+		key = strings.TrimPrefix(key, from+"/")
+	}
+	return path.Join(to, key)
+}
+
+// moveHandler moves a file to another folder, along with its content in
+// storage. Like a rename, content shared with another entry stays where it
+// is and only the metadata moves.
+func moveHandler(c *fiber.Ctx) error {
+	filename, from, to, code, err := parseMoveRequest(c)
+	if err != nil {
+		return jsonError(c, fiber.StatusBadRequest, code, err.Error())
+	}
+
+	webfiles.mu.Lock()
+	fileIndex := findAccessibleFileUnlocked(c, from, filename)
+	if fileIndex == -1 {
+		webfiles.mu.Unlock()
+		return jsonError(c, fiber.StatusNotFound, errCodeFileNotFound, "File not found in metadata")
+	}
+	meta := webfiles.Files[fileIndex]
+	if from == to {
+		webfiles.mu.Unlock()
+		return c.JSON(meta)
+	}
+	if !claimNameUnlocked(to, meta.Filename) {
+		webfiles.mu.Unlock()
+		return jsonError(c, fiber.StatusConflict, errCodeFileExists, "A file with that name already exists in the destination folder")
+	}
+	shared := keySharedUnlocked(meta.Key, fileIndex)
+	webfiles.mu.Unlock()
+	defer func() {
+		webfiles.mu.Lock()
+		releaseNameUnlocked(to, meta.Filename)
+		webfiles.mu.Unlock()
+	}()
+
+	// As in renameHandler, the content moves without holding the lock.
+	oldKey, newKey := meta.Key, meta.Key
+	if shared {
+		slog.DebugContext(c.UserContext(), "Key is shared with another entry; moving metadata only", "filename", filename, "key", meta.Key)
+	} else {
+		newKey = keyInFolder(meta.Key, from, to)
+		if !validKey(meta.Key) || !validKey(newKey) {
+			slog.WarnContext(c.UserContext(), "Refusing to move key outside the storage root", "component", "security", "key", meta.Key, "newKey", newKey)
+			return jsonError(c, fiber.StatusForbidden, errCodeForbidden, "File path is outside the upload directory")
+		}
+		if _, err := fileStorage.Stat(newKey); err == nil {
+			return jsonError(c, fiber.StatusConflict, errCodeFileExists, "A file with that name already exists in the destination folder")
+		}
+		if err := fileStorage.Rename(oldKey, newKey); err != nil {
+			slog.ErrorContext(c.UserContext(), "Could not move file", "key", oldKey, "newKey", newKey, "error", err)
+			return jsonError(c, fiber.StatusInternalServerError, errCodeInternal, "Could not move file")
+		}
+	}
+
+	webfiles.mu.Lock()
+	fileIndex = findFileUnlocked(from, meta.Filename)
+	if fileIndex == -1 || webfiles.Files[fileIndex].Key != oldKey {
+		webfiles.mu.Unlock()
+		restoreKey(c, oldKey, newKey)
+		return jsonError(c, fiber.StatusNotFound, errCodeFileNotFound, "File was removed or replaced during the move")
+	}
+	relinkKeyUnlocked(oldKey, newKey)
+	entry := &webfiles.Files[fileIndex]
+	entry.Folder = to
+	moved := *entry
+	err = saveMetadataUnlocked()
+	webfiles.mu.Unlock()
+	if err != nil {
+		return jsonError(c, fiber.StatusInternalServerError, errCodeInternal, "Failed to update metadata")
+	}
+
+	slog.InfoContext(c.UserContext(), "Moved file", "filename", filename, "folder", from, "toFolder", to, "user", currentUser(c))
+	recordAudit(c, AuditRecord{Action: auditMove, Filename: filename, Folder: from, Size: moved.Size, Detail: to})
+	events.broadcast(FileEvent{Type: eventRenamed, File: &moved, Filename: moved.Filename, Folder: from}, moved)
+	return c.JSON(moved)
+}
+
+// copyHandler copies a file into another folder as a new entry owned by the
+// caller. Unless DEDUP_MODE is off the copy shares the original's content,
+// as an identical upload would; otherwise the content is duplicated in
+// storage.
+func copyHandler(c *fiber.Ctx) error {
+	filename, from, to, code, err := parseMoveRequest(c)
+	if err != nil {
+		return jsonError(c, fiber.StatusBadRequest, code, err.Error())
+	}
+
+	webfiles.mu.Lock()
+	fileIndex := findAccessibleFileUnlocked(c, from, filename)
+	if fileIndex == -1 {
+		webfiles.mu.Unlock()
+		return jsonError(c, fiber.StatusNotFound, errCodeFileNotFound, "File not found in metadata")
+	}
+	source := webfiles.Files[fileIndex]
+	if nameTakenUnlocked(to, filename) {
+		webfiles.mu.Unlock()
+		return jsonError(c, fiber.StatusConflict, errCodeFileExists, "A file with that name already exists in the destination folder")
+	}
+
+	meta := source
+	meta.Folder = to
+	meta.Owner = currentUser(c)
+	meta.Tags = slices.Clone(source.Tags)
+	meta.UploadedAt = time.Now().UTC()
+	meta.Downloads = 0
+	meta.LastAccessed = time.Time{}
+
+	// A linked copy touches no storage, so the lock is held throughout and
+	// the source can't be deleted from under it.
+	if settings().dedupMode != dedupModeOff {
+		webfiles.Files = append(webfiles.Files, meta)
+		err = saveMetadataUnlocked()
+		webfiles.mu.Unlock()
+		if err != nil {
+			return jsonError(c, fiber.StatusInternalServerError, errCodeInternal, "Failed to update metadata")
+		}
+		return copied(c, meta, from, true)
+	}
+
+	if quotaErr := quotaErrorUnlocked(source.Size); quotaErr != "" {
+		webfiles.mu.Unlock()
+		return jsonError(c, fiber.StatusRequestEntityTooLarge, errCodeQuotaExceeded, quotaErr)
+	}
+	claimNameUnlocked(to, filename)
+	webfiles.mu.Unlock()
+	defer func() {
+		webfiles.mu.Lock()
+		releaseNameUnlocked(to, filename)
+		webfiles.mu.Unlock()
+	}()
+
+	// The content is copied without holding the lock, so a large file
+	// doesn't stall other requests; the claim keeps the destination free.
+	meta.Key = keyInFolder(source.Key, from, to)
+	if !validKey(source.Key) || !validKey(meta.Key) {
+		slog.WarnContext(c.UserContext(), "Refusing to copy key outside the storage root", "component", "security", "key", source.Key, "newKey", meta.Key)
+		return jsonError(c, fiber.StatusForbidden, errCodeForbidden, "File path is outside the upload directory")
+	}
+	if _, err := fileStorage.Stat(meta.Key); err == nil {
+		return jsonError(c, fiber.StatusConflict, errCodeFileExists, "A file with that name already exists in the destination folder")
+	}
+	if err := copyStored(source.Key, meta.Key, source.Size); err != nil {
+		slog.ErrorContext(c.UserContext(), "Could not copy file", "key", source.Key, "newKey", meta.Key, "error", err)
+		return jsonError(c, fiber.StatusInternalServerError, errCodeInternal, "Could not copy file")
+	}
+
+	webfiles.mu.Lock()
+	fileIndex = findFileUnlocked(from, source.Filename)
+	if fileIndex == -1 || webfiles.Files[fileIndex].Key != source.Key {
+		webfiles.mu.Unlock()
+		if err := fileStorage.Delete(meta.Key); err != nil {
+			slog.WarnContext(c.UserContext(), "Could not remove copy of a file removed meanwhile", "key", meta.Key, "error", err)
+		}
+		return jsonError(c, fiber.StatusNotFound, errCodeFileNotFound, "File was removed or replaced during the copy")
+	}
+	webfiles.Files = append(webfiles.Files, meta)
+	err = saveMetadataUnlocked()
+	webfiles.mu.Unlock()
+	if err != nil {
+		return jsonError(c, fiber.StatusInternalServerError, errCodeInternal, "Failed to update metadata")
+	}
+	return copied(c, meta, from, false)
+}
+
+// copied reports a copy recorded by copyHandler and responds with the new
+// entry.
+func copied(c *fiber.Ctx, meta FileMeta, from string, linked bool) error {
+	slog.InfoContext(c.UserContext(), "Copied file", "filename", meta.Filename, "folder", from, "toFolder", meta.Folder, "linked", linked, "user", meta.Owner)
+	recordAudit(c, AuditRecord{Action: auditCopy, Filename: meta.Filename, Folder: from, Size: meta.Size, Detail: meta.Folder})
+	events.broadcast(FileEvent{Type: eventUploaded, File: &meta}, meta)
+	c.Location(fileLocation(meta.Folder, meta.Filename))
+	return c.Status(fiber.StatusCreated).JSON(meta)
+}
+
+// copyStored duplicates the content at src to dst.
+func copyStored(src, dst string, size int64) error {
+	f, err := fileStorage.Open(src)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return fileStorage.Save(dst, f, size)
+}
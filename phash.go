@@ -0,0 +1,206 @@
+package main
+
+import (
+	"fmt"
+	"image"
+	_ "image/gif"
+	_ "image/jpeg"
+	_ "image/png"
+	"log/slog"
+	"math"
+	"math/bits"
+	"net/url"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+const (
+	phashSize       = 32
+	phashLowFreq    = 8
+	defaultPHashMax = 10
+)
+
+// phashEnabled turns on perceptual hashing of image uploads.
+var phashEnabled bool
+
+var phashExtensions = map[string]bool{
+	".jpg":  true,
+	".jpeg": true,
+	".png":  true,
+	".gif":  true,
+}
+
+type SimilarFile struct {
+	Filename string `json:"filename"`
+	Folder   string `json:"folder,omitempty"`
+	Size     int64  `json:"size"`
+	Distance int    `json:"distance"`
+}
+
+// computePHash returns a 64-bit DCT perceptual hash of the image at path.
+// The image is reduced to a 32x32 grayscale grid, transformed with a 2D DCT,
+// and the top-left 8x8 low-frequency block (minus the DC term) is compared
+// against its median to produce the bits.
+func computePHash(key string) (uint64, error) {
+	f, err := fileStorage.Open(key)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+
+	img, _, err := image.Decode(f)
+	if err != nil {
+		return 0, err
+	}
+
+	bounds := img.Bounds()
+	if bounds.Dx() == 0 || bounds.Dy() == 0 {
+		return 0, fmt.Errorf("empty image")
+	}
+
+	var pixels [phashSize][phashSize]float64
+	for y := 0; y < phashSize; y++ {
+		for x := 0; x < phashSize; x++ {
+			sx := bounds.Min.X + x*bounds.Dx()/phashSize
+			sy := bounds.Min.Y + y*bounds.Dy()/phashSize
+			r, g, b, _ := img.At(sx, sy).RGBA()
+			pixels[y][x] = 0.299*float64(r>>8) + 0.587*float64(g>>8) + 0.114*float64(b>>8)
+		}
+	}
+
+	dct := dct2D(pixels)
+
+	coeffs := make([]float64, 0, phashLowFreq*phashLowFreq-1)
+	for y := 0; y < phashLowFreq; y++ {
+		for x := 0; x < phashLowFreq; x++ {
+			if x == 0 && y == 0 {
+				continue
+			}
+			coeffs = append(coeffs, dct[y][x])
+		}
+	}
+
+	sorted := append([]float64(nil), coeffs...)
+	sort.Float64s(sorted)
+	median := sorted[len(sorted)/2]
+
+	var hash uint64
+	for i, v := range coeffs {
+		if v > median {
+			hash |= 1 << uint(i)
+		}
+	}
+	return hash, nil
+}
+
+func dct2D(in [phashSize][phashSize]float64) [phashSize][phashSize]float64 {
+	var tmp, out [phashSize][phashSize]float64
+	for y := 0; y < phashSize; y++ {
+		tmp[y] = dct1D(in[y])
+	}
+	for x := 0; x < phashSize; x++ {
+		var col [phashSize]float64
+		for y := 0; y < phashSize; y++ {
+			col[y] = tmp[y][x]
+		}
+		col = dct1D(col)
+		for y := 0; y < phashSize; y++ {
+			out[y][x] = col[y]
+		}
+	}
+	return out
+}
+
+func dct1D(in [phashSize]float64) [phashSize]float64 {
+	var out [phashSize]float64
+	for k := 0; k < phashSize; k++ {
+		sum := 0.0
+		for n := 0; n < phashSize; n++ {
+			sum += in[n] * math.Cos(math.Pi/phashSize*(float64(n)+0.5)*float64(k))
+		}
+		out[k] = sum
+	}
+	return out
+}
+
+// schedulePHash computes the perceptual hash of an uploaded image in the
+// background and records it on the matching FileMeta once done.
+func schedulePHash(filename, key string) {
+	if !phashEnabled || !phashExtensions[strings.ToLower(filepath.Ext(filename))] {
+		return
+	}
+
+	go func() {
+		hash, err := computePHash(key)
+		if err != nil {
+			slog.Warn("Could not compute perceptual hash", "component", "phash", "filename", filename, "error", err)
+			return
+		}
+
+		webfiles.mu.Lock()
+		defer webfiles.mu.Unlock()
+		for i := range webfiles.Files {
+			if webfiles.Files[i].Filename == filename && webfiles.Files[i].Key == key {
+				webfiles.Files[i].PHash = fmt.Sprintf("%016x", hash)
+				if err := saveMetadataUnlocked(); err != nil {
+					slog.Error("Failed to save perceptual hash", "component", "phash", "filename", filename, "error", err)
+				}
+				return
+			}
+		}
+	}()
+}
+
+func similarHandler(c *fiber.Ctx) error {
+	requestedFilename, err := url.QueryUnescape(c.Params("filename"))
+	if err != nil {
+		return jsonError(c, fiber.StatusBadRequest, errCodeInvalidFilename, "Invalid filename")
+	}
+	folder, err := folderQuery(c)
+	if err != nil {
+		return jsonError(c, fiber.StatusBadRequest, errCodeInvalidFolder, err.Error())
+	}
+
+	maxDistance := settings().phashMaxDistance
+	if raw := c.Query("distance"); raw != "" {
+		maxDistance, err = strconv.Atoi(raw)
+		if err != nil || maxDistance < 0 || maxDistance > 64 {
+			return jsonError(c, fiber.StatusBadRequest, errCodeInvalidRequest, "distance must be between 0 and 64")
+		}
+	}
+
+	webfiles.mu.Lock()
+	defer webfiles.mu.Unlock()
+
+	targetIndex := findAccessibleFileUnlocked(c, folder, requestedFilename)
+	if targetIndex == -1 {
+		return jsonError(c, fiber.StatusNotFound, errCodeFileNotFound, "File not found in metadata")
+	}
+	target := &webfiles.Files[targetIndex]
+
+	similar := []SimilarFile{}
+	targetHash, err := strconv.ParseUint(target.PHash, 16, 64)
+	if target.PHash == "" || err != nil {
+		return c.JSON(similar)
+	}
+
+	for i, f := range webfiles.Files {
+		if i == targetIndex || f.PHash == "" || !canAccess(c, f) {
+			continue
+		}
+		hash, err := strconv.ParseUint(f.PHash, 16, 64)
+		if err != nil {
+			continue
+		}
+		if d := bits.OnesCount64(targetHash ^ hash); d <= maxDistance {
+			similar = append(similar, SimilarFile{Filename: f.Filename, Folder: f.Folder, Size: f.Size, Distance: d})
+		}
+	}
+	sort.Slice(similar, func(i, j int) bool { return similar[i].Distance < similar[j].Distance })
+
+	return c.JSON(similar)
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"crypto/subtle"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// loginPINHash is the bcrypt hash from LOGIN_PIN_HASH, or of the PIN set
+// through POST /admin/change-pin. When set it takes precedence over the
+// plaintext correctPIN. pinMu guards both once the server is running.
+var (
+	loginPINHash []byte
+	pinMu        sync.RWMutex
+)
+
+// setLoginPINHash makes hash the only accepted PIN.
+func setLoginPINHash(hash []byte) {
+	pinMu.Lock()
+	defer pinMu.Unlock()
+	loginPINHash = hash
+	correctPIN = ""
+}
+
+// verifyPIN checks a login attempt. The plaintext fallback compares SHA-256
+// digests in constant time so neither the content nor the length of the PIN
+// leaks through response timing.
+func verifyPIN(pin string) bool {
+	pinMu.RLock()
+	defer pinMu.RUnlock()
+	if loginPINHash != nil {
+		return bcrypt.CompareHashAndPassword(loginPINHash, []byte(pin)) == nil
+	}
+	got := sha256.Sum256([]byte(pin))
+	want := sha256.Sum256([]byte(correctPIN))
+	return subtle.ConstantTimeCompare(got[:], want[:]) == 1
+}
+
+// runHashPIN implements the -hash-pin flag: it reads a PIN from stdin and
+// prints a bcrypt hash suitable for LOGIN_PIN_HASH. Reading from stdin keeps
+// the PIN out of shell history and the process list.
+func runHashPIN() {
+	fmt.Fprint(os.Stderr, "PIN: ")
+	line, err := bufio.NewReader(os.Stdin).ReadString('\n')
+	if err != nil && line == "" {
+		fmt.Fprintln(os.Stderr, "Error: could not read PIN:", err)
+		os.Exit(1)
+	}
+	pin := strings.TrimRight(line, "\r\n")
+	if pin == "" {
+		fmt.Fprintln(os.Stderr, "Error: PIN must not be empty.")
+		os.Exit(1)
+	}
+	hash, err := bcrypt.GenerateFromPassword([]byte(pin), bcrypt.DefaultCost)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Error:", err)
+		os.Exit(1)
+	}
+	fmt.Println(string(hash))
+}
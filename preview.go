@@ -0,0 +1,81 @@
+package main
+
+import (
+	"log/slog"
+	"mime"
+	"net/url"
+	"path/filepath"
+	"strings"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// previewableTypes are rendered inline by /preview. Anything that can run
+// script in the page origin (HTML, SVG, XML) is deliberately missing and is
+// served as an attachment instead, so a stored file can't be used for XSS.
+var previewableTypes = map[string]bool{
+	"image/png":       true,
+	"image/jpeg":      true,
+	"image/gif":       true,
+	"image/webp":      true,
+	"image/bmp":       true,
+	"application/pdf": true,
+	"text/plain":      true,
+	"video/mp4":       true,
+	"video/webm":      true,
+	"audio/mpeg":      true,
+	"audio/ogg":       true,
+	"audio/wave":      true,
+	"audio/wav":       true,
+}
+
+// isPreviewable reports whether contentType is safe to serve inline.
+func isPreviewable(contentType string) bool {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return false
+	}
+	return previewableTypes[strings.ToLower(mediaType)]
+}
+
+// previewHandler serves a file for viewing in the browser. Types that aren't
+// safe to render fall back to the same attachment response as /download.
+func previewHandler(c *fiber.Ctx) error {
+	requestedFilename, err := url.QueryUnescape(c.Params("filename"))
+	if err != nil {
+		return jsonError(c, fiber.StatusBadRequest, errCodeInvalidFilename, "Invalid filename")
+	}
+	folder, err := folderQuery(c)
+	if err != nil {
+		return jsonError(c, fiber.StatusBadRequest, errCodeInvalidFolder, err.Error())
+	}
+
+	webfiles.mu.Lock()
+	index := findAccessibleFileUnlocked(c, folder, requestedFilename)
+	var meta FileMeta
+	if index != -1 {
+		meta = webfiles.Files[index]
+	}
+	webfiles.mu.Unlock()
+
+	if index == -1 {
+		return jsonError(c, fiber.StatusNotFound, errCodeFileNotFound, "File not found in metadata")
+	}
+
+	contentType := meta.ContentType
+	if contentType == "" {
+		contentType = mime.TypeByExtension(strings.ToLower(filepath.Ext(meta.Filename)))
+	}
+	if meta.Checksum != "" {
+		c.Set("X-Checksum-SHA256", meta.Checksum)
+	}
+	// Stop browsers from second-guessing the declared type into something
+	// executable.
+	c.Set(fiber.HeaderXContentTypeOptions, "nosniff")
+
+	if !isPreviewable(contentType) {
+		slog.DebugContext(c.UserContext(), "Not previewable; serving as attachment", "filename", meta.Filename, "contentType", contentType)
+		return serveFile(c, meta)
+	}
+	return serveFileInline(c, meta, contentType)
+}
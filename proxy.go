@@ -0,0 +1,133 @@
+package main
+
+import (
+	"fmt"
+	"net/netip"
+	"strings"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// trustedProxies are the addresses and CIDR ranges, from TRUST_PROXY, of the
+// reverse proxies in front of the server; a single address is a /32 or /128
+// range. Only requests arriving from one of them have their client IP taken
+// from proxyHeader, from PROXY_HEADER, and their scheme from
+// X-Forwarded-Proto.
+var (
+	trustedProxies []netip.Prefix
+	proxyHeader    string
+)
+
+// parseTrustedProxies reads a comma-separated list of IP addresses and CIDR
+// ranges.
+func parseTrustedProxies(raw string) ([]netip.Prefix, error) {
+	var proxies []netip.Prefix
+	for _, proxy := range strings.Split(raw, ",") {
+		proxy = strings.TrimSpace(proxy)
+		if proxy == "" {
+			continue
+		}
+		if strings.Contains(proxy, "/") {
+			prefix, err := netip.ParsePrefix(proxy)
+			if err != nil {
+				return nil, fmt.Errorf("%q is not a CIDR range like 10.0.0.0/8", proxy)
+			}
+			proxies = append(proxies, prefix.Masked())
+			continue
+		}
+		addr, err := netip.ParseAddr(proxy)
+		if err != nil {
+			return nil, fmt.Errorf("%q is not an IP address", proxy)
+		}
+		addr = addr.Unmap()
+		proxies = append(proxies, netip.PrefixFrom(addr, addr.BitLen()))
+	}
+	return proxies, nil
+}
+
+// isTrustedProxy reports whether addr is in TRUST_PROXY.
+func isTrustedProxy(addr netip.Addr) bool {
+	addr = addr.Unmap()
+	for _, proxy := range trustedProxies {
+		if proxy.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// applyProxyConfig makes c.IP() report the client behind a trusted proxy,
+// which the rate limiters, the lockout and the logs all key on. Without
+// TRUST_PROXY the connecting address is used, as before.
+func applyProxyConfig(cfg *fiber.Config) {
+	if len(trustedProxies) == 0 {
+		return
+	}
+	cfg.EnableTrustedProxyCheck = true
+	for _, proxy := range trustedProxies {
+		cfg.TrustedProxies = append(cfg.TrustedProxies, proxy.String())
+	}
+	cfg.ProxyHeader = proxyHeader
+	// resolveProxyHeader leaves a single address in the header, or removes
+	// it; validation makes c.IP() fall back to the connecting address if a
+	// request from a trusted proxy still carries garbage.
+	cfg.EnableIPValidation = true
+}
+
+// forwardedClient picks the client address out of a forwarded header. Each
+// proxy appends the address it received the request from, so the entries
+// right of the client's are the trusted proxies' own; anything left of it
+// was sent by the client and may be made up. The header is read from the
+// right and the first address that isn't a trusted proxy is the client.
+// When every entry is a trusted proxy the left-most one is. ok is false when
+// an entry isn't an address before the client is reached.
+func forwardedClient(values []string) (client netip.Addr, ok bool) {
+	var entries []string
+	for _, value := range values {
+		entries = append(entries, strings.Split(value, ",")...)
+	}
+	for i := len(entries) - 1; i >= 0; i-- {
+		entry := strings.TrimSpace(entries[i])
+		if entry == "" {
+			continue
+		}
+		addr, err := netip.ParseAddr(entry)
+		if err != nil {
+			// Some proxies add the client's port.
+			addrPort, err := netip.ParseAddrPort(entry)
+			if err != nil {
+				return netip.Addr{}, false
+			}
+			addr = addrPort.Addr()
+		}
+		client, ok = addr.Unmap(), true
+		if !isTrustedProxy(client) {
+			break
+		}
+	}
+	return client, ok
+}
+
+// resolveProxyHeader replaces proxyHeader on requests from a trusted proxy
+// with the one address forwardedClient picks, which is what c.IP() then
+// returns, or removes it so c.IP() is the connecting address. It must run
+// before anything calls c.IP().
+func resolveProxyHeader(c *fiber.Ctx) error {
+	if len(trustedProxies) == 0 || !c.IsProxyTrusted() {
+		return c.Next()
+	}
+	header := &c.Request().Header
+	var values []string
+	for _, value := range header.PeekAll(proxyHeader) {
+		values = append(values, string(value))
+	}
+	if len(values) == 0 {
+		return c.Next()
+	}
+	if client, ok := forwardedClient(values); ok {
+		header.Set(proxyHeader, client.String())
+	} else {
+		header.Del(proxyHeader)
+	}
+	return c.Next()
+}
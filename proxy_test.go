@@ -0,0 +1,39 @@
+package main
+
+import "testing"
+
+func TestForwardedClient(t *testing.T) {
+	proxies, err := parseTrustedProxies("127.0.0.1,10.0.0.0/8")
+	if err != nil {
+		t.Fatal(err)
+	}
+	saved := trustedProxies
+	trustedProxies = proxies
+	defer func() { trustedProxies = saved }()
+
+	tests := []struct {
+		name   string
+		values []string
+		want   string
+		ok     bool
+	}{
+		{"single address", []string{"1.2.3.4"}, "1.2.3.4", true},
+		{"client-supplied entry ignored", []string{"6.6.6.6, 1.2.3.4"}, "1.2.3.4", true},
+		{"trusted proxies skipped", []string{"6.6.6.6, 1.2.3.4, 10.1.1.1, 127.0.0.1"}, "1.2.3.4", true},
+		{"only trusted proxies", []string{"10.0.0.2, 10.0.0.1"}, "10.0.0.2", true},
+		{"port stripped", []string{"1.2.3.4:5678"}, "1.2.3.4", true},
+		{"IPv6", []string{"2001:db8::1, 10.0.0.1"}, "2001:db8::1", true},
+		{"garbage left of the client", []string{"not-an-ip, 1.2.3.4"}, "1.2.3.4", true},
+		{"garbage right of the client", []string{"1.2.3.4, not-an-ip"}, "", false},
+		{"repeated header lines", []string{"6.6.6.6", "7.7.7.7"}, "7.7.7.7", true},
+		{"empty", []string{""}, "", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, ok := forwardedClient(tt.values)
+			if ok != tt.ok || (ok && got.String() != tt.want) {
+				t.Errorf("forwardedClient(%q) = %v, %v; want %s, %v", tt.values, got, ok, tt.want, tt.ok)
+			}
+		})
+	}
+}
@@ -2,32 +2,63 @@ const uploadBtn = document.getElementById("uploadBtn");
 const fileInput = document.getElementById("fileInput");
 const fileTable = document.querySelector("#fileTable tbody");
 
+// โทเค็น CSRF ที่เซิร์ฟเวอร์ตั้งไว้ในคุกกี้ ต้องส่งกลับใน header ทุกครั้งที่แก้ไขข้อมูล
+function csrfToken() {
+  const match = document.cookie.match(/(?:^|; )csrf_token=([^;]*)/);
+  return match ? decodeURIComponent(match[1]) : "";
+}
+
 // โหลดไฟล์
 async function loadFiles() {
-  const res = await fetch("/files");
-  const files = await res.json();
+  const res = await fetch("/files?limit=1000");
+  const { files } = await res.json();
   fileTable.innerHTML = "";
 
   files.forEach(f => {
     const row = document.createElement("tr");
+    const folderQuery = f.folder ? `?folder=${encodeURIComponent(f.folder)}` : "";
 
+    // ชื่อไฟล์และโฟลเดอร์มาจากผู้อัปโหลด จึงใส่เป็นข้อความเท่านั้น ห้ามใส่เป็น HTML
         row.innerHTML = `
-        <td>${getFileIcon(f.filename)} ${f.filename}</td>
+        <td><span class="file-icon"></span> <span class="file-name"></span></td>
         <td>${formatFileSize(f.size)}</td>
+        <td>${formatUploadDate(f.uploadedAt)}</td>
         <td>
-            <a href="/download/${encodeURIComponent(f.filename)}" target="_blank" class="btn btn-success btn-sm me-1">
+            ${isPreviewable(f.contentType) ? `<a href="/preview/${encodeURIComponent(f.filename)}${folderQuery}" target="_blank" class="btn btn-primary btn-sm me-1">
+            <i class="bi bi-eye"></i> ดูตัวอย่าง
+            </a>` : ""}
+            <a href="/download/${encodeURIComponent(f.filename)}${folderQuery}" target="_blank" class="btn btn-success btn-sm me-1">
             <i class="bi bi-download"></i> ดาวน์โหลด
             </a>
-            <button class="btn btn-danger btn-sm" onclick="deleteFile('${f.filename}')">
+            <button class="btn btn-danger btn-sm delete-btn">
             <i class="bi bi-trash"></i> ลบ
             </button>
         </td>
         `;
 
+    row.querySelector(".file-icon").innerHTML = getFileIcon(f.filename);
+    const nameCell = row.querySelector(".file-name");
+    nameCell.textContent = (f.folder ? `${f.folder}/` : "") + (f.originalName || f.filename);
+    if (f.originalName && f.originalName !== f.filename) {
+      const stored = document.createElement("small");
+      stored.className = "text-muted";
+      stored.textContent = `(${f.filename})`;
+      nameCell.append(" ", stored);
+    }
+    row.querySelector(".delete-btn").addEventListener("click", () => deleteFile(f.filename, f.folder || ""));
+
     fileTable.appendChild(row);
   });
 }
 
+// ชนิดไฟล์ที่เปิดดูในเบราว์เซอร์ได้ (ตรงกับ /preview ฝั่งเซิร์ฟเวอร์)
+function isPreviewable(contentType) {
+  if (!contentType) return false;
+  const type = contentType.split(';')[0].trim().toLowerCase();
+  return /^image\/(png|jpeg|gif|webp|bmp)$/.test(type) ||
+    ['application/pdf', 'text/plain', 'video/mp4', 'video/webm', 'audio/mpeg', 'audio/ogg', 'audio/wave', 'audio/wav'].includes(type);
+}
+
 function getFileIcon(filename) {
   const ext = filename.split('.').pop().toLowerCase();
 
@@ -80,13 +111,21 @@ function formatFileSize(bytes) {
   return gb.toFixed(2) + ' GB';
 }
 
+// แสดงวันที่อัปโหลด (ไฟล์เก่าที่ไม่มีข้อมูลจะแสดง -)
+function formatUploadDate(uploadedAt) {
+  if (!uploadedAt) return '-';
+  const date = new Date(uploadedAt);
+  if (isNaN(date)) return '-';
+  return date.toLocaleString('th-TH');
+}
+
 // อัปโหลดไฟล์
 function uploadFile() {
-  const file = fileInput.files[0];
-  if (!file) { Swal.fire({icon:'warning',title:'กรุณาเลือกไฟล์ก่อน'}); return; }
+  const files = fileInput.files;
+  if (files.length === 0) { Swal.fire({icon:'warning',title:'กรุณาเลือกไฟล์ก่อน'}); return; }
 
   const formData = new FormData();
-  formData.append("file", file);
+  for (const file of files) formData.append("file", file);
 
   const xhr = new XMLHttpRequest();
   const progressContainer = document.getElementById("uploadProgress");
@@ -105,20 +144,29 @@ function uploadFile() {
     progressContainer.style.display = "none";
     progressBar.style.width = "0%";
     progressBar.textContent = "0%";
-    if(xhr.status===200){ Swal.fire({icon:'success',title:'อัปโหลดสำเร็จ!',timer:1500,showConfirmButton:false}); fileInput.value=""; loadFiles(); }
-    else{ Swal.fire({icon:'error',title:'เกิดข้อผิดพลาด',text:xhr.responseText}); }
+    let results = [];
+    try { results = JSON.parse(xhr.responseText); } catch (e) {}
+    const failed = Array.isArray(results) ? results.filter(r => r.status !== "uploaded") : [];
+
+    if(xhr.status>=200 && xhr.status<300 && failed.length===0){ Swal.fire({icon:'success',title:'อัปโหลดสำเร็จ!',timer:1500,showConfirmButton:false}); fileInput.value=""; loadFiles(); }
+    else if(failed.length>0){
+      Swal.fire({icon:'error',title:'บางไฟล์อัปโหลดไม่สำเร็จ',text:failed.map(r => `${r.filename}: ${r.error ? r.error.message : r.status}`).join("\n")});
+      loadFiles();
+    }
+    else{ Swal.fire({icon:'error',title:'เกิดข้อผิดพลาด',text:(results && results.error && results.error.message) || xhr.responseText}); }
   }
 
   xhr.open("POST","/upload");
+  xhr.setRequestHeader("X-CSRF-Token", csrfToken());
   xhr.send(formData);
 }
 
 
 
 // ลบไฟล์
-async function deleteFile(name) {
+async function deleteFile(name, folder) {
   const result = await Swal.fire({
-    title: `ต้องการลบไฟล์ ${name} ใช่หรือไม่?`,
+    titleText: `ต้องการลบไฟล์ ${name} ใช่หรือไม่?`,
     icon: 'warning',
     showCancelButton: true,
     confirmButtonColor: '#dc3545',
@@ -128,12 +176,12 @@ async function deleteFile(name) {
   });
 
   if (result.isConfirmed) {
-    const res = await fetch(`/delete/${encodeURIComponent(name)}`, { method: "DELETE" });
+    const res = await fetch(`/delete/${encodeURIComponent(name)}${folder ? `?folder=${encodeURIComponent(folder)}` : ""}`, { method: "DELETE", headers: { "X-CSRF-Token": csrfToken() } });
     const data = await res.json();
     if (res.ok) {
       Swal.fire({
         icon: 'success',
-        title: `ลบไฟล์ ${name} สำเร็จ`,
+        titleText: `ลบไฟล์ ${name} สำเร็จ`,
         timer: 1500,
         showConfirmButton: false
       });
@@ -142,12 +190,21 @@ async function deleteFile(name) {
       Swal.fire({
         icon: 'error',
         title: 'ไม่สามารถลบไฟล์ได้',
-        text: data.error
+        text: data.error && data.error.message
       });
     }
   }
 }
 
+// รับแจ้งเมื่อมีการอัปโหลด ลบ หรือเปลี่ยนชื่อไฟล์ แล้วโหลดรายการใหม่ (เชื่อมต่อใหม่เมื่อหลุด)
+function watchFileEvents() {
+  const scheme = location.protocol === "https:" ? "wss" : "ws";
+  const socket = new WebSocket(`${scheme}://${location.host}/ws`);
+  socket.addEventListener("message", () => loadFiles());
+  socket.addEventListener("close", () => setTimeout(watchFileEvents, 5000));
+}
+
 // Event listeners
 uploadBtn.addEventListener("click", uploadFile);
 window.addEventListener("load", loadFiles);
+window.addEventListener("load", watchFileEvents);
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// deleteAllHandler empties the store: every tracked file and thumbnail is
+// deleted from storage and the metadata is cleared. It only acts when the
+// request carries ?confirm=true, so a stray DELETE can't wipe everything.
+// Contents that fail to delete are logged and left behind as untracked
+// files, which POST /admin/reconcile can list again.
+func deleteAllHandler(c *fiber.Ctx) error {
+	if !isAdmin(c) {
+		return jsonError(c, fiber.StatusForbidden, errCodeForbidden, "Only admins can delete all files")
+	}
+	if !c.QueryBool("confirm") {
+		return jsonError(c, fiber.StatusBadRequest, errCodeConfirmationRequired, "This deletes every file; repeat the request with ?confirm=true to proceed")
+	}
+
+	// The metadata is cleared first and storage emptied after the lock is
+	// released, as in deleteHandler.
+	webfiles.mu.Lock()
+	removed := webfiles.Files
+	files := len(removed)
+	bytes := storedBytesUnlocked()
+	webfiles.Files = []FileMeta{}
+	err := saveMetadataUnlocked()
+	webfiles.mu.Unlock()
+	if err != nil {
+		return jsonError(c, fiber.StatusInternalServerError, errCodeInternal, "Failed to update metadata")
+	}
+
+	failed := 0
+	deleted := make(map[string]bool, files)
+	for _, f := range removed {
+		for _, key := range []string{f.Key, f.ThumbnailPath} {
+			if key == "" || deleted[key] {
+				continue
+			}
+			deleted[key] = true
+			if !validKey(key) {
+				slog.WarnContext(c.UserContext(), "Refusing to delete key outside the storage root", "component", "security", "filename", f.Filename, "key", key)
+				failed++
+				continue
+			}
+			if err := fileStorage.Delete(key); err != nil {
+				slog.WarnContext(c.UserContext(), "Could not delete file from storage", "filename", f.Filename, "key", key, "error", err)
+				failed++
+			}
+		}
+	}
+
+	deletesTotal.Add(float64(files))
+	slog.WarnContext(c.UserContext(), "Deleted all files", "files", files, "bytes", bytes, "failed", failed, "user", currentUser(c), "ip", c.IP())
+	recordAudit(c, AuditRecord{Action: auditDeleteAll, Size: bytes, Detail: fmt.Sprintf("%d files", files)})
+	for _, f := range removed {
+		events.broadcast(FileEvent{Type: eventDeleted, Filename: f.Filename, Folder: f.Folder}, f)
+	}
+	return c.JSON(fiber.Map{"deleted": files, "bytes": bytes, "failed": failed})
+}
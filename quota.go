@@ -0,0 +1,71 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+)
+
+var byteSizeUnits = []struct {
+	suffix string
+	factor int64
+}{
+	{"TB", 1 << 40},
+	{"GB", 1 << 30},
+	{"MB", 1 << 20},
+	{"KB", 1 << 10},
+	{"B", 1},
+}
+
+// parseByteSize parses sizes like "1048576", "500MB" or "2 GB". Units are
+// binary (1KB = 1024 bytes) and case-insensitive.
+func parseByteSize(raw string) (int64, error) {
+	s := strings.ToUpper(strings.TrimSpace(raw))
+	factor := int64(1)
+	for _, unit := range byteSizeUnits {
+		if strings.HasSuffix(s, unit.suffix) {
+			s = strings.TrimSpace(strings.TrimSuffix(s, unit.suffix))
+			factor = unit.factor
+			break
+		}
+	}
+	n, err := strconv.ParseInt(s, 10, 64)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("invalid size %q", raw)
+	}
+	if n > math.MaxInt64/factor {
+		return 0, fmt.Errorf("size %q is too large", raw)
+	}
+	return n * factor, nil
+}
+
+// storedBytesUnlocked returns the disk space used by tracked files. Entries
+// linked to the same content by dedup share one file and are counted once.
+// The caller must hold webfiles.mu.
+func storedBytesUnlocked() int64 {
+	seen := make(map[string]bool, len(webfiles.Files))
+	var total int64
+	for _, f := range webfiles.Files {
+		if seen[f.Key] {
+			continue
+		}
+		seen[f.Key] = true
+		total += f.Size
+	}
+	return total
+}
+
+// quotaError describes why a file of size bytes doesn't fit in the remaining
+// quota, or returns "" when it does. The caller must hold webfiles.mu.
+func quotaErrorUnlocked(size int64) string {
+	limit := settings().maxTotalSize
+	if limit <= 0 {
+		return ""
+	}
+	available := max(limit-storedBytesUnlocked(), 0)
+	if size <= available {
+		return ""
+	}
+	return fmt.Sprintf("Not enough storage space: %s available of %s, file is %s", formatSize(available), formatSize(limit), formatSize(size))
+}
@@ -0,0 +1,30 @@
+package main
+
+import (
+	"math"
+	"testing"
+)
+
+func TestParseByteSize(t *testing.T) {
+	tests := []struct {
+		raw     string
+		want    int64
+		wantErr bool
+	}{
+		{"1024", 1024, false},
+		{"10MB", 10 << 20, false},
+		{" 2 gb ", 2 << 30, false},
+		{"9223372036854775807", math.MaxInt64, false},
+		{"8388607TB", 8388607 << 40, false},
+		{"8388608TB", 0, true},
+		{"9223372036854775807KB", 0, true},
+		{"-1", 0, true},
+		{"lots", 0, true},
+	}
+	for _, tt := range tests {
+		got, err := parseByteSize(tt.raw)
+		if (err != nil) != tt.wantErr || got != tt.want {
+			t.Errorf("parseByteSize(%q) = %d, %v; want %d, error %v", tt.raw, got, err, tt.want, tt.wantErr)
+		}
+	}
+}
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"log/slog"
+	"strings"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/gofiber/fiber/v2/middleware/limiter"
+)
+
+const (
+	defaultLoginRateLimit    = 5
+	defaultUploadRateLimit   = 60
+	defaultDownloadRateLimit = 600
+	defaultRateLimitWindow   = time.Minute
+)
+
+// rateLimiter builds the limiter for one group of routes from
+// <NAME>_RATE_LIMIT, the requests allowed per <NAME>_RATE_LIMIT_WINDOW for
+// each client, where 0 turns it off. Clients over the limit get 429 with
+// Retry-After set to the seconds until the window resets.
+func rateLimiter(name string, defMax int, store *lruStorage, key func(*fiber.Ctx) string) fiber.Handler {
+	routes := strings.ToLower(name)
+	maxRequests := envInt(name+"_RATE_LIMIT", defMax)
+	window := envDuration(name+"_RATE_LIMIT_WINDOW", defaultRateLimitWindow)
+	if maxRequests <= 0 {
+		slog.Info("Rate limiting disabled", "routes", routes)
+		return func(c *fiber.Ctx) error { return c.Next() }
+	}
+	if window <= 0 {
+		fatal(name + "_RATE_LIMIT_WINDOW must be a positive duration")
+	}
+
+	storage := limiterStorage("webfiles:limiter:"+routes+":", store)
+	return guardRedisLimiter(storage, limiter.New(limiter.Config{
+		Max:          maxRequests,
+		Expiration:   window,
+		Storage:      storage,
+		KeyGenerator: key,
+		LimitReached: func(c *fiber.Ctx) error {
+			slog.WarnContext(c.UserContext(), "Rate limit reached", "component", "security", "routes", routes, "ip", c.IP(), "user", currentUser(c))
+			return jsonError(c, fiber.StatusTooManyRequests, errCodeRateLimited, "Too many requests, try again later")
+		},
+	}))
+}
+
+// clientKey identifies a client for the upload and download limits: the
+// user in multi-user mode, so people behind one NAT don't share a budget,
+// otherwise the IP.
+func clientKey(c *fiber.Ctx) string {
+	if username := currentUser(c); username != "" {
+		return "user:" + username
+	}
+	return "ip:" + c.IP()
+}
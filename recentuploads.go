@@ -0,0 +1,97 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"sync"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+const defaultDuplicateUploadWindow = 5 * time.Second
+
+// recentUpload tracks one upload for duplicate suppression. done is closed
+// once the upload finished; result and ok are only valid after that. shared
+// entries are kept in Redis rather than in recentUploads.
+type recentUpload struct {
+	done     chan struct{}
+	result   UploadResult
+	ok       bool
+	finished time.Time
+	shared   bool
+}
+
+var recentUploads = struct {
+	mu      sync.Mutex
+	entries map[string]*recentUpload
+}{entries: make(map[string]*recentUpload)}
+
+// recentUploadClient identifies the sender of an upload for duplicate
+// suppression: the user in multi-user mode, so users sharing an address
+// never get each other's results, and the client IP otherwise.
+func recentUploadClient(c *fiber.Ctx) string {
+	if multiUser() {
+		return "user:" + currentUser(c)
+	}
+	return c.IP()
+}
+
+func recentUploadKey(client, filename string, size int64) string {
+	return fmt.Sprintf("%s|%s|%d", client, filename, size)
+}
+
+// beginRecentUpload registers an upload under key. If an identical upload is
+// in progress or finished within the window, that entry is returned with
+// dup set and the caller should wait on it instead of storing the file.
+func beginRecentUpload(key string) (entry *recentUpload, dup bool) {
+	if idempotencyUseRedis {
+		entry, dup, err := beginRedisRecentUpload(key)
+		if err == nil {
+			return entry, dup
+		}
+		slog.Warn("Could not check Redis for duplicate uploads; checking this instance only", "component", "redis", "error", err)
+	}
+
+	recentUploads.mu.Lock()
+	defer recentUploads.mu.Unlock()
+
+	now := time.Now()
+	window := settings().duplicateUploadWindow
+	for k, e := range recentUploads.entries {
+		if !e.finished.IsZero() && now.Sub(e.finished) > window {
+			delete(recentUploads.entries, k)
+		}
+	}
+
+	if e, ok := recentUploads.entries[key]; ok {
+		return e, true
+	}
+	e := &recentUpload{done: make(chan struct{})}
+	recentUploads.entries[key] = e
+	return e, false
+}
+
+// finishRecentUpload records the outcome of an upload started with
+// beginRecentUpload and wakes any duplicates waiting on it. Failed uploads
+// are forgotten so a retry is processed normally.
+func finishRecentUpload(key string, e *recentUpload, result UploadResult, ok bool) {
+	if e.shared {
+		if err := finishRedisRecentUpload(key, result, ok); err != nil {
+			slog.Warn("Could not record upload in Redis for duplicate suppression", "component", "redis", "error", err)
+		}
+		e.result, e.ok = result, ok
+		close(e.done)
+		return
+	}
+
+	recentUploads.mu.Lock()
+	e.result = result
+	e.ok = ok
+	e.finished = time.Now()
+	if !ok {
+		delete(recentUploads.entries, key)
+	}
+	recentUploads.mu.Unlock()
+	close(e.done)
+}
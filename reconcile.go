@@ -0,0 +1,233 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io"
+	"io/fs"
+	"log/slog"
+	"mime"
+	"net/http"
+	"path"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// reconcileGracePeriod leaves alone files written this recently, since they
+// may belong to an upload whose metadata hasn't been recorded yet.
+const reconcileGracePeriod = time.Minute
+
+// datePartition matches the YYYY/MM/DD directories PARTITION_BY_DATE adds
+// below a folder.
+var datePartition = regexp.MustCompile(`(^|/)\d{4}/\d{2}/\d{2}$`)
+
+type ReconcileEntry struct {
+	Filename string `json:"filename"`
+	Folder   string `json:"folder,omitempty"`
+	Key      string `json:"key"`
+	Size     int64  `json:"size"`
+	Reason   string `json:"reason,omitempty"`
+}
+
+type ReconcileResult struct {
+	Added   []ReconcileEntry `json:"added"`
+	Removed []ReconcileEntry `json:"removed"`
+	Skipped []ReconcileEntry `json:"skipped"`
+}
+
+// internalKey reports whether key belongs to the server rather than to an
+// upload: thumbnails, resumable uploads in progress and temporary files all
+// live under names starting with a dot.
+func internalKey(key string) bool {
+	for _, segment := range strings.Split(key, "/") {
+		if strings.HasPrefix(segment, ".") {
+			return true
+		}
+	}
+	return false
+}
+
+// placeForKey works out the folder and filename an untracked key would be
+// listed under, reporting false when it isn't a name an upload could have.
+func placeForKey(key string) (folder, filename string, ok bool) {
+	dir, filename := path.Split(key)
+	dir = datePartition.ReplaceAllString(strings.TrimSuffix(dir, "/"), "")
+	folder, err := sanitizeFolder(dir)
+	if err != nil || folder != dir {
+		return "", "", false
+	}
+	if name, err := checkWindowsName(filename); err != nil || name != filename {
+		return "", "", false
+	}
+	return folder, filename, true
+}
+
+// inspectStored hashes the content at key and sniffs its content type.
+func inspectStored(key string) (checksum, contentType string, info fs.FileInfo, err error) {
+	f, err := fileStorage.Open(key)
+	if err != nil {
+		return "", "", nil, err
+	}
+	defer f.Close()
+	if info, err = f.Stat(); err != nil {
+		return "", "", nil, err
+	}
+
+	head := make([]byte, 512)
+	n, err := io.ReadFull(f, head)
+	if err != nil && !errors.Is(err, io.ErrUnexpectedEOF) && !errors.Is(err, io.EOF) {
+		return "", "", nil, err
+	}
+	head = head[:n]
+	contentType = http.DetectContentType(head)
+	if contentType == defaultContentType {
+		if byExt := mime.TypeByExtension(path.Ext(key)); byExt != "" {
+			contentType = byExt
+		}
+	}
+
+	h := sha256.New()
+	h.Write(head)
+	if _, err := io.Copy(h, f); err != nil {
+		return "", "", nil, err
+	}
+	return hex.EncodeToString(h.Sum(nil)), contentType, info, nil
+}
+
+// reconcileHandler brings the metadata back in line with storage after files
+// were added or removed behind the server's back. Entries whose content is
+// gone are dropped, and stored files nothing refers to are listed again,
+// owned by nobody so that only admins see them until they are moved.
+func reconcileHandler(c *fiber.Ctx) error {
+	if !isAdmin(c) {
+		return jsonError(c, fiber.StatusForbidden, errCodeForbidden, "Only admins can reconcile metadata")
+	}
+
+	keys, err := fileStorage.List()
+	if err != nil {
+		slog.ErrorContext(c.UserContext(), "Could not list storage", "error", err)
+		return jsonError(c, fiber.StatusInternalServerError, errCodeInternal, "Could not list storage")
+	}
+	stored := make(map[string]bool, len(keys))
+	for _, key := range keys {
+		stored[key] = true
+	}
+
+	webfiles.mu.Lock()
+	tracked := make(map[string]bool, len(webfiles.Files))
+	for _, f := range webfiles.Files {
+		tracked[f.Key] = true
+	}
+	webfiles.mu.Unlock()
+
+	result := ReconcileResult{Added: []ReconcileEntry{}, Removed: []ReconcileEntry{}, Skipped: []ReconcileEntry{}}
+
+	// Hashing can take a while, so untracked files are read without holding
+	// the lock and checked again before they are added.
+	var found []FileMeta
+	for _, key := range keys {
+		if tracked[key] || internalKey(key) {
+			continue
+		}
+		folder, filename, ok := placeForKey(key)
+		if !ok {
+			result.Skipped = append(result.Skipped, ReconcileEntry{Filename: path.Base(key), Key: key, Reason: "unsupported name"})
+			continue
+		}
+		checksum, contentType, info, err := inspectStored(key)
+		if err != nil {
+			slog.WarnContext(c.UserContext(), "Could not read untracked file", "key", key, "error", err)
+			result.Skipped = append(result.Skipped, ReconcileEntry{Filename: filename, Folder: folder, Key: key, Reason: "unreadable"})
+			continue
+		}
+		if time.Since(info.ModTime()) < reconcileGracePeriod {
+			result.Skipped = append(result.Skipped, ReconcileEntry{Filename: filename, Folder: folder, Key: key, Size: info.Size(), Reason: "modified recently"})
+			continue
+		}
+		found = append(found, FileMeta{
+			Filename:     filename,
+			OriginalName: filename,
+			Folder:       folder,
+			Size:         info.Size(),
+			ContentType:  contentType,
+			Checksum:     checksum,
+			UploadedAt:   info.ModTime().UTC(),
+			Key:          key,
+		})
+	}
+
+	// Thumbnails left without an entry are deleted from storage once the
+	// lock below has been released.
+	orphaned := make(map[string]FileMeta)
+	defer func() {
+		for key, f := range orphaned {
+			removeThumbnail(f, key)
+		}
+	}()
+	webfiles.mu.Lock()
+	defer webfiles.mu.Unlock()
+
+	// The listing may be stale by now: a file moved since then is missing
+	// from it, so each candidate is checked again before its entry goes.
+	missing := make(map[string]bool)
+	kept := webfiles.Files[:0]
+	var gone []FileMeta
+	for _, f := range webfiles.Files {
+		if !stored[f.Key] && !missing[f.Key] {
+			if _, err := fileStorage.Stat(f.Key); !errors.Is(err, fs.ErrNotExist) && !errors.Is(err, errInvalidKey) {
+				stored[f.Key] = true
+			} else {
+				missing[f.Key] = true
+			}
+		}
+		if missing[f.Key] {
+			gone = append(gone, f)
+			continue
+		}
+		kept = append(kept, f)
+	}
+	webfiles.Files = kept
+	for _, f := range gone {
+		if thumbnail := orphanedThumbnailUnlocked(f); thumbnail != "" {
+			orphaned[thumbnail] = f
+		}
+		result.Removed = append(result.Removed, ReconcileEntry{Filename: f.Filename, Folder: f.Folder, Key: f.Key, Size: f.Size})
+	}
+
+	var added []FileMeta
+	for _, meta := range found {
+		entry := ReconcileEntry{Filename: meta.Filename, Folder: meta.Folder, Key: meta.Key, Size: meta.Size}
+		if keySharedUnlocked(meta.Key, -1) {
+			continue
+		}
+		if findFileUnlocked(meta.Folder, meta.Filename) != -1 {
+			entry.Reason = "name already in use"
+			result.Skipped = append(result.Skipped, entry)
+			continue
+		}
+		webfiles.Files = append(webfiles.Files, meta)
+		added = append(added, meta)
+		result.Added = append(result.Added, entry)
+	}
+
+	if len(gone) > 0 || len(added) > 0 {
+		if err := saveMetadataUnlocked(); err != nil {
+			return jsonError(c, fiber.StatusInternalServerError, errCodeInternal, "Failed to update metadata")
+		}
+	}
+	for _, f := range gone {
+		events.broadcast(FileEvent{Type: eventDeleted, Filename: f.Filename, Folder: f.Folder}, f)
+	}
+	for _, meta := range added {
+		events.broadcast(FileEvent{Type: eventUploaded, File: &meta}, meta)
+		schedulePHash(meta.Filename, meta.Key)
+		scheduleThumbnail(meta)
+	}
+
+	slog.InfoContext(c.UserContext(), "Reconciled metadata with storage", "added", len(result.Added), "removed", len(result.Removed), "skipped", len(result.Skipped), "user", currentUser(c))
+	return c.JSON(result)
+}
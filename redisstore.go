@@ -0,0 +1,283 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/redis/go-redis/v9"
+)
+
+const (
+	redisTimeout = 2 * time.Second
+
+	redisSessionVersionPrefix = "webfiles:session-version:"
+	redisUploadTokenPrefix    = "webfiles:upload-token:"
+	redisRecentUploadPrefix   = "webfiles:recent-upload:"
+
+	// redisPendingUploadTTL bounds how long an upload in progress holds its
+	// duplicate-suppression key, in case the instance storing it dies.
+	redisPendingUploadTTL = 10 * time.Minute
+	redisPollInterval     = 200 * time.Millisecond
+)
+
+// redisClient is set when REDIS_URL is configured. Subsystems opt in to it
+// individually so one instance can share limiter state while keeping other
+// state local.
+var redisClient *redis.Client
+
+// limiterUseRedis stores rate-limit counters in Redis instead of memory.
+var limiterUseRedis bool
+
+// limiterRedisFailOpen lets requests through unthrottled while Redis is down
+// instead of refusing them.
+var limiterRedisFailOpen = true
+
+// revocationUseRedis keeps session versions and spent upload tokens in
+// Redis instead of authStateFile, from REVOCATION_STORE=redis, so signing out
+// everywhere or using an upload link on one instance counts on all of them.
+var revocationUseRedis bool
+
+// revocationRedisFailOpen accepts sessions without checking whether they
+// were revoked, and upload links on this instance's record alone, while
+// Redis is down, instead of refusing them with 503.
+var revocationRedisFailOpen bool
+
+// idempotencyUseRedis shares duplicate upload suppression between instances,
+// from IDEMPOTENCY_STORE=redis. It always fails open: while Redis is down
+// each instance only suppresses the duplicates it receives itself.
+var idempotencyUseRedis bool
+
+// redisStorage is a fiber.Storage backed by Redis, used so several instances
+// behind a load balancer share the same rate-limit counters.
+//
+// When Redis is unreachable, failOpen decides the behaviour: fail-open lets
+// requests through without enforcing limits, fail-closed refuses them with
+// 503 (see guardRedisLimiter). Fiber's limiter ignores storage errors, so the
+// fail-closed check has to happen before it runs.
+type redisStorage struct {
+	client   *redis.Client
+	prefix   string
+	failOpen bool
+}
+
+func newRedisStorage(client *redis.Client, prefix string, failOpen bool) *redisStorage {
+	return &redisStorage{client: client, prefix: prefix, failOpen: failOpen}
+}
+
+func (s *redisStorage) Get(key string) ([]byte, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), redisTimeout)
+	defer cancel()
+
+	val, err := s.client.Get(ctx, s.prefix+key).Bytes()
+	if errors.Is(err, redis.Nil) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, s.handleError("get", err)
+	}
+	return val, nil
+}
+
+func (s *redisStorage) Set(key string, val []byte, exp time.Duration) error {
+	if key == "" || len(val) == 0 {
+		return nil
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), redisTimeout)
+	defer cancel()
+
+	if err := s.client.Set(ctx, s.prefix+key, val, exp).Err(); err != nil {
+		return s.handleError("set", err)
+	}
+	return nil
+}
+
+func (s *redisStorage) Delete(key string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), redisTimeout)
+	defer cancel()
+
+	if err := s.client.Del(ctx, s.prefix+key).Err(); err != nil {
+		return s.handleError("delete", err)
+	}
+	return nil
+}
+
+// Reset removes every key under this storage's prefix.
+func (s *redisStorage) Reset() error {
+	ctx, cancel := context.WithTimeout(context.Background(), redisTimeout)
+	defer cancel()
+
+	iter := s.client.Scan(ctx, 0, s.prefix+"*", 100).Iterator()
+	for iter.Next(ctx) {
+		if err := s.client.Del(ctx, iter.Val()).Err(); err != nil {
+			return s.handleError("reset", err)
+		}
+	}
+	if err := iter.Err(); err != nil {
+		return s.handleError("reset", err)
+	}
+	return nil
+}
+
+func (s *redisStorage) Close() error {
+	return nil
+}
+
+func (s *redisStorage) handleError(op string, err error) error {
+	slog.Error("Redis operation failed", "component", "redis", "op", op, "prefix", s.prefix, "error", err)
+	return err
+}
+
+func (s *redisStorage) ping() error {
+	ctx, cancel := context.WithTimeout(context.Background(), redisTimeout)
+	defer cancel()
+	return s.client.Ping(ctx).Err()
+}
+
+// guardRedisLimiter wraps a limiter so that, when its store is a fail-closed
+// Redis store, requests are refused with 503 while Redis is unreachable.
+func guardRedisLimiter(store fiber.Storage, limiter fiber.Handler) fiber.Handler {
+	rs, ok := store.(*redisStorage)
+	if !ok || rs.failOpen {
+		return limiter
+	}
+	return func(c *fiber.Ctx) error {
+		if err := rs.ping(); err != nil {
+			slog.ErrorContext(c.UserContext(), "Limiter store unavailable, refusing request", "component", "redis", "prefix", rs.prefix, "error", err)
+			return jsonError(c, fiber.StatusServiceUnavailable, errCodeServiceUnavailable, "Rate limiter unavailable, try again later")
+		}
+		return limiter(c)
+	}
+}
+
+// connectRedis parses REDIS_URL and checks the server is reachable. An
+// unreachable server at startup is only a warning: each subsystem's fail
+// mode decides what happens while it stays down.
+func connectRedis(rawURL string) *redis.Client {
+	opts, err := redis.ParseURL(rawURL)
+	if err != nil {
+		fatal("REDIS_URL is invalid", "error", err)
+	}
+	client := redis.NewClient(opts)
+
+	ctx, cancel := context.WithTimeout(context.Background(), redisTimeout)
+	defer cancel()
+	if err := client.Ping(ctx).Err(); err != nil {
+		slog.Warn("Redis is not reachable yet", "component", "redis", "addr", opts.Addr, "error", err)
+	} else {
+		slog.Info("Connected to Redis", "component", "redis", "addr", opts.Addr)
+	}
+	return client
+}
+
+// limiterStorage picks the backing store for a rate limiter. Redis is used
+// when REDIS_URL is set and LIMITER_STORE=redis; otherwise limits are kept in
+// the bounded in-memory store local to this instance.
+func limiterStorage(prefix string, memory *lruStorage) fiber.Storage {
+	if redisClient != nil && limiterUseRedis {
+		return newRedisStorage(redisClient, prefix, limiterRedisFailOpen)
+	}
+	return memory
+}
+
+// redisSessionVersion reads the session version of username from Redis. A
+// user who never had their sessions revoked has none, which counts as 0.
+func redisSessionVersion(username string) (int, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), redisTimeout)
+	defer cancel()
+	ver, err := redisClient.Get(ctx, redisSessionVersionPrefix+username).Int()
+	if errors.Is(err, redis.Nil) {
+		return 0, nil
+	}
+	return ver, err
+}
+
+// bumpRedisSessionVersion revokes every session of username.
+func bumpRedisSessionVersion(username string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), redisTimeout)
+	defer cancel()
+	return redisClient.Incr(ctx, redisSessionVersionPrefix+username).Err()
+}
+
+// reserveRedisUploadToken claims the upload token with ID id for one
+// upload, reporting false when another upload holds or has used it. The key
+// lives until the token expires.
+func reserveRedisUploadToken(id string, expiresAt time.Time) (bool, error) {
+	var ttl time.Duration
+	if !expiresAt.IsZero() {
+		ttl = max(time.Until(expiresAt), time.Second)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), redisTimeout)
+	defer cancel()
+	return redisClient.SetNX(ctx, redisUploadTokenPrefix+id, "reserved", ttl).Result()
+}
+
+// releaseRedisUploadToken marks a token reserved with reserveRedisUploadToken
+// as spent or, when the upload failed, frees it for another try.
+func releaseRedisUploadToken(id string, used bool) error {
+	ctx, cancel := context.WithTimeout(context.Background(), redisTimeout)
+	defer cancel()
+	if used {
+		return redisClient.Set(ctx, redisUploadTokenPrefix+id, "used", redis.KeepTTL).Err()
+	}
+	return redisClient.Del(ctx, redisUploadTokenPrefix+id).Err()
+}
+
+// beginRedisRecentUpload is beginRecentUpload across instances. The key
+// holds nothing while the upload is stored and its result afterwards. When
+// another upload holds the key, the returned entry is done once that upload
+// has a result there.
+func beginRedisRecentUpload(key string) (entry *recentUpload, dup bool, err error) {
+	ctx, cancel := context.WithTimeout(context.Background(), redisTimeout)
+	defer cancel()
+	claimed, err := redisClient.SetNX(ctx, redisRecentUploadPrefix+key, "", redisPendingUploadTTL).Result()
+	if err != nil {
+		return nil, false, err
+	}
+	entry = &recentUpload{done: make(chan struct{}), shared: true}
+	if !claimed {
+		go waitRedisRecentUpload(key, entry)
+	}
+	return entry, !claimed, nil
+}
+
+// waitRedisRecentUpload polls the upload holding key until it has a result
+// and then closes e.done. e.ok stays false if the upload failed and freed
+// the key, or Redis stopped answering, so the caller tries again itself.
+func waitRedisRecentUpload(key string, e *recentUpload) {
+	defer close(e.done)
+	for deadline := time.Now().Add(redisPendingUploadTTL); time.Now().Before(deadline); time.Sleep(redisPollInterval) {
+		ctx, cancel := context.WithTimeout(context.Background(), redisTimeout)
+		val, err := redisClient.Get(ctx, redisRecentUploadPrefix+key).Bytes()
+		cancel()
+		if err != nil {
+			return
+		}
+		if len(val) > 0 {
+			e.ok = json.Unmarshal(val, &e.result) == nil
+			e.result.code = fiber.StatusCreated
+			return
+		}
+	}
+}
+
+// finishRedisRecentUpload records the result of an upload started with
+// beginRedisRecentUpload for the rest of the window, or frees the key if it
+// failed.
+func finishRedisRecentUpload(key string, result UploadResult, ok bool) error {
+	ctx, cancel := context.WithTimeout(context.Background(), redisTimeout)
+	defer cancel()
+	window := settings().duplicateUploadWindow
+	if !ok || window <= 0 {
+		return redisClient.Del(ctx, redisRecentUploadPrefix+key).Err()
+	}
+	data, err := json.Marshal(result)
+	if err != nil {
+		return err
+	}
+	return redisClient.Set(ctx, redisRecentUploadPrefix+key, data, window).Err()
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// withUnreachableRedis points redisClient at a port nothing listens on.
+func withUnreachableRedis(t *testing.T) {
+	t.Helper()
+	client := redis.NewClient(&redis.Options{Addr: "127.0.0.1:1", MaxRetries: -1})
+	saved := redisClient
+	redisClient = client
+	t.Cleanup(func() {
+		redisClient = saved
+		client.Close()
+	})
+}
+
+func TestRevocationRedisOutage(t *testing.T) {
+	withUnreachableRedis(t)
+	savedUse, savedFailOpen := revocationUseRedis, revocationRedisFailOpen
+	t.Cleanup(func() { revocationUseRedis, revocationRedisFailOpen = savedUse, savedFailOpen })
+	revocationUseRedis = true
+	expiresAt := time.Now().Add(time.Hour)
+
+	revocationRedisFailOpen = false
+	if _, err := sessionVersion("alice"); err == nil {
+		t.Error("sessionVersion succeeded with Redis down")
+	}
+	if ok, err := reserveUploadToken("closed", expiresAt); ok || err == nil {
+		t.Errorf("fail-closed reserveUploadToken = %v, %v; want false and an error", ok, err)
+	}
+
+	revocationRedisFailOpen = true
+	if ok, err := reserveUploadToken("open", expiresAt); !ok || err != nil {
+		t.Fatalf("fail-open reserveUploadToken = %v, %v; want true", ok, err)
+	}
+	t.Cleanup(func() { delete(uploadTokenUse.reserved, "open") })
+	if ok, _ := reserveUploadToken("open", expiresAt); ok {
+		t.Error("a token reserved on this instance was reserved again")
+	}
+}
+
+func TestIdempotencyRedisOutageFallsBack(t *testing.T) {
+	withUnreachableRedis(t)
+	saved := idempotencyUseRedis
+	t.Cleanup(func() { idempotencyUseRedis = saved })
+	idempotencyUseRedis = true
+	withSettings(t, func(cfg *reloadableConfig) { cfg.duplicateUploadWindow = time.Minute })
+
+	key := recentUploadKey("127.0.0.1", "a.txt", 1)
+	entry, dup := beginRecentUpload(key)
+	if dup || entry.shared {
+		t.Fatalf("first upload: dup %v, shared %v; want a local claim", dup, entry.shared)
+	}
+	result := UploadResult{Filename: "a.txt", Size: 1, Status: uploadStatusUploaded}
+	finishRecentUpload(key, entry, result, true)
+	t.Cleanup(func() { delete(recentUploads.entries, key) })
+
+	again, dup := beginRecentUpload(key)
+	if !dup || !again.ok || again.result.Filename != "a.txt" {
+		t.Errorf("repeat upload: dup %v, entry %+v; want the first upload's result", dup, again)
+	}
+}
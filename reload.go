@@ -0,0 +1,402 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"log/slog"
+	"os"
+	"runtime"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/joho/godotenv"
+)
+
+// configMu serialises reloads so two POST /admin/reload calls can't
+// interleave. A reload parses and validates every setting before applying
+// any, so a bad .env leaves the running configuration untouched. Handlers
+// don't take it: they read the settings through settings, which a reload
+// replaces atomically.
+var configMu sync.Mutex
+
+// processEnv records which variables were set in the real environment before
+// .env was read. godotenv never overrides those, and neither does a reload.
+var processEnv map[string]bool
+
+// dotenvKeys are the variables taken from .env by the last load, so a reload
+// can unset the ones that have since been removed from the file.
+var dotenvKeys map[string]string
+
+// restartOnlyKeys are read once at startup, into the storage, the listener,
+// the Redis connection and the rate limiters. The secrets are
+// deliberately excluded: swapping JWT_SECRET_KEY would log everyone out or,
+// worse, keep accepting tokens signed with a secret the operator believes is
+// retired, and credentials should change through a restart that shows up in
+// the logs rather than through an HTTP call made with one of them.
+var restartOnlyKeys = []string{
+	"PORT", "UPLOAD_DIR", "PUBLIC_DIR", "METADATA_FILE", "METADATA_BACKEND", "METADATA_DB", "METADATA_BACKUP_DIR",
+	"JWT_SECRET_KEY", "JWT_SECRET_KEY_OLD", "API_KEY", "API_KEY_USER", "LOGIN_PIN", "LOGIN_PIN_HASH", "AUTH_STATE_FILE", "USERS_FILE",
+	"REDIS_URL", "LIMITER_STORE", "LIMITER_REDIS_FAIL_OPEN", "REVOCATION_STORE", "REVOCATION_REDIS_FAIL_OPEN", "IDEMPOTENCY_STORE", "PHASH_ENABLED",
+	"BROWSE_ENABLED", "ALLOWED_ORIGINS", "EXPIRY_SWEEP_INTERVAL", "LIMITER_MAX_KEYS",
+	"LOGIN_RATE_LIMIT", "LOGIN_RATE_LIMIT_WINDOW", "UPLOAD_RATE_LIMIT", "UPLOAD_RATE_LIMIT_WINDOW",
+	"DOWNLOAD_RATE_LIMIT", "DOWNLOAD_RATE_LIMIT_WINDOW", "MAX_CONCURRENT_UPLOADS", "MAX_CONCURRENT_UPLOADS_PER_IP",
+	"STORAGE_BACKEND", "ENCRYPTION_KEY", "S3_BUCKET", "S3_PREFIX", "S3_ENDPOINT", "S3_FORCE_PATH_STYLE",
+	"CLAMAV_ADDR", "CLAMAV_TIMEOUT", "TEMP_CLEANUP_AGE", "TEMP_CLEANUP_INTERVAL",
+	"AUDIT_LOG", "AUDIT_LOG_FILE", "TRUST_PROXY", "PROXY_HEADER",
+}
+
+// loadDotenv applies .env on top of the process environment. On a reload it
+// also unsets variables that were removed from the file. A missing file is
+// reported as fs.ErrNotExist; the environment is still updated.
+func loadDotenv() error {
+	if processEnv == nil {
+		processEnv = make(map[string]bool)
+		for _, kv := range os.Environ() {
+			key, _, _ := strings.Cut(kv, "=")
+			processEnv[key] = true
+		}
+	}
+	values, err := godotenv.Read()
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+	for key := range dotenvKeys {
+		if _, ok := values[key]; !ok && !processEnv[key] {
+			os.Unsetenv(key)
+		}
+	}
+	for key, value := range values {
+		if !processEnv[key] {
+			os.Setenv(key, value)
+		}
+	}
+	dotenvKeys = values
+	return err
+}
+
+// reloadableConfig holds the settings that can change without a restart. A
+// reload builds a new one and swaps it in whole; one is never modified once
+// it is running.
+type reloadableConfig struct {
+	logLevel slog.Level
+
+	// cookieSecure decides the Secure flag of the session and CSRF cookies.
+	// The default sets it always, so the session can't leak over plain HTTP.
+	cookieSecure string
+	// sessionTTL is how long a newly issued session stays valid.
+	sessionTTL time.Duration
+	// sessionRefreshWindow renews a valid session on any request made within
+	// this long of its expiry, so active users aren't logged out mid-use.
+	// Zero disables sliding expiration; POST /refresh still works.
+	sessionRefreshWindow time.Duration
+
+	// requireExtension rejects uploads whose sanitized filename has no
+	// extension.
+	requireExtension bool
+	// rejectEmptyUploads rejects zero-byte uploads, which are usually a
+	// failed client-side read rather than an intentional empty file.
+	rejectEmptyUploads bool
+	// maxFileSize and maxTotalSize limit a single upload and the space used
+	// by all stored files, in bytes. Zero means unlimited.
+	maxFileSize  int64
+	maxTotalSize int64
+	// allowedExtensions, when non-empty, is the only set of extensions
+	// accepted. blockedExtensions is always refused. Both hold lowercase
+	// extensions without the leading dot; "" means no extension.
+	allowedExtensions map[string]bool
+	blockedExtensions map[string]bool
+	// duplicateUploadWindow is how long an identical upload (same client,
+	// filename and size) is answered with the first upload's result instead
+	// of being stored again. Zero disables the check.
+	duplicateUploadWindow time.Duration
+	// partitionByDate stores uploads under YYYY/MM/DD keys instead of
+	// directly in their folder. The listing stays flat; only FileMeta.Key
+	// changes.
+	partitionByDate bool
+	// honorIfUnmodifiedSince makes deleteHandler refuse (412) to delete a
+	// file whose on-disk modification time is newer than the
+	// If-Unmodified-Since header.
+	honorIfUnmodifiedSince bool
+	// mimeExtensionPolicy decides what happens when an upload's extension
+	// disagrees with its sniffed content type: "warn" logs and sets a
+	// response header, "fix" stores the file under the canonical extension,
+	// "reject" refuses the upload with 415, "off" skips the check.
+	mimeExtensionPolicy string
+	// dedupMode decides what happens when an upload's content is already
+	// stored: "link" records a new entry that shares the existing file on
+	// disk, "reject" answers 409 with the existing filename, "off" stores a
+	// copy.
+	dedupMode string
+
+	// windowsSafeNames enables the Windows filename checks. It defaults to
+	// true when the server runs on Windows and can be forced on elsewhere so
+	// the store stays portable.
+	windowsSafeNames bool
+	// reservedNamePolicy decides what happens to a name Windows can't
+	// create: "reject" answers 400, "rename" appends a safe suffix.
+	reservedNamePolicy string
+	// maxFilenameLength is the longest filename accepted, in bytes of UTF-8;
+	// 0 removes the limit.
+	maxFilenameLength int
+	// phashMaxDistance is the default Hamming distance under which two
+	// images are reported as similar.
+	phashMaxDistance int
+	// shutdownTimeout is how long in-flight requests, such as uploads still
+	// being received, get to finish after SIGINT or SIGTERM.
+	shutdownTimeout time.Duration
+	// resumableUploadTTL is how long an unfinished resumable upload is kept
+	// after its last chunk before it is discarded.
+	resumableUploadTTL time.Duration
+	// shareMaxTTL caps how long a share link can stay valid.
+	shareMaxTTL time.Duration
+	// compressionLevel trades CPU for bandwidth when compressing responses.
+	compressionLevel string
+	// nameCollisionPolicy decides what happens to an upload whose name is
+	// already taken in its folder: "timestamp", "uuid" and "counter" pick
+	// the suffix added to make it unique, "reject" answers 409.
+	nameCollisionPolicy string
+
+	// metadataBackups is how many metadata backups are kept.
+	// metadataBackupInterval is the least time between two backups; 0 backs
+	// up before every save. Neither applies to the SQLite backend.
+	metadataBackups        int
+	metadataBackupInterval time.Duration
+	// metadataFlushInterval coalesces metadata writes: a change marks the
+	// store dirty and the whole of it is written at most once per interval,
+	// instead of once per change. A crash loses the changes of the last
+	// interval at most, 500ms by default. 0 writes every change right away.
+	metadataFlushInterval time.Duration
+	// downloadChunkSize is how much of a download is read and flushed to the
+	// client at a time.
+	downloadChunkSize int64
+	// urlUploadTimeout bounds a whole fetch by POST /upload-url, from
+	// connecting to the last byte.
+	urlUploadTimeout time.Duration
+
+	// loginLockoutThreshold is how many failed logins, from any IP, within
+	// loginLockoutWindow close the login endpoint for loginLockoutDuration.
+	// A threshold of 0 turns the lockout off.
+	loginLockoutThreshold int
+	loginLockoutWindow    time.Duration
+	loginLockoutDuration  time.Duration
+}
+
+// runningConfig is the configuration in effect. Handlers that read several
+// settings should load it once, through settings, so a reload halfway
+// through a request can't mix old and new values.
+var runningConfig atomic.Pointer[reloadableConfig]
+
+func init() {
+	runningConfig.Store(&reloadableConfig{
+		logLevel:               slog.LevelInfo,
+		cookieSecure:           cookieSecureAlways,
+		sessionTTL:             defaultSessionTTL,
+		sessionRefreshWindow:   defaultSessionRefreshWindow,
+		duplicateUploadWindow:  defaultDuplicateUploadWindow,
+		mimeExtensionPolicy:    mimeExtensionPolicyWarn,
+		dedupMode:              dedupModeLink,
+		windowsSafeNames:       runtime.GOOS == "windows",
+		reservedNamePolicy:     reservedNamePolicyReject,
+		maxFilenameLength:      defaultMaxFilenameLength,
+		phashMaxDistance:       defaultPHashMax,
+		shutdownTimeout:        defaultShutdownTimeout,
+		resumableUploadTTL:     defaultResumableUploadTTL,
+		shareMaxTTL:            defaultShareMaxTTL,
+		compressionLevel:       compressionLevelDefault,
+		nameCollisionPolicy:    nameCollisionPolicyTimestamp,
+		metadataBackups:        defaultMetadataBackups,
+		metadataBackupInterval: defaultMetadataBackupInterval,
+		metadataFlushInterval:  defaultMetadataFlushInterval,
+		downloadChunkSize:      defaultDownloadChunkSize,
+		urlUploadTimeout:       defaultURLUploadTimeout,
+		loginLockoutWindow:     defaultLoginLockoutWindow,
+		loginLockoutDuration:   defaultLoginLockoutDuration,
+	})
+}
+
+// settings returns the running configuration. It must not be modified.
+func settings() *reloadableConfig {
+	return runningConfig.Load()
+}
+
+// loadReloadableConfig reads the reloadable settings from the environment.
+// It returns an error instead of exiting so a reload can refuse a bad value.
+func loadReloadableConfig() (reloadableConfig, error) {
+	cfg := reloadableConfig{logLevel: slog.LevelInfo}
+	var err error
+
+	if raw := os.Getenv("LOG_LEVEL"); raw != "" {
+		if err := cfg.logLevel.UnmarshalText([]byte(raw)); err != nil {
+			return cfg, fmt.Errorf("LOG_LEVEL must be debug, info, warn or error, got %q", raw)
+		}
+	}
+
+	cfg.sessionTTL = envDuration("SESSION_TTL", defaultSessionTTL)
+	if cfg.sessionTTL <= 0 {
+		return cfg, fmt.Errorf("SESSION_TTL must be a positive duration")
+	}
+	cfg.sessionRefreshWindow = envDuration("SESSION_REFRESH_WINDOW", defaultSessionRefreshWindow)
+	switch mode := strings.ToLower(os.Getenv("COOKIE_SECURE")); mode {
+	case "", cookieSecureAlways:
+		cfg.cookieSecure = cookieSecureAlways
+	case cookieSecureNever, cookieSecureAuto:
+		cfg.cookieSecure = mode
+	default:
+		return cfg, fmt.Errorf("COOKIE_SECURE must be %s, %s or %s, got %q", cookieSecureAlways, cookieSecureAuto, cookieSecureNever, mode)
+	}
+
+	cfg.loginLockoutThreshold = envInt("LOGIN_LOCKOUT_THRESHOLD", 0)
+	cfg.loginLockoutWindow = envDuration("LOGIN_LOCKOUT_WINDOW", defaultLoginLockoutWindow)
+	cfg.loginLockoutDuration = envDuration("LOGIN_LOCKOUT_DURATION", defaultLoginLockoutDuration)
+	if cfg.loginLockoutThreshold > 0 && (cfg.loginLockoutWindow <= 0 || cfg.loginLockoutDuration <= 0) {
+		return cfg, fmt.Errorf("LOGIN_LOCKOUT_WINDOW and LOGIN_LOCKOUT_DURATION must be positive durations")
+	}
+
+	cfg.requireExtension = envBool("REQUIRE_EXTENSION", false)
+	cfg.rejectEmptyUploads = envBool("REJECT_EMPTY_UPLOADS", false)
+	if cfg.maxFileSize, err = envByteSize("MAX_FILE_SIZE"); err != nil {
+		return cfg, err
+	}
+	if cfg.maxTotalSize, err = envByteSize("MAX_TOTAL_SIZE"); err != nil {
+		return cfg, err
+	}
+	cfg.allowedExtensions = parseExtensionList(os.Getenv("ALLOWED_EXTENSIONS"))
+	cfg.blockedExtensions = parseExtensionList(os.Getenv("BLOCKED_EXTENSIONS"))
+	cfg.duplicateUploadWindow = envDuration("DUPLICATE_UPLOAD_WINDOW", defaultDuplicateUploadWindow)
+	cfg.partitionByDate = envBool("PARTITION_BY_DATE", false)
+	cfg.honorIfUnmodifiedSince = envBool("HONOR_IF_UNMODIFIED_SINCE", false)
+
+	switch policy := strings.ToLower(os.Getenv("MIME_EXTENSION_POLICY")); policy {
+	case "", mimeExtensionPolicyWarn:
+		cfg.mimeExtensionPolicy = mimeExtensionPolicyWarn
+	case mimeExtensionPolicyOff, mimeExtensionPolicyFix, mimeExtensionPolicyReject:
+		cfg.mimeExtensionPolicy = policy
+	default:
+		return cfg, fmt.Errorf("MIME_EXTENSION_POLICY must be %s, %s, %s or %s, got %q", mimeExtensionPolicyOff, mimeExtensionPolicyWarn, mimeExtensionPolicyFix, mimeExtensionPolicyReject, policy)
+	}
+
+	switch mode := strings.ToLower(os.Getenv("DEDUP_MODE")); mode {
+	case "", dedupModeLink:
+		cfg.dedupMode = dedupModeLink
+	case dedupModeOff, dedupModeReject:
+		cfg.dedupMode = mode
+	default:
+		return cfg, fmt.Errorf("DEDUP_MODE must be %s, %s or %s, got %q", dedupModeLink, dedupModeReject, dedupModeOff, mode)
+	}
+
+	cfg.windowsSafeNames = envBool("WINDOWS_SAFE_NAMES", runtime.GOOS == "windows")
+	switch policy := strings.ToLower(os.Getenv("RESERVED_NAME_POLICY")); policy {
+	case "", reservedNamePolicyReject:
+		cfg.reservedNamePolicy = reservedNamePolicyReject
+	case reservedNamePolicyRename:
+		cfg.reservedNamePolicy = reservedNamePolicyRename
+	default:
+		return cfg, fmt.Errorf("RESERVED_NAME_POLICY must be %s or %s, got %q", reservedNamePolicyReject, reservedNamePolicyRename, policy)
+	}
+	cfg.maxFilenameLength = envInt("MAX_FILENAME_LENGTH", defaultMaxFilenameLength)
+	if cfg.maxFilenameLength < 0 {
+		return cfg, fmt.Errorf("MAX_FILENAME_LENGTH must be 0 or more, got %d", cfg.maxFilenameLength)
+	}
+	switch policy := strings.ToLower(os.Getenv("NAME_COLLISION_POLICY")); policy {
+	case "", nameCollisionPolicyTimestamp:
+		cfg.nameCollisionPolicy = nameCollisionPolicyTimestamp
+	case nameCollisionPolicyUUID, nameCollisionPolicyCounter, nameCollisionPolicyReject:
+		cfg.nameCollisionPolicy = policy
+	default:
+		return cfg, fmt.Errorf("NAME_COLLISION_POLICY must be %s, %s, %s or %s, got %q", nameCollisionPolicyTimestamp, nameCollisionPolicyUUID, nameCollisionPolicyCounter, nameCollisionPolicyReject, policy)
+	}
+	cfg.phashMaxDistance = envInt("PHASH_MAX_DISTANCE", defaultPHashMax)
+	cfg.metadataBackups = envInt("METADATA_BACKUPS", defaultMetadataBackups)
+	if cfg.metadataBackups < 0 {
+		return cfg, fmt.Errorf("METADATA_BACKUPS must be 0 or more, got %d", cfg.metadataBackups)
+	}
+	cfg.metadataBackupInterval = envDuration("METADATA_BACKUP_INTERVAL", defaultMetadataBackupInterval)
+	cfg.metadataFlushInterval = envDuration("METADATA_FLUSH_INTERVAL", defaultMetadataFlushInterval)
+	if cfg.metadataFlushInterval < 0 {
+		return cfg, fmt.Errorf("METADATA_FLUSH_INTERVAL must not be negative")
+	}
+	if cfg.downloadChunkSize, err = envByteSize("DOWNLOAD_CHUNK_SIZE"); err != nil {
+		return cfg, err
+	}
+	if cfg.downloadChunkSize == 0 {
+		cfg.downloadChunkSize = defaultDownloadChunkSize
+	}
+
+	cfg.shutdownTimeout = envDuration("SHUTDOWN_TIMEOUT", defaultShutdownTimeout)
+	cfg.resumableUploadTTL = envDuration("RESUMABLE_UPLOAD_TTL", defaultResumableUploadTTL)
+	cfg.urlUploadTimeout = envDuration("URL_UPLOAD_TIMEOUT", defaultURLUploadTimeout)
+	if cfg.urlUploadTimeout <= 0 {
+		return cfg, fmt.Errorf("URL_UPLOAD_TIMEOUT must be a positive duration")
+	}
+	cfg.shareMaxTTL = envDuration("SHARE_MAX_TTL", defaultShareMaxTTL)
+	if cfg.shareMaxTTL <= 0 {
+		return cfg, fmt.Errorf("SHARE_MAX_TTL must be a positive duration")
+	}
+
+	switch level := strings.ToLower(os.Getenv("COMPRESSION_LEVEL")); level {
+	case "", compressionLevelDefault:
+		cfg.compressionLevel = compressionLevelDefault
+	case compressionLevelOff, compressionLevelSpeed, compressionLevelBest:
+		cfg.compressionLevel = level
+	default:
+		return cfg, fmt.Errorf("COMPRESSION_LEVEL must be %s, %s, %s or %s, got %q", compressionLevelOff, compressionLevelSpeed, compressionLevelDefault, compressionLevelBest, level)
+	}
+	return cfg, nil
+}
+
+// apply makes cfg the running configuration.
+func (cfg reloadableConfig) apply() {
+	logLevel.Set(cfg.logLevel)
+	runningConfig.Store(&cfg)
+
+	if cfg.cookieSecure != cookieSecureAlways {
+		slog.Warn("Session cookies may be sent over plain HTTP; use only for local development or behind a TLS proxy", "component", "security", "cookieSecure", cfg.cookieSecure)
+	}
+	if len(cfg.allowedExtensions) > 0 {
+		slog.Info("Only accepting uploads with listed extensions", "extensions", describeExtensions(cfg.allowedExtensions))
+	}
+	if len(cfg.blockedExtensions) > 0 {
+		slog.Info("Blocking uploads with listed extensions", "extensions", describeExtensions(cfg.blockedExtensions))
+	}
+}
+
+// reloadHandler re-reads .env and the environment and applies the reloadable
+// settings. Settings in restartOnlyKeys that changed are listed in the
+// response but keep their current values until the next restart.
+func reloadHandler(c *fiber.Ctx) error {
+	if !isAdmin(c) {
+		return jsonError(c, fiber.StatusForbidden, errCodeForbidden, "Only admins can reload the configuration")
+	}
+
+	configMu.Lock()
+	defer configMu.Unlock()
+	before := make(map[string]string, len(restartOnlyKeys))
+	for _, key := range restartOnlyKeys {
+		before[key] = os.Getenv(key)
+	}
+	err := loadDotenv()
+	if errors.Is(err, fs.ErrNotExist) {
+		err = nil
+	}
+	var cfg reloadableConfig
+	if err == nil {
+		cfg, err = loadReloadableConfig()
+	}
+	restartRequired := []string{}
+	for _, key := range restartOnlyKeys {
+		if os.Getenv(key) != before[key] {
+			restartRequired = append(restartRequired, key)
+		}
+	}
+	if err != nil {
+		slog.WarnContext(c.UserContext(), "Configuration reload refused", "user", currentUser(c), "error", err)
+		return jsonError(c, fiber.StatusBadRequest, errCodeInvalidConfig, err.Error())
+	}
+	cfg.apply()
+	slog.InfoContext(c.UserContext(), "Configuration reloaded", "user", currentUser(c), "logLevel", cfg.logLevel.String(), "restartRequired", restartRequired)
+	return c.JSON(fiber.Map{"status": "reloaded", "restartRequired": restartRequired})
+}
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"log/slog"
+	"net/url"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+type RenameRequest struct {
+	NewName string `json:"newName"`
+}
+
+// renameHandler renames a stored file within its folder. The new name goes
+// through the same sanitizing as an upload and must not collide with a
+// tracked file or an untracked one on disk. When the content is shared with
+// another entry (dedup link), only the metadata name changes so the other
+// entry keeps working.
+func renameHandler(c *fiber.Ctx) error {
+	requestedFilename, err := url.QueryUnescape(c.Params("filename"))
+	if err != nil {
+		return jsonError(c, fiber.StatusBadRequest, errCodeInvalidFilename, "Invalid filename")
+	}
+	folder, err := folderQuery(c)
+	if err != nil {
+		return jsonError(c, fiber.StatusBadRequest, errCodeInvalidFolder, err.Error())
+	}
+
+	var req RenameRequest
+	if err := c.BodyParser(&req); err != nil {
+		return jsonError(c, fiber.StatusBadRequest, errCodeInvalidRequest, "Invalid request body")
+	}
+
+	newName := filepath.Base(strings.TrimSpace(req.NewName))
+	if newName == "." || newName == "/" {
+		slog.WarnContext(c.UserContext(), "Invalid rename target", "component", "security", "newName", req.NewName, "ip", c.IP())
+		return jsonError(c, fiber.StatusBadRequest, errCodeInvalidFilename, "Invalid filename")
+	}
+	if newName, err = normalizeFilename(newName); err != nil {
+		return jsonError(c, fiber.StatusBadRequest, errCodeInvalidFilename, err.Error())
+	}
+	if newName, err = checkWindowsName(newName); err != nil {
+		return jsonError(c, fiber.StatusBadRequest, errCodeInvalidFilename, err.Error())
+	}
+	if settings().requireExtension && strings.TrimPrefix(filepath.Ext(newName), ".") == "" {
+		return jsonError(c, fiber.StatusBadRequest, errCodeInvalidFilename, "File has no extension; please include one (e.g. .txt, .pdf)")
+	}
+
+	if err := checkExtensionPolicy(newName); err != nil {
+		slog.WarnContext(c.UserContext(), "Rejected rename by extension policy", "component", "security", "filename", requestedFilename, "newName", newName, "error", err)
+		return jsonError(c, fiber.StatusUnsupportedMediaType, errCodeExtensionNotAllowed, err.Error())
+	}
+
+	webfiles.mu.Lock()
+	fileIndex := findAccessibleFileUnlocked(c, folder, requestedFilename)
+	if fileIndex == -1 {
+		webfiles.mu.Unlock()
+		return jsonError(c, fiber.StatusNotFound, errCodeFileNotFound, "File not found in metadata")
+	}
+	meta := webfiles.Files[fileIndex]
+	if ifMatchFailed(c, meta) {
+		webfiles.mu.Unlock()
+		slog.DebugContext(c.UserContext(), "If-Match does not match the current file, refusing rename", "filename", requestedFilename, "ifMatch", c.Get(fiber.HeaderIfMatch))
+		return jsonError(c, fiber.StatusPreconditionFailed, errCodePreconditionFailed, "File has changed since the given ETag")
+	}
+	if newName == meta.Filename {
+		webfiles.mu.Unlock()
+		return c.JSON(meta)
+	}
+	if !claimNameUnlocked(folder, newName) {
+		webfiles.mu.Unlock()
+		return jsonError(c, fiber.StatusConflict, errCodeFileExists, "A file with that name already exists")
+	}
+	shared := keySharedUnlocked(meta.Key, fileIndex)
+	webfiles.mu.Unlock()
+	defer func() {
+		webfiles.mu.Lock()
+		releaseNameUnlocked(folder, newName)
+		webfiles.mu.Unlock()
+	}()
+
+	// The content is renamed without holding the lock, since on S3 that is
+	// a copy and a delete; the name is claimed so nothing else takes it.
+	oldKey, newKey := meta.Key, meta.Key
+	if shared {
+		slog.DebugContext(c.UserContext(), "Key is shared with another entry; renaming metadata only", "filename", meta.Filename, "key", meta.Key)
+	} else {
+		newKey = path.Join(path.Dir(meta.Key), newName)
+		if !validKey(meta.Key) || !validKey(newKey) {
+			slog.WarnContext(c.UserContext(), "Refusing to rename key outside the storage root", "component", "security", "key", meta.Key, "newKey", newKey)
+			return jsonError(c, fiber.StatusForbidden, errCodeForbidden, "File path is outside the upload directory")
+		}
+		if _, err := fileStorage.Stat(newKey); err == nil {
+			return jsonError(c, fiber.StatusConflict, errCodeFileExists, "A file with that name already exists")
+		}
+		if err := fileStorage.Rename(oldKey, newKey); err != nil {
+			slog.ErrorContext(c.UserContext(), "Could not rename file", "key", oldKey, "newKey", newKey, "error", err)
+			return jsonError(c, fiber.StatusInternalServerError, errCodeInternal, "Could not rename file")
+		}
+	}
+
+	webfiles.mu.Lock()
+	fileIndex = findFileUnlocked(folder, meta.Filename)
+	if fileIndex == -1 || webfiles.Files[fileIndex].Key != oldKey {
+		webfiles.mu.Unlock()
+		restoreKey(c, oldKey, newKey)
+		return jsonError(c, fiber.StatusNotFound, errCodeFileNotFound, "File was removed or replaced during the rename")
+	}
+	relinkKeyUnlocked(oldKey, newKey)
+	entry := &webfiles.Files[fileIndex]
+	oldName := entry.Filename
+	entry.Filename = newName
+	// The new name was chosen on purpose, so downloads use it as it is.
+	entry.OriginalName = newName
+	renamed := *entry
+	err = saveMetadataUnlocked()
+	webfiles.mu.Unlock()
+	if err != nil {
+		return jsonError(c, fiber.StatusInternalServerError, errCodeInternal, "Failed to update metadata")
+	}
+
+	slog.InfoContext(c.UserContext(), "Renamed file", "filename", oldName, "newName", newName, "folder", folder, "user", currentUser(c))
+	recordAudit(c, AuditRecord{Action: auditRename, Filename: oldName, Folder: folder, Size: renamed.Size, Detail: newName})
+	events.broadcast(FileEvent{Type: eventRenamed, File: &renamed, Filename: oldName, Folder: folder}, renamed)
+	return c.JSON(renamed)
+}
+
+// restoreKey moves content renamed from oldKey to newKey back, when the
+// entry it was renamed for changed while the lock was released.
+func restoreKey(c *fiber.Ctx, oldKey, newKey string) {
+	if oldKey == newKey {
+		return
+	}
+	if err := fileStorage.Rename(newKey, oldKey); err != nil {
+		slog.ErrorContext(c.UserContext(), "Could not move file back after a conflicting change", "key", newKey, "oldKey", oldKey, "error", err)
+	}
+}
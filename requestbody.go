@@ -0,0 +1,73 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"mime/multipart"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// bodyLimit caps the size of a request body. The server streams request
+// bodies, and fasthttp doesn't apply its own BodyLimit to a streamed body, so
+// limitRequestBody and readUploadForm enforce it.
+const bodyLimit = 2 * 1024 * 1024 * 1024
+
+// uploadFormMemory is how much of a multipart upload is kept in memory. File
+// parts larger than this are written to a temp file as they arrive.
+const uploadFormMemory = 256 * 1024
+
+// bodyDrainLimit is how much of a body left unread by a handler, such as an
+// upload refused before it was read, is discarded to keep the connection
+// usable. Anything larger closes the connection instead.
+const bodyDrainLimit = 64 * 1024
+
+// limitRequestBody refuses bodies declared larger than bodyLimit before any
+// of it is read. Chunked bodies have no declared size; only POST /upload,
+// which counts what it reads, accepts them. The connection is closed on
+// refusal since the unread body can't be skipped.
+//
+// A streamed body is read from the connection itself, so whatever the
+// handler leaves unread would be parsed as the next request on a keep-alive
+// connection. It is drained or the connection closed once the handler is
+// done.
+func limitRequestBody(c *fiber.Ctx) error {
+	switch length := c.Request().Header.ContentLength(); {
+	case length > bodyLimit:
+		c.Context().SetConnectionClose()
+		return jsonError(c, fiber.StatusRequestEntityTooLarge, errCodeBodyTooLarge, "Request body too large")
+	case length == -1 && (c.Method() != fiber.MethodPost || c.Path() != "/upload"):
+		c.Context().SetConnectionClose()
+		return jsonError(c, fiber.StatusLengthRequired, errCodeLengthRequired, "Content-Length is required")
+	}
+
+	err := c.Next()
+	if stream := c.Context().RequestBodyStream(); stream != nil {
+		n, drainErr := io.CopyN(io.Discard, stream, bodyDrainLimit+1)
+		if n > bodyDrainLimit || (drainErr != nil && drainErr != io.EOF) {
+			c.Context().SetConnectionClose()
+		}
+	}
+	return err
+}
+
+// requestBody returns the body of the request as a reader that pulls from the
+// connection as it is read.
+func requestBody(c *fiber.Ctx) io.Reader {
+	if stream := c.Context().RequestBodyStream(); stream != nil {
+		return stream
+	}
+	return bytes.NewReader(c.Body())
+}
+
+// readUploadForm parses a multipart upload while it is received, so a large
+// file never sits in memory: past uploadFormMemory each file goes to a temp
+// file in os.TempDir. The caller must call RemoveAll on the form.
+func readUploadForm(c *fiber.Ctx) (*multipart.Form, error) {
+	boundary := string(c.Request().Header.MultipartFormBoundary())
+	if boundary == "" {
+		return nil, errors.New("request is not multipart/form-data")
+	}
+	return multipart.NewReader(io.LimitReader(requestBody(c), bodyLimit), boundary).ReadForm(uploadFormMemory)
+}
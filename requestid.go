@@ -0,0 +1,77 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+const requestIDHeader = "X-Request-ID"
+
+// maxRequestIDLength bounds an ID taken from the client, which ends up in
+// every log line of the request.
+const maxRequestIDLength = 128
+
+type requestIDKey struct{}
+
+// validRequestID reports whether a client-supplied ID can be used as is:
+// short, and made only of characters that need no escaping anywhere it is
+// echoed.
+func validRequestID(id string) bool {
+	if id == "" || len(id) > maxRequestIDLength {
+		return false
+	}
+	for _, r := range id {
+		switch {
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r >= '0' && r <= '9':
+		case r == '-' || r == '_' || r == '.' || r == ':':
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+// assignRequestID gives every request an ID, reusing the X-Request-ID sent
+// by a proxy or client when it is usable and generating one otherwise. The
+// ID is sent back in X-Request-ID, carried in error responses and added to
+// the log lines written with the request's context.
+func assignRequestID(c *fiber.Ctx) error {
+	id := c.Get(requestIDHeader)
+	if !validRequestID(id) {
+		id = newUUID()
+	}
+	c.Set(requestIDHeader, id)
+	c.Locals(requestIDKey{}, id)
+	c.SetUserContext(context.WithValue(c.UserContext(), requestIDKey{}, id))
+	return c.Next()
+}
+
+// requestID returns the ID assigned to the request, "" before
+// assignRequestID has run.
+func requestID(c *fiber.Ctx) string {
+	id, _ := c.Locals(requestIDKey{}).(string)
+	return id
+}
+
+// requestIDHandler adds "requestId" to records logged with a request's
+// context, so every line about one request can be found by its ID.
+type requestIDHandler struct {
+	slog.Handler
+}
+
+func (h requestIDHandler) Handle(ctx context.Context, r slog.Record) error {
+	if id, ok := ctx.Value(requestIDKey{}).(string); ok {
+		r.AddAttrs(slog.String("requestId", id))
+	}
+	return h.Handler.Handle(ctx, r)
+}
+
+func (h requestIDHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return requestIDHandler{h.Handler.WithAttrs(attrs)}
+}
+
+func (h requestIDHandler) WithGroup(name string) slog.Handler {
+	return requestIDHandler{h.Handler.WithGroup(name)}
+}
@@ -0,0 +1,319 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+const (
+	defaultResumableUploadTTL = 24 * time.Hour
+
+	// resumableSweepInterval is how often idle resumable uploads are looked
+	// for, besides whenever one starts.
+	resumableSweepInterval = 10 * time.Minute
+)
+
+// resumableUpload is an upload being received in chunks. received is the
+// number of bytes written to tempPath so far. expired is set once the
+// session was discarded for being idle, for handlers that looked it up
+// just before.
+type resumableUpload struct {
+	mu          sync.Mutex
+	id          string
+	filename    string
+	folder      string
+	owner       string
+	size        int64
+	contentType string
+	ttl         string
+	tags        []string
+	tempPath    string
+	received    int64
+	updated     time.Time
+	expired     bool
+}
+
+var resumableUploads = struct {
+	mu      sync.Mutex
+	entries map[string]*resumableUpload
+}{entries: make(map[string]*resumableUpload)}
+
+type ResumableInitRequest struct {
+	Filename    string   `json:"filename"`
+	Size        int64    `json:"size"`
+	Folder      string   `json:"folder"`
+	ContentType string   `json:"contentType"`
+	TTL         string   `json:"ttl"`
+	Tags        []string `json:"tags"`
+}
+
+// partialUploadDir holds the temp files of resumable uploads. It lives
+// inside uploadDir so a finished upload can be renamed into place.
+func partialUploadDir() string {
+	return filepath.Join(uploadDir, ".partial")
+}
+
+// clearPartialUploads removes temp files left by a previous run; sessions
+// are kept in memory and don't survive a restart.
+func clearPartialUploads() {
+	if err := os.RemoveAll(partialUploadDir()); err != nil {
+		slog.Warn("Could not clear partial uploads", "path", partialUploadDir(), "error", err)
+	}
+}
+
+// runResumableUploadSweeper calls expireResumableUploads every
+// resumableSweepInterval, so abandoned uploads don't keep their temp files
+// until the next one starts.
+func runResumableUploadSweeper() {
+	ticker := time.NewTicker(resumableSweepInterval)
+	defer ticker.Stop()
+	for range ticker.C {
+		expireResumableUploads()
+	}
+}
+
+// expireResumableUploads discards sessions idle for longer than
+// RESUMABLE_UPLOAD_TTL. A session whose lock is held is receiving a chunk
+// or completing, so it isn't idle and is skipped rather than waited for.
+// u.mu is taken before resumableUploads.mu, as the handlers do.
+func expireResumableUploads() {
+	ttl := settings().resumableUploadTTL
+	resumableUploads.mu.Lock()
+	sessions := make([]*resumableUpload, 0, len(resumableUploads.entries))
+	for _, u := range resumableUploads.entries {
+		sessions = append(sessions, u)
+	}
+	resumableUploads.mu.Unlock()
+
+	for _, u := range sessions {
+		if !u.mu.TryLock() {
+			continue
+		}
+		if !u.expired && time.Since(u.updated) > ttl {
+			resumableUploads.mu.Lock()
+			delete(resumableUploads.entries, u.id)
+			resumableUploads.mu.Unlock()
+			u.expired = true
+			os.Remove(u.tempPath)
+			slog.Debug("Expired resumable upload", "id", u.id, "filename", u.filename)
+		}
+		u.mu.Unlock()
+	}
+}
+
+// lookupResumableUpload returns the session named in the URL if it belongs
+// to the caller.
+func lookupResumableUpload(c *fiber.Ctx) *resumableUpload {
+	resumableUploads.mu.Lock()
+	defer resumableUploads.mu.Unlock()
+	u, ok := resumableUploads.entries[c.Params("id")]
+	if !ok || u.owner != currentUser(c) {
+		return nil
+	}
+	return u
+}
+
+// resumableInitHandler starts a resumable upload. The size is declared up
+// front so limits are enforced before any data is sent and the server knows
+// when the upload is complete.
+func resumableInitHandler(c *fiber.Ctx) error {
+	var req ResumableInitRequest
+	if err := c.BodyParser(&req); err != nil {
+		return jsonError(c, fiber.StatusBadRequest, errCodeInvalidRequest, "Invalid request body")
+	}
+	name := filepath.Base(req.Filename)
+	if req.Filename == "" || name == "." || name == "/" {
+		return jsonError(c, fiber.StatusBadRequest, errCodeInvalidFilename, "Invalid filename")
+	}
+	if _, err := normalizeFilename(name); err != nil {
+		return jsonError(c, fiber.StatusBadRequest, errCodeInvalidFilename, err.Error())
+	}
+	if req.Size < 0 {
+		return jsonError(c, fiber.StatusBadRequest, errCodeInvalidRequest, "size must not be negative")
+	}
+	folder, err := sanitizeFolder(req.Folder)
+	if err != nil {
+		return jsonError(c, fiber.StatusBadRequest, errCodeInvalidFolder, err.Error())
+	}
+	if limit := settings().maxFileSize; limit > 0 && req.Size > limit {
+		return jsonError(c, fiber.StatusRequestEntityTooLarge, errCodeFileTooLarge, fmt.Sprintf("File is %s; the maximum file size is %s", formatSize(req.Size), formatSize(limit)))
+	}
+	webfiles.mu.Lock()
+	quotaErr := quotaErrorUnlocked(req.Size)
+	webfiles.mu.Unlock()
+	if quotaErr != "" {
+		return jsonError(c, fiber.StatusRequestEntityTooLarge, errCodeQuotaExceeded, quotaErr)
+	}
+	if err := checkExtensionPolicy(name); err != nil {
+		return jsonError(c, fiber.StatusUnsupportedMediaType, errCodeExtensionNotAllowed, err.Error())
+	}
+	if _, err := parseTTL(req.TTL); err != nil {
+		return jsonError(c, fiber.StatusBadRequest, errCodeInvalidRequest, err.Error())
+	}
+
+	expireResumableUploads()
+
+	buf := make([]byte, 16)
+	if _, err := rand.Read(buf); err != nil {
+		return jsonError(c, fiber.StatusInternalServerError, errCodeInternal, "Could not start upload")
+	}
+	id := hex.EncodeToString(buf)
+	if err := os.MkdirAll(partialUploadDir(), 0755); err != nil {
+		slog.ErrorContext(c.UserContext(), "Could not create partial upload directory", "path", partialUploadDir(), "error", err)
+		return jsonError(c, fiber.StatusInternalServerError, errCodeInternal, "Could not start upload")
+	}
+	u := &resumableUpload{
+		id:          id,
+		filename:    req.Filename,
+		folder:      folder,
+		owner:       currentUser(c),
+		size:        req.Size,
+		contentType: req.ContentType,
+		ttl:         req.TTL,
+		tags:        normalizeTags(req.Tags),
+		tempPath:    filepath.Join(partialUploadDir(), id),
+		updated:     time.Now(),
+	}
+	f, err := os.Create(u.tempPath)
+	if err != nil {
+		slog.ErrorContext(c.UserContext(), "Could not create partial upload", "path", u.tempPath, "error", err)
+		return jsonError(c, fiber.StatusInternalServerError, errCodeInternal, "Could not start upload")
+	}
+	f.Close()
+
+	resumableUploads.mu.Lock()
+	resumableUploads.entries[id] = u
+	resumableUploads.mu.Unlock()
+
+	slog.InfoContext(c.UserContext(), "Started resumable upload", "id", id, "filename", req.Filename, "folder", folder, "size", req.Size)
+	c.Location("/upload/" + id)
+	return c.Status(fiber.StatusCreated).JSON(fiber.Map{"id": id, "offset": 0, "size": req.Size})
+}
+
+// resumableStatusHandler answers HEAD /upload/:id with the number of bytes
+// received, so a client can resume from there after a disconnect.
+func resumableStatusHandler(c *fiber.Ctx) error {
+	u := lookupResumableUpload(c)
+	if u == nil {
+		return c.SendStatus(fiber.StatusNotFound)
+	}
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	if u.expired {
+		return c.SendStatus(fiber.StatusNotFound)
+	}
+	c.Set("Upload-Offset", strconv.FormatInt(u.received, 10))
+	c.Set("Upload-Length", strconv.FormatInt(u.size, 10))
+	c.Set(fiber.HeaderCacheControl, "no-store")
+	return c.SendStatus(fiber.StatusOK)
+}
+
+// resumableChunkHandler appends the request body at the offset given in the
+// Upload-Offset header. The offset must equal the bytes received so far;
+// otherwise 409 is returned with the current offset so the client can
+// re-sync.
+func resumableChunkHandler(c *fiber.Ctx) error {
+	u := lookupResumableUpload(c)
+	if u == nil {
+		return jsonError(c, fiber.StatusNotFound, errCodeUploadNotFound, "Upload not found")
+	}
+	offset, err := strconv.ParseInt(c.Get("Upload-Offset"), 10, 64)
+	if err != nil || offset < 0 {
+		return jsonError(c, fiber.StatusBadRequest, errCodeInvalidRequest, "Missing or invalid Upload-Offset header")
+	}
+
+	// Without a length the chunk can't be checked against the declared
+	// size, and the copy below would read nothing.
+	length := int64(c.Request().Header.ContentLength())
+	if length < 0 {
+		return jsonError(c, fiber.StatusLengthRequired, errCodeLengthRequired, "Content-Length is required")
+	}
+
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	if u.expired {
+		return jsonError(c, fiber.StatusNotFound, errCodeUploadNotFound, "Upload not found")
+	}
+	c.Set("Upload-Offset", strconv.FormatInt(u.received, 10))
+	if offset != u.received {
+		return c.Status(fiber.StatusConflict).JSON(fiber.Map{"error": newAPIError(c, errCodeOffsetMismatch, "Upload-Offset does not match the bytes received"), "offset": u.received})
+	}
+	if u.received+length > u.size {
+		return c.Status(fiber.StatusRequestEntityTooLarge).JSON(fiber.Map{"error": newAPIError(c, errCodeFileTooLarge, "Chunk goes past the declared size"), "offset": u.received})
+	}
+
+	f, err := os.OpenFile(u.tempPath, os.O_WRONLY, 0)
+	if err != nil {
+		slog.ErrorContext(c.UserContext(), "Could not open partial upload", "id", u.id, "path", u.tempPath, "error", err)
+		return jsonError(c, fiber.StatusInternalServerError, errCodeInternal, "Could not write chunk")
+	}
+	// The chunk is copied from the connection as it arrives. If the client
+	// drops mid-chunk, what was written still counts, so it resumes from
+	// there.
+	var n int64
+	if _, err = f.Seek(offset, io.SeekStart); err == nil {
+		n, err = io.Copy(f, io.LimitReader(requestBody(c), length))
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	u.received += n
+	u.updated = time.Now()
+	if err != nil {
+		slog.ErrorContext(c.UserContext(), "Could not write chunk", "id", u.id, "path", u.tempPath, "error", err)
+		c.Set("Upload-Offset", strconv.FormatInt(u.received, 10))
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": newAPIError(c, errCodeInternal, "Could not write chunk"), "offset": u.received})
+	}
+
+	slog.DebugContext(c.UserContext(), "Received chunk", "id", u.id, "offset", offset, "length", n, "received", u.received, "size", u.size)
+	c.Set("Upload-Offset", strconv.FormatInt(u.received, 10))
+	return c.SendStatus(fiber.StatusNoContent)
+}
+
+// resumableCompleteHandler stores a fully received upload through the same
+// pipeline as a form upload, so deduplication, limits and metadata behave
+// identically. The session ends either way.
+func resumableCompleteHandler(c *fiber.Ctx) error {
+	u := lookupResumableUpload(c)
+	if u == nil {
+		return jsonError(c, fiber.StatusNotFound, errCodeUploadNotFound, "Upload not found")
+	}
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	if u.expired {
+		return jsonError(c, fiber.StatusNotFound, errCodeUploadNotFound, "Upload not found")
+	}
+	if u.received != u.size {
+		c.Set("Upload-Offset", strconv.FormatInt(u.received, 10))
+		return c.Status(fiber.StatusConflict).JSON(fiber.Map{"error": newAPIError(c, errCodeUploadIncomplete, fmt.Sprintf("Upload is incomplete: received %d of %d bytes", u.received, u.size)), "offset": u.received})
+	}
+
+	resumableUploads.mu.Lock()
+	delete(resumableUploads.entries, u.id)
+	resumableUploads.mu.Unlock()
+	defer os.Remove(u.tempPath)
+
+	// The ttl counts from completion, not from when the upload started.
+	expiresAt, _ := parseTTL(u.ttl)
+	result := storeUpload(c, incomingFile{
+		Filename:    u.filename,
+		Size:        u.size,
+		ContentType: u.contentType,
+		open:        func() (io.ReadCloser, error) { return os.Open(u.tempPath) },
+		tempPath:    u.tempPath,
+	}, u.folder, expiresAt, u.tags)
+	if result.Status == uploadStatusUploaded {
+		c.Location(fileLocation(result.Folder, result.Filename))
+	}
+	return c.Status(result.code).JSON([]UploadResult{result})
+}
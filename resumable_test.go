@@ -0,0 +1,51 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestExpireResumableUploads(t *testing.T) {
+	setupTestStore(t)
+	withSettings(t, func(cfg *reloadableConfig) { cfg.resumableUploadTTL = time.Hour })
+	if err := os.MkdirAll(partialUploadDir(), 0755); err != nil {
+		t.Fatal(err)
+	}
+	session := func(id string, idle time.Duration) *resumableUpload {
+		u := &resumableUpload{id: id, tempPath: filepath.Join(partialUploadDir(), id), updated: time.Now().Add(-idle)}
+		if err := os.WriteFile(u.tempPath, []byte("partial"), 0644); err != nil {
+			t.Fatal(err)
+		}
+		resumableUploads.mu.Lock()
+		resumableUploads.entries[id] = u
+		resumableUploads.mu.Unlock()
+		t.Cleanup(func() {
+			resumableUploads.mu.Lock()
+			delete(resumableUploads.entries, id)
+			resumableUploads.mu.Unlock()
+		})
+		return u
+	}
+	active := session("active", time.Minute)
+	idle := session("idle", 2*time.Hour)
+	busy := session("busy", 2*time.Hour)
+	busy.mu.Lock()
+
+	expireResumableUploads()
+	busy.mu.Unlock()
+
+	for _, tt := range []struct {
+		u    *resumableUpload
+		kept bool
+	}{{active, true}, {idle, false}, {busy, true}} {
+		resumableUploads.mu.Lock()
+		_, listed := resumableUploads.entries[tt.u.id]
+		resumableUploads.mu.Unlock()
+		_, err := os.Stat(tt.u.tempPath)
+		if listed != tt.kept || (err == nil) != tt.kept || tt.u.expired == tt.kept {
+			t.Errorf("%s: listed %v, temp file kept %v, expired %v; want kept %v", tt.u.id, listed, err == nil, tt.u.expired, tt.kept)
+		}
+	}
+}
@@ -0,0 +1,274 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log/slog"
+	"net/url"
+	"os"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	v4 "github.com/aws/aws-sdk-go-v2/aws/signer/v4"
+	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+)
+
+// s3Timeout bounds the S3 calls that don't move file content. Uploads and
+// downloads run as long as the transfer takes.
+const s3Timeout = 30 * time.Second
+
+// s3Storage keeps uploads as objects in an S3 bucket, under prefix.
+type s3Storage struct {
+	client *s3.Client
+	bucket string
+	prefix string
+	// plainHTTP is set for an http:// endpoint, such as a local MinIO.
+	// The SDK can only stream a body of unknown content over TLS, so
+	// uploads to it are sent unsigned and without a checksum.
+	plainHTTP bool
+}
+
+// connectS3 builds the S3 backend from S3_BUCKET, S3_PREFIX, S3_ENDPOINT and
+// S3_FORCE_PATH_STYLE. Region and credentials come from the usual AWS
+// variables (AWS_REGION, AWS_ACCESS_KEY_ID, AWS_SECRET_ACCESS_KEY, or a
+// profile or instance role). The bucket must exist and be reachable.
+func connectS3() *s3Storage {
+	bucket := os.Getenv("S3_BUCKET")
+	if bucket == "" {
+		fatal("S3_BUCKET is required when STORAGE_BACKEND is s3")
+	}
+	endpoint := os.Getenv("S3_ENDPOINT")
+
+	ctx, cancel := context.WithTimeout(context.Background(), s3Timeout)
+	defer cancel()
+	cfg, err := config.LoadDefaultConfig(ctx)
+	if err != nil {
+		fatal("Could not load AWS configuration", "error", err)
+	}
+	client := s3.NewFromConfig(cfg, func(o *s3.Options) {
+		if endpoint != "" {
+			o.BaseEndpoint = aws.String(endpoint)
+		}
+		o.UsePathStyle = envBool("S3_FORCE_PATH_STYLE", endpoint != "")
+	})
+	if _, err := client.HeadBucket(ctx, &s3.HeadBucketInput{Bucket: aws.String(bucket)}); err != nil {
+		fatal("S3 bucket is not reachable", "bucket", bucket, "endpoint", endpoint, "error", err)
+	}
+
+	s := &s3Storage{
+		client:    client,
+		bucket:    bucket,
+		prefix:    os.Getenv("S3_PREFIX"),
+		plainHTTP: strings.HasPrefix(strings.ToLower(endpoint), "http://"),
+	}
+	slog.Info("Storage backend configured", "backend", storageBackendS3, "bucket", bucket, "prefix", s.prefix, "region", cfg.Region, "endpoint", endpoint)
+	return s
+}
+
+func (s *s3Storage) objectKey(key string) (string, error) {
+	if !validKey(key) {
+		return "", fmt.Errorf("%q: %w", key, errInvalidKey)
+	}
+	return path.Join(s.prefix, path.Clean(key)), nil
+}
+
+// s3Error maps the SDK's not-found errors to fs.ErrNotExist.
+func s3Error(key string, err error) error {
+	var notFound *types.NotFound
+	var noSuchKey *types.NoSuchKey
+	if errors.As(err, &notFound) || errors.As(err, &noSuchKey) {
+		return fmt.Errorf("%s: %w", key, fs.ErrNotExist)
+	}
+	return err
+}
+
+// Save streams r with a known length, so the object is only created once
+// the whole body has arrived.
+func (s *s3Storage) Save(key string, r io.Reader, size int64) error {
+	objectKey, err := s.objectKey(key)
+	if err != nil {
+		return err
+	}
+	var opts []func(*s3.Options)
+	if s.plainHTTP {
+		opts = append(opts, s3.WithAPIOptions(v4.SwapComputePayloadSHA256ForUnsignedPayloadMiddleware), func(o *s3.Options) {
+			o.RequestChecksumCalculation = aws.RequestChecksumCalculationWhenRequired
+		})
+	}
+	_, err = s.client.PutObject(context.Background(), &s3.PutObjectInput{
+		Bucket:        aws.String(s.bucket),
+		Key:           aws.String(objectKey),
+		Body:          r,
+		ContentLength: aws.Int64(size),
+	}, opts...)
+	return err
+}
+
+func (s *s3Storage) Stat(key string) (fs.FileInfo, error) {
+	objectKey, err := s.objectKey(key)
+	if err != nil {
+		return nil, err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), s3Timeout)
+	defer cancel()
+	out, err := s.client.HeadObject(ctx, &s3.HeadObjectInput{Bucket: aws.String(s.bucket), Key: aws.String(objectKey)})
+	if err != nil {
+		return nil, s3Error(key, err)
+	}
+	return s3FileInfo{name: path.Base(key), size: aws.ToInt64(out.ContentLength), modTime: aws.ToTime(out.LastModified)}, nil
+}
+
+// Open checks the object exists and returns a reader that fetches it when
+// first read.
+func (s *s3Storage) Open(key string) (StoredFile, error) {
+	info, err := s.Stat(key)
+	if err != nil {
+		return nil, err
+	}
+	objectKey, _ := s.objectKey(key)
+	return &s3Object{storage: s, key: objectKey, info: info}, nil
+}
+
+func (s *s3Storage) Delete(key string) error {
+	objectKey, err := s.objectKey(key)
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), s3Timeout)
+	defer cancel()
+	_, err = s.client.DeleteObject(ctx, &s3.DeleteObjectInput{Bucket: aws.String(s.bucket), Key: aws.String(objectKey)})
+	return err
+}
+
+// Rename copies the object and deletes the original; S3 has no move.
+func (s *s3Storage) Rename(oldKey, newKey string) error {
+	oldObject, err := s.objectKey(oldKey)
+	if err != nil {
+		return err
+	}
+	newObject, err := s.objectKey(newKey)
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), s3Timeout)
+	defer cancel()
+	_, err = s.client.CopyObject(ctx, &s3.CopyObjectInput{
+		Bucket:     aws.String(s.bucket),
+		Key:        aws.String(newObject),
+		CopySource: aws.String(s.bucket + "/" + url.PathEscape(oldObject)),
+	})
+	if err != nil {
+		return s3Error(oldKey, err)
+	}
+	return s.Delete(oldKey)
+}
+
+func (s *s3Storage) List() ([]string, error) {
+	prefix := ""
+	if s.prefix != "" {
+		prefix = path.Clean(s.prefix) + "/"
+	}
+	var keys []string
+	pages := s3.NewListObjectsV2Paginator(s.client, &s3.ListObjectsV2Input{Bucket: aws.String(s.bucket), Prefix: aws.String(prefix)})
+	for pages.HasMorePages() {
+		ctx, cancel := context.WithTimeout(context.Background(), s3Timeout)
+		page, err := pages.NextPage(ctx)
+		cancel()
+		if err != nil {
+			return nil, err
+		}
+		for _, obj := range page.Contents {
+			keys = append(keys, strings.TrimPrefix(aws.ToString(obj.Key), prefix))
+		}
+	}
+	return keys, nil
+}
+
+// get fetches the object from offset to the end.
+func (s *s3Storage) get(key string, offset int64) (io.ReadCloser, error) {
+	out, err := s.client.GetObject(context.Background(), &s3.GetObjectInput{
+		Bucket: aws.String(s.bucket),
+		Key:    aws.String(key),
+		Range:  aws.String(fmt.Sprintf("bytes=%d-", offset)),
+	})
+	if err != nil {
+		return nil, s3Error(key, err)
+	}
+	return out.Body, nil
+}
+
+// s3Object reads an object through one ranged GET, reopened from the new
+// offset after a Seek, so a range request costs a single GET.
+type s3Object struct {
+	storage *s3Storage
+	key     string
+	info    fs.FileInfo
+	offset  int64
+	body    io.ReadCloser
+}
+
+func (o *s3Object) Read(p []byte) (int, error) {
+	if o.offset >= o.info.Size() {
+		return 0, io.EOF
+	}
+	if o.body == nil {
+		body, err := o.storage.get(o.key, o.offset)
+		if err != nil {
+			return 0, err
+		}
+		o.body = body
+	}
+	n, err := o.body.Read(p)
+	o.offset += int64(n)
+	return n, err
+}
+
+func (o *s3Object) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekCurrent:
+		offset += o.offset
+	case io.SeekEnd:
+		offset += o.info.Size()
+	}
+	if offset < 0 {
+		return 0, errors.New("seek before start of object")
+	}
+	if offset != o.offset && o.body != nil {
+		o.body.Close()
+		o.body = nil
+	}
+	o.offset = offset
+	return offset, nil
+}
+
+func (o *s3Object) Stat() (fs.FileInfo, error) { return o.info, nil }
+
+func (o *s3Object) Close() error {
+	if o.body == nil {
+		return nil
+	}
+	err := o.body.Close()
+	o.body = nil
+	return err
+}
+
+// s3FileInfo is the fs.FileInfo of an object, from HeadObject.
+type s3FileInfo struct {
+	name    string
+	size    int64
+	modTime time.Time
+}
+
+func (i s3FileInfo) Name() string       { return i.name }
+func (i s3FileInfo) Size() int64        { return i.size }
+func (i s3FileInfo) Mode() fs.FileMode  { return 0644 }
+func (i s3FileInfo) ModTime() time.Time { return i.modTime }
+func (i s3FileInfo) IsDir() bool        { return false }
+func (i s3FileInfo) Sys() any           { return nil }
@@ -0,0 +1,37 @@
+package main
+
+import (
+	"path/filepath"
+	"strings"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// searchHandler finds files by name: ?q= matches a case-insensitive
+// substring, ?glob= a case-insensitive filepath.Match pattern such as
+// "*.pdf". Results have the same shape, pagination and sorting as /files.
+func searchHandler(c *fiber.Ctx) error {
+	query := strings.ToLower(strings.TrimSpace(c.Query("q")))
+	glob := strings.ToLower(strings.TrimSpace(c.Query("glob")))
+	if query == "" && glob == "" {
+		return jsonError(c, fiber.StatusBadRequest, errCodeInvalidRequest, "Provide a search query with q or glob")
+	}
+	if glob != "" {
+		if _, err := filepath.Match(glob, ""); err != nil {
+			return jsonError(c, fiber.StatusBadRequest, errCodeInvalidRequest, "Invalid glob pattern")
+		}
+	}
+
+	return listFiles(c, func(f FileMeta) bool {
+		name := strings.ToLower(f.Filename)
+		if query != "" && !strings.Contains(name, query) {
+			return false
+		}
+		if glob != "" {
+			if ok, _ := filepath.Match(glob, name); !ok {
+				return false
+			}
+		}
+		return true
+	})
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"errors"
+	"log/slog"
+	"net/url"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/golang-jwt/jwt/v5"
+)
+
+const (
+	shareTokenAudience = "webfiles-share"
+	defaultShareTTL    = 24 * time.Hour
+	defaultShareMaxTTL = 7 * 24 * time.Hour
+)
+
+type ShareRequest struct {
+	ExpiresIn string `json:"expiresIn"`
+}
+
+// shareHandler issues a signed, expiring link that lets anyone download one
+// file without logging in. The token names the file by folder, name and
+// checksum, so a different file uploaded under the same name later is not
+// reachable through an old link.
+func shareHandler(c *fiber.Ctx) error {
+	requestedFilename, err := url.QueryUnescape(c.Params("filename"))
+	if err != nil {
+		return jsonError(c, fiber.StatusBadRequest, errCodeInvalidFilename, "Invalid filename")
+	}
+	folder, err := folderQuery(c)
+	if err != nil {
+		return jsonError(c, fiber.StatusBadRequest, errCodeInvalidFolder, err.Error())
+	}
+
+	maxTTL := settings().shareMaxTTL
+	ttl := min(defaultShareTTL, maxTTL)
+	if len(c.Body()) > 0 {
+		var req ShareRequest
+		if err := c.BodyParser(&req); err != nil {
+			return jsonError(c, fiber.StatusBadRequest, errCodeInvalidRequest, "Invalid request body")
+		}
+		if req.ExpiresIn != "" {
+			ttl, err = time.ParseDuration(req.ExpiresIn)
+			if err != nil || ttl <= 0 {
+				return jsonError(c, fiber.StatusBadRequest, errCodeInvalidRequest, "expiresIn must be a positive duration such as \"2h\" or \"30m\"")
+			}
+			if ttl > maxTTL {
+				return jsonError(c, fiber.StatusBadRequest, errCodeInvalidRequest, "expiresIn exceeds the maximum of "+maxTTL.String())
+			}
+		}
+	}
+
+	webfiles.mu.Lock()
+	index := findAccessibleFileUnlocked(c, folder, requestedFilename)
+	var meta FileMeta
+	if index != -1 {
+		meta = webfiles.Files[index]
+	}
+	webfiles.mu.Unlock()
+	if index == -1 {
+		return jsonError(c, fiber.StatusNotFound, errCodeFileNotFound, "File not found in metadata")
+	}
+
+	expiresAt := time.Now().Add(ttl)
+	token := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims{
+		"aud":    shareTokenAudience,
+		"exp":    expiresAt.Unix(),
+		"iat":    time.Now().Unix(),
+		"file":   meta.Filename,
+		"folder": meta.Folder,
+		"sha256": meta.Checksum,
+	})
+	tokenString, err := token.SignedString(jwtSecret)
+	if err != nil {
+		return jsonError(c, fiber.StatusInternalServerError, errCodeInternal, "Failed to generate token")
+	}
+
+	slog.InfoContext(c.UserContext(), "Created share link", "filename", meta.Filename, "folder", meta.Folder, "expiresAt", expiresAt.UTC())
+	return c.JSON(fiber.Map{
+		"token":     tokenString,
+		"url":       "/public/share/" + tokenString,
+		"expiresAt": expiresAt.UTC(),
+	})
+}
+
+// publicShareHandler streams the file named by a share token. It lives under
+// /public so it bypasses the session check; the token is the only
+// credential. Expired or tampered tokens get 403.
+func publicShareHandler(c *fiber.Ctx) error {
+	token, err := parseSignedToken(c.Params("token"), jwt.WithAudience(shareTokenAudience))
+	if err != nil {
+		if errors.Is(err, jwt.ErrTokenExpired) {
+			return jsonError(c, fiber.StatusForbidden, errCodeShareExpired, "Share link has expired")
+		}
+		slog.WarnContext(c.UserContext(), "Rejected share token", "component", "security", "ip", c.IP(), "error", err)
+		return jsonError(c, fiber.StatusForbidden, errCodeShareInvalid, "Invalid share link")
+	}
+	claims, _ := token.Claims.(jwt.MapClaims)
+	filename, _ := claims["file"].(string)
+	folder, _ := claims["folder"].(string)
+	checksum, _ := claims["sha256"].(string)
+
+	webfiles.mu.Lock()
+	index := findFileUnlocked(folder, filename)
+	var meta FileMeta
+	if index != -1 {
+		meta = webfiles.Files[index]
+	}
+	webfiles.mu.Unlock()
+	if index == -1 || meta.Checksum != checksum {
+		return jsonError(c, fiber.StatusNotFound, errCodeFileNotFound, "File not found in metadata")
+	}
+
+	slog.InfoContext(c.UserContext(), "Serving shared file", "filename", meta.Filename, "folder", meta.Folder, "ip", c.IP())
+	if meta.Checksum != "" {
+		c.Set("X-Checksum-SHA256", meta.Checksum)
+	}
+	if err := serveFile(c, meta); err != nil {
+		return err
+	}
+	recordDownload(c, meta.Folder, meta.Filename)
+	return nil
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"log/slog"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+const defaultShutdownTimeout = 30 * time.Second
+
+// listenAndServe runs the server until SIGINT or SIGTERM. It then stops
+// accepting connections, waits up to SHUTDOWN_TIMEOUT for in-flight requests
+// and flushes metadata before returning.
+func listenAndServe(app *fiber.App, addr string) {
+	quit := make(chan os.Signal, 1)
+	signal.Notify(quit, os.Interrupt, syscall.SIGTERM)
+	drained := make(chan struct{})
+	go func() {
+		sig := <-quit
+		timeout := settings().shutdownTimeout
+		slog.Info("Shutting down", "signal", sig.String(), "timeout", timeout.String())
+		if err := app.ShutdownWithTimeout(timeout); err != nil {
+			slog.Warn("In-flight requests did not finish before the shutdown timeout", "error", err)
+		}
+		close(drained)
+	}()
+
+	slog.Info("Listening", "addr", addr)
+	if err := app.Listen(addr); err != nil {
+		fatal("Server stopped", "error", err)
+	}
+	<-drained
+	flushOnShutdown()
+}
+
+// flushOnShutdown writes the metadata one last time, closes the metadata
+// database and removes unfinished resumable uploads, which can't be resumed
+// after a restart.
+func flushOnShutdown() {
+	webfiles.mu.Lock()
+	defer webfiles.mu.Unlock()
+
+	if err := writeMetadataUnlocked(); err != nil {
+		slog.Error("Could not flush metadata on shutdown", "error", err)
+	}
+	if metadataDB != nil {
+		if err := metadataDB.Close(); err != nil {
+			slog.Error("Could not close metadata database", "path", metadataDBPath, "error", err)
+		}
+	}
+	clearPartialUploads()
+	if audit != nil {
+		audit.close()
+	}
+	slog.Info("Shutdown complete")
+}
@@ -0,0 +1,242 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"os"
+	"time"
+
+	_ "modernc.org/sqlite"
+)
+
+const (
+	metadataBackendJSON   = "json"
+	metadataBackendSQLite = "sqlite"
+	defaultMetadataDB     = "./filedata.db"
+)
+
+// metadataBackend selects where metadata is persisted: filedata.json or a
+// SQLite database at metadataDBPath.
+var metadataBackend = metadataBackendJSON
+var metadataDBPath = defaultMetadataDB
+
+// metadataDB is open when METADATA_BACKEND=sqlite. The in-memory webfiles
+// index stays the working copy for reads; the changes of every save are
+// applied to the database in a single transaction, so a crash mid-write
+// leaves the previous state intact instead of a truncated JSON file.
+var metadataDB *sql.DB
+
+// The path column holds the storage key (FileMeta.Key); it kept its name
+// from when files could only be stored on disk.
+const sqliteSchema = `
+CREATE TABLE IF NOT EXISTS files (
+	folder      TEXT NOT NULL DEFAULT '',
+	filename    TEXT NOT NULL,
+	size        INTEGER NOT NULL,
+	path        TEXT NOT NULL,
+	checksum    TEXT NOT NULL DEFAULT '',
+	uploaded_at TEXT NOT NULL DEFAULT '',
+	attrs       TEXT NOT NULL DEFAULT '{}',
+	PRIMARY KEY (folder, filename)
+);
+CREATE INDEX IF NOT EXISTS files_checksum ON files (checksum);
+`
+
+// openMetadataDB opens (creating if needed) the SQLite metadata database.
+func openMetadataDB(path string) (*sql.DB, error) {
+	db, err := sql.Open("sqlite", fmt.Sprintf("file:%s?_pragma=journal_mode(WAL)&_pragma=busy_timeout(5000)&_pragma=synchronous(NORMAL)", path))
+	if err != nil {
+		return nil, err
+	}
+	// Writes are serialized by webfiles.mu anyway; one connection avoids
+	// SQLITE_BUSY between our own connections.
+	db.SetMaxOpenConns(1)
+	if _, err := db.Exec(sqliteSchema); err != nil {
+		db.Close()
+		return nil, err
+	}
+	if err := migrateFolderColumn(db); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("migrate: %w", err)
+	}
+	return db, nil
+}
+
+// migrateFolderColumn upgrades databases created before folders existed,
+// whose files table is keyed by filename alone. SQLite can't change a
+// primary key in place, so the table is rebuilt with every row in the root
+// folder.
+func migrateFolderColumn(db *sql.DB) error {
+	var n int
+	if err := db.QueryRow(`SELECT COUNT(*) FROM pragma_table_info('files') WHERE name = 'folder'`).Scan(&n); err != nil {
+		return err
+	}
+	if n > 0 {
+		return nil
+	}
+
+	slog.Info("Migrating SQLite metadata to add folders")
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	for _, stmt := range []string{
+		`ALTER TABLE files RENAME TO files_old`,
+		sqliteSchema,
+		`INSERT INTO files (folder, filename, size, path, checksum, uploaded_at, attrs)
+			SELECT '', filename, size, path, checksum, uploaded_at, attrs FROM files_old ORDER BY rowid`,
+		`DROP TABLE files_old`,
+		// The checksum index went away with files_old.
+		sqliteSchema,
+	} {
+		if _, err := tx.Exec(stmt); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// loadMetadataSQLite fills webfiles from the database. If the database is
+// empty and a filedata.json exists, it is imported once so switching
+// backends keeps the existing index. The caller must hold webfiles.mu.
+func loadMetadataSQLite() error {
+	var count int
+	if err := metadataDB.QueryRow(`SELECT COUNT(*) FROM files`).Scan(&count); err != nil {
+		return err
+	}
+
+	if count == 0 {
+		if _, err := os.Stat(metadataFile); err == nil {
+			slog.Info("SQLite metadata is empty, importing JSON metadata", "path", metadataFile)
+			data, err := os.ReadFile(metadataFile)
+			if err != nil {
+				return err
+			}
+			files, err := decodeMetadataJSON(data)
+			if err != nil {
+				return fmt.Errorf("import %s: %w", metadataFile, err)
+			}
+			webfiles.Files = files
+			if err := saveMetadataSQLite(); err != nil {
+				return fmt.Errorf("import %s: %w", metadataFile, err)
+			}
+			slog.Info("Imported JSON metadata; the JSON file is no longer updated", "path", metadataFile, "files", len(webfiles.Files))
+			return nil
+		}
+	}
+
+	rows, err := metadataDB.Query(`SELECT folder, filename, path, attrs FROM files ORDER BY rowid`)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	files := []FileMeta{}
+	loaded := make(map[sqliteRowKey]sqliteRow)
+	for rows.Next() {
+		var key sqliteRowKey
+		var row sqliteRow
+		if err := rows.Scan(&key.folder, &key.filename, &row.path, &row.attrs); err != nil {
+			return err
+		}
+		var meta FileMeta
+		if err := json.Unmarshal([]byte(row.attrs), &meta); err != nil {
+			return err
+		}
+		meta.Key = keyFromStoredPath(row.path, meta.Filename)
+		files = append(files, meta)
+		loaded[key] = row
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	webfiles.Files = files
+	sqliteRows = loaded
+	return nil
+}
+
+// sqliteRowKey is the primary key of a files row.
+type sqliteRowKey struct{ folder, filename string }
+
+// sqliteRow holds the columns of a files row that a save compares; the
+// others are derived from attrs.
+type sqliteRow struct{ path, attrs string }
+
+// sqliteRows mirrors the files table as of the last load or save, so a save
+// only writes the rows that changed instead of every row. Guarded by
+// webfiles.mu.
+var sqliteRows = make(map[sqliteRowKey]sqliteRow)
+
+// saveMetadataSQLite makes the files table match webfiles.Files in one
+// transaction: new files are inserted, changed ones updated and those no
+// longer tracked deleted, each compared with sqliteRows. The caller must
+// hold webfiles.mu.
+func saveMetadataSQLite() error {
+	rows := make(map[sqliteRowKey]sqliteRow, len(webfiles.Files))
+	var changed []FileMeta
+	for _, f := range webfiles.Files {
+		key := sqliteRowKey{f.Folder, f.Filename}
+		if _, dup := rows[key]; dup {
+			continue
+		}
+		attrs, err := json.Marshal(f)
+		if err != nil {
+			return err
+		}
+		row := sqliteRow{path: f.Key, attrs: string(attrs)}
+		rows[key] = row
+		if old, ok := sqliteRows[key]; !ok || old != row {
+			changed = append(changed, f)
+		}
+	}
+	var removed []sqliteRowKey
+	for key := range sqliteRows {
+		if _, ok := rows[key]; !ok {
+			removed = append(removed, key)
+		}
+	}
+	if len(changed) == 0 && len(removed) == 0 {
+		return nil
+	}
+
+	tx, err := metadataDB.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	for _, key := range removed {
+		if _, err := tx.Exec(`DELETE FROM files WHERE folder = ? AND filename = ?`, key.folder, key.filename); err != nil {
+			return err
+		}
+	}
+	for _, f := range changed {
+		key := sqliteRowKey{f.Folder, f.Filename}
+		row := rows[key]
+		uploadedAt := ""
+		if !f.UploadedAt.IsZero() {
+			uploadedAt = f.UploadedAt.Format(time.RFC3339Nano)
+		}
+		if _, ok := sqliteRows[key]; ok {
+			_, err = tx.Exec(`UPDATE files SET size = ?, path = ?, checksum = ?, uploaded_at = ?, attrs = ? WHERE folder = ? AND filename = ?`,
+				f.Size, row.path, f.Checksum, uploadedAt, row.attrs, f.Folder, f.Filename)
+		} else {
+			_, err = tx.Exec(`INSERT INTO files (folder, filename, size, path, checksum, uploaded_at, attrs) VALUES (?, ?, ?, ?, ?, ?, ?)`,
+				f.Folder, f.Filename, f.Size, row.path, f.Checksum, uploadedAt, row.attrs)
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	sqliteRows = rows
+	slog.Debug("Applied metadata changes to SQLite", "written", len(changed), "deleted", len(removed))
+	return nil
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"math"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+type LargestFile struct {
+	Filename string `json:"filename"`
+	Folder   string `json:"folder,omitempty"`
+	Size     int64  `json:"size"`
+}
+
+// QuotaStatus is how much of MAX_TOTAL_SIZE is in use. The quota is shared
+// by everyone, so Used counts every stored file, not only the caller's.
+type QuotaStatus struct {
+	Limit       int64   `json:"limit"`
+	Used        int64   `json:"used"`
+	Remaining   int64   `json:"remaining"`
+	PercentUsed float64 `json:"percentUsed"`
+}
+
+type StatsResponse struct {
+	Files   int          `json:"files"`
+	Bytes   int64        `json:"bytes"`
+	Largest *LargestFile `json:"largest,omitempty"`
+	Quota   *QuotaStatus `json:"quota,omitempty"`
+}
+
+// statsHandler reports the number and total size of the files the session
+// can see, the largest of them and, when MAX_TOTAL_SIZE is set, how much of
+// the quota is left.
+func statsHandler(c *fiber.Ctx) error {
+	webfiles.mu.Lock()
+	defer webfiles.mu.Unlock()
+
+	var stats StatsResponse
+	for _, f := range webfiles.Files {
+		if !canAccess(c, f) {
+			continue
+		}
+		stats.Files++
+		stats.Bytes += f.Size
+		if stats.Largest == nil || f.Size > stats.Largest.Size {
+			stats.Largest = &LargestFile{Filename: f.Filename, Folder: f.Folder, Size: f.Size}
+		}
+	}
+	if limit := settings().maxTotalSize; limit > 0 {
+		used := storedBytesUnlocked()
+		stats.Quota = &QuotaStatus{
+			Limit:       limit,
+			Used:        used,
+			Remaining:   max(limit-used, 0),
+			PercentUsed: math.Round(float64(used)/float64(limit)*1000) / 10,
+		}
+	}
+	return c.JSON(stats)
+}
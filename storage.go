@@ -0,0 +1,234 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log/slog"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+const (
+	storageBackendLocal = "local"
+	storageBackendS3    = "s3"
+)
+
+// Storage is where uploaded content lives. Keys are slash-separated paths
+// relative to the root of the backend, such as "docs/2024/05/01/report.pdf";
+// they are what FileMeta.Key records, so the metadata doesn't depend on
+// where the backend keeps its bytes. Missing objects are reported with an
+// error wrapping fs.ErrNotExist.
+type Storage interface {
+	// Save stores size bytes read from r under key, replacing any existing
+	// object. Nothing is left behind if it fails.
+	Save(key string, r io.Reader, size int64) error
+	Open(key string) (StoredFile, error)
+	Stat(key string) (fs.FileInfo, error)
+	// Delete removes key. Deleting a missing key is not an error.
+	Delete(key string) error
+	Rename(oldKey, newKey string) error
+	// List returns the key of every stored object, including the server's
+	// own, such as thumbnails, whose keys start with a dot.
+	List() ([]string, error)
+}
+
+// StoredFile is an open stored object. *os.File satisfies it.
+type StoredFile interface {
+	io.ReadSeekCloser
+	Stat() (fs.FileInfo, error)
+}
+
+// fileMover is implemented by backends that can take over a file already on
+// local disk without copying it, such as a finished resumable upload.
+type fileMover interface {
+	MoveFrom(src, key string) error
+}
+
+// fileStorage holds the content of every upload, chosen by STORAGE_BACKEND.
+// uploadDir is still used for scratch space by resumable uploads whichever
+// backend is configured.
+var fileStorage Storage
+
+var errInvalidKey = errors.New("storage key is outside the storage root")
+
+// setupStorage creates the backend named by STORAGE_BACKEND, encrypting it
+// when ENCRYPTION_KEY is set.
+func setupStorage() {
+	switch backend := strings.ToLower(os.Getenv("STORAGE_BACKEND")); backend {
+	case "", storageBackendLocal:
+		fileStorage = localStorage{root: uploadDir}
+		slog.Info("Storage backend configured", "backend", storageBackendLocal, "uploadDir", uploadDir)
+	case storageBackendS3:
+		fileStorage = connectS3()
+	default:
+		fatal("STORAGE_BACKEND must be local or s3", "value", backend)
+	}
+
+	raw := os.Getenv("ENCRYPTION_KEY")
+	if raw == "" {
+		return
+	}
+	key, err := parseEncryptionKey(raw)
+	if err != nil {
+		fatal(err.Error())
+	}
+	encrypted, err := newEncryptedStorage(fileStorage, key)
+	if err != nil {
+		fatal("Could not set up encryption", "error", err)
+	}
+	fileStorage = encrypted
+	slog.Info("Encrypting stored files", "cipher", "AES-256-GCM")
+}
+
+// storageKey returns the key a file uploaded to folder at time t is stored
+// under.
+func storageKey(folder, name string, t time.Time) string {
+	if settings().partitionByDate {
+		return path.Join(folder, t.Format("2006"), t.Format("01"), t.Format("02"), name)
+	}
+	return path.Join(folder, name)
+}
+
+// validKey reports whether key stays inside the storage root. Keys come from
+// metadata, so this is what stops a corrupted or tampered entry from making
+// the server touch files elsewhere.
+func validKey(key string) bool {
+	if key == "" || strings.HasPrefix(key, "/") || strings.Contains(key, `\`) || filepath.IsAbs(key) {
+		return false
+	}
+	clean := path.Clean(key)
+	return clean != "." && clean != ".." && !strings.HasPrefix(clean, "../")
+}
+
+// localStorage keeps uploads as plain files under root.
+type localStorage struct {
+	root string
+}
+
+func (s localStorage) path(key string) (string, error) {
+	if !validKey(key) {
+		return "", fmt.Errorf("%q: %w", key, errInvalidKey)
+	}
+	return filepath.Join(s.root, filepath.FromSlash(key)), nil
+}
+
+// Save writes to a temporary file next to the target and renames it into
+// place, so a concurrent reader never sees a partial file.
+func (s localStorage) Save(key string, r io.Reader, size int64) error {
+	dst, err := s.path(key)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(dst), 0755); err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(dst), ".save-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := io.Copy(tmp, r); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), dst)
+}
+
+func (s localStorage) MoveFrom(src, key string) error {
+	dst, err := s.path(key)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(dst), 0755); err != nil {
+		return err
+	}
+	return os.Rename(src, dst)
+}
+
+func (s localStorage) Open(key string) (StoredFile, error) {
+	p, err := s.path(key)
+	if err != nil {
+		return nil, err
+	}
+	return os.Open(p)
+}
+
+func (s localStorage) Stat(key string) (fs.FileInfo, error) {
+	p, err := s.path(key)
+	if err != nil {
+		return nil, err
+	}
+	return os.Stat(p)
+}
+
+func (s localStorage) Delete(key string) error {
+	p, err := s.path(key)
+	if err != nil {
+		return err
+	}
+	if err := os.Remove(p); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+	return nil
+}
+
+func (s localStorage) Rename(oldKey, newKey string) error {
+	oldPath, err := s.path(oldKey)
+	if err != nil {
+		return err
+	}
+	newPath, err := s.path(newKey)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(newPath), 0755); err != nil {
+		return err
+	}
+	return os.Rename(oldPath, newPath)
+}
+
+func (s localStorage) List() ([]string, error) {
+	var keys []string
+	err := filepath.WalkDir(s.root, func(p string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return err
+		}
+		rel, err := filepath.Rel(s.root, p)
+		if err != nil {
+			return err
+		}
+		keys = append(keys, filepath.ToSlash(rel))
+		return nil
+	})
+	return keys, err
+}
+
+// keyFromStoredPath turns a persisted path back into a storage key. Entries
+// written before paths were persisted live directly in uploadDir; absolute
+// paths from older versions are made relative when they lie inside it and
+// kept otherwise, which validKey then refuses.
+func keyFromStoredPath(stored, filename string) string {
+	if stored == "" {
+		return filename
+	}
+	if !filepath.IsAbs(stored) {
+		return stored
+	}
+	base, err := filepath.Abs(uploadDir)
+	if err != nil {
+		return stored
+	}
+	rel, err := filepath.Rel(base, stored)
+	if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return stored
+	}
+	return filepath.ToSlash(rel)
+}
@@ -0,0 +1,28 @@
+package main
+
+import "testing"
+
+func TestValidKey(t *testing.T) {
+	tests := []struct {
+		key  string
+		want bool
+	}{
+		{"report.pdf", true},
+		{"docs/report.pdf", true},
+		{"docs/2024/../report.pdf", true},
+		{"..report.pdf", true},
+		{"", false},
+		{".", false},
+		{"..", false},
+		{"../report.pdf", false},
+		{"docs/../../report.pdf", false},
+		{"/etc/passwd", false},
+		{`..\report.pdf`, false},
+		{`C:\Windows\win.ini`, false},
+	}
+	for _, tt := range tests {
+		if got := validKey(tt.key); got != tt.want {
+			t.Errorf("validKey(%q) = %v, want %v", tt.key, got, tt.want)
+		}
+	}
+}
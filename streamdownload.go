@@ -0,0 +1,57 @@
+package main
+
+import (
+	"bufio"
+	"io"
+	"log/slog"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+const defaultDownloadChunkSize = 64 << 10
+
+// streamDownload sends length bytes of r as the response body, chunk by
+// chunk, flushing after each so the client sees steady progress instead of
+// whatever the connection buffer happens to release. Content-Length is still
+// set, so clients can show a percentage and resume with a Range request if
+// the transfer breaks off. closer is closed once the body has been written or
+// abandoned.
+func streamDownload(c *fiber.Ctx, r io.Reader, closer io.Closer, length int64, begin time.Time) error {
+	ctx := c.UserContext()
+	chunkSize := settings().downloadChunkSize
+	// nginx buffers proxied responses by default, which would undo the
+	// flushing; this turns that off for the one response.
+	c.Set("X-Accel-Buffering", "no")
+	c.Context().SetBodyStreamWriter(func(w *bufio.Writer) {
+		defer closer.Close()
+		buf := make([]byte, min(chunkSize, max(length, 1)))
+		var sent int64
+		for sent < length {
+			n, err := io.ReadFull(r, buf[:min(int64(len(buf)), length-sent)])
+			if n > 0 {
+				if _, werr := w.Write(buf[:n]); werr != nil {
+					slog.DebugContext(ctx, "Download aborted by client", "sent", sent, "length", length, "error", werr)
+					return
+				}
+				if werr := w.Flush(); werr != nil {
+					slog.DebugContext(ctx, "Download aborted by client", "sent", sent, "length", length, "error", werr)
+					return
+				}
+				sent += int64(n)
+				downloadBytesTotal.Add(float64(n))
+			}
+			if err != nil {
+				// Stopping short of Content-Length makes the server drop the
+				// connection, so the client knows the file is incomplete.
+				slog.ErrorContext(ctx, "Could not read file for download", "sent", sent, "length", length, "error", err)
+				return
+			}
+		}
+		downloadDuration.Observe(time.Since(begin).Seconds())
+	})
+	// SetBodyStreamWriter sends chunked by default; with the length known
+	// the body is written as is.
+	c.Response().Header.SetContentLength(int(length))
+	return nil
+}
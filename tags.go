@@ -0,0 +1,250 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"net/url"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+const (
+	tagMatchAll = "all"
+	tagMatchAny = "any"
+)
+
+type BulkTagFilter struct {
+	Glob string `json:"glob"`
+	Tag  string `json:"tag"`
+}
+
+type BulkTagRequest struct {
+	Filenames []string       `json:"filenames"`
+	Folder    string         `json:"folder"`
+	Filter    *BulkTagFilter `json:"filter"`
+	Add       []string       `json:"add"`
+	Remove    []string       `json:"remove"`
+}
+
+type TagsRequest struct {
+	Tags []string `json:"tags"`
+}
+
+type TagInfo struct {
+	Tag   string `json:"tag"`
+	Files int    `json:"files"`
+}
+
+type BulkTagResult struct {
+	Filename string   `json:"filename"`
+	Folder   string   `json:"folder,omitempty"`
+	Tags     []string `json:"tags,omitempty"`
+	Error    string   `json:"error,omitempty"`
+}
+
+// normalizeTags trims, lowercases and de-duplicates tags, dropping empty ones.
+// The original order of first appearance is kept.
+func normalizeTags(tags []string) []string {
+	seen := make(map[string]bool, len(tags))
+	out := make([]string, 0, len(tags))
+	for _, t := range tags {
+		t = strings.ToLower(strings.TrimSpace(t))
+		if t == "" || seen[t] {
+			continue
+		}
+		seen[t] = true
+		out = append(out, t)
+	}
+	return out
+}
+
+// splitTags normalizes tags given as comma-separated lists, such as the
+// repeatable tags field of an upload.
+func splitTags(values []string) []string {
+	var tags []string
+	for _, v := range values {
+		tags = append(tags, strings.Split(v, ",")...)
+	}
+	return normalizeTags(tags)
+}
+
+// tagQuery reads the repeatable ?tag= filter and ?tagMatch=, which is "all"
+// (the default) to require every tag or "any" to require one of them. It
+// returns nil when no tag is asked for.
+func tagQuery(c *fiber.Ctx) (func(FileMeta) bool, error) {
+	var values []string
+	for _, v := range c.Context().QueryArgs().PeekMulti("tag") {
+		values = append(values, string(v))
+	}
+	tags := splitTags(values)
+	mode := c.Query("tagMatch", tagMatchAll)
+	if mode != tagMatchAll && mode != tagMatchAny {
+		return nil, fmt.Errorf("tagMatch must be %s or %s", tagMatchAll, tagMatchAny)
+	}
+	if len(tags) == 0 {
+		return nil, nil
+	}
+	return func(f FileMeta) bool {
+		for _, t := range tags {
+			if hasTag(f.Tags, t) == (mode == tagMatchAny) {
+				return mode == tagMatchAny
+			}
+		}
+		return mode == tagMatchAll
+	}, nil
+}
+
+func hasTag(tags []string, tag string) bool {
+	for _, t := range tags {
+		if t == tag {
+			return true
+		}
+	}
+	return false
+}
+
+// applyTagChanges returns tags with add appended and remove taken out. Both
+// add and remove must already be normalized.
+func applyTagChanges(tags, add, remove []string) []string {
+	out := make([]string, 0, len(tags)+len(add))
+	for _, t := range normalizeTags(append(append([]string{}, tags...), add...)) {
+		if !hasTag(remove, t) {
+			out = append(out, t)
+		}
+	}
+	return out
+}
+
+func (f *BulkTagFilter) matches(meta FileMeta) bool {
+	if f.Glob != "" {
+		ok, err := filepath.Match(f.Glob, meta.Filename)
+		if err != nil || !ok {
+			return false
+		}
+	}
+	if f.Tag != "" && !hasTag(meta.Tags, strings.ToLower(strings.TrimSpace(f.Tag))) {
+		return false
+	}
+	return true
+}
+
+func bulkTagHandler(c *fiber.Ctx) error {
+	var req BulkTagRequest
+	if err := c.BodyParser(&req); err != nil {
+		return jsonError(c, fiber.StatusBadRequest, errCodeInvalidRequest, "Invalid request")
+	}
+
+	add := normalizeTags(req.Add)
+	remove := normalizeTags(req.Remove)
+	if len(add) == 0 && len(remove) == 0 {
+		return jsonError(c, fiber.StatusBadRequest, errCodeInvalidRequest, "Nothing to do: provide tags to add or remove")
+	}
+	if (len(req.Filenames) == 0) == (req.Filter == nil) {
+		return jsonError(c, fiber.StatusBadRequest, errCodeInvalidRequest, "Provide either filenames or filter")
+	}
+	folder, err := sanitizeFolder(req.Folder)
+	if err != nil {
+		return jsonError(c, fiber.StatusBadRequest, errCodeInvalidFolder, err.Error())
+	}
+	if req.Filter != nil {
+		if req.Filter.Glob == "" && req.Filter.Tag == "" {
+			return jsonError(c, fiber.StatusBadRequest, errCodeInvalidRequest, "Filter must set glob or tag")
+		}
+		if _, err := filepath.Match(req.Filter.Glob, ""); err != nil {
+			return jsonError(c, fiber.StatusBadRequest, errCodeInvalidRequest, "Invalid glob pattern")
+		}
+	}
+
+	webfiles.mu.Lock()
+	defer webfiles.mu.Unlock()
+
+	results := []BulkTagResult{}
+	changed := 0
+	if req.Filter != nil {
+		for i := range webfiles.Files {
+			if !canAccess(c, webfiles.Files[i]) || !req.Filter.matches(webfiles.Files[i]) {
+				continue
+			}
+			webfiles.Files[i].Tags = applyTagChanges(webfiles.Files[i].Tags, add, remove)
+			results = append(results, BulkTagResult{Filename: webfiles.Files[i].Filename, Folder: webfiles.Files[i].Folder, Tags: webfiles.Files[i].Tags})
+			changed++
+		}
+	} else {
+		for _, name := range req.Filenames {
+			index := findAccessibleFileUnlocked(c, folder, name)
+			if index == -1 {
+				results = append(results, BulkTagResult{Filename: name, Folder: folder, Error: "File not found in metadata"})
+				continue
+			}
+			webfiles.Files[index].Tags = applyTagChanges(webfiles.Files[index].Tags, add, remove)
+			results = append(results, BulkTagResult{Filename: name, Folder: folder, Tags: webfiles.Files[index].Tags})
+			changed++
+		}
+	}
+
+	if changed > 0 {
+		if err := saveMetadataUnlocked(); err != nil {
+			return jsonError(c, fiber.StatusInternalServerError, errCodeInternal, "Failed to update metadata")
+		}
+	}
+
+	slog.InfoContext(c.UserContext(), "Bulk tag update", "changed", changed, "add", add, "remove", remove)
+	return c.JSON(fiber.Map{"updated": changed, "results": results})
+}
+
+// setTagsHandler replaces the tags of one file.
+func setTagsHandler(c *fiber.Ctx) error {
+	requestedFilename, err := url.QueryUnescape(c.Params("filename"))
+	if err != nil {
+		return jsonError(c, fiber.StatusBadRequest, errCodeInvalidFilename, "Invalid filename")
+	}
+	folder, err := folderQuery(c)
+	if err != nil {
+		return jsonError(c, fiber.StatusBadRequest, errCodeInvalidFolder, err.Error())
+	}
+	var req TagsRequest
+	if err := c.BodyParser(&req); err != nil {
+		return jsonError(c, fiber.StatusBadRequest, errCodeInvalidRequest, "Invalid request body")
+	}
+
+	webfiles.mu.Lock()
+	defer webfiles.mu.Unlock()
+
+	index := findAccessibleFileUnlocked(c, folder, requestedFilename)
+	if index == -1 {
+		return jsonError(c, fiber.StatusNotFound, errCodeFileNotFound, "File not found in metadata")
+	}
+	meta := &webfiles.Files[index]
+	meta.Tags = normalizeTags(req.Tags)
+	if err := saveMetadataUnlocked(); err != nil {
+		return jsonError(c, fiber.StatusInternalServerError, errCodeInternal, "Failed to update metadata")
+	}
+
+	slog.InfoContext(c.UserContext(), "Set tags", "filename", meta.Filename, "folder", folder, "tags", meta.Tags, "user", currentUser(c))
+	return c.JSON(meta)
+}
+
+// tagsHandler lists every tag on the files the session can access, with the
+// number of files carrying it.
+func tagsHandler(c *fiber.Ctx) error {
+	counts := make(map[string]int)
+	webfiles.mu.Lock()
+	for _, f := range webfiles.Files {
+		if canAccess(c, f) {
+			for _, t := range f.Tags {
+				counts[t]++
+			}
+		}
+	}
+	webfiles.mu.Unlock()
+
+	tags := make([]TagInfo, 0, len(counts))
+	for tag, n := range counts {
+		tags = append(tags, TagInfo{Tag: tag, Files: n})
+	}
+	sort.Slice(tags, func(i, j int) bool { return tags[i].Tag < tags[j].Tag })
+	return c.JSON(tags)
+}
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"errors"
+	"io/fs"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+const (
+	defaultTempCleanupAge      = 24 * time.Hour
+	defaultTempCleanupInterval = time.Hour
+)
+
+// tempCleanupAge is how old a leftover temp file must be before it is
+// removed, from TEMP_CLEANUP_AGE; 0 turns the cleanup off.
+// tempCleanupInterval, from TEMP_CLEANUP_INTERVAL, is how often it runs.
+var (
+	tempCleanupAge      = defaultTempCleanupAge
+	tempCleanupInterval = defaultTempCleanupInterval
+)
+
+// tempKey reports whether key is one of the server's temporary files: an
+// atomic write (.save-*), a startup probe (.write-check-*), a resumable or
+// URL upload (.partial) or an upload waiting for its virus scan
+// (.quarantine). Thumbnails are internal too but not temporary.
+func tempKey(key string) bool {
+	for _, segment := range strings.Split(key, "/") {
+		if segment == ".partial" || segment == quarantineDir ||
+			strings.HasPrefix(segment, ".save-") || strings.HasPrefix(segment, ".write-check-") {
+			return true
+		}
+	}
+	return false
+}
+
+// runTempCleanup removes leftover temp files once at startup and then every
+// tempCleanupInterval.
+func runTempCleanup() {
+	if tempCleanupAge <= 0 {
+		return
+	}
+	cleanupTempFiles()
+	ticker := time.NewTicker(tempCleanupInterval)
+	defer ticker.Stop()
+	for range ticker.C {
+		cleanupTempFiles()
+	}
+}
+
+// cleanupTempFiles removes temp files older than tempCleanupAge that no
+// entry and no resumable upload in progress refers to. They are left behind
+// when a save fails half way or the server stops during an upload. Temp
+// files are written to uploadDir on local disk whatever the storage
+// backend, except quarantined uploads, which go through fileStorage and are
+// looked for there as well.
+func cleanupTempFiles() {
+	cutoff := time.Now().Add(-tempCleanupAge)
+
+	webfiles.mu.Lock()
+	tracked := make(map[string]bool, len(webfiles.Files))
+	for _, f := range webfiles.Files {
+		tracked[f.Key] = true
+	}
+	webfiles.mu.Unlock()
+
+	resumableUploads.mu.Lock()
+	active := make(map[string]bool, len(resumableUploads.entries))
+	for _, u := range resumableUploads.entries {
+		active[u.tempPath] = true
+	}
+	resumableUploads.mu.Unlock()
+
+	removed := 0
+	err := filepath.WalkDir(uploadDir, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			if errors.Is(err, fs.ErrNotExist) {
+				return nil
+			}
+			return err
+		}
+		if d.IsDir() {
+			return nil
+		}
+		rel, err := filepath.Rel(uploadDir, p)
+		if err != nil {
+			return err
+		}
+		key := filepath.ToSlash(rel)
+		if !tempKey(key) || tracked[key] || active[p] {
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil || info.ModTime().After(cutoff) {
+			return nil
+		}
+		if err := os.Remove(p); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			slog.Warn("Could not remove leftover temp file", "path", p, "error", err)
+			return nil
+		}
+		slog.Info("Removed leftover temp file", "path", p, "size", info.Size(), "modified", info.ModTime().UTC())
+		removed++
+		return nil
+	})
+	if err != nil {
+		slog.Warn("Could not walk upload directory for temp files", "path", uploadDir, "error", err)
+	}
+
+	// On local storage the walk above already removed these.
+	keys, err := fileStorage.List()
+	if err != nil {
+		slog.Warn("Could not list storage for temp files", "error", err)
+		keys = nil
+	}
+	for _, key := range keys {
+		if !strings.HasPrefix(key, quarantineDir+"/") || tracked[key] {
+			continue
+		}
+		info, err := fileStorage.Stat(key)
+		if err != nil || info.ModTime().After(cutoff) {
+			continue
+		}
+		if err := fileStorage.Delete(key); err != nil {
+			slog.Warn("Could not remove leftover quarantined upload", "key", key, "error", err)
+			continue
+		}
+		slog.Info("Removed leftover quarantined upload", "key", key, "size", info.Size(), "modified", info.ModTime().UTC())
+		removed++
+	}
+
+	if removed > 0 {
+		slog.Info("Cleaned up leftover temp files", "removed", removed, "olderThan", tempCleanupAge.String())
+	}
+}
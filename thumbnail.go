@@ -0,0 +1,194 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"image/jpeg"
+	"log/slog"
+	"net/http"
+	"net/url"
+
+	"github.com/gofiber/fiber/v2"
+	"golang.org/x/image/draw"
+)
+
+const (
+	thumbnailMaxSize = 256
+	thumbnailQuality = 80
+	// thumbnailMaxPixels skips images that would take hundreds of MB to
+	// decode, such as a small file claiming huge dimensions.
+	thumbnailMaxPixels = 50_000_000
+)
+
+// thumbnailTypes are the content types the image decoders registered in
+// phash.go can read.
+var thumbnailTypes = map[string]bool{
+	"image/jpeg": true,
+	"image/png":  true,
+	"image/gif":  true,
+}
+
+// thumbnailKey is where the thumbnail of an image is stored, named by the
+// checksum of the original so identical uploads share one.
+func thumbnailKey(checksum string) string {
+	return ".thumbs/" + checksum + ".jpg"
+}
+
+// scheduleThumbnail generates the thumbnail of an image upload in the
+// background and records its ThumbnailPath, a storage key, on every entry
+// with the same content.
+func scheduleThumbnail(meta FileMeta) {
+	if !thumbnailTypes[meta.ContentType] || meta.Checksum == "" {
+		return
+	}
+
+	go func() {
+		key := thumbnailKey(meta.Checksum)
+		if _, err := fileStorage.Stat(key); err != nil {
+			if err := writeThumbnail(meta.Key, key); err != nil {
+				slog.Warn("Could not generate thumbnail", "component", "thumbnail", "filename", meta.Filename, "error", err)
+				return
+			}
+			slog.Debug("Generated thumbnail", "component", "thumbnail", "filename", meta.Filename, "key", key)
+		}
+
+		webfiles.mu.Lock()
+		found := false
+		for i := range webfiles.Files {
+			if webfiles.Files[i].Checksum == meta.Checksum {
+				found = true
+				webfiles.Files[i].ThumbnailPath = key
+			}
+		}
+		if found {
+			if err := saveMetadataUnlocked(); err != nil {
+				slog.Error("Failed to save thumbnail path", "component", "thumbnail", "filename", meta.Filename, "error", err)
+			}
+		}
+		webfiles.mu.Unlock()
+		// The upload was deleted while its thumbnail was being made.
+		if !found {
+			removeThumbnail(meta, key)
+		}
+	}()
+}
+
+// writeThumbnail scales the image stored at src to fit thumbnailMaxSize on
+// its longer side and stores it at dst as a JPEG. Transparent areas become
+// white since JPEG has no alpha channel.
+func writeThumbnail(src, dst string) error {
+	f, err := fileStorage.Open(src)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	cfg, _, err := image.DecodeConfig(f)
+	if err != nil {
+		return err
+	}
+	if cfg.Width*cfg.Height > thumbnailMaxPixels {
+		return fmt.Errorf("image is %dx%d, too large to thumbnail", cfg.Width, cfg.Height)
+	}
+	if _, err := f.Seek(0, 0); err != nil {
+		return err
+	}
+	img, _, err := image.Decode(f)
+	if err != nil {
+		return err
+	}
+
+	bounds := img.Bounds()
+	width, height := bounds.Dx(), bounds.Dy()
+	if width == 0 || height == 0 {
+		return fmt.Errorf("empty image")
+	}
+	if width >= height && width > thumbnailMaxSize {
+		width, height = thumbnailMaxSize, max(height*thumbnailMaxSize/width, 1)
+	} else if height > width && height > thumbnailMaxSize {
+		width, height = max(width*thumbnailMaxSize/height, 1), thumbnailMaxSize
+	}
+	thumb := image.NewRGBA(image.Rect(0, 0, width, height))
+	draw.Draw(thumb, thumb.Bounds(), image.White, image.Point{}, draw.Src)
+	draw.CatmullRom.Scale(thumb, thumb.Bounds(), img, bounds, draw.Over, nil)
+
+	var buf bytes.Buffer
+	if err := jpeg.Encode(&buf, thumb, &jpeg.Options{Quality: thumbnailQuality}); err != nil {
+		return err
+	}
+	return fileStorage.Save(dst, &buf, int64(buf.Len()))
+}
+
+// orphanedThumbnailUnlocked returns the thumbnail of an entry that has been
+// removed from webfiles.Files, or "" when it has none or another entry with
+// the same content still uses it. The caller must hold webfiles.mu and pass
+// the result to removeThumbnail once the lock is released.
+func orphanedThumbnailUnlocked(removed FileMeta) string {
+	if removed.ThumbnailPath == "" {
+		return ""
+	}
+	for _, f := range webfiles.Files {
+		if f.ThumbnailPath == removed.ThumbnailPath {
+			return ""
+		}
+	}
+	return removed.ThumbnailPath
+}
+
+// removeThumbnail deletes the thumbnail key of removed from storage; an
+// empty key is ignored.
+func removeThumbnail(removed FileMeta, key string) {
+	if key == "" {
+		return
+	}
+	if err := fileStorage.Delete(key); err != nil {
+		slog.Warn("Could not delete thumbnail", "component", "thumbnail", "filename", removed.Filename, "key", key, "error", err)
+	}
+}
+
+// thumbnailHandler serves the thumbnail of an image. Files that aren't
+// images, or whose thumbnail isn't ready yet, get 404.
+func thumbnailHandler(c *fiber.Ctx) error {
+	requestedFilename, err := url.QueryUnescape(c.Params("filename"))
+	if err != nil {
+		return jsonError(c, fiber.StatusBadRequest, errCodeInvalidFilename, "Invalid filename")
+	}
+	folder, err := folderQuery(c)
+	if err != nil {
+		return jsonError(c, fiber.StatusBadRequest, errCodeInvalidFolder, err.Error())
+	}
+
+	webfiles.mu.Lock()
+	index := findAccessibleFileUnlocked(c, folder, requestedFilename)
+	var meta FileMeta
+	if index != -1 {
+		meta = webfiles.Files[index]
+	}
+	webfiles.mu.Unlock()
+
+	if index == -1 {
+		return jsonError(c, fiber.StatusNotFound, errCodeFileNotFound, "File not found in metadata")
+	}
+	if meta.ThumbnailPath == "" {
+		return jsonError(c, fiber.StatusNotFound, errCodeThumbnailNotFound, "No thumbnail for this file")
+	}
+	info, err := fileStorage.Stat(meta.ThumbnailPath)
+	if err != nil {
+		return jsonError(c, fiber.StatusNotFound, errCodeThumbnailNotFound, "No thumbnail for this file")
+	}
+
+	etag := `"thumb-` + meta.Checksum + `"`
+	c.Set(fiber.HeaderETag, etag)
+	c.Set(fiber.HeaderLastModified, info.ModTime().UTC().Format(http.TimeFormat))
+	c.Set(fiber.HeaderCacheControl, "private, no-cache")
+	if notModified(c, etag, info.ModTime()) {
+		return c.SendStatus(fiber.StatusNotModified)
+	}
+	f, err := fileStorage.Open(meta.ThumbnailPath)
+	if err != nil {
+		return jsonError(c, fiber.StatusNotFound, errCodeThumbnailNotFound, "No thumbnail for this file")
+	}
+	c.Set(fiber.HeaderContentType, "image/jpeg")
+	return c.SendStream(f, int(info.Size()))
+}
@@ -0,0 +1,346 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"mime/multipart"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+const (
+	uploadStatusUploaded = "uploaded"
+	uploadStatusError    = "error"
+)
+
+const (
+	dedupModeOff    = "off"
+	dedupModeLink   = "link"
+	dedupModeReject = "reject"
+)
+
+// UploadResult describes what happened to one file of an upload request.
+type UploadResult struct {
+	Filename     string    `json:"filename"`
+	OriginalName string    `json:"originalName,omitempty"`
+	Folder       string    `json:"folder,omitempty"`
+	Size         int64     `json:"size"`
+	Checksum     string    `json:"checksum,omitempty"`
+	Status       string    `json:"status"`
+	Error        *apiError `json:"error,omitempty"`
+	Existing     string    `json:"existing,omitempty"`
+	code         int
+}
+
+// incomingFile is an uploaded file on its way into the store: a part of a
+// multipart form or a finished resumable upload.
+type incomingFile struct {
+	Filename    string
+	Size        int64
+	ContentType string // as declared by the client
+	open        func() (io.ReadCloser, error)
+	// tempPath is set when the content is already on disk under uploadDir,
+	// so a local backend can move it into place instead of copying it.
+	tempPath string
+}
+
+// formFile adapts one file of a multipart upload.
+func formFile(fh *multipart.FileHeader) incomingFile {
+	return incomingFile{
+		Filename:    fh.Filename,
+		Size:        fh.Size,
+		ContentType: fh.Header.Get("Content-Type"),
+		open:        func() (io.ReadCloser, error) { return fh.Open() },
+	}
+}
+
+func uploadFailed(c *fiber.Ctx, file incomingFile, code int, errCode, msg string) UploadResult {
+	apiErr := newAPIError(c, errCode, msg)
+	return UploadResult{Filename: file.Filename, Size: file.Size, Status: uploadStatusError, Error: &apiErr, code: code}
+}
+
+// storeUpload runs one uploaded file through the sanitize/dedupe/save
+// pipeline and records its metadata in folder (already sanitized). Failures
+// are reported in the result rather than aborting the rest of the request.
+// A non-zero expiresAt makes the file expire. tags must already be
+// normalized.
+func storeUpload(c *fiber.Ctx, file incomingFile, folder string, expiresAt time.Time, tags []string) (result UploadResult) {
+	start := time.Now()
+	cfg := settings()
+	slog.DebugContext(c.UserContext(), "Processing upload", "filename", file.Filename, "folder", folder, "size", file.Size)
+
+	if cfg.duplicateUploadWindow > 0 {
+		key := recentUploadKey(recentUploadClient(c), path.Join(folder, file.Filename), file.Size)
+		entry, dup := beginRecentUpload(key)
+		for dup {
+			<-entry.done
+			if entry.ok {
+				slog.DebugContext(c.UserContext(), "Suppressed duplicate upload", "filename", file.Filename, "size", file.Size, "ip", c.IP())
+				return entry.result
+			}
+			// The earlier attempt failed and was forgotten; try to claim the key.
+			entry, dup = beginRecentUpload(key)
+		}
+		defer func() { finishRecentUpload(key, entry, result, result.Status == uploadStatusUploaded) }()
+	}
+
+	originalName := file.Filename
+
+	cleanedFilename := filepath.Base(originalName)
+	if cleanedFilename == "." || cleanedFilename == "/" {
+		slog.WarnContext(c.UserContext(), "Invalid filename", "component", "security", "filename", originalName, "ip", c.IP())
+		return uploadFailed(c, file, fiber.StatusBadRequest, errCodeInvalidFilename, "Invalid filename")
+	}
+
+	cleanedFilename, err := normalizeFilename(cleanedFilename)
+	if err != nil {
+		slog.WarnContext(c.UserContext(), "Rejected filename", "component", "security", "filename", originalName, "ip", c.IP(), "error", err)
+		return uploadFailed(c, file, fiber.StatusBadRequest, errCodeInvalidFilename, err.Error())
+	}
+
+	safeName, err := checkWindowsName(cleanedFilename)
+	if err != nil {
+		slog.WarnContext(c.UserContext(), "Rejected Windows-reserved filename", "component", "security", "filename", cleanedFilename)
+		return uploadFailed(c, file, fiber.StatusBadRequest, errCodeInvalidFilename, err.Error())
+	}
+	if safeName != cleanedFilename {
+		slog.DebugContext(c.UserContext(), "Renamed Windows-reserved filename", "filename", cleanedFilename, "newName", safeName)
+		cleanedFilename = safeName
+	}
+
+	if cfg.rejectEmptyUploads && file.Size == 0 {
+		slog.DebugContext(c.UserContext(), "Rejected zero-byte upload", "filename", cleanedFilename)
+		return uploadFailed(c, file, fiber.StatusBadRequest, errCodeEmptyFile, "File is empty")
+	}
+
+	if cfg.maxFileSize > 0 && file.Size > cfg.maxFileSize {
+		slog.DebugContext(c.UserContext(), "Rejected upload over MAX_FILE_SIZE", "filename", cleanedFilename, "size", file.Size, "limit", cfg.maxFileSize)
+		return uploadFailed(c, file, fiber.StatusRequestEntityTooLarge, errCodeFileTooLarge, fmt.Sprintf("File is %s; the maximum file size is %s", formatSize(file.Size), formatSize(cfg.maxFileSize)))
+	}
+	webfiles.mu.Lock()
+	quotaErr := quotaErrorUnlocked(file.Size)
+	webfiles.mu.Unlock()
+	if quotaErr != "" {
+		slog.DebugContext(c.UserContext(), "Rejected upload over quota", "filename", cleanedFilename, "size", file.Size, "reason", quotaErr)
+		return uploadFailed(c, file, fiber.StatusRequestEntityTooLarge, errCodeQuotaExceeded, quotaErr)
+	}
+
+	if cfg.requireExtension && strings.TrimPrefix(filepath.Ext(cleanedFilename), ".") == "" {
+		slog.WarnContext(c.UserContext(), "Rejected upload without extension", "component", "security", "filename", cleanedFilename)
+		return uploadFailed(c, file, fiber.StatusBadRequest, errCodeInvalidFilename, "File has no extension; please rename it with one (e.g. .txt, .pdf) and try again")
+	}
+
+	sniffed, err := sniffContentType(file)
+	if err != nil {
+		slog.WarnContext(c.UserContext(), "Could not sniff content type", "filename", cleanedFilename, "error", err)
+	}
+	contentType := detectContentType(file, sniffed)
+
+	uploadedAs := cleanedFilename
+	if cfg.mimeExtensionPolicy == mimeExtensionPolicyReject && sniffed != "" {
+		want := extensionMismatch(cleanedFilename, sniffed)
+		claimed := claimedTypeMismatch(cleanedFilename, sniffed)
+		if want != "" || claimed != "" {
+			slog.WarnContext(c.UserContext(), "Rejected upload whose extension does not match its content", "component", "security", "filename", cleanedFilename, "detected", sniffed, "expected", want, "claimed", claimed, "ip", c.IP())
+			return uploadFailed(c, file, fiber.StatusUnsupportedMediaType, errCodeContentTypeMismatch, fmt.Sprintf("The content of %s was detected as %s, which does not match its extension", cleanedFilename, sniffed))
+		}
+	} else if cfg.mimeExtensionPolicy != mimeExtensionPolicyOff && sniffed != "" {
+		if want := extensionMismatch(cleanedFilename, sniffed); want != "" {
+			slog.WarnContext(c.UserContext(), "Extension does not match sniffed type", "component", "security", "filename", cleanedFilename, "detected", sniffed, "expected", want)
+			c.Append("X-Extension-Mismatch", fmt.Sprintf("detected %s, expected %s", sniffed, want))
+			if cfg.mimeExtensionPolicy == mimeExtensionPolicyFix {
+				cleanedFilename = withExtension(cleanedFilename, want)
+				slog.DebugContext(c.UserContext(), "Corrected filename extension", "filename", uploadedAs, "newName", cleanedFilename)
+			}
+		}
+	}
+
+	if err := checkExtensionPolicy(cleanedFilename); err != nil {
+		slog.WarnContext(c.UserContext(), "Rejected upload by extension policy", "component", "security", "filename", cleanedFilename, "error", err)
+		return uploadFailed(c, file, fiber.StatusUnsupportedMediaType, errCodeExtensionNotAllowed, err.Error())
+	}
+
+	// The chosen name is claimed until the entry is appended, so a
+	// concurrent upload of the same name can't pick the same key.
+	finalFilename, err := uniqueName(cleanedFilename, func(name string) bool {
+		_, err := fileStorage.Stat(storageKey(folder, name, start))
+		return err == nil || !claimName(folder, name)
+	})
+	if errors.Is(err, errNameTaken) {
+		slog.DebugContext(c.UserContext(), "Name already taken, rejected upload", "filename", cleanedFilename, "folder", folder)
+		return uploadFailed(c, file, fiber.StatusConflict, errCodeFileExists, "A file with that name already exists")
+	}
+	if err != nil {
+		return uploadFailed(c, file, fiber.StatusBadRequest, errCodeInvalidFilename, err.Error())
+	}
+	defer releaseName(folder, finalFilename)
+	key := storageKey(folder, finalFilename, start)
+	if finalFilename != cleanedFilename {
+		slog.DebugContext(c.UserContext(), "Name already taken, renamed upload", "filename", cleanedFilename, "newName", finalFilename)
+	}
+
+	save := saveAndHash
+	if clamavAddr != "" {
+		save = saveScanned
+	}
+	checksum, err := save(file, key)
+	if errors.Is(err, errIncompleteUpload) {
+		slog.WarnContext(c.UserContext(), "Rejected incomplete upload", "filename", finalFilename, "error", err)
+		return uploadFailed(c, file, fiber.StatusBadRequest, errCodeUploadIncomplete, "Upload was incomplete: "+err.Error())
+	}
+	var infected *infectedError
+	if errors.As(err, &infected) {
+		slog.WarnContext(c.UserContext(), "Rejected infected upload", "component", "security", "filename", finalFilename, "signature", infected.signature, "user", currentUser(c), "ip", c.IP())
+		malwareDetectedTotal.Inc()
+		return uploadFailed(c, file, fiber.StatusUnprocessableEntity, errCodeMalwareDetected, "Malware detected: "+infected.signature)
+	}
+	if errors.Is(err, errScanFailed) {
+		slog.ErrorContext(c.UserContext(), "Could not scan upload", "filename", finalFilename, "error", err)
+		return uploadFailed(c, file, fiber.StatusServiceUnavailable, errCodeScanFailed, "The file could not be scanned for viruses, try again later")
+	}
+	if err != nil {
+		slog.ErrorContext(c.UserContext(), "Failed to save upload", "filename", finalFilename, "key", key, "error", err)
+		return uploadFailed(c, file, fiber.StatusInternalServerError, errCodeInternal, err.Error())
+	}
+	slog.DebugContext(c.UserContext(), "Saved upload to storage", "filename", finalFilename, "key", key, "sha256", checksum)
+
+	meta := FileMeta{
+		Filename:     finalFilename,
+		Folder:       folder,
+		Owner:        currentUser(c),
+		Size:         file.Size,
+		ContentType:  contentType,
+		Checksum:     checksum,
+		OriginalName: uploadedAs,
+		Tags:         tags,
+		UploadedAt:   time.Now().UTC(),
+		ExpiresAt:    expiresAt,
+		Key:          key,
+	}
+
+	// The duplicate copy of linked content is deleted after the lock is
+	// released; the claimed name keeps its key from being reused meanwhile.
+	removeDuplicate := func() {
+		if err := fileStorage.Delete(key); err != nil {
+			slog.WarnContext(c.UserContext(), "Could not remove duplicate copy", "key", key, "error", err)
+		}
+	}
+	webfiles.mu.Lock()
+	var existing FileMeta
+	linked := false
+	if cfg.dedupMode != dedupModeOff {
+		if found := findByChecksumUnlocked(checksum); found != nil {
+			existing, linked = *found, true
+		}
+	}
+	// Another user's copy is linked silently rather than rejected, so the
+	// response doesn't reveal what they have stored.
+	if linked && cfg.dedupMode == dedupModeReject && canAccess(c, existing) {
+		webfiles.mu.Unlock()
+		removeDuplicate()
+		slog.DebugContext(c.UserContext(), "Rejected duplicate upload", "filename", file.Filename, "existing", existing.Filename)
+		result := uploadFailed(c, file, fiber.StatusConflict, errCodeDuplicateContent, fmt.Sprintf("Identical content already stored as '%s'", existing.Filename))
+		result.Existing = existing.Filename
+		return result
+	}
+	if linked {
+		slog.DebugContext(c.UserContext(), "Content already stored; linking instead of storing a copy", "filename", meta.Filename, "existing", existing.Filename)
+		meta.Key = existing.Key
+	} else if quotaErr := quotaErrorUnlocked(meta.Size); quotaErr != "" {
+		// Re-checked now that the lock is held: concurrent uploads may have
+		// used the space since the check above. Linked duplicates take no
+		// new space.
+		webfiles.mu.Unlock()
+		if err := fileStorage.Delete(key); err != nil {
+			slog.WarnContext(c.UserContext(), "Could not remove over-quota file", "key", key, "error", err)
+		}
+		return uploadFailed(c, file, fiber.StatusRequestEntityTooLarge, errCodeQuotaExceeded, quotaErr)
+	}
+	webfiles.Files = append(webfiles.Files, meta)
+	err = saveMetadataUnlocked()
+	webfiles.mu.Unlock()
+	if linked {
+		removeDuplicate()
+	}
+	if err != nil {
+		return uploadFailed(c, file, fiber.StatusInternalServerError, errCodeInternal, "Failed to save metadata")
+	}
+	events.broadcast(FileEvent{Type: eventUploaded, File: &meta}, meta)
+	uploadsTotal.Inc()
+	recordAudit(c, AuditRecord{Action: auditUpload, Filename: meta.Filename, Folder: meta.Folder, Size: meta.Size})
+	uploadDuration.Observe(time.Since(start).Seconds())
+	slog.InfoContext(c.UserContext(), "Stored upload", "filename", meta.Filename, "folder", meta.Folder, "size", meta.Size, "user", meta.Owner)
+
+	schedulePHash(meta.Filename, meta.Key)
+	scheduleThumbnail(meta)
+
+	return UploadResult{Filename: meta.Filename, OriginalName: meta.OriginalName, Folder: meta.Folder, Size: meta.Size, Checksum: meta.Checksum, Status: uploadStatusUploaded, code: fiber.StatusCreated}
+}
+
+// saveAndHash stores an uploaded file under key and returns the hex SHA-256
+// of its content, computed in the same pass so the file is never read twice
+// or held in memory. Nothing is stored on failure, including when fewer or
+// more bytes arrive than file.Size declares. Content already on disk is
+// hashed and moved into place when the backend can take it over.
+func saveAndHash(file incomingFile, key string) (string, error) {
+	if mover, ok := fileStorage.(fileMover); ok && file.tempPath != "" {
+		info, err := os.Stat(file.tempPath)
+		if err != nil {
+			return "", err
+		}
+		if info.Size() != file.Size {
+			return "", fmt.Errorf("%w: received %d of %d bytes", errIncompleteUpload, info.Size(), file.Size)
+		}
+		checksum, err := hashFile(file.tempPath)
+		if err != nil {
+			return "", err
+		}
+		if err := mover.MoveFrom(file.tempPath, key); err == nil {
+			return checksum, nil
+		}
+	}
+
+	src, err := file.open()
+	if err != nil {
+		return "", err
+	}
+	defer src.Close()
+
+	h := sha256.New()
+	counted := &countingReader{r: io.TeeReader(src, h)}
+	if err := fileStorage.Save(key, counted, file.Size); err != nil {
+		return "", err
+	}
+	if counted.n != file.Size {
+		if err := fileStorage.Delete(key); err != nil {
+			slog.Warn("Could not remove incomplete upload", "key", key, "error", err)
+		}
+		return "", fmt.Errorf("%w: received %d of %d bytes", errIncompleteUpload, counted.n, file.Size)
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// errIncompleteUpload reports an upload whose content doesn't match the size
+// the client declared, as when it disconnects part way through.
+var errIncompleteUpload = errors.New("the file is not the size that was declared")
+
+// countingReader counts the bytes read through it.
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += int64(n)
+	return n, err
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+func TestRequireExtension(t *testing.T) {
+	tests := []struct {
+		filename string
+		require  bool
+		want     int
+	}{
+		{"README", false, fiber.StatusCreated},
+		{"README.md", false, fiber.StatusCreated},
+		{"README", true, fiber.StatusBadRequest},
+		{"README.md", true, fiber.StatusCreated},
+		{"README.", true, fiber.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		t.Run(tt.filename, func(t *testing.T) {
+			setupTestStore(t)
+			withSettings(t, func(cfg *reloadableConfig) { cfg.requireExtension = tt.require })
+			app := fiber.New()
+			app.Post("/upload", uploadHandler)
+
+			var results []UploadResult
+			status := doRequest(t, app, uploadRequest(t, tt.filename, []byte("# notes\n")), &results)
+			if status != tt.want {
+				t.Fatalf("upload %q with REQUIRE_EXTENSION=%v: status %d, want %d (%+v)", tt.filename, tt.require, status, tt.want, results)
+			}
+			if tt.want == fiber.StatusBadRequest && (len(results) != 1 || results[0].Error == nil || results[0].Error.Code != errCodeInvalidFilename) {
+				t.Errorf("upload %q: results %+v, want one %s error", tt.filename, results, errCodeInvalidFilename)
+			}
+		})
+	}
+}
+
+func TestRejectEmptyUploads(t *testing.T) {
+	for _, reject := range []bool{false, true} {
+		t.Run(fmt.Sprintf("REJECT_EMPTY_UPLOADS=%v", reject), func(t *testing.T) {
+			setupTestStore(t)
+			withSettings(t, func(cfg *reloadableConfig) { cfg.rejectEmptyUploads = reject })
+			app := fiber.New()
+			app.Post("/upload", uploadHandler)
+
+			var results []UploadResult
+			status := doRequest(t, app, uploadRequest(t, "empty.txt", nil), &results)
+			listed := findFileUnlocked("", "empty.txt") != -1
+			if reject {
+				if status != fiber.StatusBadRequest || len(results) != 1 || results[0].Error == nil || results[0].Error.Code != errCodeEmptyFile {
+					t.Fatalf("status %d, results %+v; want 400 %s", status, results, errCodeEmptyFile)
+				}
+				if listed {
+					t.Error("rejected empty file was recorded in the metadata")
+				}
+				return
+			}
+			if status != fiber.StatusCreated || len(results) != 1 || results[0].Size != 0 {
+				t.Fatalf("status %d, results %+v; want 201 with a zero-byte file", status, results)
+			}
+			if !listed {
+				t.Error("empty file was not recorded in the metadata")
+			}
+		})
+	}
+
+	t.Run("non-empty file accepted when rejecting", func(t *testing.T) {
+		setupTestStore(t)
+		withSettings(t, func(cfg *reloadableConfig) { cfg.rejectEmptyUploads = true })
+		app := fiber.New()
+		app.Post("/upload", uploadHandler)
+		if status := doRequest(t, app, uploadRequest(t, "one.txt", []byte("x")), nil); status != fiber.StatusCreated {
+			t.Fatalf("status %d, want 201", status)
+		}
+	})
+}
+
+func TestDuplicateUploadsKeyedOnUser(t *testing.T) {
+	setupTestStore(t)
+	withSettings(t, func(cfg *reloadableConfig) { cfg.duplicateUploadWindow = time.Minute })
+	saved := users
+	users = map[string]userAccount{"alice": {Username: "alice"}, "bob": {Username: "bob"}}
+	t.Cleanup(func() {
+		users = saved
+		delete(recentUploads.entries, recentUploadKey("user:alice", "report.txt", 10))
+		delete(recentUploads.entries, recentUploadKey("user:bob", "report.txt", 10))
+	})
+	app := fiber.New()
+	app.Post("/upload", func(c *fiber.Ctx) error {
+		c.Locals("username", strings.Clone(c.Get("X-Test-User")))
+		return c.Next()
+	}, uploadHandler)
+
+	upload := func(user string) UploadResult {
+		req := uploadRequest(t, "report.txt", []byte("same bytes"))
+		req.Header.Set("X-Test-User", user)
+		var results []UploadResult
+		if status := doRequest(t, app, req, &results); status != fiber.StatusCreated || len(results) != 1 {
+			t.Fatalf("upload as %s: status %d, results %+v", user, status, results)
+		}
+		return results[0]
+	}
+	first := upload("alice")
+	if again := upload("alice"); again != first {
+		t.Errorf("repeat upload by alice = %+v, want the first result %+v", again, first)
+	}
+	upload("bob")
+
+	owners := map[string]bool{}
+	for _, f := range webfiles.Files {
+		owners[f.Owner] = true
+	}
+	if len(webfiles.Files) != 2 || !owners["alice"] || !owners["bob"] {
+		t.Errorf("stored %+v; want one file each for alice and bob", webfiles.Files)
+	}
+}
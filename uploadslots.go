@@ -0,0 +1,98 @@
+package main
+
+import (
+	"log/slog"
+	"strconv"
+	"sync"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+const (
+	defaultMaxConcurrentUploads      = 20
+	defaultMaxConcurrentUploadsPerIP = 4
+
+	// uploadRetryAfter is the Retry-After, in seconds, sent when every
+	// upload slot is taken.
+	uploadRetryAfter = 5
+)
+
+// uploadSlots caps the uploads in progress, across the server and for each
+// client IP. A slot is held while a request body is being received, so a
+// burst of large uploads is turned away up front instead of all being
+// accepted and competing for disk and CPU.
+type uploadSlots struct {
+	global chan struct{}
+	perIP  int
+	mu     sync.Mutex
+	active map[string]int
+}
+
+// acquire takes a slot for ip, reporting false when the server or the IP is
+// at its limit. A nil global channel or a zero perIP means no limit.
+func (s *uploadSlots) acquire(ip string) bool {
+	if s.global != nil {
+		select {
+		case s.global <- struct{}{}:
+		default:
+			return false
+		}
+	}
+	if s.perIP > 0 {
+		s.mu.Lock()
+		if s.active[ip] >= s.perIP {
+			s.mu.Unlock()
+			if s.global != nil {
+				<-s.global
+			}
+			return false
+		}
+		s.active[ip]++
+		s.mu.Unlock()
+	}
+	return true
+}
+
+func (s *uploadSlots) release(ip string) {
+	if s.perIP > 0 {
+		s.mu.Lock()
+		if s.active[ip]--; s.active[ip] <= 0 {
+			delete(s.active, ip)
+		}
+		s.mu.Unlock()
+	}
+	if s.global != nil {
+		<-s.global
+	}
+}
+
+// uploadConcurrencyLimiter limits concurrent uploads to MAX_CONCURRENT_UPLOADS
+// in total and MAX_CONCURRENT_UPLOADS_PER_IP for each client IP, where 0
+// turns a limit off. Requests over a limit get 503 with Retry-After. The
+// slot is released when the handler returns, whether the upload succeeded,
+// failed to save or was cut short by the client.
+func uploadConcurrencyLimiter() fiber.Handler {
+	total := envInt("MAX_CONCURRENT_UPLOADS", defaultMaxConcurrentUploads)
+	perIP := envInt("MAX_CONCURRENT_UPLOADS_PER_IP", defaultMaxConcurrentUploadsPerIP)
+	if total <= 0 && perIP <= 0 {
+		slog.Info("Concurrent upload limit disabled")
+		return func(c *fiber.Ctx) error { return c.Next() }
+	}
+
+	slots := &uploadSlots{perIP: perIP, active: make(map[string]int)}
+	if total > 0 {
+		slots.global = make(chan struct{}, total)
+	}
+	return func(c *fiber.Ctx) error {
+		ip := c.IP()
+		if !slots.acquire(ip) {
+			slog.WarnContext(c.UserContext(), "Concurrent upload limit reached", "component", "security", "ip", ip, "user", currentUser(c))
+			c.Set(fiber.HeaderRetryAfter, strconv.Itoa(uploadRetryAfter))
+			return jsonError(c, fiber.StatusServiceUnavailable, errCodeTooManyUploads, "Too many uploads in progress, try again shortly")
+		}
+		defer slots.release(ip)
+		activeUploads.Inc()
+		defer activeUploads.Dec()
+		return c.Next()
+	}
+}
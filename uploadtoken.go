@@ -0,0 +1,234 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/golang-jwt/jwt/v5"
+)
+
+const (
+	uploadTokenAudience   = "webfiles-upload"
+	defaultUploadTokenTTL = 24 * time.Hour
+)
+
+type UploadTokenRequest struct {
+	ExpiresIn string `json:"expiresIn"`
+	Folder    string `json:"folder"`
+	MaxSize   string `json:"maxSize"`
+}
+
+// uploadTokenUse tracks the single use of each upload token by its ID.
+// Tokens are reserved while an upload through them is in progress, so two
+// concurrent requests can't both use one, and released again if the upload
+// fails. Used tokens are kept in authStateFile until they expire, so a
+// restart doesn't make them usable again. With REVOCATION_STORE=redis they
+// are reserved and spent in Redis as well, so other instances refuse them;
+// reserved records whether that happened for each token.
+var uploadTokenUse = struct {
+	reserved map[string]bool
+}{reserved: make(map[string]bool)}
+
+// reserveUploadToken claims the token with ID id for one upload. It reports
+// false when the token was already used or is being used right now, and an
+// error when Redis can't be asked and fails closed.
+func reserveUploadToken(id string, expiresAt time.Time) (bool, error) {
+	auth.mu.Lock()
+	defer auth.mu.Unlock()
+	_, reserved := uploadTokenUse.reserved[id]
+	if _, used := auth.state.UsedUploadTokens[id]; used || reserved {
+		return false, nil
+	}
+	shared := false
+	if revocationUseRedis {
+		ok, err := reserveRedisUploadToken(id, expiresAt)
+		switch {
+		case err == nil && !ok:
+			return false, nil
+		case err == nil:
+			shared = true
+		case !revocationRedisFailOpen:
+			return false, err
+		default:
+			slog.Warn("Could not reserve upload token in Redis; checking this instance only", "component", "redis", "id", id, "error", err)
+		}
+	}
+	uploadTokenUse.reserved[id] = shared
+	return true, nil
+}
+
+// releaseUploadToken ends the reservation of a token. When used, the token
+// is recorded as spent until expiresAt; otherwise it can be tried again.
+func releaseUploadToken(id string, used bool, expiresAt time.Time) error {
+	auth.mu.Lock()
+	defer auth.mu.Unlock()
+	var sharedErr error
+	if uploadTokenUse.reserved[id] {
+		sharedErr = releaseRedisUploadToken(id, used)
+	}
+	delete(uploadTokenUse.reserved, id)
+	if !used {
+		return sharedErr
+	}
+	state := auth.state
+	spent := make(map[string]time.Time, len(state.UsedUploadTokens)+1)
+	for usedID, exp := range state.UsedUploadTokens {
+		if time.Now().Before(exp) {
+			spent[usedID] = exp
+		}
+	}
+	spent[id] = expiresAt
+	state.UsedUploadTokens = spent
+	// The token is spent in memory even if it can't be saved, so it can't
+	// be reused before a restart at least.
+	auth.state = state
+	return errors.Join(sharedErr, saveAuthStateLocked(state))
+}
+
+// uploadTokenHandler issues a signed token that lets someone without a login
+// upload one file through POST /public/upload/:token, into the given folder
+// and, optionally, up to maxSize. The upload is owned by the admin who
+// issued the token.
+func uploadTokenHandler(c *fiber.Ctx) error {
+	if !isAdmin(c) {
+		return jsonError(c, fiber.StatusForbidden, errCodeForbidden, "Only admins can create upload tokens")
+	}
+	var req UploadTokenRequest
+	if len(c.Body()) > 0 {
+		if err := c.BodyParser(&req); err != nil {
+			return jsonError(c, fiber.StatusBadRequest, errCodeInvalidRequest, "Invalid request body")
+		}
+	}
+	maxTTL := settings().shareMaxTTL
+	ttl := min(defaultUploadTokenTTL, maxTTL)
+	if req.ExpiresIn != "" {
+		var err error
+		ttl, err = time.ParseDuration(req.ExpiresIn)
+		if err != nil || ttl <= 0 {
+			return jsonError(c, fiber.StatusBadRequest, errCodeInvalidRequest, "expiresIn must be a positive duration such as \"2h\" or \"30m\"")
+		}
+		if ttl > maxTTL {
+			return jsonError(c, fiber.StatusBadRequest, errCodeInvalidRequest, "expiresIn exceeds the maximum of "+maxTTL.String())
+		}
+	}
+	folder, err := sanitizeFolder(req.Folder)
+	if err != nil {
+		return jsonError(c, fiber.StatusBadRequest, errCodeInvalidFolder, err.Error())
+	}
+	var maxSize int64
+	if req.MaxSize != "" {
+		if maxSize, err = parseByteSize(req.MaxSize); err != nil || maxSize <= 0 {
+			return jsonError(c, fiber.StatusBadRequest, errCodeInvalidRequest, "maxSize must be a positive size such as \"10MB\"")
+		}
+	}
+
+	id := newUUID()
+	expiresAt := time.Now().Add(ttl)
+	claims := jwt.MapClaims{
+		"aud":    uploadTokenAudience,
+		"jti":    id,
+		"exp":    expiresAt.Unix(),
+		"iat":    time.Now().Unix(),
+		"folder": folder,
+	}
+	if maxSize > 0 {
+		claims["maxSize"] = maxSize
+	}
+	if owner := currentUser(c); owner != "" {
+		claims["sub"] = owner
+	}
+	tokenString, err := jwt.NewWithClaims(jwt.SigningMethodHS256, claims).SignedString(jwtSecret)
+	if err != nil {
+		return jsonError(c, fiber.StatusInternalServerError, errCodeInternal, "Failed to generate token")
+	}
+
+	slog.InfoContext(c.UserContext(), "Created upload token", "id", id, "folder", folder, "maxSize", maxSize, "expiresAt", expiresAt.UTC(), "user", currentUser(c))
+	resp := fiber.Map{
+		"token":     tokenString,
+		"url":       "/public/upload/" + tokenString,
+		"expiresAt": expiresAt.UTC(),
+		"folder":    folder,
+	}
+	if maxSize > 0 {
+		resp["maxSize"] = maxSize
+	}
+	return c.JSON(resp)
+}
+
+// publicUploadHandler stores the single file uploaded with an upload token.
+// Like the share links it lives under /public, so the token is the only
+// credential. A token that was already used, expired or was tampered with
+// gets 403; a failed upload leaves the token usable for another try.
+func publicUploadHandler(c *fiber.Ctx) error {
+	token, err := parseSignedToken(c.Params("token"), jwt.WithAudience(uploadTokenAudience))
+	if err != nil {
+		if errors.Is(err, jwt.ErrTokenExpired) {
+			return jsonError(c, fiber.StatusForbidden, errCodeUploadTokenInvalid, "Upload link has expired")
+		}
+		slog.WarnContext(c.UserContext(), "Rejected upload token", "component", "security", "ip", c.IP(), "error", err)
+		return jsonError(c, fiber.StatusForbidden, errCodeUploadTokenInvalid, "Invalid upload link")
+	}
+	claims, _ := token.Claims.(jwt.MapClaims)
+	id, _ := claims["jti"].(string)
+	folder, _ := claims["folder"].(string)
+	maxSize, _ := claims["maxSize"].(float64)
+	owner, _ := claims["sub"].(string)
+	var expiresAt time.Time
+	if exp, err := claims.GetExpirationTime(); err == nil && exp != nil {
+		expiresAt = exp.Time
+	}
+	if id == "" {
+		return jsonError(c, fiber.StatusForbidden, errCodeUploadTokenInvalid, "Invalid upload link")
+	}
+	if multiUser() {
+		if _, ok := users[owner]; !ok {
+			return jsonError(c, fiber.StatusForbidden, errCodeUploadTokenInvalid, "Invalid upload link")
+		}
+		c.Locals("username", owner)
+	}
+
+	reserved, err := reserveUploadToken(id, expiresAt)
+	if err != nil {
+		slog.ErrorContext(c.UserContext(), "Upload token store unavailable, refusing upload", "component", "redis", "id", id, "error", err)
+		return jsonError(c, fiber.StatusServiceUnavailable, errCodeServiceUnavailable, "Upload links are unavailable, try again later")
+	}
+	if !reserved {
+		slog.WarnContext(c.UserContext(), "Refused reuse of upload token", "component", "security", "id", id, "ip", c.IP())
+		return jsonError(c, fiber.StatusForbidden, errCodeUploadTokenUsed, "This upload link has already been used")
+	}
+	used := false
+	defer func() {
+		if err := releaseUploadToken(id, used, expiresAt); err != nil {
+			slog.Error("Could not record used upload token", "id", id, "path", authStateFile, "error", err)
+		}
+	}()
+
+	form, err := readUploadForm(c)
+	if errors.Is(err, io.ErrUnexpectedEOF) {
+		return jsonError(c, fiber.StatusBadRequest, errCodeUploadIncomplete, "Upload was incomplete: the request body ended before the whole file arrived")
+	}
+	if err != nil {
+		return jsonError(c, fiber.StatusBadRequest, errCodeInvalidRequest, err.Error())
+	}
+	defer form.RemoveAll()
+	files := form.File["file"]
+	if len(files) != 1 {
+		return jsonError(c, fiber.StatusBadRequest, errCodeInvalidRequest, "Exactly one file must be uploaded with an upload link")
+	}
+	file := formFile(files[0])
+	if maxSize > 0 && file.Size > int64(maxSize) {
+		return jsonError(c, fiber.StatusRequestEntityTooLarge, errCodeFileTooLarge, fmt.Sprintf("File is %s; this upload link accepts at most %s", formatSize(file.Size), formatSize(int64(maxSize))))
+	}
+
+	result := storeUpload(c, file, folder, time.Time{}, nil)
+	if result.Status != uploadStatusUploaded {
+		return c.Status(result.code).JSON([]UploadResult{result})
+	}
+	used = true
+	slog.InfoContext(c.UserContext(), "Stored upload through upload token", "id", id, "filename", result.Filename, "folder", result.Folder, "size", result.Size, "ip", c.IP())
+	return c.Status(fiber.StatusCreated).JSON([]UploadResult{result})
+}
@@ -0,0 +1,196 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"mime"
+	"net"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"os"
+	"path"
+	"syscall"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+const (
+	defaultURLUploadTimeout = 5 * time.Minute
+
+	// maxURLUploadRedirects bounds the redirects followed for one fetch.
+	maxURLUploadRedirects = 5
+)
+
+type URLUploadRequest struct {
+	URL      string   `json:"url"`
+	Filename string   `json:"filename"`
+	Folder   string   `json:"folder"`
+	TTL      string   `json:"ttl"`
+	Tags     []string `json:"tags"`
+}
+
+// errAddressNotAllowed is returned when a fetch would connect to an address
+// that isn't on the public internet.
+var errAddressNotAllowed = errors.New("address is not publicly routable")
+
+// sharedAddressSpace is the carrier-grade NAT range (RFC 6598), which
+// netip doesn't count as private but isn't public either.
+var sharedAddressSpace = netip.MustParsePrefix("100.64.0.0/10")
+
+// publicAddr reports whether addr is a public unicast address. Loopback,
+// private, link-local (which includes cloud metadata endpoints such as
+// 169.254.169.254), multicast and unspecified addresses are all refused.
+func publicAddr(addr netip.Addr) bool {
+	addr = addr.Unmap()
+	return addr.IsValid() && addr.IsGlobalUnicast() && !addr.IsPrivate() && !sharedAddressSpace.Contains(addr)
+}
+
+// urlUploadClient fetches remote files without reaching the server's own
+// network. The address is checked as the connection is made, after DNS
+// resolution, so a hostname that resolves to an internal address, or is
+// changed to resolve to one between checks, is refused too; so is every
+// hop of a redirect. Proxy settings from the environment are ignored, since
+// a proxy would make the connection on our behalf.
+var urlUploadClient = &http.Client{
+	Transport: &http.Transport{
+		Proxy: nil,
+		DialContext: (&net.Dialer{
+			Timeout: 30 * time.Second,
+			Control: func(network, address string, _ syscall.RawConn) error {
+				addrPort, err := netip.ParseAddrPort(address)
+				if err != nil || !publicAddr(addrPort.Addr()) {
+					return fmt.Errorf("%s: %w", address, errAddressNotAllowed)
+				}
+				return nil
+			},
+		}).DialContext,
+		TLSHandshakeTimeout:   10 * time.Second,
+		ResponseHeaderTimeout: time.Minute,
+	},
+	CheckRedirect: func(req *http.Request, via []*http.Request) error {
+		if len(via) >= maxURLUploadRedirects {
+			return fmt.Errorf("stopped after %d redirects", maxURLUploadRedirects)
+		}
+		if req.URL.Scheme != "http" && req.URL.Scheme != "https" {
+			return fmt.Errorf("redirect to a %s URL", req.URL.Scheme)
+		}
+		return nil
+	},
+}
+
+// remoteFilename picks a name for a fetched file when the request gives
+// none: the one in the response's Content-Disposition, else the last
+// segment of the final URL's path.
+func remoteFilename(resp *http.Response) string {
+	if _, params, err := mime.ParseMediaType(resp.Header.Get("Content-Disposition")); err == nil && params["filename"] != "" {
+		return params["filename"]
+	}
+	if name := path.Base(resp.Request.URL.Path); name != "/" && name != "." {
+		return name
+	}
+	return "download"
+}
+
+// uploadURLHandler stores a file fetched from an http(s) URL. The body is
+// written to a temp file first, never more than MAX_FILE_SIZE of it, and then
+// goes through storeUpload like any upload, so naming, scanning, dedup,
+// checksums and quota all apply.
+func uploadURLHandler(c *fiber.Ctx) error {
+	var req URLUploadRequest
+	if err := c.BodyParser(&req); err != nil {
+		return jsonError(c, fiber.StatusBadRequest, errCodeInvalidRequest, "Invalid request body")
+	}
+	target, err := url.Parse(req.URL)
+	if err != nil || (target.Scheme != "http" && target.Scheme != "https") || target.Host == "" {
+		return jsonError(c, fiber.StatusBadRequest, errCodeURLNotAllowed, "url must be an absolute http or https URL")
+	}
+	if target.User != nil {
+		return jsonError(c, fiber.StatusBadRequest, errCodeURLNotAllowed, "url must not contain credentials")
+	}
+	folder, err := sanitizeFolder(req.Folder)
+	if err != nil {
+		return jsonError(c, fiber.StatusBadRequest, errCodeInvalidFolder, err.Error())
+	}
+	expiresAt, err := parseTTL(req.TTL)
+	if err != nil {
+		return jsonError(c, fiber.StatusBadRequest, errCodeInvalidRequest, err.Error())
+	}
+
+	cfg := settings()
+	ctx, cancel := context.WithTimeout(c.UserContext(), cfg.urlUploadTimeout)
+	defer cancel()
+	httpReq, err := http.NewRequestWithContext(ctx, http.MethodGet, target.String(), nil)
+	if err != nil {
+		return jsonError(c, fiber.StatusBadRequest, errCodeURLNotAllowed, "Invalid url")
+	}
+	slog.DebugContext(c.UserContext(), "Fetching upload from URL", "url", target.Redacted())
+	resp, err := urlUploadClient.Do(httpReq)
+	if errors.Is(err, errAddressNotAllowed) {
+		slog.WarnContext(c.UserContext(), "Refused URL upload to a non-public address", "component", "security", "url", target.Redacted(), "user", currentUser(c), "ip", c.IP(), "error", err)
+		return jsonError(c, fiber.StatusBadRequest, errCodeURLNotAllowed, "url must point to a public address")
+	}
+	if err != nil {
+		slog.WarnContext(c.UserContext(), "Could not fetch URL", "url", target.Redacted(), "error", err)
+		return jsonError(c, fiber.StatusBadGateway, errCodeFetchFailed, "Could not fetch the URL")
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		slog.WarnContext(c.UserContext(), "URL fetch was not successful", "url", target.Redacted(), "status", resp.StatusCode)
+		return jsonError(c, fiber.StatusBadGateway, errCodeFetchFailed, fmt.Sprintf("The URL answered with status %d", resp.StatusCode))
+	}
+	if cfg.maxFileSize > 0 && resp.ContentLength > cfg.maxFileSize {
+		return jsonError(c, fiber.StatusRequestEntityTooLarge, errCodeFileTooLarge, fmt.Sprintf("File is %s; the maximum file size is %s", formatSize(resp.ContentLength), formatSize(cfg.maxFileSize)))
+	}
+
+	if err := os.MkdirAll(partialUploadDir(), 0755); err != nil {
+		slog.ErrorContext(c.UserContext(), "Could not create temp directory", "path", partialUploadDir(), "error", err)
+		return jsonError(c, fiber.StatusInternalServerError, errCodeInternal, "Could not store the file")
+	}
+	tmp, err := os.CreateTemp(partialUploadDir(), "url-*")
+	if err != nil {
+		slog.ErrorContext(c.UserContext(), "Could not create temp file", "path", partialUploadDir(), "error", err)
+		return jsonError(c, fiber.StatusInternalServerError, errCodeInternal, "Could not store the file")
+	}
+	defer os.Remove(tmp.Name())
+
+	// One byte past the limit is read so an oversized body is noticed
+	// without the whole of it being downloaded.
+	var body io.Reader = resp.Body
+	if cfg.maxFileSize > 0 {
+		body = io.LimitReader(resp.Body, cfg.maxFileSize+1)
+	}
+	size, err := io.Copy(tmp, body)
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		slog.WarnContext(c.UserContext(), "Could not download URL", "url", target.Redacted(), "error", err)
+		return jsonError(c, fiber.StatusBadGateway, errCodeFetchFailed, "Could not download the file")
+	}
+	if cfg.maxFileSize > 0 && size > cfg.maxFileSize {
+		return jsonError(c, fiber.StatusRequestEntityTooLarge, errCodeFileTooLarge, fmt.Sprintf("File is larger than the maximum file size of %s", formatSize(cfg.maxFileSize)))
+	}
+
+	filename := req.Filename
+	if filename == "" {
+		filename = remoteFilename(resp)
+	}
+	contentType, _, _ := mime.ParseMediaType(resp.Header.Get("Content-Type"))
+	result := storeUpload(c, incomingFile{
+		Filename:    filename,
+		Size:        size,
+		ContentType: contentType,
+		open:        func() (io.ReadCloser, error) { return os.Open(tmp.Name()) },
+		tempPath:    tmp.Name(),
+	}, folder, expiresAt, normalizeTags(req.Tags))
+	if result.Status == uploadStatusUploaded {
+		slog.InfoContext(c.UserContext(), "Stored upload from URL", "url", target.Redacted(), "filename", result.Filename, "folder", result.Folder, "size", result.Size)
+		c.Location(fileLocation(result.Folder, result.Filename))
+	}
+	return c.Status(result.code).JSON([]UploadResult{result})
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/gofiber/fiber/v2"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// userAccount is one entry of USERS_FILE.
+type userAccount struct {
+	Username string `json:"username"`
+	PINHash  string `json:"pinHash"`
+	Admin    bool   `json:"admin"`
+}
+
+// users is loaded from USERS_FILE. It is nil in single-user mode, where the
+// shared LOGIN_PIN/LOGIN_PIN_HASH applies and everyone sees every file.
+var users map[string]userAccount
+
+// dummyPINHash is compared against when a login names an unknown user, so
+// the response time doesn't reveal which usernames exist.
+var dummyPINHash []byte
+
+// loadUsers reads a users file of the form
+//
+//	{"users": [{"username": "alice", "pinHash": "$2a$10$...", "admin": true}]}
+//
+// where pinHash comes from -hash-pin.
+func loadUsers(path string) (map[string]userAccount, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var file struct {
+		Users []userAccount `json:"users"`
+	}
+	if err := json.Unmarshal(data, &file); err != nil {
+		return nil, err
+	}
+	if len(file.Users) == 0 {
+		return nil, fmt.Errorf("no users defined")
+	}
+
+	accounts := make(map[string]userAccount, len(file.Users))
+	for _, u := range file.Users {
+		u.Username = strings.TrimSpace(u.Username)
+		if u.Username == "" {
+			return nil, fmt.Errorf("user with empty username")
+		}
+		if _, dup := accounts[u.Username]; dup {
+			return nil, fmt.Errorf("duplicate user %q", u.Username)
+		}
+		if _, err := bcrypt.Cost([]byte(u.PINHash)); err != nil {
+			return nil, fmt.Errorf("user %q: pinHash is not a valid bcrypt hash: %v", u.Username, err)
+		}
+		accounts[u.Username] = u
+	}
+
+	if dummyPINHash, err = bcrypt.GenerateFromPassword([]byte("not-a-real-pin"), bcrypt.DefaultCost); err != nil {
+		return nil, err
+	}
+	return accounts, nil
+}
+
+// multiUser reports whether per-user accounts are configured.
+func multiUser() bool {
+	return users != nil
+}
+
+// authenticateUser checks a username and PIN in multi-user mode.
+func authenticateUser(username, pin string) bool {
+	account, ok := users[username]
+	if !ok {
+		bcrypt.CompareHashAndPassword(dummyPINHash, []byte(pin))
+		return false
+	}
+	return bcrypt.CompareHashAndPassword([]byte(account.PINHash), []byte(pin)) == nil
+}
+
+// currentUser returns the username of the session, "" in single-user mode.
+func currentUser(c *fiber.Ctx) string {
+	username, _ := c.Locals("username").(string)
+	return username
+}
+
+// isAdmin reports whether the session may see and manage every file.
+// Everyone is in single-user mode.
+func isAdmin(c *fiber.Ctx) bool {
+	return !multiUser() || users[currentUser(c)].Admin
+}
+
+// canAccess reports whether the session may see and act on f. Files
+// uploaded before multi-user mode was enabled have no owner and are only
+// visible to admins. Expired files that haven't been swept yet are treated
+// as already gone.
+func canAccess(c *fiber.Ctx, f FileMeta) bool {
+	return accessibleBy(currentUser(c), f)
+}
+
+// accessibleBy is canAccess for a username rather than a request, for
+// checks made outside one such as pushing events.
+func accessibleBy(username string, f FileMeta) bool {
+	return !expired(f) && (!multiUser() || users[username].Admin || f.Owner == username)
+}
+
+// findAccessibleFileUnlocked is findFileUnlocked limited to files the
+// session can access; other users' files look the same as missing ones.
+// The caller must hold webfiles.mu.
+func findAccessibleFileUnlocked(c *fiber.Ctx, folder, name string) int {
+	index := findFileUnlocked(folder, name)
+	if index == -1 || !canAccess(c, webfiles.Files[index]) {
+		return -1
+	}
+	return index
+}
@@ -0,0 +1,190 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io"
+	"io/fs"
+	"log/slog"
+	"net/url"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// Outcomes of verifying a file against its recorded checksum.
+const (
+	verifyStatusOK         = "ok"
+	verifyStatusMismatch   = "mismatch"
+	verifyStatusMissing    = "missing"
+	verifyStatusNoChecksum = "no_checksum"
+	verifyStatusNotFound   = "not_found"
+	verifyStatusError      = "error"
+)
+
+type VerifyRequest struct {
+	Filenames []string `json:"filenames"`
+	Folder    string   `json:"folder"`
+}
+
+// VerifyResult reports whether a stored file still hashes to the checksum
+// recorded at upload. Only "ok" means the content is known to be intact;
+// "mismatch" means it changed on disk (bit rot or tampering), "missing" that
+// it is gone from storage, "no_checksum" that there is nothing to compare
+// with.
+type VerifyResult struct {
+	Filename string `json:"filename"`
+	Folder   string `json:"folder,omitempty"`
+	Key      string `json:"key,omitempty"`
+	Status   string `json:"status"`
+	Expected string `json:"expected,omitempty"`
+	Actual   string `json:"actual,omitempty"`
+	Size     int64  `json:"size,omitempty"`
+	Read     int64  `json:"read,omitempty"`
+	Error    string `json:"error,omitempty"`
+}
+
+// hashStored returns the hex-encoded SHA-256 of the content stored under
+// key and how many bytes it read, streaming it so large files aren't held
+// in memory. Encrypted content is hashed as decrypted, as it was at upload.
+func hashStored(key string) (string, int64, error) {
+	f, err := fileStorage.Open(key)
+	if err != nil {
+		return "", 0, err
+	}
+	defer f.Close()
+	h := sha256.New()
+	n, err := io.Copy(h, f)
+	if err != nil {
+		return "", n, err
+	}
+	return hex.EncodeToString(h.Sum(nil)), n, nil
+}
+
+// verifyFile re-reads meta's content and compares it with its checksum.
+// hashes caches results by key, since deduplicated entries share content; it
+// may be nil. Nothing is modified, whatever the outcome.
+func verifyFile(ctx context.Context, meta FileMeta, hashes map[string]VerifyResult) VerifyResult {
+	result := VerifyResult{Filename: meta.Filename, Folder: meta.Folder, Key: meta.Key, Expected: meta.Checksum, Size: meta.Size}
+	if meta.Checksum == "" {
+		result.Status = verifyStatusNoChecksum
+		return result
+	}
+	hashed, ok := hashes[meta.Key]
+	if !ok {
+		actual, read, err := hashStored(meta.Key)
+		hashed = VerifyResult{Actual: actual, Read: read}
+		switch {
+		case errors.Is(err, fs.ErrNotExist):
+			hashed.Status = verifyStatusMissing
+		case err != nil:
+			slog.ErrorContext(ctx, "Could not read file to verify", "key", meta.Key, "error", err)
+			hashed.Status, hashed.Error = verifyStatusError, err.Error()
+		}
+		if hashes != nil {
+			hashes[meta.Key] = hashed
+		}
+	}
+	result.Actual, result.Read, result.Status, result.Error = hashed.Actual, hashed.Read, hashed.Status, hashed.Error
+	if result.Status == "" {
+		result.Status = verifyStatusOK
+		if result.Actual != meta.Checksum {
+			result.Status = verifyStatusMismatch
+		}
+	}
+	switch result.Status {
+	case verifyStatusMismatch:
+		slog.WarnContext(ctx, "File does not match its recorded checksum", "component", "integrity", "filename", meta.Filename, "folder", meta.Folder, "key", meta.Key, "expected", meta.Checksum, "actual", result.Actual, "size", meta.Size, "read", result.Read)
+	case verifyStatusMissing:
+		slog.WarnContext(ctx, "File to verify is missing from storage", "component", "integrity", "filename", meta.Filename, "folder", meta.Folder, "key", meta.Key)
+	}
+	return result
+}
+
+// verifyHandler checks one file against its recorded checksum. The answer
+// is 200 whatever the outcome; a damaged file is flagged by its status.
+func verifyHandler(c *fiber.Ctx) error {
+	if !isAdmin(c) {
+		return jsonError(c, fiber.StatusForbidden, errCodeForbidden, "Only admins can verify files")
+	}
+	requestedFilename, err := url.QueryUnescape(c.Params("filename"))
+	if err != nil {
+		return jsonError(c, fiber.StatusBadRequest, errCodeInvalidFilename, "Invalid filename")
+	}
+	folder, err := folderQuery(c)
+	if err != nil {
+		return jsonError(c, fiber.StatusBadRequest, errCodeInvalidFolder, err.Error())
+	}
+
+	// The file is read without the lock; a large one takes a while.
+	webfiles.mu.Lock()
+	index := findFileUnlocked(folder, requestedFilename)
+	var meta FileMeta
+	if index != -1 {
+		meta = webfiles.Files[index]
+	}
+	webfiles.mu.Unlock()
+	if index == -1 {
+		return jsonError(c, fiber.StatusNotFound, errCodeFileNotFound, "File not found in metadata")
+	}
+	return c.JSON(verifyFile(c.UserContext(), meta, nil))
+}
+
+// verifyAllHandler checks many files in one request: those named in the
+// body, every file in the body's folder, or, with neither, every file.
+// Results come one per entry, with the entries needing attention also
+// counted in the summary.
+func verifyAllHandler(c *fiber.Ctx) error {
+	if !isAdmin(c) {
+		return jsonError(c, fiber.StatusForbidden, errCodeForbidden, "Only admins can verify files")
+	}
+	var req VerifyRequest
+	if len(c.Body()) > 0 {
+		if err := c.BodyParser(&req); err != nil {
+			return jsonError(c, fiber.StatusBadRequest, errCodeInvalidRequest, "Invalid request body")
+		}
+	}
+	folder, err := sanitizeFolder(req.Folder)
+	if err != nil {
+		return jsonError(c, fiber.StatusBadRequest, errCodeInvalidFolder, err.Error())
+	}
+
+	results := []VerifyResult{}
+	var files []FileMeta
+	webfiles.mu.Lock()
+	switch {
+	case len(req.Filenames) > 0:
+		for _, name := range req.Filenames {
+			if index := findFileUnlocked(folder, name); index != -1 {
+				files = append(files, webfiles.Files[index])
+			} else {
+				results = append(results, VerifyResult{Filename: name, Folder: folder, Status: verifyStatusNotFound})
+			}
+		}
+	case req.Folder != "":
+		for _, f := range webfiles.Files {
+			if f.Folder == folder {
+				files = append(files, f)
+			}
+		}
+	default:
+		files = append(files, webfiles.Files...)
+	}
+	webfiles.mu.Unlock()
+
+	hashes := make(map[string]VerifyResult)
+	for _, f := range files {
+		results = append(results, verifyFile(c.UserContext(), f, hashes))
+	}
+	summary := map[string]int{}
+	for _, r := range results {
+		summary[r.Status]++
+	}
+	slog.InfoContext(c.UserContext(), "Verified files", "files", len(results), "ok", summary[verifyStatusOK], "mismatch", summary[verifyStatusMismatch], "missing", summary[verifyStatusMissing])
+	return c.JSON(fiber.Map{
+		"results": results,
+		"checked": len(results),
+		"summary": summary,
+	})
+}
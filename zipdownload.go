@@ -0,0 +1,127 @@
+package main
+
+import (
+	"archive/zip"
+	"bufio"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/url"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// zipMissingReport is added to an archive listing the requested files that
+// could not be included.
+const zipMissingReport = "MISSING.txt"
+
+// downloadZipHandler streams the requested files as one zip archive. The
+// body is a JSON array of names; files in a folder are given as
+// "folder/name". The archive is written straight to the connection, so
+// memory use doesn't grow with the size of the files.
+//
+// Names that aren't found are skipped: they are listed in the
+// X-Missing-Files header and, with any file that fails to read while
+// streaming, in a MISSING.txt inside the archive.
+func downloadZipHandler(c *fiber.Ctx) error {
+	var names []string
+	if err := c.BodyParser(&names); err != nil {
+		return jsonError(c, fiber.StatusBadRequest, errCodeInvalidRequest, "Body must be a JSON array of filenames")
+	}
+	if len(names) == 0 {
+		return jsonError(c, fiber.StatusBadRequest, errCodeInvalidRequest, "No files requested")
+	}
+
+	var files []FileMeta
+	var missing []string
+	seen := make(map[string]bool, len(names))
+	webfiles.mu.Lock()
+	for _, name := range names {
+		if seen[name] {
+			continue
+		}
+		seen[name] = true
+
+		folder, filename := "", name
+		if i := strings.LastIndex(name, "/"); i != -1 {
+			folder, filename = name[:i], name[i+1:]
+		}
+		index := -1
+		if clean, err := sanitizeFolder(folder); err == nil {
+			index = findAccessibleFileUnlocked(c, clean, filename)
+		}
+		if index == -1 {
+			missing = append(missing, name)
+			continue
+		}
+		files = append(files, webfiles.Files[index])
+	}
+	webfiles.mu.Unlock()
+
+	if len(files) == 0 {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"error": newAPIError(c, errCodeFileNotFound, "None of the requested files were found"), "missing": missing})
+	}
+
+	archiveName := "webfiles-" + time.Now().Format("20060102-150405") + ".zip"
+	slog.InfoContext(c.UserContext(), "Streaming zip archive", "archive", archiveName, "files", len(files), "missing", len(missing))
+
+	c.Set(fiber.HeaderContentDisposition, contentDisposition("attachment", archiveName))
+	c.Set(fiber.HeaderContentType, "application/zip")
+	if len(missing) > 0 {
+		escaped := make([]string, len(missing))
+		for i, name := range missing {
+			escaped[i] = url.PathEscape(name)
+		}
+		c.Set("X-Missing-Files", strings.Join(escaped, ","))
+	}
+
+	c.Context().SetBodyStreamWriter(func(w *bufio.Writer) {
+		zw := zip.NewWriter(w)
+		for _, f := range files {
+			if err := addToZip(zw, f); err != nil {
+				slog.ErrorContext(c.UserContext(), "Could not add file to zip archive", "filename", f.Filename, "folder", f.Folder, "archive", archiveName, "error", err)
+				missing = append(missing, path.Join(f.Folder, f.Filename))
+			}
+		}
+		if len(missing) > 0 {
+			if report, err := zw.CreateHeader(&zip.FileHeader{Name: zipMissingReport, Method: zip.Deflate, Modified: time.Now()}); err == nil {
+				fmt.Fprintf(report, "The following requested files could not be included:\n\n%s\n", strings.Join(missing, "\n"))
+			}
+		}
+		if err := zw.Close(); err != nil {
+			slog.ErrorContext(c.UserContext(), "Could not finish zip archive", "archive", archiveName, "error", err)
+			return
+		}
+		downloadsTotal.Inc()
+	})
+	return nil
+}
+
+// addToZip copies one stored file into the archive under folder/filename.
+func addToZip(zw *zip.Writer, f FileMeta) error {
+	src, err := fileStorage.Open(f.Key)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+
+	header := &zip.FileHeader{
+		Name:     path.Join(f.Folder, f.Filename),
+		Method:   zip.Deflate,
+		Modified: f.UploadedAt,
+	}
+	if header.Modified.IsZero() {
+		if info, err := src.Stat(); err == nil {
+			header.Modified = info.ModTime()
+		}
+	}
+	dst, err := zw.CreateHeader(header)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(dst, src)
+	return err
+}